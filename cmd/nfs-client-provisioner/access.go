@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// annLastModified is set on PVs to the latest modification time of the files of their volume
+	annLastModified = "nchc.ai/last-modified"
+	// annLastAccessed is set on PVs to the latest access time of the files of
+	// their volume, which is only maintained if the export is not mounted with noatime
+	annLastAccessed = "nchc.ai/last-accessed"
+
+	// accessPatchesPerSecond limits the PV updates of an access scan
+	accessPatchesPerSecond = 2
+)
+
+// accessMonitor periodically records when the volumes were last modified and
+// accessed, so that volumes nobody uses anymore can be found. Annotations are
+// only written when the times changed, and at most accessPatchesPerSecond.
+type accessMonitor struct {
+	p       *nfsProvisioner
+	limiter flowcontrol.RateLimiter
+}
+
+func newAccessMonitor(p *nfsProvisioner) *accessMonitor {
+	return &accessMonitor{p: p, limiter: flowcontrol.NewTokenBucketRateLimiter(accessPatchesPerSecond, 1)}
+}
+
+func (m *accessMonitor) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, m.scan, interval)
+}
+
+func (m *accessMonitor) scan(ctx context.Context) {
+	pvs, err := m.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for access scan fail: %s", err.Error())
+		return
+	}
+
+	volumeLastModified.Reset()
+	volumeLastAccessed.Reset()
+	for _, pv := range pvs {
+		// linked volumes share the data of their source, which is scanned on its own
+		if !m.p.ownsVolume(pv) || pv.Annotations[annCloneMode] == cloneModeLink {
+			continue
+		}
+		dir := filepath.Join(mountPath, m.p.volumeDirectory(pv))
+		if info, err := dataFS.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		modified, accessed, err := volumeTimes(dir)
+		if err != nil {
+			glog.Warningf("access scan of volume %s fail: %s", pv.Name, err.Error())
+			continue
+		}
+		var namespace, claim string
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			namespace, claim = ref.Namespace, ref.Name
+		}
+		volumeLastModified.WithLabelValues(pv.Name, namespace, claim, pv.Spec.StorageClassName).Set(float64(modified.Unix()))
+		volumeLastAccessed.WithLabelValues(pv.Name, namespace, claim, pv.Spec.StorageClassName).Set(float64(accessed.Unix()))
+
+		annotations := map[string]string{
+			annLastModified: modified.UTC().Format(time.RFC3339),
+			annLastAccessed: accessed.UTC().Format(time.RFC3339),
+		}
+		if pv.Annotations[annLastModified] == annotations[annLastModified] && pv.Annotations[annLastAccessed] == annotations[annLastAccessed] {
+			continue
+		}
+		if err := m.limiter.Wait(ctx); err != nil {
+			return
+		}
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": annotations},
+		})
+		if _, err := m.p.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			glog.Warningf("update access times of pv %s fail: %s", pv.Name, err.Error())
+		}
+	}
+}
+
+// volumeTimes returns the latest modification and access times of the files
+// below dir, which include dir itself but not its marker.
+func volumeTimes(dir string) (time.Time, time.Time, error) {
+	var modified, accessed time.Time
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == filepath.Join(dir, markerFile) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if atime := time.Unix(st.Atim.Unix()); atime.After(accessed) {
+				accessed = atime
+			}
+		}
+		return nil
+	})
+	// a file is accessed when it is written
+	if modified.After(accessed) {
+		accessed = modified
+	}
+	return modified, accessed, err
+}
@@ -0,0 +1,434 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// subcommands are admin tools run inside the provisioner pod, e.g.
+// `kubectl exec <pod> -- /nfs-client-provisioner du`.
+var subcommands = map[string]func(args []string) error{
+	"du":              runDu,
+	"prune-archives":  runPruneArchives,
+	"lineage":         runLineage,
+	"inventory":       runInventory,
+	"suggest-reclaim": runSuggestReclaim,
+	"export-metadata": runExportMetadata,
+	"import-metadata": runImportMetadata,
+	"loadtest":        runLoadTest,
+	"ledger":          runLedger,
+	"undelete":        runUndelete,
+}
+
+func runDu(args []string) error {
+	fs := flag.NewFlagSet("du", flag.ContinueOnError)
+	addScanFlags(fs)
+	root := fs.String("root", mountPath, "directory to scan")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	usages, err := scanVolumes(*root)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, usages)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tFILES\tVOLUME")
+	for _, u := range usages {
+		name := u.Name
+		if u.Link != "" {
+			name += " -> " + u.Link
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", formatBytes(u.Bytes), u.Files, name)
+	}
+	return w.Flush()
+}
+
+func runPruneArchives(args []string) error {
+	fs := flag.NewFlagSet("prune-archives", flag.ContinueOnError)
+	addScanFlags(fs)
+	root := fs.String("root", mountPath, "directory holding the archives")
+	olderThan := fs.String("older-than", "", "only prune archives not modified for this long, e.g. 720h or 30d")
+	largerThan := fs.String("larger-than", "", "only prune archives larger than this size, e.g. 10Gi")
+	maxTotalSize := fs.String("max-total-size", "", "prune the oldest archives until all archives fit into this size, e.g. 2Ti")
+	dryRun := fs.Bool("dry-run", false, "list matching archives without deleting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var minAge time.Duration
+	if *olderThan != "" {
+		d, err := parseAge(*olderThan)
+		if err != nil {
+			return fmt.Errorf("invalid -older-than: %v", err)
+		}
+		minAge = d
+	}
+	var minSize int64
+	if *largerThan != "" {
+		q, err := resource.ParseQuantity(*largerThan)
+		if err != nil {
+			return fmt.Errorf("invalid -larger-than: %v", err)
+		}
+		minSize = q.Value()
+	}
+	var budget int64 = -1
+	if *maxTotalSize != "" {
+		q, err := resource.ParseQuantity(*maxTotalSize)
+		if err != nil {
+			return fmt.Errorf("invalid -max-total-size: %v", err)
+		}
+		budget = q.Value()
+	}
+
+	usages, err := scanArchives(*root)
+	if err != nil {
+		return err
+	}
+	var over map[string]bool
+	if budget >= 0 {
+		over = overBudget(usages, budget, nil)
+	}
+
+	now := time.Now()
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tAGE\tSIZE\tARCHIVE")
+	for _, u := range usages {
+		age := now.Sub(u.ModTime)
+		action := "keep"
+		// without -larger-than, empty archives are pruned by age too
+		larger := *largerThan == "" || u.Bytes > minSize
+		if ((*olderThan != "" || *largerThan != "") && age >= minAge && larger) || over[u.Name] {
+			action = "delete"
+			if *dryRun {
+				action = "would delete"
+			} else if err := removeArchive(*root, u.Name); err != nil {
+				action = "error: " + err.Error()
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", action, age.Truncate(time.Second), formatBytes(u.Bytes), u.Name)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d archives could not be deleted", failed)
+	}
+	return nil
+}
+
+// parseAge parses a Go duration, additionally accepting a "d" suffix for days.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func runLineage(args []string) error {
+	fs := flag.NewFlagSet("lineage", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: lineage [-json] <namespace>/<pvc>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || !strings.Contains(fs.Arg(0), "/") {
+		fs.Usage()
+		return fmt.Errorf("a single <namespace>/<pvc> argument is required")
+	}
+	namespace, name, _ := strings.Cut(fs.Arg(0), "/")
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	idx := newLineageIndex(pvs.Items)
+	for i := range pvs.Items {
+		if pvs.Items[i].Name != pvc.Spec.VolumeName {
+			continue
+		}
+		tree := idx.descendants(&pvs.Items[i])
+		if *asJSON {
+			return writeJSON(os.Stdout, tree)
+		}
+		printLineage(os.Stdout, tree, "")
+		return nil
+	}
+	return fmt.Errorf("pvc %s is not bound", fs.Arg(0))
+}
+
+func printLineage(w io.Writer, node *lineageNode, indent string) {
+	mode := node.Mode
+	if mode == "" || indent == "" {
+		mode = "source"
+	}
+	fmt.Fprintf(w, "%s%s %s (%s)\n", indent, mode, node.PVC, node.PV)
+	for _, child := range node.Children {
+		printLineage(w, child, indent+"  ")
+	}
+}
+
+// inventoryEntry describes one directory on the export and the volume using it, if any.
+type inventoryEntry struct {
+	Directory    string    `json:"directory"`
+	PV           string    `json:"pv,omitempty"`
+	PVC          string    `json:"pvc,omitempty"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	Phase        string    `json:"phase,omitempty"`
+	Bytes        int64     `json:"bytes"`
+	Files        int64     `json:"files"`
+	ModTime      time.Time `json:"modTime"`
+	Archived     bool      `json:"archived"`
+	Missing      bool      `json:"missing,omitempty"`
+	Link         string    `json:"link,omitempty"`
+	// the lineage of cloned and populated volumes
+	CloneMode       string `json:"cloneMode,omitempty"`
+	SourceDirectory string `json:"sourceDirectory,omitempty"`
+	SourcePVC       string `json:"sourcePVC,omitempty"`
+	DataSource      string `json:"dataSource,omitempty"`
+}
+
+// runInventory prints every volume of the provisioner and every other directory
+// on the export as JSON, for asset-management tools.
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	addScanFlags(fs)
+	root := fs.String("root", mountPath, "directory to scan")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	usages, err := scanVolumes(*root)
+	if err != nil {
+		return err
+	}
+	byName := map[string]volumeUsage{}
+	for _, u := range usages {
+		byName[u.Name] = u
+	}
+
+	provisioner := lookupSetting("provisioner-name")
+	entries := []inventoryEntry{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.NFS == nil || (provisioner != "" && pv.Annotations[annProvisionedBy] != provisioner) {
+			continue
+		}
+		name := volumeDirectoryOn(lookupSetting("nfs-path"), &pv)
+		u, found := byName[name]
+		delete(byName, name)
+		// volumes below namespace roots are not top-level entries, their roots are no orphans
+		if dir, _, nested := strings.Cut(name, string(filepath.Separator)); nested {
+			delete(byName, dir)
+			if info, err := dataFS.Lstat(filepath.Join(*root, name)); err == nil {
+				u, found = volumeUsage{Name: name, ModTime: info.ModTime()}, true
+				if info.Mode()&os.ModeSymlink != 0 {
+					u.Link, _ = dataFS.Readlink(filepath.Join(*root, name))
+				} else if u.Bytes, u.Files, err = dirUsage(filepath.Join(*root, name)); err != nil {
+					return err
+				}
+			}
+		}
+		e := inventoryEntry{
+			Directory:       name,
+			PV:              pv.Name,
+			StorageClass:    pv.Spec.StorageClassName,
+			Phase:           string(pv.Status.Phase),
+			Bytes:           u.Bytes,
+			Files:           u.Files,
+			ModTime:         u.ModTime,
+			Missing:         !found,
+			Link:            u.Link,
+			CloneMode:       pv.Annotations[annCloneMode],
+			SourceDirectory: pv.Annotations[annSrcDirectory],
+			SourcePVC:       pv.Annotations[annSrcPVC],
+			DataSource:      pv.Annotations[annDataSource],
+		}
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			e.PVC = ref.Namespace + "/" + ref.Name
+		}
+		entries = append(entries, e)
+	}
+	// archives and orphans
+	for _, u := range usages {
+		if _, ok := byName[u.Name]; !ok || strings.HasPrefix(u.Name, ".") {
+			continue
+		}
+		e := inventoryEntry{
+			Directory: u.Name,
+			Bytes:     u.Bytes,
+			Files:     u.Files,
+			ModTime:   u.ModTime,
+			Archived:  u.Archived,
+			Link:      u.Link,
+		}
+		// the marker still names the former owner
+		if u.Link == "" {
+			if m, err := readMarker(filepath.Join(*root, u.Name)); err == nil {
+				e.PV, e.PVC, e.StorageClass = m.Volume, m.ClaimNamespace+"/"+m.ClaimName, m.StorageClass
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	return writeJSON(os.Stdout, map[string]interface{}{
+		"server":    lookupSetting("nfs-server"),
+		"path":      lookupSetting("nfs-path"),
+		"generated": time.Now().UTC(),
+		"volumes":   entries,
+	})
+}
+
+func runSuggestReclaim(args []string) error {
+	fs := flag.NewFlagSet("suggest-reclaim", flag.ContinueOnError)
+	addScanFlags(fs)
+	root := fs.String("root", mountPath, "directory the export is mounted at")
+	idleAfterFlag := fs.String("idle-after", "180d", "how long a volume was not used to be listed, e.g. 4320h or 180d")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	idleAfter, err := parseAge(*idleAfterFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -idle-after: %v", err)
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	list, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	provisioner := lookupSetting("provisioner-name")
+	var pvs []*v1.PersistentVolume
+	for i := range list.Items {
+		pv := &list.Items[i]
+		if pv.Spec.NFS != nil && (provisioner == "" || pv.Annotations[annProvisionedBy] == provisioner) {
+			pvs = append(pvs, pv)
+		}
+	}
+	directory := func(pv *v1.PersistentVolume) string {
+		return volumeDirectoryOn(lookupSetting("nfs-path"), pv)
+	}
+	// volumes the access scan did not record yet are scanned now
+	times := func(pv *v1.PersistentVolume) (time.Time, bool) {
+		if last, ok := lastUsed(pv); ok {
+			return last, true
+		}
+		dir := filepath.Join(*root, directory(pv))
+		if info, err := dataFS.Lstat(dir); err != nil || !info.IsDir() {
+			return time.Time{}, false
+		}
+		_, accessed, err := volumeTimes(dir)
+		return accessed, err == nil
+	}
+	idle := findIdleVolumes(pvs, time.Now(), idleAfter, times, directory, func(dir string) int64 {
+		size, _, _ := dirUsage(filepath.Join(*root, dir))
+		return size
+	})
+	if *asJSON {
+		return writeJSON(os.Stdout, idle)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IDLE\tSIZE\tPHASE\tPVC\tPV\tSUGGESTION")
+	var total int64
+	for _, v := range idle {
+		total += v.Bytes
+		pvc := "-"
+		if v.PVC != "" {
+			pvc = v.Namespace + "/" + v.PVC
+		}
+		fmt.Fprintf(w, "%dd\t%s\t%s\t%s\t%s\t%s\n", v.IdleDays, formatBytes(v.Bytes), v.Phase, pvc, v.PV, v.Suggestion)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d volumes holding %s can be reclaimed\n", len(idle), formatBytes(total))
+	return nil
+}
+
+// addScanFlags lets admin commands spread their disk usage scans over time.
+func addScanFlags(fs *flag.FlagSet) {
+	fs.IntVar(&usage.concurrency, "concurrency", 1, "number of directories measured in parallel")
+	fs.DurationVar(&usage.pace, "pace", 0, "pause after reading each directory, to limit the load on the NFS server")
+}
+
+// newAdminClient returns a client using the service account of the provisioner pod.
+func newAdminClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
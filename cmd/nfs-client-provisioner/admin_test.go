@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPruneArchivesOlderThan(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		fault   string
+		wantErr bool
+		want    []string
+	}{
+		{name: "older than 30 days", args: []string{"-older-than", "30d"}, want: []string{"archived-1d", "archived-20d"}},
+		{name: "older than 10 days", args: []string{"-older-than", "240h"}, want: []string{"archived-1d"}},
+		{name: "dry run", args: []string{"-older-than", "10d", "-dry-run"}, want: []string{"archived-1d", "archived-20d", "archived-40d"}},
+		{name: "larger than", args: []string{"-older-than", "10d", "-larger-than", "50000"}, want: []string{"archived-1d", "archived-20d"}},
+		{name: "invalid age", args: []string{"-older-than", "a month"}, wantErr: true, want: []string{"archived-1d", "archived-20d", "archived-40d"}},
+		{name: "removal fails", args: []string{"-older-than", "30d"}, fault: "removeall", wantErr: true, want: []string{"archived-1d", "archived-20d", "archived-40d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useTempMount(t)
+			makeArchives(t, root, 100000, "1d", "40d")
+			makeArchives(t, root, 1000, "20d")
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			err := runPruneArchives(append([]string{"-root", root}, tt.args...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("prune-archives %s = %v, want error %v", strings.Join(tt.args, " "), err, tt.wantErr)
+			}
+			got, err := listArchives(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("archives = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
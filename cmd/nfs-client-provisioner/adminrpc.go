@@ -0,0 +1,225 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// watchOperationsMethod is the path of the WatchOperations RPC of the admin
+// gRPC service, see admin.proto.
+const watchOperationsMethod = "/nfsclient.admin.v1.Admin/WatchOperations"
+
+// The gRPC status codes the admin service returns.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+	grpcUnauthenticated = 16
+)
+
+// operationEventTypes are the values of OperationEvent.Type.
+var operationEventTypes = map[string]uint64{
+	operationAdded:    1,
+	operationModified: 2,
+	operationDeleted:  3,
+}
+
+// serveAdminRPC serves the admin gRPC service, with the token of the dashboard
+// as bearer token in the authorization metadata. Clients connect without TLS,
+// like to the dashboard.
+func (d *dashboard) serveAdminRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	switch {
+	case r.Method != http.MethodPost:
+		grpcStatus(w, grpcUnimplemented, "method not allowed")
+	case !d.authorized(r):
+		grpcStatus(w, grpcUnauthenticated, "a bearer token is required")
+	case r.URL.Path != watchOperationsMethod:
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+	default:
+		d.watchOperations(w, r)
+	}
+}
+
+// watchOperations streams the changes of the operations in progress until
+// the client cancels the call, see admin.proto.
+func (d *dashboard) watchOperations(w http.ResponseWriter, r *http.Request) {
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	kinds, err := parseWatchOperationsRequest(request)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		grpcStatus(w, grpcUnimplemented, "streaming not supported")
+		return
+	}
+
+	ops, events, stop := d.p.operations.watch()
+	defer stop()
+	send := func(e operationEvent) error {
+		if len(kinds) > 0 && !kinds[e.Operation.Kind] {
+			return nil
+		}
+		if err := writeGRPCMessage(w, marshalOperationEvent(e)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	for _, op := range ops {
+		if err := send(operationEvent{Type: operationAdded, Operation: op}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				grpcStatus(w, grpcUnavailable, "the watcher fell behind, reconnect")
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// grpcStatus ends a call with code and message.
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
+
+// readGRPCMessage reads the single, uncompressed, message of a unary or
+// server-streaming call.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	message := make([]byte, size)
+	_, err := io.ReadFull(r, message)
+	return message, err
+}
+
+// writeGRPCMessage writes message with the length prefix of gRPC.
+func writeGRPCMessage(w io.Writer, message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+// parseWatchOperationsRequest returns the kinds of a WatchOperationsRequest.
+func parseWatchOperationsRequest(b []byte) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			kind, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			kinds[kind] = true
+			b = b[n:]
+			continue
+		}
+		// unknown fields are skipped, like by generated code
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return kinds, nil
+}
+
+// marshalOperationEvent encodes e as an OperationEvent.
+func marshalOperationEvent(e operationEvent) []byte {
+	var op []byte
+	for _, f := range []struct {
+		num   protowire.Number
+		value string
+	}{{1, e.Operation.ID}, {2, e.Operation.Kind}, {3, e.Operation.Volume}, {4, e.Operation.Directory}, {5, e.Operation.Source}, {6, e.Operation.Target}} {
+		if f.value != "" {
+			op = protowire.AppendTag(op, f.num, protowire.BytesType)
+			op = protowire.AppendString(op, f.value)
+		}
+	}
+	// google.protobuf.Timestamp
+	var started []byte
+	started = protowire.AppendTag(started, 1, protowire.VarintType)
+	started = protowire.AppendVarint(started, uint64(e.Operation.Started.Unix()))
+	if nanos := e.Operation.Started.Nanosecond(); nanos != 0 {
+		started = protowire.AppendTag(started, 2, protowire.VarintType)
+		started = protowire.AppendVarint(started, uint64(nanos))
+	}
+	op = protowire.AppendTag(op, 7, protowire.BytesType)
+	op = protowire.AppendBytes(op, started)
+	for _, f := range []struct {
+		num   protowire.Number
+		value int64
+	}{{8, e.Operation.Files}, {9, e.Operation.Bytes}, {10, e.Operation.TotalBytes}} {
+		if f.value != 0 {
+			op = protowire.AppendTag(op, f.num, protowire.VarintType)
+			op = protowire.AppendVarint(op, uint64(f.value))
+		}
+	}
+	if e.Operation.Error != "" {
+		op = protowire.AppendTag(op, 11, protowire.BytesType)
+		op = protowire.AppendString(op, e.Operation.Error)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, operationEventTypes[e.Type])
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, op)
+}
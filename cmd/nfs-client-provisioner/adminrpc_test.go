@@ -0,0 +1,142 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeOperationEvent returns the type and the operation kind of an OperationEvent.
+func decodeOperationEvent(t *testing.T, b []byte) (uint64, string) {
+	t.Helper()
+	var eventType uint64
+	var kind string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			eventType, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var op []byte
+			op, n = protowire.ConsumeBytes(b)
+			for len(op) > 0 {
+				num, typ, m := protowire.ConsumeTag(op)
+				op = op[m:]
+				if num == 2 {
+					kind, m = protowire.ConsumeString(op)
+				} else {
+					m = protowire.ConsumeFieldValue(num, typ, op)
+				}
+				op = op[m:]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			t.Fatalf("invalid OperationEvent: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return eventType, kind
+}
+
+func TestWatchOperations(t *testing.T) {
+	tracker := newOperationTracker()
+	tracker.start(operationCopy, "pv-copy", "default-copy")
+	tracker.start(operationDelete, "pv-delete", "default-delete")
+	d := newDashboard(&nfsProvisioner{operations: tracker}, "secret")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nfsclient.admin.v1.Admin/", d.serveAdminRPC)
+	server := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	request := protowire.AppendTag(nil, 1, protowire.BytesType)
+	request = protowire.AppendString(request, operationCopy)
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		wantStatus string
+		wantKind   string
+	}{
+		{name: "unauthenticated", method: watchOperationsMethod, wantStatus: "16"},
+		{name: "wrong token", method: watchOperationsMethod, token: "guess", wantStatus: "16"},
+		{name: "unknown method", method: "/nfsclient.admin.v1.Admin/Unknown", token: "secret", wantStatus: "12"},
+		{name: "copies only", method: watchOperationsMethod, token: "secret", wantKind: operationCopy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body := &bytes.Buffer{}
+			if err := writeGRPCMessage(body, request); err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+tt.method, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/grpc")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if tt.wantStatus != "" {
+				io.Copy(io.Discard, resp.Body)
+				status := resp.Trailer.Get("Grpc-Status")
+				if status == "" {
+					status = resp.Header.Get("Grpc-Status")
+				}
+				if status != tt.wantStatus {
+					t.Errorf("grpc-status = %q, want %q", status, tt.wantStatus)
+				}
+				return
+			}
+			message, err := readGRPCMessage(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			eventType, kind := decodeOperationEvent(t, message)
+			if eventType != operationEventTypes[operationAdded] || kind != tt.wantKind {
+				t.Errorf("first event = %d %q, want ADDED %q", eventType, kind, tt.wantKind)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The v2 annotations are all prefixed with annV2Prefix and named consistently:
+// what clones a volume starts with clone-, what populates it with populate-. The
+// provisioner still uses the v1 annotations internally, v1Annotations translates.
+const (
+	annV2Prefix = "nfs.nchc.ai/"
+	// annV2Clone on a PVC is "copy" or "link", replacing copy-data and link-data
+	annV2Clone = annV2Prefix + "clone"
+	// annV2CloneSource on a PVC is the "namespace/name" of the PVC to clone, or
+	// its name in the same namespace, replacing src-pvc-namespace and src-pvc-name
+	annV2CloneSource = annV2Prefix + "clone-source"
+)
+
+const (
+	annotationSchemaV1 = "v1"
+	annotationSchemaV2 = "v2"
+)
+
+// annV2Aliases are the v2 annotations which take the same values as a v1
+// annotation, by the v1 annotation.
+var annV2Aliases = map[string]string{
+	annSrcArchived:       annV2Prefix + "clone-from-archive",
+	annGCLinkTarget:      annV2Prefix + "clone-keep-source",
+	annAllowedNamespaces: annV2Prefix + "clone-allowed-namespaces",
+	annSyncInterval:      annV2Prefix + "clone-sync-interval",
+	annResyncNow:         annV2Prefix + "clone-resync-now",
+	annSeal:              annV2Prefix + "seal",
+	annProtectData:       annV2Prefix + "protect-data",
+	annMirror:            annV2Prefix + "mirror",
+	annReclaimPolicy:     annV2Prefix + "reclaim-policy",
+	annSkipMarkerCheck:   annV2Prefix + "skip-marker-check",
+	annDeletedBy:         annV2Prefix + "deleted-by",
+	annSubdirName:        annV2Prefix + "subdir-name",
+	annPopulateS3:        annV2Prefix + "populate-s3",
+	annPopulateS3Secret:  annV2Prefix + "populate-s3-secret",
+	annPopulateURL:       annV2Prefix + "populate-url",
+	annPopulateSHA256:    annV2Prefix + "populate-sha256",
+	annPopulateGit:       annV2Prefix + "populate-git",
+	annPopulateGitRef:    annV2Prefix + "populate-git-ref",
+	annPopulateGitCommit: annV2Prefix + "populate-git-commit",
+	annPopulateOCI:       annV2Prefix + "populate-oci",
+	annPopulateOCISecret: annV2Prefix + "populate-oci-secret",
+	annUndeleteFrom:      annV2Prefix + "undelete-from",
+}
+
+// isV1Annotation reports whether key is a v1 annotation users set.
+func isV1Annotation(key string) bool {
+	switch key {
+	case annCopyDate, annLinkDate, annSrcPVCNamespace, annSrcPVCName:
+		return true
+	}
+	_, ok := annV2Aliases[key]
+	return ok
+}
+
+// annotationSchemas returns the schemas of the annotations users set in annotations, sorted.
+func annotationSchemas(annotations map[string]string) []string {
+	var v1, v2 bool
+	for key := range annotations {
+		v1 = v1 || isV1Annotation(key)
+		v2 = v2 || strings.HasPrefix(key, annV2Prefix)
+	}
+	var schemas []string
+	if v1 {
+		schemas = append(schemas, annotationSchemaV1)
+	}
+	if v2 {
+		schemas = append(schemas, annotationSchemaV2)
+	}
+	return schemas
+}
+
+// v1Annotations returns the annotations of obj with the v2 annotations
+// translated to their v1 form. A setting given in both forms with different
+// values, and unknown or invalid v2 annotations, are errors; the v2 form wins
+// in the returned annotations then.
+func v1Annotations(obj metav1.Object) (map[string]string, error) {
+	in := obj.GetAnnotations()
+	out := make(map[string]string, len(in))
+	for key, value := range in {
+		out[key] = value
+	}
+	var problems []string
+	set := func(v2Key, key, value string) {
+		if old, ok := in[key]; ok && old != value {
+			problems = append(problems, fmt.Sprintf("%s conflicts with %s %q", v2Key, key, old))
+		}
+		out[key] = value
+	}
+
+	v1Keys := make(map[string]string, len(annV2Aliases))
+	for key, alias := range annV2Aliases {
+		v1Keys[alias] = key
+	}
+	var keys []string
+	for key := range in {
+		if strings.HasPrefix(key, annV2Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := in[key]
+		switch key {
+		case annV2Clone:
+			v1Key, other := annCopyDate, annLinkDate
+			if value == cloneModeLink {
+				v1Key, other = annLinkDate, annCopyDate
+			} else if value != cloneModeCopy {
+				problems = append(problems, fmt.Sprintf("invalid %s %q, must be %q or %q", key, value, cloneModeCopy, cloneModeLink))
+				continue
+			}
+			if enabled, _ := strconv.ParseBool(in[other]); enabled {
+				problems = append(problems, fmt.Sprintf("%s conflicts with %s %q", key, other, in[other]))
+			}
+			set(key, v1Key, "true")
+		case annV2CloneSource:
+			namespace, name := obj.GetNamespace(), value
+			if i := strings.Index(value, "/"); i >= 0 {
+				namespace, name = value[:i], value[i+1:]
+			}
+			if namespace == "" || name == "" || strings.Contains(name, "/") {
+				problems = append(problems, fmt.Sprintf("invalid %s %q, must be <namespace>/<name> or <name>", key, value))
+				continue
+			}
+			set(key, annSrcPVCNamespace, namespace)
+			set(key, annSrcPVCName, name)
+		default:
+			if v1Key, ok := v1Keys[key]; ok {
+				set(key, v1Key, value)
+			} else {
+				problems = append(problems, fmt.Sprintf("unknown annotation %s", key))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return out, misconfigured("%s", strings.Join(problems, "; "))
+	}
+	return out, nil
+}
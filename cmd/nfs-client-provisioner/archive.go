@@ -0,0 +1,401 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// paramArchivePath is the template of the path volumes of the class are
+	// archived to, e.g. archived/${namespace}/${pvcName}-${timestamp}
+	paramArchivePath = "archivePath"
+
+	// archiveTimestamp is the format of ${timestamp}, sortable and valid in file names
+	archiveTimestamp = "20060102-150405"
+
+	// archiveManifestFile is written into every archive, so that archives
+	// describe what they hold without the prefix or template they are named by
+	archiveManifestFile = ".nfs-archive.json"
+	// annDeletedBy on a PV is recorded in the manifest of its archive as who
+	// requested the deletion, e.g. by tools deleting volumes on behalf of users
+	annDeletedBy = "nchc.ai/deleted-by"
+
+	// paramArchiveEviction is the order the archives of the class are removed
+	// in when they exceed -archive-budget or the export runs short of -archive-min-free
+	paramArchiveEviction = "archiveEviction"
+	// archiveEvictionOldest removes the archives whose data is oldest first
+	archiveEvictionOldest = "oldest"
+	// archiveEvictionLRU removes the archives which were least recently archived
+	// or copied by src-archived first
+	archiveEvictionLRU = "lru"
+)
+
+// archivePrefix names the archives of classes without an archivePath template,
+// set by -archive-prefix.
+var archivePrefix = "archived-"
+
+// validArchivePrefix checks that prefix names top-level directories which are
+// neither hidden nor quarantined volumes.
+func validArchivePrefix(prefix string) error {
+	if prefix == "" || strings.ContainsRune(prefix, '/') || strings.HasPrefix(prefix, ".") ||
+		strings.HasPrefix(prefix, quarantinePrefix) || strings.HasPrefix(quarantinePrefix, prefix) {
+		return fmt.Errorf("invalid archive prefix %q, must be a file name not starting with '.' and not overlapping %s", prefix, quarantinePrefix)
+	}
+	return nil
+}
+
+// archiveManifest describes an archive: the PV and PVC its data belonged to,
+// and when and why it was archived.
+type archiveManifest struct {
+	Provisioner    string `json:"provisioner"`
+	Volume         string `json:"volume"`
+	VolumeUID      string `json:"volumeUID"`
+	ClaimNamespace string `json:"claimNamespace,omitempty"`
+	ClaimName      string `json:"claimName,omitempty"`
+	ClaimUID       string `json:"claimUID,omitempty"`
+	StorageClass   string `json:"storageClass"`
+	Server         string `json:"server"`
+	Path           string `json:"path"`
+	// Directory is the path of the volume below the export before it was archived
+	Directory string    `json:"directory"`
+	Archived  time.Time `json:"archived"`
+	// DeletedBy is the annDeletedBy annotation of the deleted PV, if any
+	DeletedBy string `json:"deletedBy,omitempty"`
+	// DeletedVolume is the deleted PV, if it is not the volume whose data was
+	// archived, like a link to a kept source
+	DeletedVolume string `json:"deletedVolume,omitempty"`
+	// Replica is the provisioner pod which archived the volume
+	Replica string `json:"replica,omitempty"`
+}
+
+func newArchiveManifest(provisioner string, volume, owner *v1.PersistentVolume, name string, now time.Time) *archiveManifest {
+	m := &archiveManifest{
+		Provisioner:  provisioner,
+		Volume:       owner.Name,
+		VolumeUID:    string(owner.UID),
+		StorageClass: owner.Spec.StorageClassName,
+		Directory:    name,
+		Archived:     now.UTC(),
+		Replica:      os.Getenv("POD_NAME"),
+	}
+	if nfs := owner.Spec.NFS; nfs != nil {
+		m.Server, m.Path = nfs.Server, nfs.Path
+	}
+	if ref := owner.Spec.ClaimRef; ref != nil {
+		m.ClaimNamespace, m.ClaimName, m.ClaimUID = ref.Namespace, ref.Name, string(ref.UID)
+	}
+	annotations, _ := v1Annotations(volume)
+	m.DeletedBy = annotations[annDeletedBy]
+	if volume.Name != owner.Name {
+		m.DeletedVolume = volume.Name
+	}
+	return m
+}
+
+// writeArchiveManifest writes m into the archive dir.
+func writeArchiveManifest(dir string, m *archiveManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return dataFS.WriteFile(filepath.Join(dir, archiveManifestFile), append(data, '\n'), 0444)
+}
+
+// readArchiveManifest reads the manifest of the archive dir.
+func readArchiveManifest(dir string) (*archiveManifest, error) {
+	data, err := dataFS.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &archiveManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", archiveManifestFile, err)
+	}
+	return m, nil
+}
+
+// archiveOwner returns the PVC and PV the archive dir belonged to, from its
+// manifest or, for archives of earlier versions, the marker of the volume.
+func archiveOwner(dir string) (namespace, claim, volume string, ok bool) {
+	if m, err := readArchiveManifest(dir); err == nil {
+		return m.ClaimNamespace, m.ClaimName, m.Volume, true
+	}
+	if m, err := readMarker(dir); err == nil {
+		return m.ClaimNamespace, m.ClaimName, m.Volume, true
+	}
+	return "", "", "", false
+}
+
+// manifestOwner is archiveOwner without the marker fallback, the marker is in
+// the data of the volume and may have been written by its users.
+func manifestOwner(dir string) (namespace, claim, volume string, ok bool) {
+	m, err := readArchiveManifest(dir)
+	if err != nil {
+		return "", "", "", false
+	}
+	return m.ClaimNamespace, m.ClaimName, m.Volume, true
+}
+
+// archivePathFor returns the path below mountPath the directory name of volume is
+// archived to, archived-<name> next to it unless the class has an archivePath template.
+func archivePathFor(class *storage.StorageClass, volume *v1.PersistentVolume, name string, now time.Time) (string, error) {
+	template, ok := class.Parameters[paramArchivePath]
+	if !ok {
+		// volumes below a namespace root are archived in it
+		return filepath.Join(filepath.Dir(name), archivePrefix+filepath.Base(name)), nil
+	}
+
+	vars := map[string]string{
+		"directory": name,
+		"pvName":    volume.Name,
+		"timestamp": now.UTC().Format(archiveTimestamp),
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		vars["namespace"], vars["pvcName"] = ref.Namespace, ref.Name
+	}
+	var unknown []string
+	expanded := os.Expand(template, func(key string) string {
+		value, ok := vars[key]
+		if !ok {
+			unknown = append(unknown, key)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", misconfigured("invalid %s %q, unknown variables %s", paramArchivePath, template, strings.Join(unknown, ", "))
+	}
+
+	path := filepath.Clean(expanded)
+	// hidden directories hold snapshots and the archive index
+	if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, "../") || strings.HasPrefix(path, ".") {
+		return "", misconfigured("invalid %s %q, %q is not a path below the export", paramArchivePath, template, expanded)
+	}
+	return path, nil
+}
+
+// listArchives returns the paths of the archives below root: the top-level
+// archived-* directories and the archives recorded by recordArchiveClass, which
+// includes the ones named by archivePath templates.
+func listArchives(root string) ([]string, error) {
+	entries, err := dataFS.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var archives []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), archivePrefix) {
+			seen[e.Name()] = true
+			archives = append(archives, e.Name())
+		}
+	}
+
+	index := filepath.Join(root, archiveClassDir)
+	err = filepath.WalkDir(index, func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(index, path)
+		if err != nil || seen[name] {
+			return err
+		}
+		// archives removed by hand leave their entry behind, archived links are records only
+		if info, err := dataFS.Lstat(filepath.Join(root, name)); err == nil && info.IsDir() {
+			archives = append(archives, name)
+		}
+		return nil
+	})
+	sort.Strings(archives)
+	return archives, err
+}
+
+// archiveRoots returns the top-level directories of archives, e.g. "archived"
+// for archived/ns/pvc-20240101-000000.
+func archiveRoots(archives []string) map[string]bool {
+	roots := map[string]bool{}
+	for _, a := range archives {
+		roots[strings.SplitN(a, string(filepath.Separator), 2)[0]] = true
+	}
+	return roots
+}
+
+// findArchive returns the most recently archived directory of the deleted pvc
+// {namespace/name}. Archives are identified by the owner their manifest, or the
+// marker of the volume, records; their names are ambiguous for names with
+// dashes, archived-a-b-pvc-1 may be pvc b of namespace a or pvc pvc-1 of a-b.
+func findArchive(namespace, name string) (string, error) {
+	return findArchiveOwnedBy(namespace, name, archiveOwner)
+}
+
+// findArchiveOwnedBy is findArchive with the owner of an archive read by owner.
+func findArchiveOwnedBy(namespace, name string, owner func(dir string) (namespace, claim, volume string, ok bool)) (string, error) {
+	archives, err := listArchives(mountPath)
+	if err != nil {
+		return "", err
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, a := range archives {
+		ns, claim, _, ok := owner(filepath.Join(mountPath, a))
+		if !ok || ns != namespace || claim != name {
+			continue
+		}
+		info, err := dataFS.Stat(filepath.Join(mountPath, a))
+		if err != nil {
+			return "", err
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = a, info.ModTime()
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no archive found for pvc {%s/%s}", namespace, name)
+	}
+	return newest, nil
+}
+
+// findArchiveOf returns the archive of the volume directory name, if any.
+func findArchiveOf(name string) (string, bool) {
+	archived := filepath.Join(filepath.Dir(name), archivePrefix+filepath.Base(name))
+	if info, err := dataFS.Stat(filepath.Join(mountPath, archived)); err == nil && info.IsDir() {
+		return archived, true
+	}
+	archives, err := listArchives(mountPath)
+	if err != nil {
+		return "", false
+	}
+	for _, a := range archives {
+		if strings.HasPrefix(a, archivePrefix) {
+			continue
+		}
+		ns, claim, volume, ok := archiveOwner(filepath.Join(mountPath, a))
+		if ok && ns+"-"+claim+"-"+volume == filepath.Base(name) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// overBudget returns the names of the archives which have to be removed for
+// the total size of archives to fit into budget, the ones with the earliest
+// eviction time first. Archives without an eviction time, or all if evictAt is
+// nil, are evicted by the age of their data.
+func overBudget(archives []volumeUsage, budget int64, evictAt map[string]time.Time) map[string]bool {
+	var total int64
+	for _, a := range archives {
+		total += a.Bytes
+	}
+	at := func(a volumeUsage) time.Time {
+		if t, ok := evictAt[a.Name]; ok {
+			return t
+		}
+		return a.ModTime
+	}
+	oldest := append([]volumeUsage(nil), archives...)
+	sort.SliceStable(oldest, func(i, j int) bool {
+		return at(oldest[i]).Before(at(oldest[j]))
+	})
+	remove := map[string]bool{}
+	for _, a := range oldest {
+		if total <= budget {
+			break
+		}
+		remove[a.Name] = true
+		total -= a.Bytes
+	}
+	return remove
+}
+
+// evictionTimes returns the eviction time of the archives of classes with
+// archiveEviction: lru, when they were last archived or accessed.
+func (p *nfsProvisioner) evictionTimes(root string, archives []volumeUsage) map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, a := range archives {
+		r, _ := readArchiveRecord(root, a.Name)
+		if r.class == "" || p.classLister == nil {
+			continue
+		}
+		class, err := p.classLister.Get(r.class)
+		if err != nil || class.Parameters[paramArchiveEviction] != archiveEvictionLRU {
+			continue
+		}
+		// archives of earlier versions were not recorded with their time
+		last := r.archived
+		if last.IsZero() {
+			last = a.ModTime
+		}
+		if r.accessed.After(last) {
+			last = r.accessed
+		}
+		times[a.Name] = last
+	}
+	return times
+}
+
+// enforceArchiveBudget removes archives below root until they fit into budget
+// bytes, -1 for no budget, and the export has minFree percent free space, 0
+// to ignore it, in the order of the archiveEviction of their classes.
+func (p *nfsProvisioner) enforceArchiveBudget(root string, budget int64, minFree float64) {
+	archives, err := scanArchives(root)
+	if err != nil {
+		glog.Warningf("scan archives of %s fail: %s", root, err.Error())
+		return
+	}
+	reason := fmt.Sprintf("the archives exceed the budget of %s", formatBytes(budget))
+	if minFree > 0 {
+		free, total, err := exportCapacity(root)
+		if err != nil {
+			glog.Warningf("statfs %s for archive eviction fail: %s", root, err.Error())
+		} else if short := int64(minFree*float64(total)/100) - free; short > 0 {
+			var archived int64
+			for _, a := range archives {
+				archived += a.Bytes
+			}
+			// removing all archives is the most that can be done
+			if limit := max(archived-short, 0); budget < 0 || limit < budget {
+				budget = limit
+				reason = fmt.Sprintf("the export has less than %.0f%% free space", minFree)
+			}
+		}
+	}
+	if budget < 0 {
+		return
+	}
+	for name := range overBudget(archives, budget, p.evictionTimes(root, archives)) {
+		glog.Infof("removing archive %s, %s", name, reason)
+		if err := removeArchive(root, name); err != nil {
+			glog.Warningf("remove archive %s fail: %s", name, err.Error())
+		}
+	}
+}
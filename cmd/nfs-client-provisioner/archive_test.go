@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// makeArchives creates an archive of size bytes below root per age, named
+// archived-<age> and last modified age ago.
+func makeArchives(t *testing.T, root string, size int, ages ...string) {
+	t.Helper()
+	for _, age := range ages {
+		d, err := parseAge(age)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(root, archivePrefix+age)
+		writeTestFile(t, filepath.Join(dir, "data"), strings.Repeat("x", size))
+		modTime := time.Now().Add(-d)
+		if err := os.Chtimes(dir, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEnforceArchiveBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget int64
+		// lru are the archives of a class with archiveEviction: lru, accessed now
+		lru   []string
+		fault string
+		want  []string
+	}{
+		{name: "no budget", budget: -1, want: []string{"archived-1d", "archived-20d", "archived-40d"}},
+		{name: "oldest evicted", budget: 250000, want: []string{"archived-1d", "archived-20d"}},
+		{name: "oldest two evicted", budget: 150000, want: []string{"archived-1d"}},
+		{name: "accessed kept", budget: 250000, lru: []string{"archived-40d"}, want: []string{"archived-1d", "archived-40d"}},
+		{name: "removal fails", budget: 150000, fault: "removeall", want: []string{"archived-1d", "archived-20d", "archived-40d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			classes.Add(testClass("lru", map[string]string{paramArchiveEviction: archiveEvictionLRU}))
+			p := newTestProvisioner(t, markerCheckStrict)
+			p.classLister = storagelisters.NewStorageClassLister(classes)
+			makeArchives(t, mountPath, 100000, "1d", "20d", "40d")
+			for _, name := range tt.lru {
+				if err := writeArchiveRecord(mountPath, name, archiveRecord{class: "lru", accessed: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			p.enforceArchiveBudget(mountPath, tt.budget, 0)
+			got, err := listArchives(mountPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("archives = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	otiai10 "github.com/otiai10/copy"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	backupDir = ".backups"
+
+	backupPhaseRunning   = "Running"
+	backupPhaseCompleted = "Completed"
+	backupPhaseFailed    = "Failed"
+)
+
+var volumeBackupResource = schema.GroupVersionResource{Group: "nchc.ai", Version: "v1alpha1", Resource: "volumebackups"}
+
+// backupController copies the directory of the PVC referenced by a VolumeBackup
+// to .backups/<namespace>/<name> on the export, or below its spec.s3URL, and
+// records the result on the VolumeBackup status.
+type backupController struct {
+	p        *nfsProvisioner
+	client   dynamic.Interface
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+func newBackupController(p *nfsProvisioner, client dynamic.Interface) *backupController {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 10*time.Minute)
+	c := &backupController{
+		p:        p,
+		client:   client,
+		informer: factory.ForResource(volumeBackupResource).Informer(),
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	enqueue := func(obj interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			c.queue.Add(key)
+		}
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	})
+	return c
+}
+
+func (c *backupController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	go c.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		return
+	}
+	go func() {
+		for c.processNext(ctx) {
+		}
+	}()
+	<-ctx.Done()
+}
+
+func (c *backupController) processNext(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		glog.Warningf("sync volume backup %s fail: %s", key, err.Error())
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *backupController) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	backup := obj.(*unstructured.Unstructured).DeepCopy()
+
+	phase, _, _ := unstructured.NestedString(backup.Object, "status", "phase")
+	if phase == backupPhaseCompleted || phase == backupPhaseFailed {
+		return nil
+	}
+
+	claimName, _, _ := unstructured.NestedString(backup.Object, "spec", "claimName")
+	src, err := c.sourceDirectory(ctx, backup.GetNamespace(), claimName)
+	if err != nil {
+		return c.fail(ctx, backup, claimName, "", err)
+	}
+
+	s3URL, _, _ := unstructured.NestedString(backup.Object, "spec", "s3URL")
+	if s3URL != "" {
+		return c.backupToS3(ctx, backup, claimName, src, s3URL)
+	}
+
+	dest := filepath.Join(backupDir, backup.GetNamespace(), backup.GetName())
+	if err := c.updateStatus(ctx, backup, map[string]interface{}{
+		"phase": backupPhaseRunning,
+		"path":  dest,
+	}); err != nil {
+		return err
+	}
+
+	glog.Infof("Backup %s to %s", src, dest)
+	fullDest := filepath.Join(mountPath, dest)
+	// start from scratch in case a previous attempt was interrupted
+	if err := removeAll(fullDest); err != nil {
+		return err
+	}
+	if err := dataFS.Copy(src, fullDest, otiai10.Options{}); err != nil {
+		return c.fail(ctx, backup, claimName, dest, err)
+	}
+	bytes, _, err := dirUsage(fullDest)
+	if err != nil {
+		return err
+	}
+	return c.complete(ctx, backup, dest, bytes)
+}
+
+// backupToS3 uploads src, the directory of the PVC claimName, below the
+// s3://bucket/prefix URL s3URL of backup, to <prefix>/<namespace>/<name>/.
+func (c *backupController) backupToS3(ctx context.Context, backup *unstructured.Unstructured, claimName, src, s3URL string) error {
+	bucket, prefix, err := parseS3URL(s3URL)
+	if err != nil {
+		return c.fail(ctx, backup, claimName, "", fmt.Errorf("invalid spec.s3URL: %w", err))
+	}
+	prefix = path.Join(prefix, backup.GetNamespace(), backup.GetName()) + "/"
+	dest := "s3://" + bucket + "/" + prefix
+	if err := c.updateStatus(ctx, backup, map[string]interface{}{
+		"phase": backupPhaseRunning,
+		"path":  dest,
+	}); err != nil {
+		return err
+	}
+
+	// the Secret is read on behalf of the creator of the backup, only those the
+	// class of the backed up volume allows are
+	class, err := c.claimClass(ctx, backup.GetNamespace(), claimName)
+	if err != nil {
+		return c.fail(ctx, backup, claimName, dest, err)
+	}
+	secret, _, _ := unstructured.NestedString(backup.Object, "spec", "s3Secret")
+	client, err := c.p.newS3Client(ctx, class, backup.GetNamespace(), secret)
+	if err != nil {
+		return c.fail(ctx, backup, claimName, dest, err)
+	}
+	glog.Infof("Backup %s to %s", src, dest)
+	bytes, err := uploadToS3(ctx, client, src, bucket, prefix)
+	if err != nil {
+		return c.fail(ctx, backup, claimName, dest, err)
+	}
+	return c.complete(ctx, backup, dest, bytes)
+}
+
+// fail records that the backup of claimName to dest failed with err.
+func (c *backupController) fail(ctx context.Context, backup *unstructured.Unstructured, claimName, dest string, err error) error {
+	c.p.warn(backup, reasonBackupFailed, "backup of pvc %s/%s fail: %s", backup.GetNamespace(), claimName, err.Error())
+	status := map[string]interface{}{
+		"phase":   backupPhaseFailed,
+		"message": err.Error(),
+	}
+	if dest != "" {
+		status["path"] = dest
+	}
+	return c.updateStatus(ctx, backup, status)
+}
+
+// complete records that the backup to dest holds bytes.
+func (c *backupController) complete(ctx context.Context, backup *unstructured.Unstructured, dest string, bytes int64) error {
+	return c.updateStatus(ctx, backup, map[string]interface{}{
+		"phase":          backupPhaseCompleted,
+		"path":           dest,
+		"bytes":          bytes,
+		"completionTime": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// sourceDirectory returns the backing directory of a bound PVC provisioned by us,
+// following the symbolic link of linked volumes.
+func (c *backupController) sourceDirectory(ctx context.Context, namespace, claimName string) (string, error) {
+	if claimName == "" {
+		return "", fmt.Errorf("spec.claimName is not set")
+	}
+	pvc, err := c.p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pvc.Status.Phase != v1.ClaimBound {
+		return "", fmt.Errorf("pvc %s/%s is not bound", namespace, claimName)
+	}
+	pv, err := c.p.client.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !c.p.ownsVolume(pv) {
+		return "", fmt.Errorf("pv %s is not provisioned by %s", pv.Name, c.p.name)
+	}
+	dir, err := c.p.resolveDirectory(c.p.volumeDirectory(pv))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mountPath, dir), nil
+}
+
+// claimClass returns the storage class of the volume of the bound PVC claimName.
+func (c *backupController) claimClass(ctx context.Context, namespace, claimName string) (*storage.StorageClass, error) {
+	pvc, err := c.p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pv, err := c.p.client.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return c.p.getClassForVolume(ctx, pv)
+}
+
+func (c *backupController) updateStatus(ctx context.Context, backup *unstructured.Unstructured, status map[string]interface{}) error {
+	if err := unstructured.SetNestedField(backup.Object, status, "status"); err != nil {
+		return err
+	}
+	updated, err := c.client.Resource(volumeBackupResource).Namespace(backup.GetNamespace()).UpdateStatus(ctx, backup, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	backup.SetResourceVersion(updated.GetResourceVersion())
+	return nil
+}
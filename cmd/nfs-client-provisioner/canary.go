@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// canaryDir holds the canaries of the replicas, below mountPath
+	canaryDir = ".canary"
+	// canaryTimeout limits a whole canary run
+	canaryTimeout = time.Minute
+	// canarySize is the size of the file the canary writes and reads back
+	canarySize = 4096
+)
+
+// canary provisions, writes, reads back and deletes a tiny volume directory
+// like a real one, so that broken mounts and permissions show up before the
+// first claim fails.
+type canary struct {
+	p *nfsProvisioner
+	// pod receives the events, nil to only log them
+	pod *v1.ObjectReference
+}
+
+func newCanary(p *nfsProvisioner) *canary {
+	return &canary{p: p, pod: podReference()}
+}
+
+// Run runs the canary now and then every interval, 0 to only run it once.
+func (c *canary) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		c.check(ctx)
+		return
+	}
+	wait.UntilWithContext(ctx, c.check, interval)
+}
+
+func (c *canary) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, canaryTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.run(ctx)
+	canaryDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		canarySuccess.Set(0)
+		var obj runtime.Object
+		if c.pod != nil {
+			obj = c.pod
+		}
+		c.p.warn(obj, reasonCanaryFailed, "canary volume on %s:%s fail: %s", c.p.server, c.p.path, err.Error())
+		return
+	}
+	canarySuccess.Set(1)
+	glog.V(4).Infof("canary volume on %s:%s succeeded in %s", c.p.server, c.p.path, time.Since(start))
+}
+
+// run goes through the steps of provisioning, using and deleting a volume.
+func (c *canary) run(ctx context.Context) error {
+	name := "canary"
+	if c.pod != nil {
+		name = c.pod.Name
+	}
+	dir := filepath.Join(mountPath, canaryDir, name)
+	// a canary left behind by a crash is replaced
+	if err := removeAllCtx(ctx, dir); err != nil {
+		return fmt.Errorf("remove %s: %w", dir, err)
+	}
+	if err := mkdirAllCtx(ctx, dir, 0777); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	if err := chmodCtx(ctx, dir, 0777); err != nil {
+		return fmt.Errorf("chmod %s: %w", dir, err)
+	}
+	marker := &volumeMarker{Provisioner: c.p.name, Volume: name, Created: time.Now().UTC()}
+	if err := runFS(ctx, func() error { return writeMarker(dir, marker) }); err != nil {
+		return fmt.Errorf("write marker of %s: %w", dir, err)
+	}
+
+	data := make([]byte, canarySize)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "data")
+	if err := runFS(ctx, func() error { return writeSynced(path, data) }); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	var read []byte
+	if err := runFS(ctx, func() error {
+		f, err := dataFS.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		read, err = io.ReadAll(f)
+		return err
+	}); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("%s reads back %d bytes differing from the %d written", path, len(read), len(data))
+	}
+
+	if err := removeAllCtx(ctx, dir); err != nil {
+		return fmt.Errorf("remove %s: %w", dir, err)
+	}
+	return nil
+}
+
+// writeSynced writes data to path and flushes it to the NFS server.
+func writeSynced(path string, data []byte) error {
+	f, err := dataFS.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
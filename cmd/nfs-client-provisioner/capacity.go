@@ -0,0 +1,109 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	capacityOK       = "OK"
+	capacityWarning  = "Warning"
+	capacityCritical = "Critical"
+
+	capacityCheckInterval = time.Minute
+)
+
+// capacityMonitor watches the free space of the export and reports crossing the
+// warning and critical thresholds as events on the provisioner pod.
+type capacityMonitor struct {
+	p *nfsProvisioner
+	// warning and critical are thresholds in percent of free space, 0 to disable
+	warning, critical float64
+	// pause stops provisioning while the free space is below the critical threshold
+	pause bool
+	// pod receives the events, nil to only log them
+	pod   *v1.ObjectReference
+	level string
+}
+
+func newCapacityMonitor(p *nfsProvisioner, warning, critical float64, pause bool) *capacityMonitor {
+	return &capacityMonitor{p: p, warning: warning, critical: critical, pause: pause, level: capacityOK, pod: podReference()}
+}
+
+// podReference returns the provisioner pod, nil if it is unknown.
+func podReference() *v1.ObjectReference {
+	// set with the downward API, see deploy/deployment.yaml
+	if name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE"); name != "" && namespace != "" {
+		return &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+	}
+	return nil
+}
+
+func (m *capacityMonitor) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, m.check, capacityCheckInterval)
+}
+
+func (m *capacityMonitor) check(ctx context.Context) {
+	free, total, err := exportCapacity(mountPath)
+	if err != nil || total == 0 {
+		glog.Warningf("statfs %s for capacity check fail: %v", mountPath, err)
+		return
+	}
+	exportFreeBytes.Set(float64(free))
+	exportSizeBytes.Set(float64(total))
+
+	percent := float64(free) * 100 / float64(total)
+	level := capacityOK
+	switch {
+	case m.critical > 0 && percent < m.critical:
+		level = capacityCritical
+	case m.warning > 0 && percent < m.warning:
+		level = capacityWarning
+	}
+	if m.pause {
+		m.p.provisioningPaused.Store(level == capacityCritical)
+	}
+	if level == m.level {
+		return
+	}
+
+	previous := m.level
+	m.level = level
+	message := fmt.Sprintf("export %s:%s has %s (%.1f%%) free", m.p.server, m.p.path, formatBytes(free), percent)
+	var obj runtime.Object
+	if m.pod != nil {
+		obj = m.pod
+	}
+	if level == capacityOK {
+		glog.Infof("%s, back above the thresholds after %s", message, previous)
+		m.p.event(obj, nil, v1.EventTypeNormal, reasonExportCapacity+capacityOK, message)
+		return
+	}
+	if level == capacityCritical && m.pause {
+		message += ", provisioning is paused"
+	}
+	m.p.warn(obj, reasonExportCapacity+level, "%s", message)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// cloneSourceIndex indexes pending claims by the "namespace/name" of their clone source
+	cloneSourceIndex = "cloneSource"
+	// annSrcBound is set on pending clones when their source claim gets bound, to retry them right away
+	annSrcBound = "nchc.ai/src-bound"
+)
+
+// getClaim returns a claim from the cache, falling back to the API server on a cache miss.
+func (p *nfsProvisioner) getClaim(ctx context.Context, namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	if p.claimLister != nil {
+		if claim, err := p.claimLister.PersistentVolumeClaims(namespace).Get(name); err == nil {
+			return claim, nil
+		}
+	}
+	return p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// getVolume returns a volume from the cache, falling back to the API server on a cache miss.
+func (p *nfsProvisioner) getVolume(ctx context.Context, name string) (*v1.PersistentVolume, error) {
+	if p.volumeLister != nil {
+		if volume, err := p.volumeLister.Get(name); err == nil {
+			return volume, nil
+		}
+	}
+	return p.client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+}
+
+// cloneSourceKey returns the "namespace/name" of the claim pvc is cloned from, if any.
+func cloneSourceKey(pvc *v1.PersistentVolumeClaim) string {
+	annotations, _ := v1Annotations(pvc)
+	namespace, name := annotations[annSrcPVCNamespace], annotations[annSrcPVCName]
+	if namespace == "" || name == "" {
+		return ""
+	}
+	return namespace + "/" + name
+}
+
+// watchCloneSources retries pending clones as soon as their source claim gets bound,
+// instead of waiting for the rate limited retry of the provision controller.
+// It must be called before the claim informer is started.
+func (p *nfsProvisioner) watchCloneSources(informer cache.SharedIndexInformer) error {
+	err := informer.AddIndexers(cache.Indexers{
+		cloneSourceIndex: func(obj interface{}) ([]string, error) {
+			pvc, ok := obj.(*v1.PersistentVolumeClaim)
+			if !ok || pvc.Status.Phase != v1.ClaimPending {
+				return nil, nil
+			}
+			if key := cloneSourceKey(pvc); key != "" {
+				return []string{key}, nil
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPVC, ok := oldObj.(*v1.PersistentVolumeClaim)
+			if !ok {
+				return
+			}
+			newPVC, ok := newObj.(*v1.PersistentVolumeClaim)
+			if !ok || oldPVC.Status.Phase == v1.ClaimBound || newPVC.Status.Phase != v1.ClaimBound {
+				return
+			}
+			clones, err := informer.GetIndexer().ByIndex(cloneSourceIndex, newPVC.Namespace+"/"+newPVC.Name)
+			if err != nil {
+				return
+			}
+			for _, obj := range clones {
+				p.touchClaim(obj.(*v1.PersistentVolumeClaim))
+			}
+		},
+	})
+	return err
+}
+
+// touchClaim updates an annotation of pvc, so the provision controller syncs it again.
+func (p *nfsProvisioner) touchClaim(pvc *v1.PersistentVolumeClaim) {
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annSrcBound: time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	glog.V(4).Infof("source of pending pvc {%s/%s} got bound, retrying", pvc.Namespace, pvc.Name)
+	_, err := p.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(context.Background(), pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		glog.Warningf("retry pending pvc {%s/%s} fail: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// annUsed is set on bound PVCs to the size of their volume directory, e.g. 9.5Gi
+	annUsed = "nchc.ai/used"
+	// annUsedPercent is set on bound PVCs to their usage in percent of the request
+	annUsedPercent = "nchc.ai/used-percent"
+
+	// claimUsagePatchesPerSecond limits the PVC updates of a usage run
+	claimUsagePatchesPerSecond = 2
+)
+
+// claimUsageMonitor periodically annotates bound PVCs with the usage of their
+// volume. Annotations are only written when the rounded values changed, and at
+// most claimUsagePatchesPerSecond, so large clusters do not flood the API server.
+// Volumes using more than their request are reported whatever their class, so
+// that they are found before quotas are set.
+type claimUsageMonitor struct {
+	p       *nfsProvisioner
+	limiter flowcontrol.RateLimiter
+	// overRequest are the volumes above their request, an event is only
+	// posted when a volume exceeds it
+	overRequest map[string]bool
+}
+
+func newClaimUsageMonitor(p *nfsProvisioner) *claimUsageMonitor {
+	return &claimUsageMonitor{p: p, limiter: flowcontrol.NewTokenBucketRateLimiter(claimUsagePatchesPerSecond, 1), overRequest: map[string]bool{}}
+}
+
+func (m *claimUsageMonitor) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, m.update, interval)
+}
+
+func (m *claimUsageMonitor) update(ctx context.Context) {
+	pvs, err := m.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for claim usage fail: %s", err.Error())
+		return
+	}
+	volumeOverRequestBytes.Reset()
+	overRequest := map[string]bool{}
+	for _, pv := range pvs {
+		ref := pv.Spec.ClaimRef
+		if !m.p.ownsVolume(pv) || ref == nil || pv.Status.Phase != v1.VolumeBound {
+			continue
+		}
+		// linked volumes share the data of their source, the usage would be misleading
+		dir := filepath.Join(mountPath, m.p.volumeDirectory(pv))
+		if info, err := dataFS.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		pvc, err := m.p.getClaim(ctx, ref.Namespace, ref.Name)
+		if err != nil || pvc.UID != ref.UID {
+			continue
+		}
+		used, _, err := dirUsage(dir)
+		if err != nil {
+			glog.Warningf("usage of volume %s fail: %s", pv.Name, err.Error())
+			continue
+		}
+
+		annotations := map[string]string{annUsed: formatBytes(used)}
+		request := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		if request.Value() > 0 {
+			annotations[annUsedPercent] = strconv.FormatInt(used*100/request.Value(), 10)
+		}
+		if request.Value() > 0 && used > request.Value() {
+			overRequest[pv.Name] = true
+			volumeOverRequestBytes.WithLabelValues(pv.Name, pvc.Namespace, pvc.Name, pv.Spec.StorageClassName).Set(float64(used - request.Value()))
+			if !m.overRequest[pv.Name] {
+				m.p.warn(pvc, reasonOverRequest, "volume %s uses %s, more than the requested %s", pv.Name, formatBytes(used), request.String())
+			}
+		} else if m.overRequest[pv.Name] {
+			glog.Infof("volume %s uses %s, within its request again", pv.Name, formatBytes(used))
+		}
+		if pvc.Annotations[annUsed] == annotations[annUsed] && pvc.Annotations[annUsedPercent] == annotations[annUsedPercent] {
+			continue
+		}
+		if err := m.limiter.Wait(ctx); err != nil {
+			return
+		}
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": annotations},
+		})
+		_, err = m.p.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			glog.Warningf("update usage of pvc {%s/%s} fail: %s", pvc.Namespace, pvc.Name, err.Error())
+		}
+	}
+	m.overRequest = overRequest
+}
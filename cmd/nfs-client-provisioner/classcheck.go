@@ -0,0 +1,204 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/robfig/cron/v3"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// paramArchiveOnDelete false removes the directories of deleted volumes, superseded by onDelete
+const paramArchiveOnDelete = "archiveOnDelete"
+
+// knownParameters are the StorageClass parameters the provisioner understands.
+var knownParameters = map[string]bool{
+	paramArchiveOnDelete:            true,
+	paramOnDelete:                   true,
+	paramRecycleRebind:              true,
+	paramArchivePath:                true,
+	paramArchiveEviction:            true,
+	paramSecureDelete:               true,
+	paramResticRepository:           true,
+	paramLinkMode:                   true,
+	paramLinkOnDelete:               true,
+	paramMaxCloneSize:               true,
+	paramStrictCloneSource:          true,
+	paramMaxVolumesPerNamespace:     true,
+	paramAllowReclaimPolicyOverride: true,
+	paramAllowedAccessModes:         true,
+	paramForceAccessModes:           true,
+	paramSoftQuota:                  true,
+	paramHardQuota:                  true,
+	paramSnapshotSchedule:           true,
+	paramSnapshotRetention:          true,
+	paramDefaultMountOptions:        true,
+	paramAllowSubdirName:            true,
+	paramExistingDirectory:          true,
+	paramDirectoryNaming:            true,
+	paramDeletionGracePeriod:        true,
+	paramTrashRetention:             true,
+	paramDataSourceSecrets:          true,
+	paramQuotaAction:                true,
+	paramInodeLimit:                 true,
+	paramInodesPerGiB:               true,
+}
+
+// validateClass returns the problems of the parameters of class, which would
+// otherwise only show when a PVC of the class is provisioned or deleted.
+func validateClass(class *storage.StorageClass) []string {
+	var problems []string
+	for key := range class.Parameters {
+		if !knownParameters[key] {
+			problems = append(problems, fmt.Sprintf("unknown parameter %q", key))
+		}
+	}
+	for _, key := range []string{paramArchiveOnDelete, paramRecycleRebind, paramSecureDelete, paramStrictCloneSource, paramAllowReclaimPolicyOverride, paramDefaultMountOptions, paramAllowSubdirName} {
+		if v, ok := class.Parameters[key]; ok {
+			if _, err := strconv.ParseBool(v); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s %q, must be true or false", key, v))
+			}
+		}
+	}
+	if _, err := onDeleteAction(class); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := existingDirectoryPolicy(class); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := directoryNaming(class); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := trashRetention(class); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if v, ok := class.Parameters[paramDeletionGracePeriod]; ok {
+		if d, err := parseAge(v); err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s %q, must be a duration like 24h or 2d", paramDeletionGracePeriod, v))
+		}
+	}
+	if _, hard, err := quotaLimits(class); err != nil {
+		problems = append(problems, err.Error())
+	} else if _, ok := class.Parameters[paramQuotaAction]; ok && hard == 0 {
+		problems = append(problems, fmt.Sprintf("%s has no effect without %s", paramQuotaAction, paramHardQuota))
+	}
+	if _, err := quotaAction(class); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := inodeLimit(class, resource.Quantity{}); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, ok := class.Parameters[paramArchivePath]; ok {
+		sample := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-0"},
+			Spec:       v1.PersistentVolumeSpec{ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "pvc"}},
+		}
+		if _, err := archivePathFor(class, sample, "default-pvc-pvc-0", time.Now()); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	switch v := class.Parameters[paramArchiveEviction]; v {
+	case "", archiveEvictionOldest, archiveEvictionLRU:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid %s %q, must be %q or %q", paramArchiveEviction, v, archiveEvictionOldest, archiveEvictionLRU))
+	}
+	if v, ok := class.Parameters[paramLinkMode]; ok && v != linkModeRelative && v != linkModeAbsolute {
+		problems = append(problems, fmt.Sprintf("invalid %s %q, must be %q or %q", paramLinkMode, v, linkModeRelative, linkModeAbsolute))
+	}
+	switch v := class.Parameters[paramLinkOnDelete]; v {
+	case "", linkOnDeleteRemove, linkOnDeleteArchive, linkOnDeleteGC:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid %s %q, must be %q, %q or %q", paramLinkOnDelete, v, linkOnDeleteRemove, linkOnDeleteArchive, linkOnDeleteGC))
+	}
+	if v, ok := class.Parameters[paramMaxCloneSize]; ok {
+		if _, err := resource.ParseQuantity(v); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q: %v", paramMaxCloneSize, v, err))
+		}
+	}
+	if v, ok := class.Parameters[paramMaxVolumesPerNamespace]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s %q, must be a number", paramMaxVolumesPerNamespace, v))
+		}
+	}
+	for _, key := range []string{paramAllowedAccessModes, paramForceAccessModes} {
+		if v, ok := class.Parameters[key]; ok {
+			if _, err := parseAccessModes(key, v); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if v, ok := class.Parameters[paramSnapshotSchedule]; ok {
+		if _, err := cron.ParseStandard(v); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q: %v", paramSnapshotSchedule, v, err))
+		}
+	}
+	if v, ok := class.Parameters[paramSnapshotRetention]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			problems = append(problems, fmt.Sprintf("invalid %s %q, must be at least 1", paramSnapshotRetention, v))
+		}
+	}
+	return problems
+}
+
+// watchClasses validates the storage classes of the provisioner when they are
+// listed at startup and whenever they change, and reports the broken ones. It
+// must be called before the class informer is started.
+func (p *nfsProvisioner) watchClasses(informer cache.SharedIndexInformer) error {
+	check := func(obj interface{}) {
+		class, ok := obj.(*storage.StorageClass)
+		if !ok || class.Provisioner != p.name {
+			return
+		}
+		problems := validateClass(class)
+		classProblems.WithLabelValues(class.Name).Set(float64(len(problems)))
+		if len(problems) > 0 {
+			p.warn(class, reasonInvalidStorageClass, "storage class %s: %s", class.Name, strings.Join(problems, "; "))
+		} else {
+			glog.V(4).Infof("storage class %s is valid", class.Name)
+		}
+		if keys := deprecatedKeys(class.Parameters, deprecatedParameters); len(keys) > 0 {
+			p.warn(class, reasonDeprecated, "%s", deprecationMessage("storage class "+class.Name, "parameter", keys, deprecatedParameters))
+		}
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: check,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldClass, ok := oldObj.(*storage.StorageClass)
+			// resyncs and changes of other fields do not repeat the events
+			if ok && reflect.DeepEqual(oldClass.Parameters, newObj.(*storage.StorageClass).Parameters) {
+				return
+			}
+			check(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if class, ok := obj.(*storage.StorageClass); ok {
+				classProblems.DeleteLabelValues(class.Name)
+			}
+		},
+	})
+	return err
+}
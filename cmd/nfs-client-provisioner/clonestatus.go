@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// annCloneStatus on a cloned PVC is the state of the clone, see the cloneStatus values
+	annCloneStatus = "nchc.ai/clone-status"
+	// annCloneStatusReason is a CamelCase reason for the state, for scripts to match on
+	annCloneStatusReason = "nchc.ai/clone-status-reason"
+	// annCloneStatusMessage explains the state to humans
+	annCloneStatusMessage = "nchc.ai/clone-status-message"
+)
+
+// The states of a clone. Pending moves to Copying, then Verifying and Complete
+// for copies, or straight to Complete for links. Any state may move to Failed,
+// which is final unless the provision controller retries the claim.
+const (
+	cloneStatusPending   = "Pending"
+	cloneStatusCopying   = "Copying"
+	cloneStatusVerifying = "Verifying"
+	cloneStatusComplete  = "Complete"
+	cloneStatusFailed    = "Failed"
+)
+
+// Reasons of the clone states besides the error classes of failed provisioning.
+const (
+	cloneReasonProvisioning = "Provisioning"
+	cloneReasonCopying      = "Copying"
+	cloneReasonLinking      = "Linking"
+	cloneReasonVerifying    = "Verifying"
+	cloneReasonCopied       = "Copied"
+	cloneReasonLinked       = "Linked"
+)
+
+// isCloneRequest reports whether pvc is cloned from another claim or an archive.
+func isCloneRequest(pvc *v1.PersistentVolumeClaim) bool {
+	if ref := dataSourceRef(pvc); ref != nil && isClaimRef(ref) {
+		return true
+	}
+	annotations, _ := v1Annotations(pvc)
+	iscopy, _ := strconv.ParseBool(annotations[annCopyDate])
+	islink, _ := strconv.ParseBool(annotations[annLinkDate])
+	return iscopy || islink
+}
+
+// setCloneStatus records the state of the clone pvc. The state, reason and
+// message are patched together, so pollers never see the reason of another
+// state. Failures to patch are only logged, they do not fail the clone.
+func (p *nfsProvisioner) setCloneStatus(pvc *v1.PersistentVolumeClaim, status, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if pvc.Annotations[annCloneStatus] == status && pvc.Annotations[annCloneStatusReason] == reason &&
+		pvc.Annotations[annCloneStatusMessage] == message {
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annCloneStatus:        status,
+				annCloneStatusReason:  reason,
+				annCloneStatusMessage: message,
+			},
+		},
+	})
+	glog.V(4).Infof("clone status of pvc {%s/%s}: %s (%s) %s", pvc.Namespace, pvc.Name, status, reason, message)
+	// not the context of the provisioning, timed out clones must be marked as well
+	_, err := p.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(context.Background(), pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		glog.Warningf("set clone status of pvc {%s/%s} to %s fail: %s", pvc.Namespace, pvc.Name, status, err.Error())
+	}
+}
+
+// setCloneFailure records that provisioning the clone pvc failed with err.
+// Transient failures are retried, so the clone stays pending.
+func (p *nfsProvisioner) setCloneFailure(pvc *v1.PersistentVolumeClaim, err error) {
+	class := classify(err)
+	status, reason := cloneStatusFailed, string(class)
+	if class == classTransient {
+		status = cloneStatusPending
+	} else if class == classPermanent && categorize(err) == categoryCopy {
+		reason = reasonCopyFailed
+	}
+	p.setCloneStatus(pvc, status, reason, "%s", err.Error())
+}
+
+// verifyCopy compares the number of files and symbolic links and the size of
+// the files of destDir, the name of a copy below mountPath, with its source
+// srcDir. The marker files are left out, the copy gets one of its own. Streamed
+// sources are verified by the stream itself.
+func verifyCopy(srcDir, destDir string) error {
+	if isStreamSource(srcDir) {
+		return nil
+	}
+	srcBytes, srcFiles, err := treeContent(sourcePath(srcDir))
+	if err != nil {
+		return err
+	}
+	destBytes, destFiles, err := treeContent(filepath.Join(mountPath, destDir))
+	if err != nil {
+		return err
+	}
+	if srcBytes != destBytes || srcFiles != destFiles {
+		return fmt.Errorf("the copy has %d files of %s, its source %d files of %s", destFiles, formatBytes(destBytes), srcFiles, formatBytes(srcBytes))
+	}
+	return nil
+}
+
+// treeContent returns the size of the regular files below root and their number
+// plus the number of symbolic links, without the marker file of root. Unlike
+// dirUsage it never uses cached sizes and leaves out the size of directories,
+// which differs between file systems.
+func treeContent(root string) (int64, int64, error) {
+	var bytes, files int64
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == filepath.Join(root, markerFile) {
+			return nil
+		}
+		switch {
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			bytes += info.Size()
+			files++
+		case d.Type()&fs.ModeSymlink != 0:
+			files++
+		}
+		return nil
+	})
+	return bytes, files, err
+}
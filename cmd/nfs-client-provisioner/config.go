@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables of settings, e.g.
+	// NFS_CLIENT_METRICS_PORT for -metrics-port
+	envPrefix = "NFS_CLIENT_"
+	// configFlag names the config file, which cannot be set in itself
+	configFlag = "config"
+)
+
+// legacyEnv are the environment variables of settings which predate
+// envPrefix. They are still read, after the prefixed ones.
+var legacyEnv = map[string]string{
+	"nfs-server":       "NFS_SERVER",
+	"nfs-path":         "NFS_PATH",
+	"provisioner-name": provisionerNameKey,
+}
+
+// envNames returns the environment variables of the setting name, in order of precedence.
+func envNames(name string) []string {
+	names := []string{envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))}
+	if legacy, ok := legacyEnv[name]; ok {
+		names = append(names, legacy)
+	}
+	return names
+}
+
+// lookupSetting returns the value of the setting name from the environment, for
+// commands which do not load the configuration, like the admin commands.
+func lookupSetting(name string) string {
+	for _, env := range envNames(name) {
+		if value, ok := os.LookupEnv(env); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// loadConfig sets every flag of fs which was not given on the command line from
+// the environment or, with lower precedence, from the config file, a YAML map of
+// flag names to values. It returns where the value of each flag comes from.
+func loadConfig(fs *flag.FlagSet) (map[string]string, error) {
+	sources := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+
+	file := map[string]interface{}{}
+	path := fs.Lookup(configFlag).Value.String()
+	if _, ok := sources[configFlag]; !ok {
+		if env := lookupSetting(configFlag); env != "" {
+			path = env
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil || name == configFlag {
+				return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+			}
+		}
+	}
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := sources[f.Name]; ok {
+			return
+		}
+		for _, env := range envNames(f.Name) {
+			if value, ok := os.LookupEnv(env); ok {
+				sources[f.Name] = "env " + env
+				if err := fs.Set(f.Name, value); err != nil {
+					errs = append(errs, fmt.Sprintf("invalid %s %q: %v", env, value, err))
+				}
+				return
+			}
+		}
+		if value, ok := file[f.Name]; ok && f.Name != configFlag {
+			sources[f.Name] = "config file"
+			if err := fs.Set(f.Name, configValue(value)); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid %s %v in config file: %v", f.Name, value, err))
+			}
+			return
+		}
+		sources[f.Name] = "default"
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return sources, nil
+}
+
+// configValue renders a value of the config file as flag value. YAML numbers
+// are decoded as float64, which fmt would print in exponent notation.
+func configValue(value interface{}) string {
+	if n, ok := value.(float64); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// logConfig logs the effective value of every flag of fs together with its source.
+func logConfig(fs *flag.FlagSet, sources map[string]string) {
+	var lines []string
+	fs.VisitAll(func(f *flag.Flag) {
+		lines = append(lines, fmt.Sprintf("  -%s=%s (%s)", f.Name, f.Value.String(), sources[f.Name]))
+	})
+	sort.Strings(lines)
+	glog.Infof("effective configuration:\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// consistencyReport summarizes how the export matches the volumes of the cluster.
+type consistencyReport struct {
+	Healthy int
+	// Orphans are directories on the export without a volume
+	Orphans []string
+	// Missing are volumes whose directory does not exist
+	Missing []string
+	// BrokenLinks are linked volumes whose source does not exist
+	BrokenLinks []string
+	// Unreadable are volumes whose directory cannot be read
+	Unreadable []string
+}
+
+func (r *consistencyReport) consistent() bool {
+	return len(r.Orphans) == 0 && len(r.Missing) == 0 && len(r.BrokenLinks) == 0 && len(r.Unreadable) == 0
+}
+
+// checkConsistency reconciles the directories on the export with the volumes of
+// this provisioner. Archived, quarantined, recycled, still linked and hidden
+// directories are not orphans. Only the top level of the export is checked for
+// orphans, namespace roots are not.
+func (p *nfsProvisioner) checkConsistency(ctx context.Context) (*consistencyReport, error) {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := dataFS.ReadDir(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := listArchives(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	roots := archiveRoots(archives)
+	// namespace roots and tenants hold volumes, they are checked through their volumes
+	var volumeRoots []string
+	if nsRoots, err := p.namespaceRoots(ctx); err == nil {
+		volumeRoots = nsRoots.all()
+	}
+	for _, t := range p.listTenants() {
+		volumeRoots = append(volumeRoots, t.Directory)
+	}
+	for _, root := range volumeRoots {
+		if root != "" {
+			roots[strings.SplitN(filepath.Clean(root), string(filepath.Separator), 2)[0]] = true
+		}
+	}
+
+	report := &consistencyReport{}
+	known := map[string]bool{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if !p.ownsVolume(pv) {
+			continue
+		}
+		name := p.volumeDirectory(pv)
+		known[strings.SplitN(name, string(filepath.Separator), 2)[0]] = true
+
+		info, err := dataFS.Lstat(filepath.Join(mountPath, name))
+		switch {
+		case os.IsNotExist(err) && pv.Annotations[annQuarantined] != "":
+			report.BrokenLinks = append(report.BrokenLinks, pv.Name)
+		case os.IsNotExist(err):
+			report.Missing = append(report.Missing, pv.Name)
+		case err == nil && info.Mode()&os.ModeSymlink != 0 && p.checkVolumeHealth(pv) != "":
+			report.BrokenLinks = append(report.BrokenLinks, pv.Name)
+		case err != nil || p.checkVolumeHealth(pv) != "":
+			report.Unreadable = append(report.Unreadable, pv.Name)
+		default:
+			report.Healthy++
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if known[name] || strings.HasPrefix(name, ".") || roots[name] || strings.HasPrefix(name, archivePrefix) || strings.HasPrefix(name, quarantinePrefix) || isKept(name) {
+			continue
+		}
+		if _, pending := pendingLinkTarget(name); pending {
+			continue
+		}
+		report.Orphans = append(report.Orphans, name)
+	}
+	return report, nil
+}
+
+// logConsistency logs the summary of report and its details at verbosity 2.
+func logConsistency(report *consistencyReport) {
+	glog.Infof("export consistency: %d healthy volumes, %d orphan directories, %d missing directories, %d broken links, %d unreadable directories",
+		report.Healthy, len(report.Orphans), len(report.Missing), len(report.BrokenLinks), len(report.Unreadable))
+	for _, name := range report.Orphans {
+		glog.V(2).Infof("orphan directory %s", name)
+	}
+	for _, name := range report.Missing {
+		glog.V(2).Infof("directory of volume %s is missing", name)
+	}
+	for _, name := range report.BrokenLinks {
+		glog.V(2).Infof("link of volume %s is broken", name)
+	}
+	for _, name := range report.Unreadable {
+		glog.V(2).Infof("directory of volume %s is unreadable", name)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/reference"
+)
+
+// maxRecentWarnings is the number of warnings the dashboard shows.
+const maxRecentWarnings = 50
+
+// recentWarning is a failure reported by warn, as shown on the dashboard.
+type recentWarning struct {
+	Time    time.Time
+	Reason  string
+	Object  string
+	Message string
+}
+
+// recentWarnings keeps the latest warnings, newest last. A nil recentWarnings keeps nothing.
+type recentWarnings struct {
+	mu       sync.Mutex
+	warnings []recentWarning
+}
+
+func (r *recentWarnings) add(reason, object, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warnings = append(r.warnings, recentWarning{Time: time.Now(), Reason: reason, Object: object, Message: message})
+	if n := len(r.warnings); n > maxRecentWarnings {
+		r.warnings = append([]recentWarning(nil), r.warnings[n-maxRecentWarnings:]...)
+	}
+}
+
+// objectName returns the "Kind/namespace/name" of obj, with the kind looked up in
+// the scheme since typed objects from informers have none set.
+func objectName(obj runtime.Object) string {
+	if obj == nil {
+		return ""
+	}
+	ref, err := reference.GetReference(scheme.Scheme, obj)
+	if err != nil {
+		return objectKey(obj)
+	}
+	if ref.Namespace == "" {
+		return ref.Kind + "/" + ref.Name
+	}
+	return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
+
+// list returns the kept warnings, newest first.
+func (r *recentWarnings) list() []recentWarning {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]recentWarning, len(r.warnings))
+	for i, w := range r.warnings {
+		list[len(list)-1-i] = w
+	}
+	return list
+}
+
+// dashboardExport is the capacity of an export, as shown on the dashboard.
+type dashboardExport struct {
+	Export string
+	Mount  string
+	Free   int64
+	Size   int64
+	Error  string
+}
+
+func (e dashboardExport) UsedPercent() float64 {
+	if e.Size == 0 {
+		return 0
+	}
+	return 100 * float64(e.Size-e.Free) / float64(e.Size)
+}
+
+// dashboardVolume is the usage of a volume, as shown on the dashboard.
+type dashboardVolume struct {
+	Volume       string
+	Claim        string
+	StorageClass string
+	Phase        v1.PersistentVolumePhase
+	Directory    string
+	Requested    string
+	Bytes        int64
+	Files        int64
+	Error        string
+}
+
+// dashboard serves a read-only web page with the exports, the usage of the
+// volumes, the operations in progress and the latest warnings. The usage of the
+// volumes is measured every interval in the background, not on every request.
+type dashboard struct {
+	p     *nfsProvisioner
+	token string
+
+	mu      sync.Mutex
+	volumes []dashboardVolume
+	scanned time.Time
+}
+
+func newDashboard(p *nfsProvisioner, token string) *dashboard {
+	return &dashboard{p: p, token: token}
+}
+
+func (d *dashboard) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.scan, interval)
+}
+
+func (d *dashboard) scan(ctx context.Context) {
+	pvs, err := d.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for dashboard fail: %s", err.Error())
+		return
+	}
+	var volumes []dashboardVolume
+	for _, pv := range pvs {
+		if !d.p.ownsVolume(pv) {
+			continue
+		}
+		v := dashboardVolume{
+			Volume:       pv.Name,
+			StorageClass: pv.Spec.StorageClassName,
+			Phase:        pv.Status.Phase,
+			Directory:    d.p.volumeDirectory(pv),
+		}
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			v.Claim = ref.Namespace + "/" + ref.Name
+		}
+		if q, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			v.Requested = q.String()
+		}
+		v.Bytes, v.Files, err = dirUsage(filepath.Join(mountPath, v.Directory))
+		if err != nil {
+			v.Error = err.Error()
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Bytes != volumes[j].Bytes {
+			return volumes[i].Bytes > volumes[j].Bytes
+		}
+		return volumes[i].Volume < volumes[j].Volume
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.volumes, d.scanned = volumes, time.Now()
+}
+
+// exports returns the capacity of the export, the source exports and the mirror export.
+func (d *dashboard) exports() []dashboardExport {
+	exports := []dashboardExport{{Export: d.p.server + ":" + d.p.path, Mount: mountPath}}
+	for _, e := range d.p.sourceExports {
+		exports = append(exports, dashboardExport{Export: e.server + ":" + e.path, Mount: e.mount})
+	}
+	if e := d.p.mirrorExport; e != nil {
+		exports = append(exports, dashboardExport{Export: e.server + ":" + e.path, Mount: e.mount})
+	}
+	for i := range exports {
+		free, size, err := exportCapacity(exports[i].Mount)
+		if err != nil {
+			exports[i].Error = err.Error()
+			continue
+		}
+		exports[i].Free, exports[i].Size = free, size
+	}
+	return exports
+}
+
+// authorized accepts the token as password of HTTP basic authentication, which
+// browsers prompt for, with any user name, or as bearer token.
+func (d *dashboard) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+// protect serves h only to requests authorized by the token of the dashboard.
+func (d *dashboard) protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nfs-client-provisioner"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	d.mu.Lock()
+	volumes, scanned := d.volumes, d.scanned
+	d.mu.Unlock()
+	data := map[string]interface{}{
+		"Provisioner": d.p.name,
+		"Now":         time.Now(),
+		"Exports":     d.exports(),
+		"Volumes":     volumes,
+		"Scanned":     scanned,
+		"Operations":  d.p.operations.list(),
+		"Warnings":    d.p.recent.list(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		glog.Warningf("render dashboard fail: %s", err.Error())
+	}
+}
+
+// serveDashboard serves d on port, next to the debug endpoints, which need its
+// token as well.
+func (p *nfsProvisioner) serveDashboard(port int, d *dashboard) {
+	mux := http.NewServeMux()
+	mux.Handle("/", d.protect(d))
+	mux.Handle("/debug/verbosity", d.protect(http.HandlerFunc(verbosityHandler)))
+	mux.Handle("/debug/operations", d.protect(p.operations))
+	// the admin gRPC service shares the port, over HTTP/2 without TLS
+	mux.HandleFunc("/nfsclient.admin.v1.Admin/", d.serveAdminRPC)
+	glog.Infof("serving dashboard on port %d", port)
+	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), h2c.NewHandler(mux, &http2.Server{})))
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"since": func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>{{.Provisioner}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+td.number { text-align: right; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Provisioner}}</h1>
+<p>{{time .Now}}, refreshed every 30 seconds</p>
+
+<h2>Exports</h2>
+<table>
+<tr><th>Export</th><th>Mount</th><th>Size</th><th>Free</th><th>Used</th></tr>
+{{range .Exports}}<tr><td>{{.Export}}</td><td>{{.Mount}}</td>
+{{if .Error}}<td colspan="3" class="error">{{.Error}}</td>{{else}}<td class="number">{{bytes .Size}}</td><td class="number">{{bytes .Free}}</td><td class="number">{{printf "%.1f" .UsedPercent}}%</td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Operations in progress</h2>
+{{if .Operations}}<table>
+<tr><th>Kind</th><th>Volume</th><th>Directory</th><th>Source or target</th><th>Running for</th><th>Files</th><th>Copied</th></tr>
+{{range .Operations}}<tr><td>{{.Kind}}</td><td>{{.Volume}}</td><td>{{.Directory}}</td><td>{{.Source}}{{.Target}}</td><td>{{since .Started}}</td>
+<td class="number">{{if .Files}}{{.Files}}{{end}}</td><td class="number">{{if .Bytes}}{{bytes .Bytes}}{{if .TotalBytes}} of {{bytes .TotalBytes}}{{end}}{{end}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<h2>Volumes</h2>
+{{if .Scanned.IsZero}}<p>Not measured yet, only the leader measures the volumes.</p>{{else}}<p>Measured {{time .Scanned}}.</p>
+<table>
+<tr><th>Volume</th><th>Claim</th><th>Storage class</th><th>Phase</th><th>Directory</th><th>Requested</th><th>Used</th><th>Files</th></tr>
+{{range .Volumes}}<tr><td>{{.Volume}}</td><td>{{.Claim}}</td><td>{{.StorageClass}}</td><td>{{.Phase}}</td><td>{{.Directory}}</td><td class="number">{{.Requested}}</td>
+{{if .Error}}<td colspan="2" class="error">{{.Error}}</td>{{else}}<td class="number">{{bytes .Bytes}}</td><td class="number">{{.Files}}</td>{{end}}</tr>
+{{end}}</table>{{end}}
+
+<h2>Recent warnings</h2>
+{{if .Warnings}}<table>
+<tr><th>Time</th><th>Reason</th><th>Object</th><th>Message</th></tr>
+{{range .Warnings}}<tr><td>{{time .Time}}</td><td>{{.Reason}}</td><td>{{.Object}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
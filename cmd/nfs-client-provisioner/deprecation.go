@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+// annBetaStorageClass is the claim annotation which predates spec.storageClassName.
+// The provision controller still honors it.
+const annBetaStorageClass = "volume.beta.kubernetes.io/storage-class"
+
+// deprecatedAnnotations are the claim annotations slated for removal, with what
+// to use instead.
+var deprecatedAnnotations = map[string]string{
+	annBetaStorageClass: "spec.storageClassName",
+}
+
+// deprecatedParameters are the StorageClass parameters slated for removal, with
+// what to use instead.
+var deprecatedParameters = map[string]string{
+	paramArchiveOnDelete: paramOnDelete,
+}
+
+// deprecatedKeys returns the keys of values which are in deprecated, sorted.
+func deprecatedKeys(values, deprecated map[string]string) []string {
+	var keys []string
+	for key := range values {
+		if _, ok := deprecated[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deprecationMessage describes the use of keys by obj, e.g. "claim ns/name uses
+// the deprecated annotation a, use b instead".
+func deprecationMessage(obj, kind string, keys []string, deprecated map[string]string) string {
+	uses := make([]string, len(keys))
+	for i, key := range keys {
+		uses[i] = fmt.Sprintf("%s, use %s instead", key, deprecated[key])
+	}
+	return fmt.Sprintf("%s uses the deprecated %s %s", obj, kind, strings.Join(uses, "; "))
+}
+
+// warnDeprecated counts the deprecated annotations of claim and parameters of
+// class used by a newly provisioned volume, by namespace so that the teams still
+// relying on them can be found, and posts a Warning event on the claim for its
+// annotations. Deprecated parameters are reported on the class by watchClasses.
+func (p *nfsProvisioner) warnDeprecated(claim *v1.PersistentVolumeClaim, class *storage.StorageClass) {
+	for _, key := range deprecatedKeys(class.Parameters, deprecatedParameters) {
+		deprecatedUsage.WithLabelValues("parameter", key, claim.Namespace).Inc()
+	}
+	keys := deprecatedKeys(claim.Annotations, deprecatedAnnotations)
+	if len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		deprecatedUsage.WithLabelValues("annotation", key, claim.Namespace).Inc()
+	}
+	p.warn(claim, reasonDeprecated, "%s", deprecationMessage("claim "+claim.Namespace+"/"+claim.Name, "annotation", keys, deprecatedAnnotations))
+}
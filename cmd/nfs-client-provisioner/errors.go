@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type errorClass string
+
+const (
+	// classTransient errors, like a stale NFS handle or an API server timeout, may go away on retry
+	classTransient errorClass = "Transient"
+	// classPermanent errors, like a full export, need an administrator
+	classPermanent errorClass = "Permanent"
+	// classMisconfiguration errors are caused by invalid annotations or parameters
+	classMisconfiguration errorClass = "Misconfiguration"
+)
+
+// classifiedError is an error with a known class.
+type classifiedError struct {
+	class errorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Categories of failures, what failed, for the nfs_client_failures_total metric.
+const (
+	categoryCopy     = "copy"
+	categoryLink     = "link"
+	categoryMkdir    = "mkdir"
+	categoryPopulate = "populate"
+	categoryQuota    = "quota"
+	categoryAPI      = "api"
+	categoryArchive  = "archive"
+	categoryBackup   = "backup"
+	categoryRemove   = "remove"
+	categoryOther    = "other"
+)
+
+// categorizedError is an error of a known category.
+type categorizedError struct {
+	category string
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+// inCategory returns err with category, nil if err is nil.
+func inCategory(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// categorize returns the category of err: the outermost one given by
+// inCategory, categoryAPI for errors of the API server, or categoryOther.
+func categorize(err error) string {
+	var ce *categorizedError
+	if errors.As(err, &ce) {
+		return ce.category
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return categoryAPI
+	}
+	return categoryOther
+}
+
+// misconfigured returns a classMisconfiguration error formatted like fmt.Errorf.
+func misconfigured(format string, args ...interface{}) error {
+	return &classifiedError{class: classMisconfiguration, err: fmt.Errorf(format, args...)}
+}
+
+// transient returns a classTransient error formatted like fmt.Errorf.
+func transient(format string, args ...interface{}) error {
+	return &classifiedError{class: classTransient, err: fmt.Errorf(format, args...)}
+}
+
+// classify returns the class of err, guessing it from well-known errors unless it
+// was classified explicitly.
+func classify(err error) errorClass {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return classTransient
+	}
+	if apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || apierrors.IsConflict(err) {
+		return classTransient
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ESTALE, syscall.EIO, syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY:
+			return classTransient
+		}
+	}
+	return classPermanent
+}
+
+// withClass prefixes the message of err with its class, for the events posted by the controller.
+func withClass(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", classify(err), err)
+}
+
+// transientBackoff is used to retry single file system operations on transient errors.
+var transientBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Steps:    3,
+}
+
+// retryTransient runs op until it succeeds, fails with a non-transient error or
+// transientBackoff is exhausted.
+func retryTransient(ctx context.Context, desc string, op func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, transientBackoff, func(ctx context.Context) (bool, error) {
+		lastErr = op()
+		if lastErr == nil {
+			return true, nil
+		}
+		if classify(lastErr) != classTransient {
+			return false, lastErr
+		}
+		glog.Warningf("%s fail, retrying: %s", desc, lastErr.Error())
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Reasons of the Warning events posted for failures which do not fail the
+// Provision or Delete call itself, or which happen in the background.
+const (
+	reasonChmodFailed        = "ChmodFailed"
+	reasonCloneSourceFailed  = "CloneSourceFailed"
+	reasonCopyFailed         = "CopyFailed"
+	reasonStorageClassFailed = "StorageClassLookupFailed"
+	reasonDeleteFailed       = "DeleteFailed"
+	reasonArchiveFailed      = "ArchiveFailed"
+	reasonSnapshotFailed     = "SnapshotFailed"
+	reasonSyncFailed         = "SyncFailed"
+	reasonBackupFailed       = "BackupFailed"
+	reasonBrokenLink         = "BrokenLink"
+	reasonHookFailed         = "HookFailed"
+	reasonVolumeUnhealthy    = "VolumeUnhealthy"
+	reasonMarkerMismatch     = "MarkerMismatch"
+	reasonSoftQuotaExceeded  = "SoftQuotaExceeded"
+	reasonHardQuotaExceeded  = "HardQuotaExceeded"
+	reasonResizeRejected     = "ResizeRejected"
+	// reasonInvalidStorageClass is posted on StorageClasses, not on claims
+	reasonInvalidStorageClass = "InvalidStorageClass"
+	reasonDeprecated          = "Deprecated"
+	reasonRebalanceCandidate  = "RebalanceCandidate"
+	reasonVolumeIdle          = "VolumeIdle"
+	reasonMirrorFailed        = "MirrorFailed"
+	reasonCanaryFailed        = "CanaryFailed"
+	reasonProbeFailed         = "ProbeFailed"
+	reasonDirectoryExists     = "DirectoryExists"
+	reasonDeletionScheduled   = "DeletionScheduled"
+	reasonOverRequest         = "OverRequest"
+	// reasonExportCapacity is suffixed with the capacity level, e.g. ExportCapacityWarning
+	reasonExportCapacity = "ExportCapacity"
+)
+
+// Actions of the events, what the provisioner was doing about the regarding
+// object when the event happened.
+const (
+	actionProvisioning = "Provisioning"
+	actionCloning      = "Cloning"
+	actionDeleting     = "Deleting"
+	actionArchiving    = "Archiving"
+	actionBackingUp    = "BackingUp"
+	actionSnapshotting = "Snapshotting"
+	actionSyncing      = "Syncing"
+	actionRunningHook  = "RunningHook"
+	actionResizing     = "Resizing"
+	actionValidating   = "Validating"
+	actionRebalancing  = "Rebalancing"
+	actionMirroring    = "Mirroring"
+	actionMonitoring   = "Monitoring"
+)
+
+// reasonActions maps the reasons to the action of their events. Reasons not
+// listed, like the ExportCapacity ones, are posted with actionMonitoring.
+var reasonActions = map[string]string{
+	reasonChmodFailed:         actionProvisioning,
+	reasonCloneSourceFailed:   actionCloning,
+	reasonCopyFailed:          actionCloning,
+	reasonStorageClassFailed:  actionDeleting,
+	reasonDeleteFailed:        actionDeleting,
+	reasonMarkerMismatch:      actionDeleting,
+	reasonArchiveFailed:       actionArchiving,
+	reasonBackupFailed:        actionBackingUp,
+	reasonSnapshotFailed:      actionSnapshotting,
+	reasonSyncFailed:          actionSyncing,
+	reasonHookFailed:          actionRunningHook,
+	reasonResizeRejected:      actionResizing,
+	reasonInvalidStorageClass: actionValidating,
+	reasonDeprecated:          actionValidating,
+	reasonRebalanceCandidate:  actionRebalancing,
+	reasonMirrorFailed:        actionMirroring,
+	reasonCanaryFailed:        actionProvisioning,
+	reasonProbeFailed:         actionProvisioning,
+	reasonDirectoryExists:     actionProvisioning,
+	reasonDeletionScheduled:   actionDeleting,
+}
+
+func eventAction(reason string) string {
+	if action, ok := reasonActions[reason]; ok {
+		return action
+	}
+	return actionMonitoring
+}
+
+// maxNoteLength is the longest note the events.k8s.io API accepts.
+const maxNoteLength = 1024
+
+// warn logs a failure and posts it as a Warning event on obj, if not nil.
+// Repeated failures are sampled, see eventSampler.
+func (p *nfsProvisioner) warn(obj runtime.Object, reason, format string, args ...interface{}) {
+	p.warnRelated(obj, relatedObject(obj), reason, format, args...)
+}
+
+// warnVolume posts a Warning event on the claim bound to pv, where users look for
+// events, with pv as the related object. Unbound volumes get the event themselves.
+func (p *nfsProvisioner) warnVolume(pv *v1.PersistentVolume, reason, format string, args ...interface{}) {
+	if pv.Spec.ClaimRef == nil {
+		p.warn(pv, reason, format, args...)
+		return
+	}
+	p.warnRelated(pv.Spec.ClaimRef, pv, reason, format, args...)
+}
+
+// warnRelated is warn with an explicit related object, which may be nil.
+func (p *nfsProvisioner) warnRelated(obj, related runtime.Object, reason, format string, args ...interface{}) {
+	warningsTotal.WithLabelValues(reason).Inc()
+	n, ok := p.sampler.sample(obj, reason)
+	if !ok {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	if n > 1 {
+		message = fmt.Sprintf("%s (%d occurrences)", message, n)
+	}
+	glog.Warningf("%s: %s", reason, message)
+	p.recent.add(reason, objectName(obj), message)
+	p.event(obj, related, v1.EventTypeWarning, reason, message)
+}
+
+// event posts an events.k8s.io Event about regarding, if not nil, with the
+// action of reason, unless the limiter suppresses it.
+func (p *nfsProvisioner) event(regarding, related runtime.Object, eventtype, reason, note string) {
+	if regarding == nil || p.recorder == nil {
+		return
+	}
+	if !p.limiter.allow(regarding, related, eventtype, reason, note) {
+		return
+	}
+	p.postEvent(regarding, related, eventtype, reason, note)
+}
+
+// postEvent posts an event, with the note truncated to what the API accepts.
+func (p *nfsProvisioner) postEvent(regarding, related runtime.Object, eventtype, reason, note string) {
+	p.recorder.Eventf(regarding, related, eventtype, reason, eventAction(reason), "%s", truncateNote(note, maxNoteLength))
+}
+
+func truncateNote(note string, n int) string {
+	if len(note) > n {
+		return note[:n-3] + "..."
+	}
+	return note
+}
+
+// relatedObject returns the object events about obj also concern: the
+// StorageClass of a claim, or the claim bound to a volume. Its result is an
+// untyped nil if there is none, the recorder only checks the interface.
+func relatedObject(obj runtime.Object) runtime.Object {
+	switch o := obj.(type) {
+	case *v1.PersistentVolumeClaim:
+		if class := o.Spec.StorageClassName; class != nil && *class != "" {
+			return &v1.ObjectReference{Kind: "StorageClass", APIVersion: "storage.k8s.io/v1", Name: *class}
+		}
+	case *v1.PersistentVolume:
+		if o.Spec.ClaimRef != nil {
+			return o.Spec.ClaimRef
+		}
+	}
+	return nil
+}
+
+// eventSampler thins out identical failures on high-churn clusters: of the
+// failures with the same reason on the same object, only the first and then
+// every Nth is logged and posted. The counts are forgotten every sampleWindow.
+// A nil sampler, or one with every <= 1, samples nothing.
+type eventSampler struct {
+	every int
+
+	mu      sync.Mutex
+	counts  map[string]int
+	resetAt time.Time
+}
+
+const sampleWindow = time.Hour
+
+func newEventSampler(every int) *eventSampler {
+	return &eventSampler{every: every, counts: map[string]int{}}
+}
+
+// sample counts a failure and returns its number of occurrences and whether it should be reported.
+func (s *eventSampler) sample(obj runtime.Object, reason string) (int, bool) {
+	if s == nil || s.every <= 1 {
+		return 1, true
+	}
+	key := objectKey(obj) + "/" + reason
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.After(s.resetAt) {
+		s.counts = map[string]int{}
+		s.resetAt = now.Add(sampleWindow)
+	}
+	s.counts[key]++
+	n := s.counts[key]
+	return n, n == 1 || n%s.every == 0
+}
+
+// objectKey returns the "kind/namespace/name" of obj, or "" for nil.
+func objectKey(obj runtime.Object) string {
+	if obj == nil {
+		return ""
+	}
+	if ref, ok := obj.(*v1.ObjectReference); ok {
+		return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+	}
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	if m, err := meta.Accessor(obj); err == nil {
+		return kind + "/" + m.GetNamespace() + "/" + m.GetName()
+	}
+	return kind
+}
+
+// eventLimiter protects the API server and etcd from floods of near-identical
+// events, e.g. for every volume during an outage of the NFS server. In every
+// window, only the first event of each reason, and at most burst events in all,
+// are posted about an object. The others are counted, and the last one of each
+// reason is posted when the window ends, with the number suppressed appended.
+// A nil limiter, or one with a window <= 0, posts every event.
+type eventLimiter struct {
+	window time.Duration
+	burst  int
+	post   func(regarding, related runtime.Object, eventtype, reason, note string)
+
+	mu      sync.Mutex
+	objects map[string]*eventWindow
+}
+
+// eventWindow is the current window of the events about an object.
+type eventWindow struct {
+	end    time.Time
+	posted int
+	// reasons are the reasons posted in the window
+	reasons    map[string]bool
+	suppressed map[string]*suppressedEvent
+}
+
+// suppressedEvent is the last suppressed event of a reason, and their number.
+type suppressedEvent struct {
+	regarding, related runtime.Object
+	eventtype, reason  string
+	note               string
+	count              int
+}
+
+func newEventLimiter(window time.Duration, burst int, post func(regarding, related runtime.Object, eventtype, reason, note string)) *eventLimiter {
+	return &eventLimiter{window: window, burst: burst, post: post, objects: map[string]*eventWindow{}}
+}
+
+// allow returns whether an event should be posted now, and counts it as
+// suppressed otherwise.
+func (l *eventLimiter) allow(regarding, related runtime.Object, eventtype, reason, note string) bool {
+	if l == nil || l.window <= 0 {
+		return true
+	}
+	key := objectKey(regarding)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.objects[key]
+	if w == nil || (now.After(w.end) && len(w.suppressed) == 0) {
+		w = &eventWindow{end: now.Add(l.window), reasons: map[string]bool{}, suppressed: map[string]*suppressedEvent{}}
+		l.objects[key] = w
+	}
+	if !w.reasons[reason] && (l.burst <= 0 || w.posted < l.burst) {
+		w.posted++
+		w.reasons[reason] = true
+		return true
+	}
+	eventsSuppressed.WithLabelValues(reason).Inc()
+	e := w.suppressed[reason]
+	if e == nil {
+		e = &suppressedEvent{reason: reason}
+		w.suppressed[reason] = e
+	}
+	e.regarding, e.related, e.eventtype, e.note = regarding, related, eventtype, note
+	e.count++
+	return false
+}
+
+// flush ends the windows which are over. The last suppressed event of every
+// reason is posted, and opens the next window of its object, so that an
+// object keeps failing results in one event per reason and window.
+func (l *eventLimiter) flush(now time.Time) {
+	var events []*suppressedEvent
+	l.mu.Lock()
+	for key, w := range l.objects {
+		if now.Before(w.end) {
+			continue
+		}
+		delete(l.objects, key)
+		if len(w.suppressed) == 0 {
+			continue
+		}
+		next := &eventWindow{end: now.Add(l.window), reasons: map[string]bool{}, suppressed: map[string]*suppressedEvent{}}
+		for reason, e := range w.suppressed {
+			next.posted++
+			next.reasons[reason] = true
+			events = append(events, e)
+		}
+		l.objects[key] = next
+	}
+	l.mu.Unlock()
+
+	for _, e := range events {
+		suffix := fmt.Sprintf(" (%d occurrences in the last %s, suppressed)", e.count, l.window)
+		l.post(e.regarding, e.related, e.eventtype, e.reason, truncateNote(e.note, maxNoteLength-len(suffix))+suffix)
+	}
+}
+
+// Run ends the windows of the limiter until ctx is done.
+func (l *eventLimiter) Run(ctx context.Context) {
+	if l == nil || l.window <= 0 {
+		return
+	}
+	interval := l.window / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	wait.UntilWithContext(ctx, func(ctx context.Context) { l.flush(time.Now()) }, interval)
+}
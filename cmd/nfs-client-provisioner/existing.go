@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// paramExistingDirectory is what happens when the directory of a new volume
+	// of the class already exists and is not empty, e.g. left behind by a crash
+	// or copied there by hand
+	paramExistingDirectory = "existingDirectory"
+
+	// existingDirectoryReuse provisions the volume with the data in the directory
+	existingDirectoryReuse = "reuse"
+	// existingDirectoryFail does not provision the volume until the directory is removed
+	existingDirectoryFail = "fail"
+	// existingDirectoryClean moves the directory aside as an archive and
+	// provisions the volume in a new, empty one
+	existingDirectoryClean = "clean"
+)
+
+// existingDirectoryPolicy returns what happens to the existing non-empty
+// directories of new volumes of class.
+func existingDirectoryPolicy(class *storage.StorageClass) (string, error) {
+	switch policy := class.Parameters[paramExistingDirectory]; policy {
+	case "":
+		return existingDirectoryReuse, nil
+	case existingDirectoryReuse, existingDirectoryFail, existingDirectoryClean:
+		return policy, nil
+	default:
+		return "", misconfigured("invalid %s %q, must be %q, %q or %q", paramExistingDirectory, policy, existingDirectoryReuse, existingDirectoryFail, existingDirectoryClean)
+	}
+}
+
+// checkExistingDirectory applies the existingDirectory policy of class to
+// the directory name below mountPath of the new volume pvName of pvc, if it
+// exists and is not empty. Directories left behind by an earlier attempt to
+// provision the same volume are always reused, directories of other existing
+// volumes never are.
+func (p *nfsProvisioner) checkExistingDirectory(ctx context.Context, class *storage.StorageClass, pvc *v1.PersistentVolumeClaim, pvName, name string) error {
+	policy, err := existingDirectoryPolicy(class)
+	if err != nil {
+		return err
+	}
+	full := filepath.Join(mountPath, name)
+	var entries []os.DirEntry
+	err = runFS(ctx, func() (err error) {
+		entries, err = dataFS.ReadDir(full)
+		return err
+	})
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read the existing directory %s: %w", full, err)
+	}
+
+	var m *volumeMarker
+	if err := runFS(ctx, func() (err error) {
+		m, err = readMarker(full)
+		return err
+	}); err == nil {
+		if m.Volume == pvName {
+			glog.Infof("reusing %s, left behind by an earlier attempt to provision %s", full, pvName)
+			return nil
+		}
+		if _, err := p.client.CoreV1().PersistentVolumes().Get(ctx, m.Volume, metav1.GetOptions{}); err == nil {
+			return misconfigured("the directory %s of the new volume holds volume %s", full, m.Volume)
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	switch policy {
+	case existingDirectoryFail:
+		return misconfigured("the directory %s of the new volume already exists and is not empty, remove it or set %s of storage class %s to %q or %q", full, paramExistingDirectory, class.Name, existingDirectoryReuse, existingDirectoryClean)
+	case existingDirectoryClean:
+		aside := filepath.Join(filepath.Dir(name), archivePrefix+filepath.Base(name)+"-"+time.Now().UTC().Format(archiveTimestamp))
+		if err := renameCtx(ctx, full, filepath.Join(mountPath, aside)); err != nil {
+			return fmt.Errorf("unable to move the existing directory %s aside: %w", full, err)
+		}
+		if err := recordArchiveClass(mountPath, aside, class.Name); err != nil {
+			glog.Warningf("record storage class of archive %s fail: %s", aside, err.Error())
+		}
+		p.warn(pvc, reasonDirectoryExists, "the directory %s of the new volume already existed with %d entries, moved to the archive %s", full, len(entries), aside)
+	default:
+		p.warn(pvc, reasonDirectoryExists, "the directory %s of the new volume already existed with %d entries, which the volume keeps", full, len(entries))
+	}
+	return nil
+}
+
+// ownDirectory reports whether full, the directory of the new volume pvName,
+// belongs to the attempt to provision it: it does not exist yet, or an earlier
+// attempt to provision the same volume left it behind. Failed attempts only
+// remove the directories they own.
+func ownDirectory(ctx context.Context, full, pvName string) (bool, error) {
+	if _, err := lstatCtx(ctx, full); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	var m *volumeMarker
+	if err := runFS(ctx, func() (err error) {
+		m, err = readMarker(full)
+		return err
+	}); err != nil {
+		return false, nil
+	}
+	return m.Volume == pvName, nil
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	otiai10 "github.com/otiai10/copy"
+	"sigs.k8s.io/yaml"
+)
+
+// faultyFS injects the failures of a flaky NFS server into the data path, for
+// -chaos and -fault-injection on staging clusters and for testing error
+// handling. Every operation but reads and writes is delayed by up to latency,
+// every operation fails with ESTALE with the probability estale, and the ones
+// writing with ENOSPC with the probability enospc. The rules of an operation
+// type replace these. With the same seed, the same sequence of operations gets
+// the same faults.
+type faultyFS struct {
+	fs      fileSystem
+	latency time.Duration
+	estale  float64
+	enospc  float64
+	rules   map[string]*faultRule
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// faultOperations are the operation types of faultyFS.
+var faultOperations = []string{"mkdir", "chmod", "chtimes", "lstat", "stat", "readdir", "rename", "remove", "removeall", "symlink", "readlink", "link", "open", "read", "write", "copy"}
+
+// faultErrors are the errors faultRules can inject.
+var faultErrors = map[string]syscall.Errno{
+	"ESTALE":    syscall.ESTALE,
+	"ENOSPC":    syscall.ENOSPC,
+	"EDQUOT":    syscall.EDQUOT,
+	"EIO":       syscall.EIO,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"EACCES":    syscall.EACCES,
+	"EPERM":     syscall.EPERM,
+	"EROFS":     syscall.EROFS,
+	"EBUSY":     syscall.EBUSY,
+	"ENOENT":    syscall.ENOENT,
+}
+
+// faultRule injects faults into one operation type.
+type faultRule struct {
+	// Probability is the chance of an operation failing, between 0 and 1
+	Probability float64 `json:"probability"`
+	// Error is the error it fails with, ESTALE by default
+	Error string `json:"error,omitempty"`
+	// Latency delays every operation by up to this duration, also reads and writes
+	Latency string `json:"latency,omitempty"`
+
+	errno   syscall.Errno
+	latency time.Duration
+}
+
+// faultConfig is the -fault-injection file.
+type faultConfig struct {
+	Seed *int64 `json:"seed,omitempty"`
+	// Latency delays the operations without a rule, but reads and writes
+	Latency    string                `json:"latency,omitempty"`
+	Operations map[string]*faultRule `json:"operations,omitempty"`
+}
+
+// loadFaultInjection adds the faults of the -fault-injection file at path to f.
+func (f *faultyFS) loadFaultInjection(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config faultConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return fmt.Errorf("invalid -fault-injection %s: %v", path, err)
+	}
+	if config.Seed != nil {
+		f.rand = rand.New(rand.NewSource(*config.Seed))
+	}
+	if config.Latency != "" {
+		if f.latency, err = time.ParseDuration(config.Latency); err != nil {
+			return fmt.Errorf("invalid -fault-injection %s: latency: %v", path, err)
+		}
+	}
+	for op, rule := range config.Operations {
+		if !contains(faultOperations, op) {
+			return fmt.Errorf("invalid -fault-injection %s: unknown operation %s, must be one of %s", path, op, strings.Join(faultOperations, ", "))
+		}
+		if rule == nil || rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("invalid -fault-injection %s: the probability of %s must be between 0 and 1", path, op)
+		}
+		if rule.Error == "" {
+			rule.Error = "ESTALE"
+		}
+		rule.Error = strings.ToUpper(rule.Error)
+		errno, ok := faultErrors[rule.Error]
+		if !ok {
+			return fmt.Errorf("invalid -fault-injection %s: unsupported error %s of %s", path, rule.Error, op)
+		}
+		rule.errno = errno
+		if rule.Latency != "" {
+			if rule.latency, err = time.ParseDuration(rule.Latency); err != nil {
+				return fmt.Errorf("invalid -fault-injection %s: latency of %s: %v", path, op, err)
+			}
+		}
+		if f.rules == nil {
+			f.rules = map[string]*faultRule{}
+		}
+		f.rules[op] = rule
+	}
+	return nil
+}
+
+// parseChaos parses the comma separated key=value faults of -chaos: latency
+// (a duration), estale and enospc (probabilities between 0 and 1) and seed.
+func parseChaos(spec string) (*faultyFS, error) {
+	f := &faultyFS{fs: osFS{}}
+	seed := time.Now().UnixNano()
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(entry, "=")
+		var err error
+		switch key {
+		case "latency":
+			f.latency, err = time.ParseDuration(value)
+		case "estale":
+			f.estale, err = parseProbability(value)
+		case "enospc":
+			f.enospc, err = parseProbability(value)
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown fault, must be latency, estale, enospc or seed")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid -chaos %q: %v", entry, err)
+		}
+	}
+	f.rand = rand.New(rand.NewSource(seed))
+	return f, nil
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be a probability between 0 and 1")
+	}
+	return p, nil
+}
+
+func (f *faultyFS) String() string {
+	s := fmt.Sprintf("latency up to %s, ESTALE with probability %g, ENOSPC with probability %g", f.latency, f.estale, f.enospc)
+	ops := make([]string, 0, len(f.rules))
+	for op := range f.rules {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		r := f.rules[op]
+		s += fmt.Sprintf(", %s: %s with probability %g, latency up to %s", op, r.Error, r.Probability, r.latency)
+	}
+	return s
+}
+
+// fault delays op on path, if delay is set or op has a latency of its own, and
+// returns the error injected into it, if any.
+func (f *faultyFS) fault(op, path string, delay, write bool) error {
+	rule := f.rules[op]
+	f.mu.Lock()
+	var latency time.Duration
+	if rule != nil && rule.latency > 0 {
+		latency = time.Duration(f.rand.Int63n(int64(rule.latency) + 1))
+	} else if rule == nil && delay && f.latency > 0 {
+		latency = time.Duration(f.rand.Int63n(int64(f.latency) + 1))
+	}
+	var errno syscall.Errno
+	if rule != nil {
+		if f.rand.Float64() < rule.Probability {
+			errno = rule.errno
+		}
+	} else if f.rand.Float64() < f.estale {
+		errno = syscall.ESTALE
+	} else if write && f.rand.Float64() < f.enospc {
+		errno = syscall.ENOSPC
+	}
+	f.mu.Unlock()
+
+	time.Sleep(latency)
+	if errno == 0 {
+		return nil
+	}
+	faultsInjected.WithLabelValues(op, strings.ToLower(faultErrorName(errno))).Inc()
+	glog.V(4).Infof("fault injection: %s %s fails with %s", op, path, errno.Error())
+	return &fs.PathError{Op: op, Path: path, Err: errno}
+}
+
+func faultErrorName(errno syscall.Errno) string {
+	for name, e := range faultErrors {
+		if e == errno {
+			return name
+		}
+	}
+	return errno.Error()
+}
+
+func (f *faultyFS) MkdirAll(path string, perm fs.FileMode) error {
+	if err := f.fault("mkdir", path, true, true); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *faultyFS) Chmod(path string, mode fs.FileMode) error {
+	if err := f.fault("chmod", path, true, true); err != nil {
+		return err
+	}
+	return f.fs.Chmod(path, mode)
+}
+
+func (f *faultyFS) Chtimes(path string, atime, mtime time.Time) error {
+	if err := f.fault("chtimes", path, true, true); err != nil {
+		return err
+	}
+	return f.fs.Chtimes(path, atime, mtime)
+}
+
+func (f *faultyFS) Lstat(path string) (fs.FileInfo, error) {
+	if err := f.fault("lstat", path, true, false); err != nil {
+		return nil, err
+	}
+	return f.fs.Lstat(path)
+}
+
+func (f *faultyFS) Stat(path string) (fs.FileInfo, error) {
+	if err := f.fault("stat", path, true, false); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(path)
+}
+
+func (f *faultyFS) ReadDir(path string) ([]fs.DirEntry, error) {
+	if err := f.fault("readdir", path, true, false); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(path)
+}
+
+func (f *faultyFS) Rename(oldpath, newpath string) error {
+	if err := f.fault("rename", oldpath, true, true); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *faultyFS) Remove(path string) error {
+	if err := f.fault("remove", path, true, false); err != nil {
+		return err
+	}
+	return f.fs.Remove(path)
+}
+
+func (f *faultyFS) RemoveAll(path string) error {
+	if err := f.fault("removeall", path, true, false); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(path)
+}
+
+func (f *faultyFS) Symlink(oldname, newname string) error {
+	if err := f.fault("symlink", newname, true, true); err != nil {
+		return err
+	}
+	return f.fs.Symlink(oldname, newname)
+}
+
+func (f *faultyFS) Readlink(path string) (string, error) {
+	if err := f.fault("readlink", path, true, false); err != nil {
+		return "", err
+	}
+	return f.fs.Readlink(path)
+}
+
+func (f *faultyFS) Link(oldname, newname string) error {
+	if err := f.fault("link", newname, true, true); err != nil {
+		return err
+	}
+	return f.fs.Link(oldname, newname)
+}
+
+func (f *faultyFS) Open(path string) (file, error) {
+	if err := f.fault("open", path, true, false); err != nil {
+		return nil, err
+	}
+	fl, err := f.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file: fl, fs: f, path: path}, nil
+}
+
+func (f *faultyFS) OpenFile(path string, flag int, perm fs.FileMode) (file, error) {
+	if err := f.fault("open", path, true, flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0); err != nil {
+		return nil, err
+	}
+	fl, err := f.fs.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file: fl, fs: f, path: path}, nil
+}
+
+func (f *faultyFS) ReadFile(path string) ([]byte, error) {
+	if err := f.fault("read", path, true, false); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadFile(path)
+}
+
+func (f *faultyFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	if err := f.fault("write", path, true, true); err != nil {
+		return err
+	}
+	return f.fs.WriteFile(path, data, perm)
+}
+
+// Copy injects faults into every entry copied, without latency, like into the
+// reads and writes of a file.
+func (f *faultyFS) Copy(src, dest string, opts otiai10.Options) error {
+	if err := f.fault("copy", src, true, true); err != nil {
+		return err
+	}
+	skip := opts.Skip
+	opts.Skip = func(s string) (bool, error) {
+		if err := f.fault("copy", s, false, true); err != nil {
+			return false, err
+		}
+		if skip == nil {
+			return false, nil
+		}
+		return skip(s)
+	}
+	return f.fs.Copy(src, dest, opts)
+}
+
+// faultyFile injects faults into the reads and writes of a file, without
+// latency, which would add up over the many calls of a copy.
+type faultyFile struct {
+	file
+	fs   *faultyFS
+	path string
+}
+
+func (f *faultyFile) Read(b []byte) (int, error) {
+	if err := f.fs.fault("read", f.path, false, false); err != nil {
+		return 0, err
+	}
+	return f.file.Read(b)
+}
+
+func (f *faultyFile) Write(b []byte) (int, error) {
+	if err := f.fs.fault("write", f.path, false, true); err != nil {
+		return 0, err
+	}
+	return f.file.Write(b)
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// annPopulateURL on a PVC extracts the tarball at a HTTP(S) URL into the new volume
+	annPopulateURL = "nchc.ai/populate-url"
+	// annPopulateSHA256 is the expected hex SHA-256 checksum of the tarball
+	annPopulateSHA256 = "nchc.ai/populate-sha256"
+	// annPopulateGit on a PVC clones a git repository into the new volume
+	annPopulateGit = "nchc.ai/populate-git"
+	// annPopulateGitRef is the branch or tag to clone, the default branch if not set
+	annPopulateGitRef = "nchc.ai/populate-git-ref"
+	// annPopulateGitCommit is the commit the cloned ref is expected to point to
+	annPopulateGitCommit = "nchc.ai/populate-git-commit"
+)
+
+// populateFromURL downloads the tarball at rawURL, verifies its checksum if
+// checksum is not empty and extracts it into dest, the name of a new volume
+// directory below mountPath. Gzip compressed tarballs are detected automatically.
+func populateFromURL(ctx context.Context, rawURL, checksum, dest string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return misconfigured("invalid %s %q, must be a http or https URL", annPopulateURL, rawURL)
+	}
+
+	// download next to the volume first, the checksum must match before anything is extracted.
+	// dest may be nested below a namespace root or an export route.
+	tmp, err := os.CreateTemp(filepath.Join(mountPath, filepath.Dir(dest)), ".download-"+filepath.Base(dest)+"-")
+	if err != nil {
+		return err
+	}
+	defer dataFS.Remove(tmp.Name())
+	defer tmp.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	glog.V(4).Infof("downloading %s to %s", rawURL, tmp.Name())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return transient("download %s fail: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return transient("download %s fail: %s", rawURL, resp.Status)
+		}
+		return fmt.Errorf("download %s fail: %s", rawURL, resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		return transient("download %s fail: %v", rawURL, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); checksum != "" && !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("checksum of %s is %s, expected %s", rawURL, sum, checksum)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return extractTar(tmp, filepath.Join(mountPath, dest))
+}
+
+// extractTar extracts the optionally gzip compressed tarball r below root.
+// Entries and symbolic links pointing outside of root are rejected. Entries are
+// never written through symbolic links, whether they come from the tarball or
+// were in root before, so links cannot be chained to escape root.
+func extractTar(r io.Reader, root string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if rel == "" {
+			// the root itself
+			continue
+		}
+		parent, err := securePath(root, filepath.Dir(rel), true)
+		if err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+		target := filepath.Join(parent, filepath.Base(rel))
+		mode := os.FileMode(header.Mode).Perm()
+		existing, err := dataFS.Lstat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// a directory entry may repeat an existing directory, anything else replaces what is there
+		if err == nil && !(header.Typeflag == tar.TypeDir && existing.IsDir()) {
+			if existing.IsDir() {
+				return fmt.Errorf("%s: cannot replace directory", header.Name)
+			}
+			if err := dataFS.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := dataFS.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+			if err := dataFS.Chmod(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := dataFS.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			resolved := filepath.Join(filepath.Dir(rel), header.Linkname)
+			if filepath.IsAbs(header.Linkname) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+				return fmt.Errorf("symbolic link %s points outside of the volume", header.Name)
+			}
+			// the links the target passes through must not lead out of root either,
+			// so it is resolved as written, filepath.Join would drop the ".." of "link/.."
+			if _, err := resolveBelow(root, filepath.Dir(rel)+string(filepath.Separator)+header.Linkname); err != nil {
+				return fmt.Errorf("symbolic link %s: %w", header.Name, err)
+			}
+			if err := dataFS.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// image layers use hard links, their target is an earlier regular file
+			srcRel := strings.TrimPrefix(filepath.Clean("/"+header.Linkname), "/")
+			srcParent, err := securePath(root, filepath.Dir(srcRel), false)
+			if err != nil {
+				return fmt.Errorf("hard link %s: %w", header.Name, err)
+			}
+			source := filepath.Join(srcParent, filepath.Base(srcRel))
+			if info, err := dataFS.Lstat(source); err != nil {
+				return fmt.Errorf("hard link %s: %w", header.Name, err)
+			} else if !info.Mode().IsRegular() {
+				return fmt.Errorf("hard link %s must point to a regular file", header.Name)
+			}
+			if err := dataFS.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			glog.Warningf("skipping %s of unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// securePath returns root joined with the relative directory rel, checking
+// every component without following symbolic links: components which are
+// symbolic links or no directories are rejected, missing ones are created if
+// create is set and rejected otherwise.
+func securePath(root, rel string, create bool) (string, error) {
+	dir := root
+	if rel == "." {
+		return dir, nil
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "" || name == "." || name == ".." {
+			return "", fmt.Errorf("invalid path %q", rel)
+		}
+		dir = filepath.Join(dir, name)
+		info, err := dataFS.Lstat(dir)
+		switch {
+		case os.IsNotExist(err) && create:
+			// the parents were checked, this creates dir only
+			if err := dataFS.MkdirAll(dir, 0777); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case info.Mode()&os.ModeSymlink != 0:
+			return "", fmt.Errorf("%s is a symbolic link", strings.TrimPrefix(dir, root+string(filepath.Separator)))
+		case !info.IsDir():
+			return "", fmt.Errorf("%s is not a directory", strings.TrimPrefix(dir, root+string(filepath.Separator)))
+		}
+	}
+	return dir, nil
+}
+
+// maxLinkDepth limits the symbolic links resolveBelow follows, like ELOOP.
+const maxLinkDepth = 40
+
+// resolveBelow resolves the relative path rel below root like the kernel
+// would, following the symbolic links which already exist, and returns the
+// resolved relative path. Paths leading outside of root are errors.
+func resolveBelow(root, rel string) (string, error) {
+	var resolved []string
+	pending := strings.Split(rel, string(filepath.Separator))
+	for links := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("%s leads outside of the volume", rel)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		path := filepath.Join(append([]string{root}, append(resolved, name)...)...)
+		info, err := dataFS.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// missing components cannot be followed, yet
+			resolved = append(resolved, name)
+			continue
+		}
+		if links++; links > maxLinkDepth {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", rel)
+		}
+		link, err := dataFS.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			return "", fmt.Errorf("%s passes the absolute symbolic link %s", rel, filepath.Join(resolved...))
+		}
+		pending = append(strings.Split(link, string(filepath.Separator)), pending...)
+	}
+	return filepath.Join(resolved...), nil
+}
+
+// populateFromGit clones the ref of the git repository at repoURL into dest, the
+// name of a new empty volume directory below mountPath, and verifies that it
+// points to commit if commit is not empty.
+func populateFromGit(ctx context.Context, repoURL, ref, commit, dest string) error {
+	if repoURL == "" || strings.HasPrefix(repoURL, "-") {
+		return misconfigured("invalid %s %q", annPopulateGit, repoURL)
+	}
+	if strings.HasPrefix(ref, "-") {
+		return misconfigured("invalid %s %q", annPopulateGitRef, ref)
+	}
+
+	dir := filepath.Join(mountPath, dest)
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", repoURL, dir)
+	glog.V(4).Infof("cloning %s %s to %s", repoURL, ref, dir)
+	if out, err := git(ctx, args...); err != nil {
+		return fmt.Errorf("git clone %s fail: %v: %s", repoURL, err, out)
+	}
+
+	if commit == "" {
+		return nil
+	}
+	head, err := git(ctx, "-C", dir, "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("git rev-parse fail: %v: %s", err, head)
+	}
+	if !strings.EqualFold(head, commit) {
+		return fmt.Errorf("%s of %s is commit %s, expected %s", ref, repoURL, head, commit)
+	}
+	return nil
+}
+
+// git runs git non-interactively and returns its trimmed combined output.
+func git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// only network transports, file:// would expose the other volumes on the export
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https:git")
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	link     string
+	body     string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+		// want are the regular files expected below root, by their content
+		want map[string]string
+	}{
+		{
+			name: "plain",
+			entries: []tarEntry{
+				{name: "dir/", typeflag: tar.TypeDir},
+				{name: "dir/file", typeflag: tar.TypeReg, body: "data"},
+				{name: "link", typeflag: tar.TypeSymlink, link: "dir/file"},
+				{name: "hard", typeflag: tar.TypeLink, link: "dir/file"},
+				{name: "usr/lib64", typeflag: tar.TypeSymlink, link: "../dir"},
+			},
+			want: map[string]string{"dir/file": "data", "hard": "data"},
+		},
+		{
+			name: "dot dot in name",
+			entries: []tarEntry{
+				{name: "../escaped.txt", typeflag: tar.TypeReg, body: "x"},
+			},
+			// names are cleaned to below root
+			want: map[string]string{"escaped.txt": "x"},
+		},
+		{
+			name: "absolute symlink",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, link: "/etc"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlink out of root",
+			entries: []tarEntry{
+				{name: "up", typeflag: tar.TypeSymlink, link: ".."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file below symlink",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, link: "."},
+				{name: "d/escaped.txt", typeflag: tar.TypeReg, body: "x"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "chained symlinks",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, link: "."},
+				{name: "d/e", typeflag: tar.TypeSymlink, link: ".."},
+				{name: "e/escaped.txt", typeflag: tar.TypeReg, body: "x"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlink through symlink",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, link: "."},
+				{name: "e", typeflag: tar.TypeSymlink, link: "d/.."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file replacing symlink",
+			entries: []tarEntry{
+				{name: "f", typeflag: tar.TypeSymlink, link: "g"},
+				{name: "f", typeflag: tar.TypeReg, body: "x"},
+			},
+			want: map[string]string{"f": "x"},
+		},
+		{
+			name: "hard link out of root",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeLink, link: "../outside.txt"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hard link through symlink",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, link: "."},
+				{name: "stolen", typeflag: tar.TypeLink, link: "d/../outside.txt"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hard link to symlink",
+			entries: []tarEntry{
+				{name: "up", typeflag: tar.TypeSymlink, link: "dir"},
+				{name: "hard", typeflag: tar.TypeLink, link: "up"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			root := filepath.Join(base, "root")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(base, "outside.txt"), []byte("secret"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := extractTar(makeTar(t, tt.entries), root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractTar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			entries, err := os.ReadDir(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() != "root" && e.Name() != "outside.txt" {
+					t.Errorf("%s was written outside of the root", e.Name())
+				}
+			}
+			if data, _ := os.ReadFile(filepath.Join(base, "outside.txt")); string(data) != "secret" {
+				t.Errorf("outside.txt was changed to %q", data)
+			}
+			for name, body := range tt.want {
+				data, err := os.ReadFile(filepath.Join(root, name))
+				if err != nil || string(data) != body {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	otiai10 "github.com/otiai10/copy"
+)
+
+// fileSystem is what the data path does on the NFS mount when it provisions,
+// clones, populates, syncs, seals, archives and deletes volumes, so that its
+// failures can be injected, see faultyFS.
+type fileSystem interface {
+	MkdirAll(path string, perm fs.FileMode) error
+	Chmod(path string, mode fs.FileMode) error
+	Chtimes(path string, atime, mtime time.Time) error
+	Lstat(path string) (fs.FileInfo, error)
+	Stat(path string) (fs.FileInfo, error)
+	ReadDir(path string) ([]fs.DirEntry, error)
+	Rename(oldpath, newpath string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Symlink(oldname, newname string) error
+	Readlink(path string) (string, error)
+	Link(oldname, newname string) error
+	Open(path string) (file, error)
+	OpenFile(path string, flag int, perm fs.FileMode) (file, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+	// Copy copies the directory tree src to dest, like otiai10.Copy
+	Copy(src, dest string, opts otiai10.Options) error
+}
+
+// file is the part of *os.File the data path uses.
+type file interface {
+	io.ReadWriteCloser
+	Sync() error
+	Readdirnames(n int) ([]string, error)
+}
+
+// dataFS is the file system of the data path, osFS unless -chaos injects faults.
+var dataFS fileSystem = osFS{}
+
+// osFS is the file system of the operating system.
+type osFS struct{}
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error      { return os.MkdirAll(path, perm) }
+func (osFS) Chmod(path string, mode fs.FileMode) error         { return os.Chmod(path, mode) }
+func (osFS) Chtimes(path string, atime, mtime time.Time) error { return os.Chtimes(path, atime, mtime) }
+func (osFS) Lstat(path string) (fs.FileInfo, error)            { return os.Lstat(path) }
+func (osFS) Stat(path string) (fs.FileInfo, error)             { return os.Stat(path) }
+func (osFS) ReadDir(path string) ([]fs.DirEntry, error)        { return os.ReadDir(path) }
+func (osFS) Rename(oldpath, newpath string) error              { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(path string) error                          { return os.Remove(path) }
+func (osFS) RemoveAll(path string) error                       { return os.RemoveAll(path) }
+func (osFS) Symlink(oldname, newname string) error             { return os.Symlink(oldname, newname) }
+func (osFS) Readlink(path string) (string, error)              { return os.Readlink(path) }
+func (osFS) Link(oldname, newname string) error                { return os.Link(oldname, newname) }
+func (osFS) ReadFile(path string) ([]byte, error)              { return os.ReadFile(path) }
+
+func (osFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+
+func (osFS) Copy(src, dest string, opts otiai10.Options) error {
+	return otiai10.Copy(src, dest, opts)
+}
+
+func (osFS) Open(path string) (file, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(path string, flag int, perm fs.FileMode) (file, error) {
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fsTimeout limits every call made through runFS, 0 for no limit besides the context.
+var fsTimeout time.Duration
+
+// runFS runs op, a blocking call on the NFS mount, in its own goroutine and
+// returns as soon as ctx is done or fsTimeout expires. A call stuck on a dead
+// mount cannot be interrupted: it keeps running in the background, but no longer
+// blocks the caller, so controller workers and shutdown can go on.
+func runFS(ctx context.Context, op func() error) error {
+	if fsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fsTimeout)
+		defer cancel()
+	}
+	return runCtx(ctx, op)
+}
+
+// runCtx is runFS without fsTimeout, for long running operations like copies.
+func runCtx(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func mkdirAllCtx(ctx context.Context, path string, perm os.FileMode) error {
+	return runFS(ctx, func() error { return dataFS.MkdirAll(path, perm) })
+}
+
+func chmodCtx(ctx context.Context, path string, mode os.FileMode) error {
+	return runFS(ctx, func() error { return dataFS.Chmod(path, mode) })
+}
+
+func renameCtx(ctx context.Context, oldpath, newpath string) error {
+	return runFS(ctx, func() error { return dataFS.Rename(oldpath, newpath) })
+}
+
+func removeAllCtx(ctx context.Context, path string) error {
+	return runFS(ctx, func() error { return removeAll(path) })
+}
+
+func lstatCtx(ctx context.Context, path string) (os.FileInfo, error) {
+	// the result is passed through a channel, op may finish after runFS returned
+	infos := make(chan os.FileInfo, 1)
+	err := runFS(ctx, func() error {
+		info, err := dataFS.Lstat(path)
+		infos <- info
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-infos, nil
+}
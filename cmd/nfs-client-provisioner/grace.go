@@ -0,0 +1,161 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	controller "sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+const (
+	// paramDeletionGracePeriod is how long the directories of deleted volumes of
+	// the class are kept before they are removed or archived, e.g. 24h or 2d,
+	// overriding -deletion-grace-period
+	paramDeletionGracePeriod = "deletionGracePeriod"
+	// annDeleteAfter on a released PV is when its directory is removed or
+	// archived, set when its deletion is first requested
+	annDeleteAfter = "nchc.ai/delete-after"
+)
+
+// deletionGracePeriod returns how long deleted volumes of class are kept.
+func (p *nfsProvisioner) deletionGracePeriod(class *storage.StorageClass) (time.Duration, error) {
+	v, ok := class.Parameters[paramDeletionGracePeriod]
+	if !ok {
+		return p.gracePeriod, nil
+	}
+	d, err := parseAge(v)
+	if err != nil || d < 0 {
+		return 0, misconfigured("invalid %s %q, must be a duration like 24h or 2d", paramDeletionGracePeriod, v)
+	}
+	return d, nil
+}
+
+// deferDeletion keeps volume for the deletion grace period of its class. The
+// first call records when the grace period ends in annDeleteAfter, which
+// survives restarts of the provisioner, and every call until then returns an
+// IgnoredError: the provision controller then neither reports a failure nor
+// retries, it calls Delete again when it resyncs the volume.
+func (p *nfsProvisioner) deferDeletion(ctx context.Context, volume *v1.PersistentVolume) error {
+	if after, ok := volume.Annotations[annDeleteAfter]; ok {
+		t, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return misconfigured("invalid %s %q of volume %s", annDeleteAfter, after, volume.Name)
+		}
+		if time.Now().Before(t) {
+			return &controller.IgnoredError{Reason: fmt.Sprintf("volume %s is kept until %s", volume.Name, after)}
+		}
+		return nil
+	}
+
+	class, err := p.getClassForVolume(ctx, volume)
+	if err != nil {
+		return err
+	}
+	grace, err := p.deletionGracePeriod(class)
+	if err != nil || grace == 0 {
+		return err
+	}
+	after := time.Now().Add(grace).UTC().Format(time.RFC3339)
+	pv := volume.DeepCopy()
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[annDeleteAfter] = after
+	if _, err := p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return transient("schedule deletion of volume %s: %v", volume.Name, err)
+	}
+	glog.Infof("volume %s is deleted after %s", volume.Name, after)
+	p.event(volume, nil, v1.EventTypeNormal, reasonDeletionScheduled, fmt.Sprintf("the directory of the volume is kept until %s, restore it with: nfs-client-provisioner undelete -pv %s", after, volume.Name))
+	return &controller.IgnoredError{Reason: fmt.Sprintf("volume %s is kept until %s", volume.Name, after)}
+}
+
+// runUndelete lists the volumes waiting for their deletion grace period to
+// end, or makes one available to a new claim of the namespace and name of its
+// former claim.
+func runUndelete(args []string) error {
+	fs := flag.NewFlagSet("undelete", flag.ContinueOnError)
+	pvName := fs.String("pv", "", "volume to restore, all volumes waiting to be deleted are listed if empty")
+	root := fs.String("root", mountPath, "directory the export is mounted at")
+	trash := fs.Bool("trash", false, "list the volumes in the trash instead")
+	restore := fs.String("restore", "", "volume in the trash to restore and recreate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *restore != "" {
+		return restoreTrashCommand(*root, *restore)
+	}
+	if *trash {
+		return listTrashCommand(*root)
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if *pvName == "" {
+		list, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PV\tPVC\tSTORAGECLASS\tDELETE AFTER")
+		for _, pv := range list.Items {
+			after, ok := pv.Annotations[annDeleteAfter]
+			if !ok || pv.Status.Phase != v1.VolumeReleased {
+				continue
+			}
+			claim := "-"
+			if ref := pv.Spec.ClaimRef; ref != nil {
+				claim = ref.Namespace + "/" + ref.Name
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pv.Name, claim, pv.Spec.StorageClassName, after)
+		}
+		return w.Flush()
+	}
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(ctx, *pvName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := pv.Annotations[annDeleteAfter]; !ok || pv.Status.Phase != v1.VolumeReleased {
+		return fmt.Errorf("volume %s is not waiting to be deleted", pv.Name)
+	}
+	if pv.Spec.ClaimRef == nil {
+		return fmt.Errorf("volume %s has no former claim", pv.Name)
+	}
+	// binding to the claim of the same namespace and name, whatever its UID,
+	// makes the volume available to it again
+	delete(pv.Annotations, annDeleteAfter)
+	pv.Spec.ClaimRef.UID = ""
+	pv.Spec.ClaimRef.ResourceVersion = ""
+	if _, err := client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	fmt.Printf("volume %s is available again, create the pvc %s/%s to bind it\n", pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	return nil
+}
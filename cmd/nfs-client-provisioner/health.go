@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// healthMonitor periodically verifies the directories of all volumes, so that
+// data lost on the export is noticed before users hit I/O errors.
+type healthMonitor struct {
+	p *nfsProvisioner
+	// unhealthy maps the volumes found unhealthy by the last check to the problem,
+	// an event is only posted when a volume becomes unhealthy
+	unhealthy map[string]string
+}
+
+func newHealthMonitor(p *nfsProvisioner) *healthMonitor {
+	return &healthMonitor{p: p, unhealthy: map[string]string{}}
+}
+
+func (m *healthMonitor) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, m.check, interval)
+}
+
+func (m *healthMonitor) check(ctx context.Context) {
+	pvs, err := m.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for health check fail: %s", err.Error())
+		return
+	}
+
+	volumeHealthy.Reset()
+	unhealthy := map[string]string{}
+	for _, pv := range pvs {
+		if !m.p.ownsVolume(pv) {
+			continue
+		}
+		var namespace, claim string
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			namespace, claim = ref.Namespace, ref.Name
+		}
+		gauge := volumeHealthy.WithLabelValues(pv.Name, namespace, claim, pv.Spec.StorageClassName)
+
+		problem := m.p.checkVolumeHealth(pv)
+		if problem == "" {
+			gauge.Set(1)
+			if previous, ok := m.unhealthy[pv.Name]; ok {
+				glog.Infof("volume %s is healthy again after: %s", pv.Name, previous)
+			}
+			continue
+		}
+		gauge.Set(0)
+		unhealthy[pv.Name] = problem
+		if _, ok := m.unhealthy[pv.Name]; !ok {
+			m.p.warnVolume(pv, reasonVolumeUnhealthy, "volume %s is unhealthy: %s", pv.Name, problem)
+		}
+	}
+	m.unhealthy = unhealthy
+}
+
+// checkVolumeHealth returns what is wrong with the directory of pv, if anything.
+func (p *nfsProvisioner) checkVolumeHealth(pv *v1.PersistentVolume) string {
+	name := p.volumeDirectory(pv)
+	dir := filepath.Join(mountPath, name)
+	info, err := dataFS.Lstat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("directory %s is missing", dir)
+	} else if err != nil {
+		return err.Error()
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := p.resolveDirectory(name)
+		if err != nil {
+			return fmt.Sprintf("link %s does not resolve: %s", dir, err.Error())
+		}
+		dir = filepath.Join(mountPath, target)
+	}
+
+	f, err := dataFS.Open(dir)
+	if err != nil {
+		return fmt.Sprintf("directory %s is not readable: %s", dir, err.Error())
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Sprintf("directory %s is not readable: %s", dir, err.Error())
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	hookPostProvision = "post-provision"
+	hookPreDelete     = "pre-delete"
+)
+
+// hookEvent describes the volume a hook is called for.
+type hookEvent struct {
+	Event          string `json:"event"`
+	Volume         string `json:"volume"`
+	StorageClass   string `json:"storageClass"`
+	ClaimNamespace string `json:"claimNamespace,omitempty"`
+	ClaimName      string `json:"claimName,omitempty"`
+	Server         string `json:"server"`
+	Path           string `json:"path"`
+	// Directory is where the provisioner mounts the volume
+	Directory string `json:"directory"`
+	// InodeLimit is the nchc.ai/inode-limit of the volume, 0 if it has none,
+	// e.g. for a post-provision hook setting a project quota on the NFS server
+	InodeLimit int64 `json:"inodeLimit,omitempty"`
+}
+
+// volumeHook is called during the lifecycle of volumes, so that backup tools can
+// register new volumes, or quiesce and snapshot volumes before they are deleted.
+type volumeHook interface {
+	// PostProvision is called after a volume was created. Errors are reported
+	// as events, the volume is provisioned anyway.
+	PostProvision(ctx context.Context, event *hookEvent) error
+	// PreDelete is called before the directory of a volume is removed or
+	// archived. Errors stop the deletion, which is retried later.
+	PreDelete(ctx context.Context, event *hookEvent) error
+}
+
+func (p *nfsProvisioner) newHookEvent(event string, pv *v1.PersistentVolume) *hookEvent {
+	e := &hookEvent{
+		Event:        event,
+		Volume:       pv.Name,
+		StorageClass: pv.Spec.StorageClassName,
+		Server:       pv.Spec.NFS.Server,
+		Path:         pv.Spec.NFS.Path,
+		Directory:    filepath.Join(mountPath, p.volumeDirectory(pv)),
+		InodeLimit:   volumeInodeLimit(pv),
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		e.ClaimNamespace, e.ClaimName = ref.Namespace, ref.Name
+	}
+	return e
+}
+
+// runHooks calls every hook for e and returns the first error.
+func (p *nfsProvisioner) runHooks(ctx context.Context, e *hookEvent) error {
+	for _, hook := range p.hooks {
+		var err error
+		if e.Event == hookPostProvision {
+			err = hook.PostProvision(ctx, e)
+		} else {
+			err = hook.PreDelete(ctx, e)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook fail: %w", e.Event, err)
+		}
+	}
+	return nil
+}
+
+// execHook runs a command with the event as JSON on stdin and as HOOK_* environment variables.
+type execHook struct {
+	command string
+	timeout time.Duration
+}
+
+func (h *execHook) PostProvision(ctx context.Context, event *hookEvent) error {
+	return h.run(ctx, event)
+}
+
+func (h *execHook) PreDelete(ctx context.Context, event *hookEvent) error {
+	return h.run(ctx, event)
+}
+
+func (h *execHook) run(ctx context.Context, event *hookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command, event.Event)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"HOOK_EVENT="+event.Event,
+		"HOOK_VOLUME="+event.Volume,
+		"HOOK_STORAGE_CLASS="+event.StorageClass,
+		"HOOK_CLAIM_NAMESPACE="+event.ClaimNamespace,
+		"HOOK_CLAIM_NAME="+event.ClaimName,
+		"HOOK_DIRECTORY="+event.Directory,
+		"HOOK_INODE_LIMIT="+strconv.FormatInt(event.InodeLimit, 10),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", h.command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// webhookHook POSTs the event as JSON to a URL, which must answer with a 2xx status.
+type webhookHook struct {
+	url    string
+	client *http.Client
+}
+
+func (h *webhookHook) PostProvision(ctx context.Context, event *hookEvent) error {
+	return h.post(ctx, event)
+}
+
+func (h *webhookHook) PreDelete(ctx context.Context, event *hookEvent) error {
+	return h.post(ctx, event)
+}
+
+func (h *webhookHook) post(ctx context.Context, event *hookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return transient("%s: %v", h.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", h.url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// idleReportKey is the key of the idle volume report in its ConfigMap
+const idleReportKey = "idle-volumes.json"
+
+// idleVolume is a volume nobody used for longer than the idle threshold.
+type idleVolume struct {
+	PV           string    `json:"pv"`
+	Namespace    string    `json:"namespace,omitempty"`
+	PVC          string    `json:"pvc,omitempty"`
+	StorageClass string    `json:"storageClass"`
+	Phase        string    `json:"phase"`
+	Directory    string    `json:"directory"`
+	Bytes        int64     `json:"bytes"`
+	LastUsed     time.Time `json:"lastUsed"`
+	IdleDays     int       `json:"idleDays"`
+	Suggestion   string    `json:"suggestion"`
+}
+
+// lastUsed returns when pv was last used as recorded by the access scan, the
+// later of its last modification and access, if it was scanned.
+func lastUsed(pv *v1.PersistentVolume) (time.Time, bool) {
+	var last time.Time
+	for _, ann := range []string{annLastModified, annLastAccessed} {
+		if t, err := time.Parse(time.RFC3339, pv.Annotations[ann]); err == nil && t.After(last) {
+			last = t
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// reclaimSuggestion returns what to do about the idle volume pv.
+func reclaimSuggestion(pv *v1.PersistentVolume) string {
+	switch pv.Status.Phase {
+	case v1.VolumeReleased, v1.VolumeFailed:
+		return fmt.Sprintf("its claim is gone, delete it: kubectl delete pv %s", pv.Name)
+	case v1.VolumeAvailable:
+		return fmt.Sprintf("it was never claimed, delete it: kubectl delete pv %s", pv.Name)
+	}
+	ref := pv.Spec.ClaimRef
+	return fmt.Sprintf("ask the owners of namespace %s whether it is still needed, then: kubectl -n %s delete pvc %s", ref.Namespace, ref.Namespace, ref.Name)
+}
+
+// findIdleVolumes returns the volumes of pvs last used more than idleAfter
+// before now, the largest first. times returns when a volume was last used,
+// directory its directory and measure the size of that directory.
+func findIdleVolumes(pvs []*v1.PersistentVolume, now time.Time, idleAfter time.Duration,
+	times func(*v1.PersistentVolume) (time.Time, bool), directory func(*v1.PersistentVolume) string, measure func(string) int64) []idleVolume {
+	idle := []idleVolume{}
+	for _, pv := range pvs {
+		// linked volumes share the data of their source
+		if pv.Annotations[annCloneMode] == cloneModeLink {
+			continue
+		}
+		last, ok := times(pv)
+		if !ok || now.Sub(last) < idleAfter {
+			continue
+		}
+		v := idleVolume{
+			PV:           pv.Name,
+			StorageClass: pv.Spec.StorageClassName,
+			Phase:        string(pv.Status.Phase),
+			Directory:    directory(pv),
+			LastUsed:     last,
+			IdleDays:     int(now.Sub(last) / (24 * time.Hour)),
+			Suggestion:   reclaimSuggestion(pv),
+		}
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			v.Namespace, v.PVC = ref.Namespace, ref.Name
+		}
+		v.Bytes = measure(v.Directory)
+		idle = append(idle, v)
+	}
+	sort.SliceStable(idle, func(i, j int) bool { return idle[i].Bytes > idle[j].Bytes })
+	return idle
+}
+
+// idleReporter periodically publishes the volumes idle for longer than
+// idleAfter to a ConfigMap, and posts a Warning event on the claims of volumes
+// when they become idle. It relies on the times recorded by the access scan.
+type idleReporter struct {
+	p         *nfsProvisioner
+	idleAfter time.Duration
+	namespace string
+	configMap string
+	// idle are the volumes found idle by the last run, an event is only posted
+	// when a volume becomes idle
+	idle map[string]bool
+}
+
+func newIdleReporter(p *nfsProvisioner, idleAfter time.Duration, namespace, configMap string) *idleReporter {
+	return &idleReporter{p: p, idleAfter: idleAfter, namespace: namespace, configMap: configMap, idle: map[string]bool{}}
+}
+
+func (r *idleReporter) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, r.report, interval)
+}
+
+func (r *idleReporter) report(ctx context.Context) {
+	all, err := r.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for idle report fail: %s", err.Error())
+		return
+	}
+	var pvs []*v1.PersistentVolume
+	for _, pv := range all {
+		if r.p.ownsVolume(pv) {
+			pvs = append(pvs, pv)
+		}
+	}
+	idle := findIdleVolumes(pvs, time.Now(), r.idleAfter, lastUsed, r.p.volumeDirectory, func(dir string) int64 {
+		size, _, err := dirUsage(filepath.Join(mountPath, dir))
+		if err != nil {
+			glog.Warningf("usage of %s for idle report fail: %s", dir, err.Error())
+		}
+		return size
+	})
+
+	found := map[string]bool{}
+	var total int64
+	for _, v := range idle {
+		found[v.PV] = true
+		total += v.Bytes
+		if r.idle[v.PV] || v.PVC == "" {
+			continue
+		}
+		claim := &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: v.Namespace, Name: v.PVC}
+		volume := &v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: v.PV}
+		r.p.warnRelated(claim, volume, reasonVolumeIdle,
+			"volume %s (%s) of pvc {%s/%s} was not used for %d days, %s", v.PV, formatBytes(v.Bytes), v.Namespace, v.PVC, v.IdleDays, v.Suggestion)
+	}
+	r.idle = found
+	glog.Infof("%d volumes holding %s were not used for %s", len(idle), formatBytes(total), r.idleAfter)
+
+	if err := r.publish(ctx, idle); err != nil {
+		glog.Warningf("publish idle report to configmap %s/%s fail: %s", r.namespace, r.configMap, err.Error())
+	}
+}
+
+// publish writes idle to the report ConfigMap, creating it if needed.
+func (r *idleReporter) publish(ctx context.Context, idle []idleVolume) error {
+	content, err := json.MarshalIndent(map[string]interface{}{
+		"generated": time.Now().UTC(),
+		"idleAfter": r.idleAfter.String(),
+		"volumes":   idle,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	client := r.p.client.CoreV1().ConfigMaps(r.namespace)
+	cm, err := client.Get(ctx, r.configMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: r.configMap, Namespace: r.namespace, Annotations: map[string]string{annProvisionedBy: r.p.name}},
+			Data:       map[string]string{idleReportKey: string(content)},
+		}
+		_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[idleReportKey] = string(content)
+	_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// idleReportName returns the default name of the idle report ConfigMap of the provisioner.
+func idleReportName(provisionerName string) string {
+	return strings.Replace(provisionerName, "/", "-", -1) + "-idle-volumes"
+}
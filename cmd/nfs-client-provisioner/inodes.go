@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// paramInodeLimit is the number of files and directories every volume of
+	// the class is monitored against, e.g. "1000000". NFS clients cannot limit
+	// them, only the quota check and the hooks, on the NFS server, act on it.
+	paramInodeLimit = "inodeLimit"
+	// paramInodesPerGiB derives the inode limit of a volume from its requested
+	// capacity, e.g. "100000" gives a 10Gi volume a limit of 1000000
+	paramInodesPerGiB = "inodesPerGiB"
+	// annInodeLimit on a PV is its inode limit. Like its capacity, it is fixed
+	// when the volume is provisioned, and passed to the lifecycle hooks so that
+	// they can set it as a project quota on the NFS server.
+	annInodeLimit = "nchc.ai/inode-limit"
+
+	gib = 1 << 30
+)
+
+// inodeLimit returns the inode limit of a volume of class requesting request,
+// 0 if the class sets none. Requests are rounded up to whole GiB.
+func inodeLimit(class *storage.StorageClass, request resource.Quantity) (int64, error) {
+	limit, hasLimit := class.Parameters[paramInodeLimit]
+	ratio, hasRatio := class.Parameters[paramInodesPerGiB]
+	switch {
+	case hasLimit && hasRatio:
+		return 0, misconfigured("%s and %s cannot be combined", paramInodeLimit, paramInodesPerGiB)
+	case hasLimit:
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 {
+			return 0, misconfigured("invalid %s %q, must be a positive integer", paramInodeLimit, limit)
+		}
+		return n, nil
+	case hasRatio:
+		n, err := strconv.ParseInt(ratio, 10, 64)
+		if err != nil || n < 1 {
+			return 0, misconfigured("invalid %s %q, must be a positive integer", paramInodesPerGiB, ratio)
+		}
+		return n * max((request.Value()+gib-1)/gib, 1), nil
+	}
+	return 0, nil
+}
+
+// volumeInodeLimit returns the inode limit recorded on pv, 0 if it has none.
+func volumeInodeLimit(pv *v1.PersistentVolume) int64 {
+	n, err := strconv.ParseInt(pv.Annotations[annInodeLimit], 10, 64)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// leaderElection configures the election of the replica that provisions and
+// deletes volumes, set by flags in main. Empty fields are defaulted by run.
+type leaderElection struct {
+	enabled       bool
+	lockType      string
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// run calls f once this replica is elected, or right away if leader election is
+// disabled. The provisioner exits when it loses the lease.
+func (le *leaderElection) run(ctx context.Context, client kubernetes.Interface, recorder record.EventRecorder, provisionerName string, f func(ctx context.Context)) error {
+	if !le.enabled {
+		f(ctx)
+		return nil
+	}
+	namespace, name, identity := le.namespace, le.name, le.identity
+	if namespace == "" {
+		namespace = podNamespace()
+	}
+	if name == "" {
+		// the lease name of the provision controller, so replicas of older versions are excluded
+		name = strings.Replace(provisionerName, "/", "-", -1)
+	}
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		identity = hostname + "_" + string(uuid.NewUUID())
+	}
+
+	lock, err := resourcelock.New(le.lockType, namespace, name, client.CoreV1(), client.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity:      identity,
+		EventRecorder: recorder,
+	})
+	if err != nil {
+		return err
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: le.leaseDuration,
+		RenewDeadline: le.renewDeadline,
+		RetryPeriod:   le.retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: f,
+			OnStoppedLeading: func() {
+				glog.Fatalf("%s lost the leader election lease %s/%s", identity, namespace, name)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					glog.Infof("%s is the leader", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election: %w", err)
+	}
+	glog.Infof("%s is waiting for the leader election lease %s %s/%s", identity, le.lockType, namespace, name)
+	elector.Run(ctx)
+	return nil
+}
+
+// podNamespace returns the namespace the provisioner runs in, or "default".
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
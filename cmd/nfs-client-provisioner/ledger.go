@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	controller "sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+const (
+	// ledgerDir holds a file per directory named by a claim rather than its
+	// volume, named like the directory, recording which claim owns the name
+	ledgerDir = ".ledger"
+	// ledgerSuffix is the suffix of the files in ledgerDir
+	ledgerSuffix = ".json"
+)
+
+// ledgerEntry records the owner of a directory named by directoryNaming:
+// sticky or nchc.ai/subdir-name. Claims of other namespaces, or with another
+// name resolving to the same directory, are rejected, even after the directory
+// was archived or removed.
+type ledgerEntry struct {
+	// Name is the name the directory was requested by: namespace/pvc for
+	// sticky directories, the nchc.ai/subdir-name otherwise
+	Name         string    `json:"name"`
+	Directory    string    `json:"directory"`
+	Namespace    string    `json:"namespace"`
+	Claim        string    `json:"claim"`
+	Tenant       string    `json:"tenant,omitempty"`
+	StorageClass string    `json:"storageClass"`
+	Created      time.Time `json:"created"`
+}
+
+// owns reports whether e and other were requested by the same name in the same namespace.
+func (e *ledgerEntry) owns(other *ledgerEntry) bool {
+	return e.Namespace == other.Namespace && e.Name == other.Name
+}
+
+func ledgerPath(root, directory string) string {
+	return filepath.Join(root, ledgerDir, directory+ledgerSuffix)
+}
+
+// claimLedger records e as the owner of its directory below root, unless the
+// directory is owned by another name or namespace. The entry is created
+// exclusively, so that replicas racing for the same directory do not both win.
+func claimLedger(root string, e *ledgerEntry) error {
+	path := ledgerPath(root, e.Directory)
+	if err := dataFS.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := dataFS.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	} else if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	owner, err := readLedger(root, e.Directory)
+	if err != nil {
+		return err
+	}
+	if !owner.owns(e) {
+		return misconfigured("the directory %s of %s in namespace %s is taken by %s in namespace %s since %s", e.Directory, e.Name, e.Namespace, owner.Name, owner.Namespace, owner.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// claimDirectoryName records in the ledger that the directory name below
+// mountPath was requested by requested for the claim of options.
+func (p *nfsProvisioner) claimDirectoryName(ctx context.Context, options controller.ProvisionOptions, tenant *storageTenant, requested, name string) error {
+	e := &ledgerEntry{
+		Name:         requested,
+		Directory:    name,
+		Namespace:    options.PVC.Namespace,
+		Claim:        options.PVC.Name,
+		StorageClass: options.StorageClass.Name,
+		Created:      time.Now().UTC(),
+	}
+	if tenant != nil {
+		e.Tenant = tenant.Name
+	}
+	return runFS(ctx, func() error { return claimLedger(mountPath, e) })
+}
+
+// readLedger returns the owner of directory below root.
+func readLedger(root, directory string) (*ledgerEntry, error) {
+	data, err := dataFS.ReadFile(ledgerPath(root, directory))
+	if err != nil {
+		return nil, err
+	}
+	e := &ledgerEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("ledger entry of %s: %w", directory, err)
+	}
+	return e, nil
+}
+
+// listLedger returns the entries of the ledger below root, by directory.
+func listLedger(root string) ([]*ledgerEntry, error) {
+	var entries []*ledgerEntry
+	dir := filepath.Join(root, ledgerDir)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ledgerSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		e, err := readLedger(root, strings.TrimSuffix(rel, ledgerSuffix))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Directory < entries[j].Directory })
+	return entries, err
+}
+
+func runLedger(args []string) error {
+	fs := flag.NewFlagSet("ledger", flag.ContinueOnError)
+	root := fs.String("root", mountPath, "directory the export is mounted at")
+	release := fs.String("release", "", "directory below the export whose name is released for other claims")
+	asJSON := fs.Bool("json", false, "print the ledger as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *release != "" {
+		directory := filepath.Clean(*release)
+		if filepath.IsAbs(directory) || directory == ".." || strings.HasPrefix(directory, "../") {
+			return fmt.Errorf("invalid -release %q, must be a directory below the export", *release)
+		}
+		if _, err := readLedger(*root, directory); err != nil {
+			return err
+		}
+		return dataFS.Remove(ledgerPath(*root, directory))
+	}
+
+	entries, err := listLedger(*root)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTORY\tNAME\tNAMESPACE\tCLAIM\tSTORAGECLASS\tCREATED\tEXISTS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n", e.Directory, e.Name, e.Namespace, e.Claim, e.StorageClass, e.Created.Format(time.RFC3339), exists(filepath.Join(*root, e.Directory)))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// lineageNode is a volume together with all volumes cloned from it.
+type lineageNode struct {
+	PV        string         `json:"pv"`
+	PVC       string         `json:"pvc,omitempty"`
+	Directory string         `json:"directory"`
+	Mode      string         `json:"mode,omitempty"`
+	Children  []*lineageNode `json:"children,omitempty"`
+}
+
+// lineageIndex indexes volumes by the directory they were cloned from.
+type lineageIndex struct {
+	clones map[string][]*v1.PersistentVolume
+}
+
+func newLineageIndex(pvs []v1.PersistentVolume) *lineageIndex {
+	idx := &lineageIndex{clones: map[string][]*v1.PersistentVolume{}}
+	for i := range pvs {
+		pv := &pvs[i]
+		if src, ok := pv.Annotations[annSrcDirectory]; ok {
+			idx.clones[src] = append(idx.clones[src], pv)
+		}
+	}
+	for _, clones := range idx.clones {
+		sort.Slice(clones, func(i, j int) bool {
+			return clones[i].Name < clones[j].Name
+		})
+	}
+	return idx
+}
+
+// descendants returns the tree of all volumes cloned, directly or not, from pv.
+func (idx *lineageIndex) descendants(pv *v1.PersistentVolume) *lineageNode {
+	return idx.build(pv, map[string]bool{})
+}
+
+func (idx *lineageIndex) build(pv *v1.PersistentVolume, seen map[string]bool) *lineageNode {
+	seen[pv.Name] = true
+	node := &lineageNode{
+		PV:   pv.Name,
+		Mode: pv.Annotations[annCloneMode],
+	}
+	if pv.Spec.ClaimRef != nil {
+		node.PVC = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+	}
+	if pv.Spec.NFS != nil {
+		node.Directory = volumeDirectoryOn(lookupSetting("nfs-path"), pv)
+	}
+	// linked volumes share the directory of their source, clones of them
+	// are recorded against that source directory and are not repeated here
+	if node.Mode == cloneModeLink {
+		return node
+	}
+	for _, clone := range idx.clones[node.Directory] {
+		if !seen[clone.Name] {
+			node.Children = append(node.Children, idx.build(clone, seen))
+		}
+	}
+	return node
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	otiai10 "github.com/otiai10/copy"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// brokenLinkReport only emits a Warning event on the claim of a broken link
+	brokenLinkReport = "report"
+	// brokenLinkQuarantine additionally renames the broken link to broken-<name>
+	brokenLinkQuarantine = "quarantine"
+	// brokenLinkRepair replaces the broken link with a copy of the archived link target, if any
+	brokenLinkRepair = "repair"
+
+	quarantinePrefix = "broken-"
+	// annQuarantined on a PV is the path below the export its broken link was
+	// quarantined to, which deleting the volume removes
+	annQuarantined = "nchc.ai/quarantined"
+)
+
+// linkChecker periodically looks for linked volumes whose source directory was
+// removed out-of-band.
+type linkChecker struct {
+	p      *nfsProvisioner
+	action string
+}
+
+func newLinkChecker(p *nfsProvisioner, action string) (*linkChecker, error) {
+	switch action {
+	case brokenLinkReport, brokenLinkQuarantine, brokenLinkRepair:
+	default:
+		return nil, fmt.Errorf("invalid broken link action %q", action)
+	}
+	return &linkChecker{p: p, action: action}, nil
+}
+
+func (c *linkChecker) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, c.check, interval)
+}
+
+func (c *linkChecker) check(ctx context.Context) {
+	pvs, err := c.p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("list persistent volumes for link check fail: %s", err.Error())
+		return
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if !c.p.ownsVolume(pv) {
+			continue
+		}
+		name := c.p.volumeDirectory(pv)
+		link := filepath.Join(mountPath, name)
+		info, err := dataFS.Lstat(link)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if _, err := c.p.resolveDirectory(name); err == nil {
+			continue
+		}
+		target := pv.Annotations[annSrcDirectory]
+		if target == "" {
+			readlink, _ := dataFS.Readlink(link)
+			target = filepath.Base(readlink)
+		}
+		c.handleBrokenLink(ctx, pv, name, target)
+	}
+}
+
+func (c *linkChecker) handleBrokenLink(ctx context.Context, pv *v1.PersistentVolume, name, target string) {
+	link := filepath.Join(mountPath, name)
+	message := fmt.Sprintf("the source %s of linked volume %s no longer exists", target, pv.Name)
+
+	switch c.action {
+	case brokenLinkQuarantine:
+		quarantined := quarantinePath(name)
+		if err := dataFS.Rename(link, filepath.Join(mountPath, quarantined)); err != nil {
+			glog.Warningf("quarantine broken link %s fail: %s", name, err.Error())
+			break
+		}
+		// the PV keeps pointing at name, record where its link went
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{annQuarantined: quarantined},
+			},
+		})
+		if _, err := c.p.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			glog.Warningf("record quarantine of broken link %s fail: %s", name, err.Error())
+			if err := dataFS.Rename(filepath.Join(mountPath, quarantined), link); err != nil {
+				glog.Warningf("restore broken link %s fail: %s", name, err.Error())
+			}
+			break
+		}
+		message += ", the link was quarantined as " + quarantined
+	case brokenLinkRepair:
+		archiveName, ok := findArchiveOf(target)
+		if !ok {
+			message += ", no archive to repair it from"
+			break
+		}
+		archive := filepath.Join(mountPath, archiveName)
+		// copy next to the link first, so the volume is never left without data
+		tmp := filepath.Join(mountPath, filepath.Dir(name), ".repair-"+filepath.Base(name))
+		if err := dataFS.Copy(archive, tmp, otiai10.Options{}); err != nil {
+			glog.Warningf("repair broken link %s fail: %s", name, err.Error())
+			removeAll(tmp)
+			break
+		}
+		// the copy is the directory of this volume now, not an archive of the source
+		if err := c.p.markRepaired(pv, tmp); err != nil {
+			glog.Warningf("repair broken link %s fail: %s", name, err.Error())
+			removeAll(tmp)
+			break
+		}
+		if err := dataFS.Remove(link); err != nil {
+			glog.Warningf("repair broken link %s fail: %s", name, err.Error())
+			removeAll(tmp)
+			break
+		}
+		if err := dataFS.Rename(tmp, link); err != nil {
+			glog.Warningf("repair broken link %s fail: %s", name, err.Error())
+			break
+		}
+		message += ", the volume was restored from " + archiveName
+		// the volume is no longer linked, nor a copy which can be re-synced
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{annCloneMode: nil, annSrcDirectory: nil, annSrcPVC: nil, annGCLinkTarget: nil},
+			},
+		})
+		if _, err := c.p.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			glog.Warningf("remove link annotations of repaired volume %s fail: %s", pv.Name, err.Error())
+		}
+	}
+
+	c.p.warnVolume(pv, reasonBrokenLink, message)
+}
+
+// markRepaired turns dir, a copy of the archived source of the broken link of
+// volume, into the directory of volume: the manifest of the archive is removed
+// and the marker of volume replaces the one of the source.
+func (p *nfsProvisioner) markRepaired(volume *v1.PersistentVolume, dir string) error {
+	if err := dataFS.Remove(filepath.Join(dir, archiveManifestFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m := &volumeMarker{
+		Provisioner:  p.name,
+		Volume:       volume.Name,
+		StorageClass: volume.Spec.StorageClassName,
+		Created:      volume.CreationTimestamp.UTC(),
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		m.ClaimNamespace, m.ClaimName, m.ClaimUID = ref.Namespace, ref.Name, string(ref.UID)
+	}
+	return writeMarker(dir, m)
+}
+
+// quarantinePath returns the path below the export the broken link name is
+// quarantined to, broken-<name> next to it.
+func quarantinePath(name string) string {
+	return filepath.Join(filepath.Dir(name), quarantinePrefix+filepath.Base(name))
+}
+
+// removeQuarantined removes the quarantined broken link of volume, whose
+// directory is name, if the link check recorded one.
+func (p *nfsProvisioner) removeQuarantined(ctx context.Context, volume *v1.PersistentVolume, name string) error {
+	quarantined, ok := volume.Annotations[annQuarantined]
+	if !ok {
+		return nil
+	}
+	// the annotation can be edited, never remove anything but the link
+	if quarantined != quarantinePath(name) {
+		return fmt.Errorf("%s %q of pv %s is not the quarantine path %s of its link", annQuarantined, quarantined, volume.Name, quarantinePath(name))
+	}
+	full := filepath.Join(mountPath, quarantined)
+	info, err := lstatCtx(ctx, full)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("quarantined %s of pv %s is not a symbolic link", full, volume.Name)
+	}
+	glog.V(4).Infof("removing quarantined link %s", full)
+	return retryTransient(ctx, "remove "+full, func() error {
+		return runFS(ctx, func() error { return dataFS.Remove(full) })
+	})
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// paramLinkOnDelete is what happens when a volume created by link-data is deleted
+	paramLinkOnDelete = "linkOnDelete"
+
+	// linkOnDeleteRemove removes the symbolic link only
+	linkOnDeleteRemove = "remove"
+	// linkOnDeleteArchive archives the symbolic link, as a record of what it pointed to
+	linkOnDeleteArchive = "archive"
+	// linkOnDeleteGC removes the symbolic link, and the directory it points to once
+	// no other volume uses it, as the class would on deletion: onDelete, archiveOnDelete
+	linkOnDeleteGC = "gc"
+
+	// annGCLinkTarget on a PVC keeps its directory, when it is deleted while
+	// linked volumes still point to it, until the last link is deleted
+	annGCLinkTarget = "nchc.ai/gc-link-target"
+	// linkGCDir holds a file per directory kept by annGCLinkTarget, named like
+	// it, with the storage class of its deleted volume
+	linkGCDir = ".link-gc"
+)
+
+// linkGC serializes the deletion of links, so that concurrent deletions of the
+// last links to a directory do not both consider the other one in use.
+var linkGC sync.Mutex
+
+// deleteLink deletes the volume name below mountPath, which was created by link-data.
+func (p *nfsProvisioner) deleteLink(ctx context.Context, volume *v1.PersistentVolume, name string) error {
+	class, err := p.getClassForVolume(ctx, volume)
+	if err != nil {
+		p.warn(volume, reasonStorageClassFailed, "unable to get storage class of pv %s: %s", volume.Name, err.Error())
+		return err
+	}
+	action := class.Parameters[paramLinkOnDelete]
+	switch action {
+	case "", linkOnDeleteRemove, linkOnDeleteArchive, linkOnDeleteGC:
+	default:
+		err := misconfigured("invalid %s %q, must be %q, %q or %q", paramLinkOnDelete, action, linkOnDeleteRemove, linkOnDeleteArchive, linkOnDeleteGC)
+		p.warn(volume, reasonStorageClassFailed, "storage class %s: %s", class.Name, err.Error())
+		return err
+	}
+
+	linkGC.Lock()
+	defer linkGC.Unlock()
+
+	target := p.linkTarget(volume, name)
+	inUse := true
+	if target != "" {
+		if inUse, err = p.linkTargetInUse(ctx, volume, target); err != nil {
+			return err
+		}
+	}
+	if action == linkOnDeleteArchive {
+		err = p.archiveDirectory(ctx, volume, volume, class, name)
+	} else {
+		err = p.removeVolume(ctx, volume, name)
+	}
+	if err != nil || inUse {
+		return err
+	}
+
+	// the source of the link opted in to be collected with its last link, as its own class would delete it
+	targetClass := class
+	if className, ok := pendingLinkTarget(target); ok {
+		targetClass = p.classOrEmpty(ctx, className)
+	} else if action != linkOnDeleteGC {
+		return nil
+	}
+	// the link is gone, a failure only leaves the target behind as an orphan
+	if err := p.collectLinkTarget(ctx, volume, targetClass, target); err != nil {
+		glog.Warningf("garbage collecting %s, the target of %s, fail: %s", target, name, err.Error())
+		return nil
+	}
+	if err := dataFS.Remove(filepath.Join(mountPath, linkGCDir, target)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("remove pending garbage collection of %s fail: %s", target, err.Error())
+	}
+	return nil
+}
+
+// deferLinkTarget keeps the directory name of the deleted source volume while
+// links still point to it, to be collected with the last of them. It reports
+// whether the directory was kept.
+func (p *nfsProvisioner) deferLinkTarget(ctx context.Context, volume *v1.PersistentVolume, name string) (bool, error) {
+	linkGC.Lock()
+	defer linkGC.Unlock()
+
+	inUse, err := p.linkTargetInUse(ctx, volume, name)
+	if err != nil || !inUse {
+		return false, err
+	}
+	err = runFS(ctx, func() error {
+		if err := dataFS.MkdirAll(filepath.Dir(filepath.Join(mountPath, linkGCDir, name)), 0755); err != nil {
+			return err
+		}
+		return dataFS.WriteFile(filepath.Join(mountPath, linkGCDir, name), []byte(volume.Spec.StorageClassName), 0644)
+	})
+	if err != nil {
+		return false, err
+	}
+	glog.Infof("%s is still linked, it is kept until the last link is deleted", name)
+	return true, nil
+}
+
+// pendingLinkTarget returns the storage class of the deleted source volume
+// name, if it waits to be collected with its last link.
+func pendingLinkTarget(name string) (string, bool) {
+	class, err := dataFS.ReadFile(filepath.Join(mountPath, linkGCDir, name))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(class)), true
+}
+
+// classOrEmpty returns the storage class name, or one without parameters if it no longer exists.
+func (p *nfsProvisioner) classOrEmpty(ctx context.Context, name string) *storage.StorageClass {
+	class, err := p.getClassForVolume(ctx, &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{StorageClassName: name}})
+	if err != nil {
+		glog.Warningf("unable to get storage class %s: %s, using the defaults", name, err.Error())
+		return &storage.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	return class
+}
+
+// linkTarget returns the directory the link name of volume points to, "" if unknown.
+func (p *nfsProvisioner) linkTarget(volume *v1.PersistentVolume, name string) string {
+	if target, ok := volume.Annotations[annSrcDirectory]; ok {
+		return target
+	}
+	// links provisioned before their source was recorded
+	target, err := p.resolveDirectory(name)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// linkTargetInUse reports whether a volume other than volume uses the directory
+// target, as its own directory or through a link.
+func (p *nfsProvisioner) linkTargetInUse(ctx context.Context, volume *v1.PersistentVolume, target string) (bool, error) {
+	pvs, err := p.listVolumes(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, pv := range pvs {
+		if pv.Name == volume.Name || !p.ownsVolume(pv) {
+			continue
+		}
+		name := p.volumeDirectory(pv)
+		// a deleted source is listed until its PV is removed
+		if _, pending := pendingLinkTarget(target); name == target && !pending {
+			return true, nil
+		}
+		if pv.Annotations[annCloneMode] == cloneModeLink && pv.Annotations[annSrcDirectory] == target {
+			// deleted links are listed until their PV is removed
+			if _, err := dataFS.Lstat(filepath.Join(mountPath, name)); err == nil {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// linkTargetPath returns the path on the NFS server of target, the directory
+// the link name of volume points to. Both are on the same export, whose mount
+// they are relative to, and the path of the link ends like its name.
+func linkTargetPath(volume *v1.PersistentVolume, name, target string) string {
+	path := volume.Spec.NFS.Path
+	for filepath.Base(path) == filepath.Base(name) && name != "." {
+		path, name = filepath.Dir(path), filepath.Dir(name)
+	}
+	rel, err := filepath.Rel(name, target)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.Join(path, target)
+	}
+	return filepath.Join(path, rel)
+}
+
+// collectLinkTarget removes, recycles, trashes or archives target, which is no
+// longer used by any volume, as class does on deletion. Failures are reported on volume, the last
+// link to target.
+func (p *nfsProvisioner) collectLinkTarget(ctx context.Context, volume *v1.PersistentVolume, class *storage.StorageClass, target string) error {
+	dir := filepath.Join(mountPath, target)
+	if _, err := lstatCtx(ctx, dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	// the target is named after the volume it was provisioned for
+	owner := volume
+	m, err := readMarker(dir)
+	if err == nil {
+		owner = m.persistentVolume()
+	}
+	if p.markerCheck != markerCheckOff {
+		if err == nil && m.Provisioner != p.name {
+			p.warn(volume, reasonMarkerMismatch, "%s, the target of the deleted link, is marked for provisioner %s, kept", target, m.Provisioner)
+			return nil
+		}
+		if err != nil && !(os.IsNotExist(err) && p.markerCheck == markerCheckMismatch) {
+			p.warn(volume, reasonMarkerMismatch, "%s, the target of the deleted link, has no readable marker file, kept", target)
+			return nil
+		}
+	}
+
+	action, err := onDeleteAction(class)
+	if err != nil {
+		return err
+	}
+	glog.Infof("%s is no longer used by any volume, %s it", target, action)
+	switch action {
+	case onDeleteDelete:
+		if err := p.removeVolume(ctx, volume, filepath.Join(snapshotDir, target)); err != nil {
+			return err
+		}
+		return p.removeVolume(ctx, volume, target)
+	case onDeleteRecycle:
+		return runFS(ctx, func() error { return p.recycleDirectory(owner, target) })
+	case onDeleteTrash:
+		// restoring the trashed target recreates the volume it was provisioned
+		// for, on the export of the link
+		owner = owner.DeepCopy()
+		owner.Spec.NFS = &v1.NFSVolumeSource{
+			Server: volume.Spec.NFS.Server,
+			Path:   linkTargetPath(volume, p.volumeDirectory(volume), target),
+		}
+		return p.trashDirectory(ctx, volume, owner, class, target)
+	default:
+		return p.archiveDirectory(ctx, volume, owner, class, target)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testLinkSource = "default-src-pv-src"
+	testLink       = "default-link-pv-link"
+)
+
+// makeLink creates the source directory of pv-src and the volume pvName of
+// the claim name, linked to it, and returns the volume.
+func makeLink(t *testing.T, pvName, name string) *v1.PersistentVolume {
+	t.Helper()
+	if !pathExists(filepath.Join(mountPath, testLinkSource)) {
+		makeVolumeDirectory(t, testVolume("pv-src", "nfs", "default", "src", testLinkSource, nil), testLinkSource, "src")
+	}
+	dir := "default-" + name + "-" + pvName
+	if err := os.Symlink(testLinkSource, filepath.Join(mountPath, dir)); err != nil {
+		t.Fatal(err)
+	}
+	return testVolume(pvName, "links", "default", name, dir, map[string]string{
+		annCloneMode:    cloneModeLink,
+		annSrcDirectory: testLinkSource,
+	})
+}
+
+func TestLinkGC(t *testing.T) {
+	tests := []struct {
+		name         string
+		linkOnDelete string
+		onDelete     string
+		// otherLink is another volume linked to the source
+		otherLink bool
+		// sourceVolume keeps the volume of the source
+		sourceVolume bool
+		// pending is the class the source waits to be collected with, if any
+		pending string
+		// check verifies what happened to the source
+		check func(t *testing.T)
+	}{
+		{
+			name:         "last link, onDelete delete",
+			linkOnDelete: linkOnDeleteGC,
+			onDelete:     onDeleteDelete,
+			check:        wantLinkSource(false),
+		},
+		{
+			name:         "last link, onDelete trash",
+			linkOnDelete: linkOnDeleteGC,
+			onDelete:     onDeleteTrash,
+			check: func(t *testing.T) {
+				wantLinkSource(false)(t)
+				e, err := readTrash(mountPath, "pv-src")
+				if err != nil {
+					t.Fatalf("trash entry of pv-src: %v", err)
+				}
+				if want := filepath.Join(testExport, testLinkSource); e.Path != want || e.Volume.ClaimName != "src" {
+					t.Errorf("trash entry = %+v, want pvc src at %s", e, want)
+				}
+				if got := readTestFile(t, filepath.Join(trashPath(mountPath, "pv-src"), trashData, "data")); got != "src" {
+					t.Errorf("data in the trash = %q, want %q", got, "src")
+				}
+			},
+		},
+		{
+			name:         "last link, onDelete archive",
+			linkOnDelete: linkOnDeleteGC,
+			onDelete:     onDeleteArchive,
+			check: func(t *testing.T) {
+				wantLinkSource(false)(t)
+				if got := readTestFile(t, filepath.Join(mountPath, archivePrefix+testLinkSource, "data")); got != "src" {
+					t.Errorf("data of the archive = %q, want %q", got, "src")
+				}
+			},
+		},
+		{
+			name:         "other link",
+			linkOnDelete: linkOnDeleteGC,
+			onDelete:     onDeleteDelete,
+			otherLink:    true,
+			check:        wantLinkSource(true),
+		},
+		{
+			name:         "source volume exists",
+			linkOnDelete: linkOnDeleteGC,
+			onDelete:     onDeleteDelete,
+			sourceVolume: true,
+			check:        wantLinkSource(true),
+		},
+		{
+			name:         "links are removed only",
+			linkOnDelete: linkOnDeleteRemove,
+			onDelete:     onDeleteDelete,
+			check:        wantLinkSource(true),
+		},
+		{
+			name:         "deleted source waits for its last link",
+			linkOnDelete: linkOnDeleteRemove,
+			onDelete:     onDeleteArchive,
+			pending:      "src",
+			sourceVolume: true,
+			check: func(t *testing.T) {
+				// as the class of the source does, not the one of the link
+				wantLinkSource(false)(t)
+				if pathExists(filepath.Join(mountPath, archivePrefix+testLinkSource)) {
+					t.Error("the source is archived, want it deleted")
+				}
+				if pathExists(filepath.Join(mountPath, linkGCDir, testLinkSource)) {
+					t.Error("the pending garbage collection of the source is kept")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, markerCheckStrict,
+				testClass("links", map[string]string{paramLinkOnDelete: tt.linkOnDelete, paramOnDelete: tt.onDelete}),
+				testClass("src", map[string]string{paramOnDelete: onDeleteDelete}))
+			link := makeLink(t, "pv-link", "link")
+			volumes := []*v1.PersistentVolume{link}
+			if tt.otherLink {
+				volumes = append(volumes, makeLink(t, "pv-other", "other"))
+			}
+			if tt.sourceVolume {
+				volumes = append(volumes, testVolume("pv-src", "src", "default", "src", testLinkSource, nil))
+			}
+			for _, pv := range volumes {
+				if _, err := p.client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.pending != "" {
+				writeTestFile(t, filepath.Join(mountPath, linkGCDir, testLinkSource), tt.pending)
+			}
+
+			if err := p.Delete(context.Background(), link); err != nil {
+				t.Fatalf("Delete() = %v", err)
+			}
+			if pathExists(filepath.Join(mountPath, testLink)) {
+				t.Errorf("link %s is kept", testLink)
+			}
+			tt.check(t)
+		})
+	}
+}
+
+// wantLinkSource returns a check that the source of the links is kept, or not.
+func wantLinkSource(kept bool) func(t *testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+		if got := pathExists(filepath.Join(mountPath, testLinkSource)); got != kept {
+			t.Errorf("source of the links kept = %v, want %v", got, kept)
+		}
+	}
+}
+
+func TestDeferLinkTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		// linked creates a volume linked to the source
+		linked bool
+		want   bool
+	}{
+		{name: "linked", linked: true, want: true},
+		{name: "not linked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, markerCheckStrict, testClass("src", map[string]string{paramOnDelete: onDeleteDelete}))
+			source := testVolume("pv-src", "src", "default", "src", testLinkSource, map[string]string{annGCLinkTarget: "true"})
+			makeVolumeDirectory(t, source, testLinkSource, "src")
+			if tt.linked {
+				if _, err := p.client.CoreV1().PersistentVolumes().Create(context.Background(), makeLink(t, "pv-link", "link"), metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := p.Delete(context.Background(), source); err != nil {
+				t.Fatalf("Delete() = %v", err)
+			}
+			wantLinkSource(tt.want)(t)
+			if class, ok := pendingLinkTarget(testLinkSource); ok != tt.want || (ok && class != "src") {
+				t.Errorf("pendingLinkTarget() = %q, %v, want pending %v with class src", class, ok, tt.want)
+			}
+		})
+	}
+}
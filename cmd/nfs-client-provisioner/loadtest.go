@@ -0,0 +1,327 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// labelLoadTest on the PVCs of loadtest is the name of the run
+	labelLoadTest = "nchc.ai/loadtest"
+)
+
+// loadTestClaim is what loadtest observed of one of its PVCs.
+type loadTestClaim struct {
+	name    string
+	created time.Time
+	bound   time.Time
+	volume  string
+	deleted time.Time
+	// removed is when the PV of the claim was gone
+	removed time.Time
+	err     error
+}
+
+// loadTestPhase sums up the provisioning or the deletion of the PVCs.
+type loadTestPhase struct {
+	Total    int     `json:"total"`
+	OK       int     `json:"ok"`
+	Errors   int     `json:"errors"`
+	Timeouts int     `json:"timeouts"`
+	P50      float64 `json:"p50Seconds"`
+	P90      float64 `json:"p90Seconds"`
+	P99      float64 `json:"p99Seconds"`
+	Max      float64 `json:"maxSeconds"`
+	// Rate is the number of completed operations per second over the phase
+	Rate float64 `json:"ratePerSecond"`
+}
+
+type loadTestResult struct {
+	Run       string         `json:"run"`
+	Class     string         `json:"storageClass"`
+	Namespace string         `json:"namespace"`
+	Provision loadTestPhase  `json:"provision"`
+	Delete    *loadTestPhase `json:"delete,omitempty"`
+}
+
+// runLoadTest creates PVCs of a class at a steady rate, waits for them to be
+// bound, deletes them again and reports the latencies and error rates.
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	class := fs.String("class", "", "storage class of the PVCs, must have volumeBindingMode Immediate")
+	namespace := fs.String("namespace", "default", "namespace the PVCs are created in")
+	count := fs.Int("count", 100, "number of PVCs")
+	rate := fs.Float64("rate", 5, "PVCs created, and deleted, per second")
+	size := fs.String("size", "1Mi", "requested size of the PVCs")
+	cloneFrom := fs.String("clone-from", "", "PVC in -namespace the PVCs are cloned from, none to create empty volumes")
+	cloneMode := fs.String("clone-mode", cloneModeCopy, "how the PVCs are cloned from -clone-from, copy or link")
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long a PVC may take to be bound, and its PV to be removed after its deletion")
+	keep := fs.Bool("keep", false, "keep the PVCs instead of deleting them")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *class == "" {
+		return fmt.Errorf("-class is required")
+	}
+	if *count <= 0 || *rate <= 0 {
+		return fmt.Errorf("-count and -rate must be positive")
+	}
+	if *cloneMode != cloneModeCopy && *cloneMode != cloneModeLink {
+		return fmt.Errorf("invalid -clone-mode %q, must be %q or %q", *cloneMode, cloneModeCopy, cloneModeLink)
+	}
+	quantity, err := resource.ParseQuantity(*size)
+	if err != nil {
+		return fmt.Errorf("invalid -size %q: %v", *size, err)
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	run := fmt.Sprintf("loadtest-%d", time.Now().Unix())
+	claims := map[string]*loadTestClaim{}
+	volumes := map[string]*loadTestClaim{}
+	var mu sync.Mutex
+
+	// the informers see the PVCs being bound and their PVs being removed
+	stop := make(chan struct{})
+	defer close(stop)
+	claimFactory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(*namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = labelLoadTest + "=" + run }))
+	claimInformer := claimFactory.Core().V1().PersistentVolumeClaims().Informer()
+	observeClaim := func(obj interface{}) {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok || pvc.Status.Phase != v1.ClaimBound {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if c := claims[pvc.Name]; c != nil && c.bound.IsZero() {
+			c.bound, c.volume = time.Now(), pvc.Spec.VolumeName
+			volumes[c.volume] = c
+		}
+	}
+	claimInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    observeClaim,
+		UpdateFunc: func(_, obj interface{}) { observeClaim(obj) },
+	})
+	volumeFactory := informers.NewSharedInformerFactory(client, 0)
+	volumeInformer := volumeFactory.Core().V1().PersistentVolumes().Informer()
+	volumeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pv, ok := obj.(*v1.PersistentVolume)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if c := volumes[pv.Name]; c != nil && c.removed.IsZero() {
+				c.removed = time.Now()
+			}
+		},
+	})
+	claimFactory.Start(stop)
+	volumeFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, claimInformer.HasSynced, volumeInformer.HasSynced) {
+		return fmt.Errorf("PVC and PV caches fail to sync")
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: creating %d PVCs of storage class %s in namespace %s, %g per second\n", run, *count, *class, *namespace, *rate)
+	interval := time.Duration(float64(time.Second) / *rate)
+	ticker := time.NewTicker(interval)
+	var ordered []*loadTestClaim
+	start := time.Now()
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			<-ticker.C
+		}
+		pvc := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        fmt.Sprintf("%s-%d", run, i),
+				Namespace:   *namespace,
+				Labels:      map[string]string{labelLoadTest: run},
+				Annotations: map[string]string{},
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: class,
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+				Resources:        v1.VolumeResourceRequirements{Requests: v1.ResourceList{v1.ResourceStorage: quantity}},
+			},
+		}
+		if *cloneFrom != "" {
+			ann := annCopyDate
+			if *cloneMode == cloneModeLink {
+				ann = annLinkDate
+			}
+			pvc.Annotations[ann] = "true"
+			pvc.Annotations[annSrcPVCNamespace] = *namespace
+			pvc.Annotations[annSrcPVCName] = *cloneFrom
+		}
+		c := &loadTestClaim{name: pvc.Name}
+		mu.Lock()
+		claims[c.name] = c
+		c.created = time.Now()
+		mu.Unlock()
+		if _, err := client.CoreV1().PersistentVolumeClaims(*namespace).Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+			mu.Lock()
+			c.err = err
+			mu.Unlock()
+			fmt.Fprintf(os.Stderr, "create pvc %s fail: %v\n", c.name, err)
+		}
+		ordered = append(ordered, c)
+	}
+	ticker.Stop()
+	waitLoadTest(&mu, ordered, *timeout, func(c *loadTestClaim) (time.Time, bool) {
+		return c.created, c.err != nil || !c.bound.IsZero()
+	})
+	result := loadTestResult{Run: run, Class: *class, Namespace: *namespace}
+	mu.Lock()
+	result.Provision = summarizeLoadTest(ordered, start, func(c *loadTestClaim) (time.Duration, bool, bool) {
+		return c.bound.Sub(c.created), c.err != nil, c.bound.IsZero()
+	})
+	mu.Unlock()
+
+	if *keep {
+		fmt.Fprintf(os.Stderr, "keeping the PVCs, delete them with: kubectl -n %s delete pvc -l %s=%s\n", *namespace, labelLoadTest, run)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: deleting the PVCs\n", run)
+		ticker := time.NewTicker(interval)
+		start := time.Now()
+		var deleted []*loadTestClaim
+		for i, c := range ordered {
+			if i > 0 {
+				<-ticker.C
+			}
+			// PVCs which failed to be created have nothing to delete
+			mu.Lock()
+			failed := c.err != nil
+			c.deleted = time.Now()
+			mu.Unlock()
+			if failed {
+				continue
+			}
+			err := client.CoreV1().PersistentVolumeClaims(*namespace).Delete(ctx, c.name, metav1.DeleteOptions{})
+			mu.Lock()
+			if err != nil {
+				c.err = err
+				fmt.Fprintf(os.Stderr, "delete pvc %s fail: %v\n", c.name, err)
+			}
+			// only the PVs of bound claims are removed
+			if c.volume != "" {
+				deleted = append(deleted, c)
+			}
+			mu.Unlock()
+		}
+		ticker.Stop()
+		waitLoadTest(&mu, deleted, *timeout, func(c *loadTestClaim) (time.Time, bool) {
+			return c.deleted, c.err != nil || !c.removed.IsZero()
+		})
+		mu.Lock()
+		phase := summarizeLoadTest(deleted, start, func(c *loadTestClaim) (time.Duration, bool, bool) {
+			return c.removed.Sub(c.deleted), c.err != nil, c.removed.IsZero()
+		})
+		mu.Unlock()
+		result.Delete = &phase
+	}
+
+	if *asJSON {
+		return writeJSON(os.Stdout, result)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tTOTAL\tOK\tERRORS\tTIMEOUTS\tP50\tP90\tP99\tMAX\tRATE")
+	phases := []struct {
+		name  string
+		phase *loadTestPhase
+	}{{"provision", &result.Provision}, {"delete", result.Delete}}
+	for _, p := range phases {
+		if p.phase == nil {
+			continue
+		}
+		s := p.phase
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.2f/s\n", p.name, s.Total, s.OK, s.Errors, s.Timeouts, s.P50, s.P90, s.P99, s.Max, s.Rate)
+	}
+	return w.Flush()
+}
+
+// waitLoadTest waits until every claim is done, or timeout after it started.
+func waitLoadTest(mu *sync.Mutex, claims []*loadTestClaim, timeout time.Duration, state func(*loadTestClaim) (started time.Time, done bool)) {
+	for {
+		pending := 0
+		mu.Lock()
+		for _, c := range claims {
+			if started, done := state(c); !done && time.Since(started) < timeout {
+				pending++
+			}
+		}
+		mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// summarizeLoadTest computes the statistics of a phase which started at start.
+func summarizeLoadTest(claims []*loadTestClaim, start time.Time, result func(*loadTestClaim) (latency time.Duration, failed, timedOut bool)) loadTestPhase {
+	phase := loadTestPhase{Total: len(claims)}
+	var latencies []float64
+	for _, c := range claims {
+		latency, failed, timedOut := result(c)
+		switch {
+		case failed:
+			phase.Errors++
+		case timedOut:
+			phase.Timeouts++
+		default:
+			phase.OK++
+			latencies = append(latencies, latency.Seconds())
+		}
+	}
+	if len(latencies) == 0 {
+		return phase
+	}
+	sort.Float64s(latencies)
+	percentile := func(p float64) float64 {
+		return latencies[int(math.Ceil(p*float64(len(latencies))))-1]
+	}
+	phase.P50, phase.P90, phase.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	phase.Max = latencies[len(latencies)-1]
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		phase.Rate = float64(phase.OK) / elapsed
+	}
+	return phase
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// debugVerbosity is the glog verbosity SIGUSR1 switches to.
+const debugVerbosity = "4"
+
+// setupLogging configures glog after the flags were parsed: logs go to stderr and,
+// with -log_dir, also to files which glog rotates at maxSize bytes and which are
+// removed once older than maxAge.
+func setupLogging(maxSize uint64, maxAge time.Duration) {
+	logDir := flag.Lookup("log_dir").Value.String()
+	if logDir == "" {
+		flag.Set("logtostderr", "true")
+		return
+	}
+	flag.Set("alsologtostderr", "true")
+	if maxSize > 0 {
+		glog.MaxSize = maxSize
+	}
+	if maxAge > 0 {
+		go wait.Forever(func() { removeOldLogs(logDir, maxAge) }, time.Hour)
+	}
+}
+
+// removeOldLogs removes the log files of this program in dir not written for maxAge.
+func removeOldLogs(dir string, maxAge time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		glog.Warningf("read log directory %s fail: %s", dir, err.Error())
+		return
+	}
+	prefix := filepath.Base(os.Args[0]) + "."
+	// glog links <program>.<severity> to the files currently written, which are kept
+	current := map[string]bool{}
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink != 0 && strings.HasPrefix(e.Name(), prefix) {
+			if target, err := os.Readlink(filepath.Join(dir, e.Name())); err == nil {
+				current[filepath.Base(target)] = true
+			}
+		}
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), prefix) || current[e.Name()] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			glog.Warningf("remove old log %s fail: %s", e.Name(), err.Error())
+		}
+	}
+}
+
+// handleVerbositySignals toggles the verbosity between its startup value and
+// debugVerbosity on every SIGUSR1.
+func handleVerbositySignals() {
+	initial := flag.Lookup("v").Value.String()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			level := debugVerbosity
+			if flag.Lookup("v").Value.String() == debugVerbosity {
+				level = initial
+			}
+			flag.Set("v", level)
+			glog.Infof("verbosity set to %s", level)
+		}
+	}()
+}
+
+// verbosityHandler serves the glog verbosity: GET returns it, PUT or POST with a
+// "level" query parameter changes it.
+func verbosityHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level := r.URL.Query().Get("level")
+		if err := flag.Set("v", level); err != nil {
+			http.Error(w, fmt.Sprintf("invalid level %q: %v", level, err), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("verbosity set to %s", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, flag.Lookup("v").Value.String())
+}
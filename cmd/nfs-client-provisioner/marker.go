@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// markerFile is written into every new volume directory, so that directories
+// found on the export can be traced back to their PV and PVC after the cluster
+// objects are gone.
+const markerFile = ".nfs-provisioner.json"
+
+const (
+	// markerCheckStrict only deletes directories with the marker of the deleted PV
+	markerCheckStrict = "strict"
+	// markerCheckMismatch also deletes directories without a marker, e.g. of
+	// volumes provisioned by older versions, but not ones marked for another PV
+	markerCheckMismatch = "mismatch"
+	// markerCheckOff deletes directories regardless of their marker
+	markerCheckOff = "off"
+
+	// annSkipMarkerCheck on a PV deletes its directory regardless of the marker
+	annSkipMarkerCheck = "nchc.ai/skip-marker-check"
+)
+
+type volumeMarker struct {
+	Provisioner    string    `json:"provisioner"`
+	Volume         string    `json:"volume"`
+	ClaimNamespace string    `json:"claimNamespace"`
+	ClaimName      string    `json:"claimName"`
+	ClaimUID       string    `json:"claimUID"`
+	StorageClass   string    `json:"storageClass"`
+	Created        time.Time `json:"created"`
+	// Recycled is when the volume was deleted with onDelete: recycle
+	Recycled *time.Time `json:"recycled,omitempty"`
+	// Released is when the volume of a sticky directory was deleted
+	Released *time.Time `json:"released,omitempty"`
+}
+
+// writeMarker writes m into dir, replacing the marker of a cloned source.
+func writeMarker(dir string, m *volumeMarker) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, markerFile)
+	dataFS.Remove(path)
+	return dataFS.WriteFile(path, append(data, '\n'), 0444)
+}
+
+// readMarker reads the marker of dir.
+func readMarker(dir string) (*volumeMarker, error) {
+	data, err := dataFS.ReadFile(filepath.Join(dir, markerFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &volumeMarker{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// persistentVolume returns a PV with the identity recorded in m, for the
+// archivePath template of a directory whose PV is gone.
+func (m *volumeMarker) persistentVolume() *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: m.Volume},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: m.StorageClass,
+			ClaimRef: &v1.ObjectReference{
+				Namespace: m.ClaimNamespace,
+				Name:      m.ClaimName,
+				UID:       types.UID(m.ClaimUID),
+			},
+		},
+	}
+}
+
+// verifyMarker checks that the directory name below mountPath belongs to volume
+// before it is removed or archived, so that data created by hand, which happens
+// to have the name of a volume, is not deleted.
+func (p *nfsProvisioner) verifyMarker(ctx context.Context, volume *v1.PersistentVolume, name string) error {
+	annotations, _ := v1Annotations(volume)
+	if skip, _ := strconv.ParseBool(annotations[annSkipMarkerCheck]); skip || p.markerCheck == markerCheckOff {
+		return nil
+	}
+	var m *volumeMarker
+	err := runFS(ctx, func() error {
+		var err error
+		m, err = readMarker(filepath.Join(mountPath, name))
+		return err
+	})
+	switch {
+	case os.IsNotExist(err):
+		if p.markerCheck == markerCheckMismatch {
+			return nil
+		}
+		return fmt.Errorf("%s has no marker file %s, annotate the volume with %s to delete it anyway", name, markerFile, annSkipMarkerCheck)
+	case err != nil:
+		return fmt.Errorf("unable to read marker file of %s: %w", name, err)
+	case m.Volume != volume.Name:
+		return fmt.Errorf("%s is marked for volume %s, not %s, annotate the volume with %s to delete it anyway", name, m.Volume, volume.Name, annSkipMarkerCheck)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestVerifyMarker(t *testing.T) {
+	tests := []struct {
+		name        string
+		markerCheck string
+		// marker is the volume the directory is marked for, "" for no marker
+		marker string
+		skip   bool
+		// fault is the operation failing with EIO, if any
+		fault   string
+		wantErr bool
+	}{
+		{name: "strict, own marker", markerCheck: markerCheckStrict, marker: "pv-a"},
+		{name: "strict, no marker", markerCheck: markerCheckStrict, wantErr: true},
+		{name: "strict, marked for another volume", markerCheck: markerCheckStrict, marker: "pv-b", wantErr: true},
+		{name: "mismatch, own marker", markerCheck: markerCheckMismatch, marker: "pv-a"},
+		{name: "mismatch, no marker", markerCheck: markerCheckMismatch},
+		{name: "mismatch, marked for another volume", markerCheck: markerCheckMismatch, marker: "pv-b", wantErr: true},
+		{name: "mismatch, unreadable marker", markerCheck: markerCheckMismatch, marker: "pv-a", fault: "read", wantErr: true},
+		{name: "off, no marker", markerCheck: markerCheckOff},
+		{name: "off, marked for another volume", markerCheck: markerCheckOff, marker: "pv-b"},
+		{name: "skipped, marked for another volume", markerCheck: markerCheckStrict, marker: "pv-b", skip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, tt.markerCheck)
+			var annotations map[string]string
+			if tt.skip {
+				annotations = map[string]string{annSkipMarkerCheck: "true"}
+			}
+			volume := testVolume("pv-a", "nfs", "default", "claim", "default-claim-pv-a", annotations)
+			if tt.marker != "" {
+				makeVolumeDirectory(t, testVolume(tt.marker, "nfs", "default", "claim", "default-claim-pv-a", nil), "default-claim-pv-a", "data")
+			} else {
+				writeTestFile(t, filepath.Join(mountPath, "default-claim-pv-a", "data"), "data")
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EIO, tt.fault)
+			}
+			err := p.verifyMarker(context.Background(), volume, "default-claim-pv-a")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyMarker() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metadataVersion identifies the format of export-metadata files.
+const metadataVersion = "nfs-client.nchc.ai/v1"
+
+// clusterMetadata is what export-metadata writes and import-metadata reads:
+// the volumes of a provisioner and the archives on its export, with paths
+// relative to the export, so that they can be recreated for a replica of it.
+type clusterMetadata struct {
+	Version     string            `json:"version"`
+	Provisioner string            `json:"provisioner"`
+	Server      string            `json:"server"`
+	Path        string            `json:"path"`
+	Exported    time.Time         `json:"exported"`
+	Volumes     []volumeMetadata  `json:"volumes"`
+	Archives    []archiveMetadata `json:"archives"`
+}
+
+// volumeMetadata describes a PV. Its annotations keep the clone lineage
+// (nchc.ai/clone-mode, src-directory, src-pvc, data-source) and the other
+// settings recorded by the provisioner, like sealing and deletion protection.
+type volumeMetadata struct {
+	Name           string                           `json:"name"`
+	Directory      string                           `json:"directory"`
+	StorageClass   string                           `json:"storageClass,omitempty"`
+	Capacity       string                           `json:"capacity,omitempty"`
+	AccessModes    []v1.PersistentVolumeAccessMode  `json:"accessModes,omitempty"`
+	ReclaimPolicy  v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	MountOptions   []string                         `json:"mountOptions,omitempty"`
+	ReadOnly       bool                             `json:"readOnly,omitempty"`
+	ClaimNamespace string                           `json:"claimNamespace,omitempty"`
+	ClaimName      string                           `json:"claimName,omitempty"`
+	Labels         map[string]string                `json:"labels,omitempty"`
+	Annotations    map[string]string                `json:"annotations,omitempty"`
+	Phase          v1.PersistentVolumePhase         `json:"phase,omitempty"`
+}
+
+// archiveMetadata describes an archived volume directory and its archive index entry.
+type archiveMetadata struct {
+	Directory    string     `json:"directory"`
+	StorageClass string     `json:"storageClass,omitempty"`
+	Archived     *time.Time `json:"archived,omitempty"`
+	Accessed     *time.Time `json:"accessed,omitempty"`
+	// Volume and Claim are the former owners, from the marker file
+	Volume string `json:"volume,omitempty"`
+	Claim  string `json:"claim,omitempty"`
+}
+
+// volumeToMetadata describes pv, a volume on the export path.
+func volumeToMetadata(pv *v1.PersistentVolume, path string) volumeMetadata {
+	m := volumeMetadata{
+		Name:          pv.Name,
+		Directory:     volumeDirectoryOn(path, pv),
+		StorageClass:  pv.Spec.StorageClassName,
+		AccessModes:   pv.Spec.AccessModes,
+		ReclaimPolicy: pv.Spec.PersistentVolumeReclaimPolicy,
+		MountOptions:  pv.Spec.MountOptions,
+		ReadOnly:      pv.Spec.NFS.ReadOnly,
+		Labels:        pv.Labels,
+		Annotations:   pv.Annotations,
+		Phase:         pv.Status.Phase,
+	}
+	if q, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		m.Capacity = q.String()
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		m.ClaimNamespace, m.ClaimName = ref.Namespace, ref.Name
+	}
+	return m
+}
+
+// metadataToVolume returns the PV described by m on the export server:path,
+// owned by provisioner. It is pre-bound to its former claim, without the UID,
+// so that the claim binds to it again once it is recreated.
+func metadataToVolume(m volumeMetadata, server, path, provisioner string) (*v1.PersistentVolume, error) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        m.Name,
+			Labels:      m.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName:              m.StorageClass,
+			AccessModes:                   m.AccessModes,
+			PersistentVolumeReclaimPolicy: m.ReclaimPolicy,
+			MountOptions:                  m.MountOptions,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server:   server,
+					Path:     filepath.Join(path, m.Directory),
+					ReadOnly: m.ReadOnly,
+				},
+			},
+		},
+	}
+	for key, value := range m.Annotations {
+		// bind-completed and the like belong to the former binding
+		if !strings.HasPrefix(key, "pv.kubernetes.io/") || key == annProvisionedBy {
+			pv.Annotations[key] = value
+		}
+	}
+	if provisioner != "" {
+		pv.Annotations[annProvisionedBy] = provisioner
+	}
+	if m.Capacity != "" {
+		q, err := resource.ParseQuantity(m.Capacity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capacity %q of volume %s: %v", m.Capacity, m.Name, err)
+		}
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: q}
+	}
+	if m.ClaimName != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: m.ClaimNamespace, Name: m.ClaimName}
+	}
+	return pv, nil
+}
+
+// runExportMetadata writes the volumes of the provisioner on its export and the
+// archives on the export as JSON, for import-metadata in a recovery cluster.
+func runExportMetadata(args []string) error {
+	fs := flag.NewFlagSet("export-metadata", flag.ContinueOnError)
+	root := fs.String("root", mountPath, "directory the export is mounted at")
+	output := fs.String("o", "-", "file to write to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	provisioner, server, path := lookupSetting("provisioner-name"), lookupSetting("nfs-server"), lookupSetting("nfs-path")
+	metadata := clusterMetadata{
+		Version:     metadataVersion,
+		Provisioner: provisioner,
+		Server:      server,
+		Path:        path,
+		Exported:    time.Now().UTC(),
+		Volumes:     []volumeMetadata{},
+		Archives:    []archiveMetadata{},
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.NFS == nil || (provisioner != "" && pv.Annotations[annProvisionedBy] != provisioner) {
+			continue
+		}
+		// volumes of storage tenants with a dedicated export are not on this export
+		if !onExport(pv, server, path) {
+			fmt.Fprintf(os.Stderr, "skipping volume %s on %s:%s, which is not on the export\n", pv.Name, pv.Spec.NFS.Server, pv.Spec.NFS.Path)
+			continue
+		}
+		metadata.Volumes = append(metadata.Volumes, volumeToMetadata(pv, path))
+	}
+
+	archives, err := listArchives(*root)
+	if err != nil {
+		return err
+	}
+	for _, name := range archives {
+		a := archiveMetadata{Directory: name}
+		if r, ok := readArchiveRecord(*root, name); ok {
+			a.StorageClass = r.class
+			if !r.archived.IsZero() {
+				a.Archived = &r.archived
+			}
+			if !r.accessed.IsZero() {
+				a.Accessed = &r.accessed
+			}
+		}
+		if m, err := readMarker(filepath.Join(*root, name)); err == nil {
+			a.Volume = m.Volume
+			if m.ClaimName != "" {
+				a.Claim = m.ClaimNamespace + "/" + m.ClaimName
+			}
+		}
+		metadata.Archives = append(metadata.Archives, a)
+	}
+
+	if *output == "-" {
+		return writeJSON(os.Stdout, metadata)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(f, metadata); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImportMetadata recreates the PVs of an export-metadata file for the
+// export of this provisioner, a replica of the exported one, and restores the
+// archive index entries of the archives found on it.
+func runImportMetadata(args []string) error {
+	fs := flag.NewFlagSet("import-metadata", flag.ContinueOnError)
+	root := fs.String("root", mountPath, "directory the export is mounted at")
+	input := fs.String("f", "-", "file to read, - for stdin")
+	server := fs.String("server", lookupSetting("nfs-server"), "NFS server of the recreated volumes")
+	path := fs.String("path", lookupSetting("nfs-path"), "export path of the recreated volumes")
+	dryRun := fs.Bool("dry-run", false, "list what would be recreated without creating anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *server == "" || *path == "" {
+		return fmt.Errorf("-server and -path are required outside of the provisioner pod")
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var metadata clusterMetadata
+	if err := json.NewDecoder(in).Decode(&metadata); err != nil {
+		return fmt.Errorf("invalid metadata: %v", err)
+	}
+	if metadata.Version != metadataVersion {
+		return fmt.Errorf("unsupported metadata version %q, expected %q", metadata.Version, metadataVersion)
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	provisioner := lookupSetting("provisioner-name")
+	ctx := context.Background()
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tPV\tPVC\tDIRECTORY")
+	for _, m := range metadata.Volumes {
+		action := "create"
+		pv, err := metadataToVolume(m, *server, *path, provisioner)
+		switch {
+		case err != nil:
+			action = "error: " + err.Error()
+			failed++
+		case !exists(filepath.Join(*root, m.Directory)):
+			action = "missing, skipped"
+			failed++
+		case *dryRun:
+			action = "would create"
+		default:
+			if _, err := client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+				action = "exists, skipped"
+			} else if err != nil {
+				action = "error: " + err.Error()
+				failed++
+			}
+		}
+		pvc := ""
+		if m.ClaimName != "" {
+			pvc = m.ClaimNamespace + "/" + m.ClaimName
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", action, m.Name, orDash(pvc), m.Directory)
+	}
+	for _, a := range metadata.Archives {
+		action := "restore index"
+		if _, ok := readArchiveRecord(*root, a.Directory); ok {
+			action = "indexed, skipped"
+		} else if !exists(filepath.Join(*root, a.Directory)) {
+			action = "missing, skipped"
+		} else if *dryRun {
+			action = "would restore index"
+		} else {
+			r := archiveRecord{class: a.StorageClass}
+			if a.Archived != nil {
+				r.archived = *a.Archived
+			}
+			if a.Accessed != nil {
+				r.accessed = *a.Accessed
+			}
+			if err := writeArchiveRecord(*root, a.Directory, r); err != nil {
+				action = "error: " + err.Error()
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", action, orDash(a.Volume), orDash(a.Claim), a.Directory)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d volumes or archives could not be imported", failed)
+	}
+	return nil
+}
+
+// onExport reports whether pv is on the export server:path, and not on the
+// dedicated export of a storage tenant.
+func onExport(pv *v1.PersistentVolume, server, path string) bool {
+	if server != "" && pv.Spec.NFS.Server != server {
+		return false
+	}
+	if path == "" {
+		return true
+	}
+	rel, err := filepath.Rel(filepath.Clean(path), filepath.Clean(pv.Spec.NFS.Path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func exists(path string) bool {
+	_, err := dataFS.Lstat(path)
+	return err == nil
+}
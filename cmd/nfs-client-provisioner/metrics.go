@@ -0,0 +1,206 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The metrics are served by the provision controller on -metrics-port.
+var (
+	volumeHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_healthy",
+		Help:      "Whether the directory of a volume exists, is readable and, for linked volumes, resolves.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_used_bytes",
+		Help:      "Disk usage of the volumes of storage classes with a softQuota or hardQuota.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	volumeUsedInodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_used_inodes",
+		Help:      "Number of files and directories of the volumes of storage classes with a softQuota, hardQuota or inode limit.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	volumeLastModified = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_last_modified_timestamp_seconds",
+		Help:      "Latest modification time of the files of a volume, measured every -access-scan-interval.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	volumeLastAccessed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_last_accessed_timestamp_seconds",
+		Help:      "Latest access time of the files of a volume, measured every -access-scan-interval.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	volumeOverRequestBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "volume_over_request_bytes",
+		Help:      "Usage beyond the request of the PVC of the volumes using more than requested, measured every -claim-usage-interval.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	mirrorLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "mirror_lag_seconds",
+		Help:      "Age of the data on the -mirror-export of the volumes with the mirror annotation.",
+	}, []string{"volume", "namespace", "claim", "storage_class"})
+	warningsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "warnings_total",
+		Help:      "Number of failures reported as Warning events, including the ones left out by sampling.",
+	}, []string{"reason"})
+	canarySuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "canary_success",
+		Help:      "Whether the last canary volume was provisioned, written, read back and deleted.",
+	})
+	canaryDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "canary_duration_seconds",
+		Help:      "Duration of the last canary volume run.",
+	})
+	probeSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "probe_success",
+		Help:      "Whether the last end-to-end probe PVC was bound, written and deleted within -probe-timeout.",
+	})
+	probeDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "probe_duration_seconds",
+		Help:      "Duration of the phases of the last end-to-end probe: bind, verify, delete and total.",
+	}, []string{"phase"})
+	probesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "probes_total",
+		Help:      "Number of end-to-end probes, by result.",
+	}, []string{"result"})
+	failuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "failures_total",
+		Help:      "Number of failed provisionings, clones, syncs and deletions, by what failed and the class of the failure.",
+	}, []string{"operation", "category", "class", "storage_class", "namespace"})
+	faultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "faults_injected_total",
+		Help:      "Number of file system errors injected by -chaos and -fault-injection, by operation and error.",
+	}, []string{"operation", "fault"})
+	eventsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "events_suppressed_total",
+		Help:      "Number of events left out by the event rate limiting, and posted later in aggregate.",
+	}, []string{"reason"})
+	deletesInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "deletes_in_progress",
+		Help:      "Number of volumes being deleted.",
+	})
+	deletesQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "delete_queue_depth",
+		Help:      "Number of deletions waiting for one of -max-concurrent-deletes slots.",
+	})
+	classProblems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "storage_class_problems",
+		Help:      "Number of invalid or unknown parameters of the storage classes of the provisioner.",
+	}, []string{"storage_class"})
+	deprecatedUsage = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "deprecated_usage_total",
+		Help:      "Number of volumes provisioned with deprecated claim annotations or storage class parameters.",
+	}, []string{"kind", "name", "namespace"})
+	annotationSchemaUsage = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nfs_client",
+		Name:      "annotation_schema_total",
+		Help:      "Number of volumes provisioned for claims with v1 or v2 annotations.",
+	}, []string{"schema"})
+	directoryEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "directory_entries",
+		Help:      "Number of volumes and archives in the directories of the export new volumes are created in, counted against -max-volumes-per-export.",
+	}, []string{"directory"})
+	exportFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "export_free_bytes",
+		Help:      "Bytes available on the export.",
+	})
+	exportSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "export_size_bytes",
+		Help:      "Total size of the export.",
+	})
+	archivedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "archived_volumes",
+		Help:      "Number of archived-* directories on the export.",
+	}, []string{"storage_class"})
+	archivedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nfs_client",
+		Name:      "archived_bytes",
+		Help:      "Total apparent size of the archived-* directories on the export.",
+	}, []string{"storage_class"})
+)
+
+func init() {
+	prometheus.MustRegister(volumeHealthy, volumeUsedBytes, volumeUsedInodes, volumeLastModified, volumeLastAccessed, volumeOverRequestBytes, mirrorLag, warningsTotal, canarySuccess, canaryDuration, probeSuccess, probeDuration, probesTotal, failuresTotal, faultsInjected, eventsSuppressed, deletesInProgress, deletesQueued, classProblems, deprecatedUsage, annotationSchemaUsage, directoryEntries, exportFreeBytes, exportSizeBytes, archivedVolumes, archivedBytes)
+}
+
+// countFailure counts a failure of operation on a volume of class, claimed in namespace.
+func countFailure(operation string, err error, class, namespace string) {
+	failuresTotal.WithLabelValues(operation, categorize(err), string(classify(err)), class, namespace).Inc()
+}
+
+// countVolumeFailure counts a failure of operation on pv.
+func countVolumeFailure(operation string, err error, pv *v1.PersistentVolume) {
+	var namespace string
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		namespace = ref.Namespace
+	}
+	countFailure(operation, err, pv.Spec.StorageClassName, namespace)
+}
+
+// updateArchiveMetrics sets the archive gauges from the archives below root.
+// Archives created before their storage class was recorded are counted with an
+// empty storage_class label.
+func updateArchiveMetrics(root string) {
+	archives, err := listArchives(root)
+	if err != nil {
+		glog.Warningf("read %s for archive metrics fail: %s", root, err.Error())
+		return
+	}
+	counts, sizes := map[string]int{}, map[string]int64{}
+	for _, name := range archives {
+		bytes, _, err := dirUsage(filepath.Join(root, name))
+		if err != nil {
+			glog.Warningf("usage of archive %s fail: %s", name, err.Error())
+			continue
+		}
+		class := archiveClass(root, name)
+		counts[class]++
+		sizes[class] += bytes
+	}
+
+	archivedVolumes.Reset()
+	archivedBytes.Reset()
+	for class, n := range counts {
+		archivedVolumes.WithLabelValues(class).Set(float64(n))
+		archivedBytes.WithLabelValues(class).Set(float64(sizes[class]))
+	}
+}
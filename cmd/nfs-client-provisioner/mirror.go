@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// annMirror on a PVC replicates its volume to the -mirror-export
+	annMirror = "nchc.ai/mirror"
+	// annLastMirrored on the PV records when the last successful replication started,
+	// the mirror holds the data of at least that time
+	annLastMirrored = "nchc.ai/last-mirrored"
+
+	mirrorCheckInterval = time.Minute
+	// rsyncPartialTransfer is the exit code of rsync when source files vanished
+	// during the transfer, which is expected on volumes in use
+	rsyncPartialTransfer = 24
+)
+
+// mirrorer replicates the volumes whose PVC carries the mirror annotation to a
+// standby export every interval, so that a warm copy is kept on another NFS
+// server. The mirror of a volume is in the same directory as the volume.
+type mirrorer struct {
+	p        *nfsProvisioner
+	export   sourceExport
+	interval time.Duration
+}
+
+func newMirrorer(p *nfsProvisioner, export sourceExport, interval time.Duration) *mirrorer {
+	return &mirrorer{p: p, export: export, interval: interval}
+}
+
+func (m *mirrorer) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, m.mirrorDue, mirrorCheckInterval)
+}
+
+func (m *mirrorer) mirrorDue(ctx context.Context) {
+	pvs, err := m.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for mirroring fail: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	mirrorLag.Reset()
+	for _, pv := range pvs {
+		ref := pv.Spec.ClaimRef
+		if !m.p.ownsVolume(pv) || ref == nil {
+			continue
+		}
+		pvc, err := m.p.getClaim(ctx, ref.Namespace, ref.Name)
+		if err != nil {
+			continue
+		}
+		annotations, _ := v1Annotations(pvc)
+		if mirror, _ := strconv.ParseBool(annotations[annMirror]); !mirror {
+			continue
+		}
+
+		last, err := time.Parse(time.RFC3339, pv.Annotations[annLastMirrored])
+		if err != nil || !now.Before(last.Add(m.interval)) {
+			if started, err := m.mirrorVolume(ctx, pv); err != nil {
+				m.p.warnVolume(pv, reasonMirrorFailed, "mirror volume %s to %s:%s fail: %s", pv.Name, m.export.server, m.export.path, err.Error())
+			} else {
+				last = started
+			}
+		}
+		// never mirrored volumes lag since they were created
+		if last.IsZero() {
+			last = pv.CreationTimestamp.Time
+		}
+		mirrorLag.WithLabelValues(pv.Name, ref.Namespace, ref.Name, pv.Spec.StorageClassName).Set(now.Sub(last).Seconds())
+	}
+}
+
+// mirrorVolume replicates pv to the mirror export and returns when the
+// replication started.
+func (m *mirrorer) mirrorVolume(ctx context.Context, pv *v1.PersistentVolume) (time.Time, error) {
+	started := time.Now()
+	// linked volumes are mirrored with the data of their source
+	dir, err := m.p.resolveDirectory(m.p.volumeDirectory(pv))
+	if err != nil {
+		return started, err
+	}
+	if filepath.IsAbs(dir) || isStreamSource(dir) {
+		return started, fmt.Errorf("the source %s of the linked volume is not on the export", dir)
+	}
+	src, dest := filepath.Join(mountPath, dir), filepath.Join(m.export.mount, m.p.volumeDirectory(pv))
+
+	release, err := m.p.acquireCopySlot(ctx)
+	if err != nil {
+		return started, err
+	}
+	defer release()
+
+	op := m.p.operations.start(operationMirror, pv.Name, m.p.volumeDirectory(pv))
+	op.setTarget(m.export.server + ":" + filepath.Join(m.export.path, m.p.volumeDirectory(pv)))
+	glog.V(4).Infof("mirroring %s to %s", src, dest)
+	err = rsyncDirectory(ctx, src, dest)
+	op.done(err)
+	if err != nil {
+		return started, err
+	}
+
+	// needs the patch verb on persistentvolumes in the ClusterRole
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annLastMirrored: started.UTC().Format(time.RFC3339)},
+		},
+	})
+	if _, err := m.p.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		glog.Warningf("update %s of pv %s fail: %s", annLastMirrored, pv.Name, err.Error())
+	}
+	return started, nil
+}
+
+// rsyncDirectory makes dest an exact copy of src, removing what src no longer has.
+func rsyncDirectory(ctx context.Context, src, dest string) error {
+	if err := dataFS.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "rsync", "--archive", "--hard-links", "--delete", "--numeric-ids", "--", src+"/", dest+"/")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rsyncPartialTransfer {
+		glog.V(4).Infof("files of %s vanished while mirroring: %s", src, strings.TrimSpace(string(out)))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("rsync of %s fail: %v: %s", src, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeMirror removes the mirror of the deleted volume, if there is one.
+func (p *nfsProvisioner) removeMirror(volume *v1.PersistentVolume) {
+	if p.mirrorExport == nil || volume.Annotations[annLastMirrored] == "" {
+		return
+	}
+	dir := filepath.Join(p.mirrorExport.mount, p.volumeDirectory(volume))
+	glog.V(4).Infof("removing mirror %s of deleted volume %s", dir, volume.Name)
+	if err := removeAll(dir); err != nil {
+		glog.Warningf("remove mirror %s of volume %s fail: %s", dir, volume.Name, err.Error())
+	}
+}
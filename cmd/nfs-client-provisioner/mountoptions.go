@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	storage "k8s.io/api/storage/v1"
+)
+
+// paramDefaultMountOptions false leaves the -mount-options out of the volumes of the class
+const paramDefaultMountOptions = "defaultMountOptions"
+
+// exclusiveMountOptions are the options which override each other, by option.
+// Options of the form name and noname, like atime and noatime, override each
+// other too.
+var exclusiveMountOptions = map[string]string{
+	"hard":  "soft",
+	"soft":  "hard",
+	"ro":    "rw",
+	"rw":    "ro",
+	"sync":  "async",
+	"async": "sync",
+}
+
+// mountOptionAliases are the other names of options, by the name mountOptionKey uses.
+var mountOptionAliases = map[string]string{
+	"nfsvers": "vers",
+}
+
+// parseMountOptions splits the comma separated options s.
+func parseMountOptions(s string) []string {
+	var options []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// mountOptionKey returns what option o sets: its name without the value, and
+// without the "no" of a negated option.
+func mountOptionKey(o string) string {
+	name, _, _ := strings.Cut(o, "=")
+	if alias, ok := mountOptionAliases[name]; ok {
+		return alias
+	}
+	if exclusive, ok := exclusiveMountOptions[name]; ok && exclusive < name {
+		return exclusive
+	}
+	return strings.TrimPrefix(name, "no")
+}
+
+// mountOptions returns the mount options of the volumes of class: the options
+// of the class, preceded by the -mount-options the class does not override.
+func (p *nfsProvisioner) mountOptions(class *storage.StorageClass) []string {
+	if use, err := strconv.ParseBool(class.Parameters[paramDefaultMountOptions]); err == nil && !use {
+		return class.MountOptions
+	}
+	overridden := map[string]bool{}
+	for _, o := range class.MountOptions {
+		overridden[mountOptionKey(o)] = true
+	}
+	var options []string
+	for _, o := range p.defaultMountOptions {
+		if !overridden[mountOptionKey(o)] {
+			options = append(options, o)
+		}
+	}
+	return append(options, class.MountOptions...)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// annPopulateOCI on a PVC unpacks the filesystem of an OCI image into the new volume
+	annPopulateOCI = "nchc.ai/populate-oci"
+	// annPopulateOCISecret names the Secret, in the namespace of the PVC, with the registry credentials
+	annPopulateOCISecret = "nchc.ai/populate-oci-secret"
+)
+
+// populateFromOCI pulls the image named by image and extracts its flattened
+// filesystem layers into dest, the name of a new volume directory of class
+// below mountPath.
+func (p *nfsProvisioner) populateFromOCI(ctx context.Context, class *storage.StorageClass, pvc *v1.PersistentVolumeClaim, image, dest string) error {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return misconfigured("invalid %s %q: %v", annPopulateOCI, image, err)
+	}
+
+	auth := authn.Anonymous
+	if secretName, ok := pvc.Annotations[annPopulateOCISecret]; ok {
+		secret, err := p.client.CoreV1().Secrets(pvc.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if auth, err = registryAuth(class, secret, ref.Context().RegistryStr()); err != nil {
+			return err
+		}
+	}
+
+	glog.V(4).Infof("pulling %s", ref.Name())
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuth(auth))
+	if err != nil {
+		return fmt.Errorf("pull %s fail: %w", ref.Name(), err)
+	}
+	// mutate.Extract applies the whiteouts of upper layers
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	return extractTar(rc, filepath.Join(mountPath, dest))
+}
+
+// registryAuth returns the credentials of secret for registry. The provisioner
+// reads the Secret on behalf of the claim, so only image pull Secrets are used,
+// and only for the registries they hold credentials of, unless dataSourceSecrets
+// of class lists the Secret: then its username and password are used as well.
+func registryAuth(class *storage.StorageClass, secret *v1.Secret, registry string) (authn.Authenticator, error) {
+	if secret.Type == v1.SecretTypeDockerConfigJson {
+		var config struct {
+			Auths map[string]authn.AuthConfig `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &config); err != nil {
+			return nil, misconfigured("invalid %s of secret %s/%s: %v", v1.DockerConfigJsonKey, secret.Namespace, secret.Name, err)
+		}
+		for host, auth := range config.Auths {
+			if registryHost(host) == registryHost(registry) {
+				return authn.FromConfig(auth), nil
+			}
+		}
+		return nil, misconfigured("secret %s/%s has no credentials of registry %s", secret.Namespace, secret.Name, registry)
+	}
+	if !secretAllowed(class, secret.Name) {
+		return nil, misconfigured("secret %s is neither of type %s nor listed in %s of storage class %s", secret.Name, v1.SecretTypeDockerConfigJson, paramDataSourceSecrets, class.Name)
+	}
+	return &authn.Basic{Username: string(secret.Data["username"]), Password: string(secret.Data["password"])}, nil
+}
+
+// registryHost returns the host of a registry in an image pull Secret, which
+// may be a URL like https://index.docker.io/v1/.
+func registryHost(registry string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		return name.DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of the operations reported on /debug/operations.
+const (
+	operationCopy    = "copy"
+	operationSync    = "sync"
+	operationDelete  = "delete"
+	operationArchive = "archive"
+	operationMirror  = "mirror"
+)
+
+// Types of the operation events, as in the watches of the Kubernetes API.
+const (
+	operationAdded    = "ADDED"
+	operationModified = "MODIFIED"
+	operationDeleted  = "DELETED"
+)
+
+// operationUpdateInterval limits how often the progress of an operation is sent to watchers.
+const operationUpdateInterval = time.Second
+
+// operation is a copy, sync, delete, archive or mirroring in progress.
+type operation struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Volume string `json:"volume,omitempty"`
+	// Directory is below the export, Source is the directory or URL copied from
+	// and Target the directory archived to
+	Directory string    `json:"directory"`
+	Source    string    `json:"source,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Started   time.Time `json:"started"`
+	// Files and Bytes are copied so far, of TotalBytes if the size of the source
+	// is known. Streams count the compressed bytes received.
+	Files      int64  `json:"files,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	TotalBytes int64  `json:"totalBytes,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// operationEvent is a change of an operation, sent to watchers.
+type operationEvent struct {
+	Type      string    `json:"type"`
+	Operation operation `json:"operation"`
+}
+
+// operationTracker keeps the operations in progress and sends their changes to
+// the watchers of /debug/operations. A nil tracker tracks nothing.
+type operationTracker struct {
+	mu       sync.Mutex
+	next     int
+	ops      map[string]*trackedOperation
+	watchers map[chan operationEvent]struct{}
+}
+
+// trackedOperation is the handle of an operation in progress, nil if not tracked.
+type trackedOperation struct {
+	t         *operationTracker
+	op        operation
+	published time.Time
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{ops: map[string]*trackedOperation{}, watchers: map[chan operationEvent]struct{}{}}
+}
+
+// start tracks a new operation of kind on the directory of volume.
+func (t *operationTracker) start(kind, volume, directory string) *trackedOperation {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	o := &trackedOperation{t: t, op: operation{
+		ID:        kind + "-" + strconv.Itoa(t.next),
+		Kind:      kind,
+		Volume:    volume,
+		Directory: directory,
+		Started:   time.Now().UTC(),
+	}}
+	t.ops[o.op.ID] = o
+	t.publish(o, operationAdded)
+	return o
+}
+
+// publish sends the state of o to the watchers, t.mu must be held. Watchers
+// too slow to keep up are dropped, their stream ends and they reconnect.
+func (t *operationTracker) publish(o *trackedOperation, eventType string) {
+	o.published = time.Now()
+	e := operationEvent{Type: eventType, Operation: o.op}
+	for ch := range t.watchers {
+		select {
+		case ch <- e:
+		default:
+			delete(t.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// update changes o with f and publishes it if the last update was long enough ago.
+func (o *trackedOperation) update(f func(op *operation), force bool) {
+	if o == nil {
+		return
+	}
+	o.t.mu.Lock()
+	defer o.t.mu.Unlock()
+	f(&o.op)
+	if force || time.Since(o.published) >= operationUpdateInterval {
+		o.t.publish(o, operationModified)
+	}
+}
+
+// setSource records where o copies from and, if known, the size of the source.
+func (o *trackedOperation) setSource(source string, totalBytes int64) {
+	o.update(func(op *operation) { op.Source, op.TotalBytes = source, totalBytes }, true)
+}
+
+// setTarget records where o archives to.
+func (o *trackedOperation) setTarget(target string) {
+	o.update(func(op *operation) { op.Target = target }, true)
+}
+
+// progress adds files and bytes to what o copied so far.
+func (o *trackedOperation) progress(files, bytes int64) {
+	o.update(func(op *operation) { op.Files += files; op.Bytes += bytes }, false)
+}
+
+// restart resets the progress of o for another attempt.
+func (o *trackedOperation) restart() {
+	o.update(func(op *operation) { op.Files, op.Bytes = 0, 0 }, true)
+}
+
+// reader counts what is read from r as progress of o.
+func (o *trackedOperation) reader(r io.Reader) io.Reader {
+	if o == nil {
+		return r
+	}
+	return &progressReader{r: r, o: o}
+}
+
+// done stops tracking o, which failed with err if not nil.
+func (o *trackedOperation) done(err error) {
+	if o == nil {
+		return
+	}
+	o.t.mu.Lock()
+	defer o.t.mu.Unlock()
+	if err != nil {
+		o.op.Error = err.Error()
+	}
+	delete(o.t.ops, o.op.ID)
+	o.t.publish(o, operationDeleted)
+}
+
+type progressReader struct {
+	r io.Reader
+	o *trackedOperation
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.o.progress(0, int64(n))
+	return n, err
+}
+
+// list returns the operations in progress, oldest first.
+func (t *operationTracker) list() []operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+func (t *operationTracker) snapshot() []operation {
+	ops := make([]operation, 0, len(t.ops))
+	for _, o := range t.ops {
+		ops = append(ops, o.op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].Started.Equal(ops[j].Started) {
+			return ops[i].Started.Before(ops[j].Started)
+		}
+		return ops[i].ID < ops[j].ID
+	})
+	return ops
+}
+
+// watch returns the operations in progress and a channel receiving their
+// changes from then on, until stop is called or the watcher falls behind.
+func (t *operationTracker) watch() ([]operation, <-chan operationEvent, func()) {
+	ch := make(chan operationEvent, 100)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.watchers[ch] = struct{}{}
+	stop := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.watchers[ch]; ok {
+			delete(t.watchers, ch)
+			close(ch)
+		}
+	}
+	return t.snapshot(), ch, stop
+}
+
+// ServeHTTP serves the operations in progress as a JSON list, or with
+// ?watch=true as a stream of newline delimited operation events: ADDED for
+// every operation in progress, then the changes as they happen.
+func (t *operationTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if watch, _ := strconv.ParseBool(r.URL.Query().Get("watch")); !watch {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.list())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ops, events, stop := t.watch()
+	defer stop()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, op := range ops {
+		if err := enc.Encode(operationEvent{Type: operationAdded, Operation: op}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	paramMaxVolumesPerNamespace = "maxVolumesPerNamespace"
+	// paramAllowReclaimPolicyOverride lets PVCs of the class set annReclaimPolicy
+	paramAllowReclaimPolicyOverride = "allowReclaimPolicyOverride"
+	// annReclaimPolicy on a PVC requests the Retain reclaim policy for its PV,
+	// it is recorded on the PV when the policy differs from the class
+	annReclaimPolicy = "nchc.ai/reclaim-policy"
+	// paramAllowedAccessModes is a comma separated list of the access modes PVCs
+	// of the class may request, e.g. "ReadWriteMany,ReadOnlyMany"
+	paramAllowedAccessModes = "allowedAccessModes"
+	// paramForceAccessModes lists access modes added to the PVs of the class
+	paramForceAccessModes = "forceAccessModes"
+	// annProtectData on a PVC or PV makes Delete keep the directory until it is removed
+	annProtectData = "nchc.ai/protect-data"
+)
+
+// checkVolumeCount verifies that the namespace of pvc has fewer volumes of class
+// than the maxVolumesPerNamespace parameter of the class, or the provisioner default.
+func (p *nfsProvisioner) checkVolumeCount(ctx context.Context, class *storage.StorageClass, pvc *v1.PersistentVolumeClaim) error {
+	limit := p.maxVolumesPerNamespace
+	if v, ok := class.Parameters[paramMaxVolumesPerNamespace]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return misconfigured("invalid %s %q", paramMaxVolumesPerNamespace, v)
+		}
+		limit = n
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	pvs, err := p.listVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, pv := range pvs {
+		if pv.Spec.StorageClassName == class.Name && pv.Spec.ClaimRef != nil &&
+			pv.Spec.ClaimRef.Namespace == pvc.Namespace && p.ownsVolume(pv) {
+			count++
+		}
+	}
+	if count >= limit {
+		return fmt.Errorf("namespace %s already has %d volumes of storage class %s, the maximum is %d", pvc.Namespace, count, class.Name, limit)
+	}
+	return nil
+}
+
+// checkExportCapacity verifies that dir, the directory below mountPath a new
+// volume is created in, has fewer entries than the max-volumes-per-export limit.
+// Volumes below namespace roots, zones and export routes are counted per
+// directory, the flat directory is what slows down the NFS server. Hidden
+// directories, like .snapshots, do not count.
+func (p *nfsProvisioner) checkExportCapacity(dir string) error {
+	if p.maxVolumesPerExport == 0 {
+		return nil
+	}
+	entries, err := dataFS.ReadDir(filepath.Join(mountPath, dir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	count := 0
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			count++
+		}
+	}
+	directoryEntries.WithLabelValues(dir).Set(float64(count))
+	if count >= p.maxVolumesPerExport {
+		where := filepath.Join(p.path, dir)
+		glog.Warningf("directory %s:%s holds %d directories, the maximum is %d", p.server, where, count, p.maxVolumesPerExport)
+		return fmt.Errorf("directory %s:%s already holds %d directories, the maximum is %d", p.server, where, count, p.maxVolumesPerExport)
+	}
+	return nil
+}
+
+// isProtected reports whether the directory of pv must not be removed or archived,
+// because pv or its claim, if it still exists, carries annProtectData.
+func (p *nfsProvisioner) isProtected(ctx context.Context, pv *v1.PersistentVolume) bool {
+	annotations, _ := v1Annotations(pv)
+	if protected, _ := strconv.ParseBool(annotations[annProtectData]); protected {
+		return true
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		claim, err := p.getClaim(ctx, ref.Namespace, ref.Name)
+		if err == nil && claim.UID == ref.UID {
+			annotations, _ = v1Annotations(claim)
+			protected, _ := strconv.ParseBool(annotations[annProtectData])
+			return protected
+		}
+	}
+	return false
+}
+
+// listVolumes returns all volumes, from the cache if there is one.
+func (p *nfsProvisioner) listVolumes(ctx context.Context) ([]*v1.PersistentVolume, error) {
+	if p.volumeLister != nil {
+		return p.volumeLister.List(labels.Everything())
+	}
+	list, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pvs := make([]*v1.PersistentVolume, 0, len(list.Items))
+	for i := range list.Items {
+		pvs = append(pvs, &list.Items[i])
+	}
+	return pvs, nil
+}
+
+// shortAccessModes are the abbreviations kubectl prints for access modes.
+var shortAccessModes = map[string]v1.PersistentVolumeAccessMode{
+	"RWO":  v1.ReadWriteOnce,
+	"ROX":  v1.ReadOnlyMany,
+	"RWX":  v1.ReadWriteMany,
+	"RWOP": v1.ReadWriteOncePod,
+}
+
+// accessModes returns the access modes of the PV for pvc: the requested ones,
+// which must be in the allowedAccessModes parameter of class, and those added
+// by its forceAccessModes parameter. A PV only binds to its claim if it has all
+// the requested access modes, so forced modes cannot replace them.
+func accessModes(class *storage.StorageClass, pvc *v1.PersistentVolumeClaim) ([]v1.PersistentVolumeAccessMode, error) {
+	modes := append([]v1.PersistentVolumeAccessMode(nil), pvc.Spec.AccessModes...)
+	if v, ok := class.Parameters[paramAllowedAccessModes]; ok {
+		allowed, err := parseAccessModes(paramAllowedAccessModes, v)
+		if err != nil {
+			return nil, err
+		}
+		for _, mode := range modes {
+			if !containsAccessMode(allowed, mode) {
+				return nil, misconfigured("access mode %s is not allowed by storage class %s, use one of %s", mode, class.Name, v)
+			}
+		}
+	}
+	if v, ok := class.Parameters[paramForceAccessModes]; ok {
+		forced, err := parseAccessModes(paramForceAccessModes, v)
+		if err != nil {
+			return nil, err
+		}
+		for _, mode := range forced {
+			if !containsAccessMode(modes, mode) {
+				modes = append(modes, mode)
+			}
+		}
+	}
+	return modes, nil
+}
+
+func parseAccessModes(param, value string) ([]v1.PersistentVolumeAccessMode, error) {
+	var modes []v1.PersistentVolumeAccessMode
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		mode, ok := shortAccessModes[name]
+		if !ok {
+			mode = v1.PersistentVolumeAccessMode(name)
+		}
+		switch mode {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany, v1.ReadWriteOncePod:
+		default:
+			return nil, misconfigured("invalid %s %q, unknown access mode %q", param, value, name)
+		}
+		if !containsAccessMode(modes, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	return modes, nil
+}
+
+func containsAccessMode(modes []v1.PersistentVolumeAccessMode, mode v1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// reclaimPolicy returns the reclaim policy of the PV for pvc, that of class
+// unless pvc overrides it with annReclaimPolicy.
+func reclaimPolicy(class *storage.StorageClass, pvc *v1.PersistentVolumeClaim) (v1.PersistentVolumeReclaimPolicy, error) {
+	policy := *class.ReclaimPolicy
+	requested, ok := pvc.Annotations[annReclaimPolicy]
+	if !ok || v1.PersistentVolumeReclaimPolicy(requested) == policy {
+		return policy, nil
+	}
+	if allowed, _ := strconv.ParseBool(class.Parameters[paramAllowReclaimPolicyOverride]); !allowed {
+		return "", misconfigured("%s is not allowed by storage class %s", annReclaimPolicy, class.Name)
+	}
+	if v1.PersistentVolumeReclaimPolicy(requested) != v1.PersistentVolumeReclaimRetain {
+		return "", misconfigured("invalid %s %q, only %s can be requested", annReclaimPolicy, requested, v1.PersistentVolumeReclaimRetain)
+	}
+	return v1.PersistentVolumeReclaimRetain, nil
+}
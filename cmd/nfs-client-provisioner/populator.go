@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	controller "sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+const (
+	// annDataSource on a PV records the data source it was populated from, as "Kind/namespace/name" or URL
+	annDataSource = "nchc.ai/data-source"
+	// paramDataSourceSecrets lists the Secrets, comma separated, which claims of the
+	// class, and their backups, may name for the credentials of their data source.
+	// The provisioner reads them on behalf of users who may not be able to.
+	paramDataSourceSecrets = "dataSourceSecrets"
+)
+
+// secretAllowed reports whether class lets its claims name the Secret name of
+// their namespace for the credentials of a data source.
+func secretAllowed(class *storage.StorageClass, name string) bool {
+	for _, allowed := range strings.Split(class.Parameters[paramDataSourceSecrets], ",") {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// populatorFunc fills dest, the name of a new volume directory of class below
+// mountPath, from the object ref in namespace.
+type populatorFunc func(ctx context.Context, p *nfsProvisioner, class *storage.StorageClass, namespace string, ref *v1.TypedObjectReference, dest string) error
+
+// populators handle the dataSourceRef kinds besides PersistentVolumeClaim, which
+// is cloned like nchc.ai/copy-data.
+var populators = map[schema.GroupKind]populatorFunc{
+	{Group: volumeBackupResource.Group, Kind: "VolumeBackup"}: populateFromBackup,
+}
+
+var _ controller.Qualifier = &nfsProvisioner{}
+
+// ShouldProvision leaves claims with a data source no populator handles to other
+// populators.
+func (p *nfsProvisioner) ShouldProvision(ctx context.Context, claim *v1.PersistentVolumeClaim) bool {
+	ref := dataSourceRef(claim)
+	if ref == nil || isClaimRef(ref) {
+		return true
+	}
+	_, ok := populators[refGroupKind(ref)]
+	return ok
+}
+
+// dataSourceRef returns the data source of pvc, if any.
+func dataSourceRef(pvc *v1.PersistentVolumeClaim) *v1.TypedObjectReference {
+	if pvc.Spec.DataSourceRef != nil {
+		return pvc.Spec.DataSourceRef
+	}
+	if ds := pvc.Spec.DataSource; ds != nil {
+		return &v1.TypedObjectReference{APIGroup: ds.APIGroup, Kind: ds.Kind, Name: ds.Name}
+	}
+	return nil
+}
+
+func refGroupKind(ref *v1.TypedObjectReference) schema.GroupKind {
+	gk := schema.GroupKind{Kind: ref.Kind}
+	if ref.APIGroup != nil {
+		gk.Group = *ref.APIGroup
+	}
+	return gk
+}
+
+func isClaimRef(ref *v1.TypedObjectReference) bool {
+	return refGroupKind(ref) == schema.GroupKind{Kind: "PersistentVolumeClaim"}
+}
+
+// refNamespace returns the namespace of ref, which defaults to the namespace of the claim.
+func refNamespace(ref *v1.TypedObjectReference, namespace string) string {
+	if ref.Namespace != nil && *ref.Namespace != "" {
+		return *ref.Namespace
+	}
+	return namespace
+}
+
+// populateFromBackup restores a completed VolumeBackup of the same namespace.
+func populateFromBackup(ctx context.Context, p *nfsProvisioner, class *storage.StorageClass, namespace string, ref *v1.TypedObjectReference, dest string) error {
+	if refNamespace(ref, namespace) != namespace {
+		return misconfigured("VolumeBackup %s must be in namespace %s", ref.Name, namespace)
+	}
+	if p.dynamicClient == nil {
+		return fmt.Errorf("VolumeBackup %s/%s cannot be read without a dynamic client", namespace, ref.Name)
+	}
+	backup, err := p.dynamicClient.Resource(volumeBackupResource).Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	phase, _, _ := unstructured.NestedString(backup.Object, "status", "phase")
+	if phase != backupPhaseCompleted {
+		return transient("VolumeBackup %s/%s is not completed yet", namespace, ref.Name)
+	}
+	path, _, _ := unstructured.NestedString(backup.Object, "status", "path")
+	if path == "" {
+		return fmt.Errorf("VolumeBackup %s/%s has no path", namespace, ref.Name)
+	}
+	if strings.HasPrefix(path, "s3://") {
+		bucket, prefix, err := parseS3URL(path)
+		if err != nil {
+			return err
+		}
+		secret, _, _ := unstructured.NestedString(backup.Object, "spec", "s3Secret")
+		client, err := p.newS3Client(ctx, class, namespace, secret)
+		if err != nil {
+			return err
+		}
+		return downloadFromS3(ctx, client, bucket, prefix, dest)
+	}
+	return p.copyDirectory(ctx, path, dest)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// labelProbe on the PVCs of the end-to-end probe is the replica that created it
+	labelProbe = "nchc.ai/probe"
+	// probePollInterval is how often the probe checks whether its PVC is bound or gone
+	probePollInterval = time.Second
+)
+
+// endToEndProbe goes through the life of a volume like a user would: it creates
+// a PVC of class, waits for it to be bound, writes to the directory of its PV
+// and deletes it again. Unlike the canary it exercises the API server, the
+// controller and the storage class, so its result is the availability of the
+// provisioner as seen by its users.
+type endToEndProbe struct {
+	p         *nfsProvisioner
+	class     string
+	namespace string
+	timeout   time.Duration
+	// pod receives the events, nil to only log them
+	pod *v1.ObjectReference
+}
+
+func newEndToEndProbe(p *nfsProvisioner, class, namespace string, timeout time.Duration) *endToEndProbe {
+	return &endToEndProbe{p: p, class: class, namespace: namespace, timeout: timeout, pod: podReference()}
+}
+
+func (e *endToEndProbe) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, e.check, interval)
+}
+
+func (e *endToEndProbe) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	start := time.Now()
+	err := e.run(ctx)
+	probeDuration.WithLabelValues("total").Set(time.Since(start).Seconds())
+	if err != nil {
+		probeSuccess.Set(0)
+		probesTotal.WithLabelValues("failure").Inc()
+		var obj runtime.Object
+		if e.pod != nil {
+			obj = e.pod
+		}
+		e.p.warn(obj, reasonProbeFailed, "end-to-end probe with storage class %s in namespace %s fail: %s", e.class, e.namespace, err.Error())
+		return
+	}
+	probeSuccess.Set(1)
+	probesTotal.WithLabelValues("success").Inc()
+	glog.V(4).Infof("end-to-end probe with storage class %s succeeded in %s", e.class, time.Since(start))
+}
+
+// name is the name of the PVC of this replica, so that replicas do not delete
+// each other's probes.
+func (e *endToEndProbe) name() string {
+	if e.pod != nil {
+		return "nfs-probe-" + e.pod.Name
+	}
+	host, _ := os.Hostname()
+	return "nfs-probe-" + host
+}
+
+func (e *endToEndProbe) run(ctx context.Context) error {
+	class, err := e.p.client.StorageV1().StorageClasses().Get(ctx, e.class, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if mode := class.VolumeBindingMode; mode != nil && *mode == storage.VolumeBindingWaitForFirstConsumer {
+		return misconfigured("storage class %s binds volumes only for pods, the probe needs %s", e.class, storage.VolumeBindingImmediate)
+	}
+
+	claims := e.p.client.CoreV1().PersistentVolumeClaims(e.namespace)
+	name := e.name()
+	// a PVC left behind by a failed probe or a crash is replaced, failed probes
+	// keep theirs until then for troubleshooting
+	if err := e.deleteClaim(ctx, name); err != nil {
+		return err
+	}
+
+	phase := time.Now()
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{labelProbe: name},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &e.class,
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			Resources: v1.VolumeResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Mi")},
+			},
+		},
+	}
+	if _, err := claims.Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("create PVC %s: %w", name, err)
+	}
+	if err := wait.PollUntilContextCancel(ctx, probePollInterval, true, func(ctx context.Context) (bool, error) {
+		claim, err = claims.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return claim.Status.Phase == v1.ClaimBound, nil
+	}); err != nil {
+		return fmt.Errorf("PVC %s not bound: %w", name, err)
+	}
+	probeDuration.WithLabelValues("bind").Set(time.Since(phase).Seconds())
+
+	phase = time.Now()
+	pv, err := e.p.client.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := e.verify(ctx, pv); err != nil {
+		return err
+	}
+	probeDuration.WithLabelValues("verify").Set(time.Since(phase).Seconds())
+
+	phase = time.Now()
+	if err := e.deleteClaim(ctx, name); err != nil {
+		return err
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		if err := wait.PollUntilContextCancel(ctx, probePollInterval, true, func(ctx context.Context) (bool, error) {
+			_, err := e.p.client.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+			return apierrors.IsNotFound(err), nil
+		}); err != nil {
+			return fmt.Errorf("PV %s not deleted: %w", pv.Name, err)
+		}
+	}
+	probeDuration.WithLabelValues("delete").Set(time.Since(phase).Seconds())
+	return nil
+}
+
+// verify checks that the directory of pv exists and can be written, like a pod
+// mounting it would.
+func (e *endToEndProbe) verify(ctx context.Context, pv *v1.PersistentVolume) error {
+	if pv.Spec.NFS == nil {
+		return fmt.Errorf("PV %s is no NFS volume", pv.Name)
+	}
+	dir := filepath.Join(mountPath, e.p.volumeDirectory(pv))
+	info, err := lstatCtx(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("directory of PV %s: %w", pv.Name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s of PV %s is no directory", dir, pv.Name)
+	}
+	path := filepath.Join(dir, ".probe")
+	if err := runFS(ctx, func() error { return writeSynced(path, []byte(time.Now().UTC().Format(time.RFC3339))) }); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+// deleteClaim deletes the PVC name and waits until it is gone.
+func (e *endToEndProbe) deleteClaim(ctx context.Context, name string) error {
+	claims := e.p.client.CoreV1().PersistentVolumeClaims(e.namespace)
+	if err := claims.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete PVC %s: %w", name, err)
+	}
+	if err := wait.PollUntilContextCancel(ctx, probePollInterval, true, func(ctx context.Context) (bool, error) {
+		_, err := claims.Get(ctx, name, metav1.GetOptions{})
+		return apierrors.IsNotFound(err), nil
+	}); err != nil {
+		return fmt.Errorf("PVC %s not deleted: %w", name, err)
+	}
+	return nil
+}
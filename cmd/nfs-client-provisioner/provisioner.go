@@ -17,15 +17,20 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
@@ -33,9 +38,20 @@ import (
 	otiai10 "github.com/otiai10/copy"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 const (
@@ -44,12 +60,90 @@ const (
 
 type nfsProvisioner struct {
 	client kubernetes.Interface
-	server string
-	path   string
+	// recorder posts events.k8s.io Events, or core Events on clusters without that API
+	recorder events.EventRecorder
+	// sampler thins out repeated Warning events, nil to report all of them
+	sampler *eventSampler
+	// limiter suppresses and aggregates floods of events about an object, nil to post all of them
+	limiter *eventLimiter
+	name    string
+	server  string
+	path    string
+	// the listers cache storage classes, claims and volumes, nil to always query the API server
+	classLister  storagelisters.StorageClassLister
+	claimLister  corelisters.PersistentVolumeClaimLister
+	volumeLister corelisters.PersistentVolumeLister
+	// dynamicClient reads custom data sources, like VolumeBackups
+	dynamicClient dynamic.Interface
+	// maxCloneSize is the default limit in bytes of the data copied by copy-data, 0 for no limit
+	maxCloneSize int64
+	// copySlots limits the number of concurrent clone copies, nil for no limit
+	copySlots chan struct{}
+	// deleteSlots limits the number of concurrent deletions, nil for no limit
+	deleteSlots chan struct{}
+	// copyAttempts is how often a failing clone copy is tried
+	copyAttempts int
+	// strictCloneSource is the default of the strictCloneSource class parameter
+	strictCloneSource bool
+	// maxVolumesPerNamespace is the default of the maxVolumesPerNamespace class parameter, 0 for no limit
+	maxVolumesPerNamespace int
+	// maxVolumesPerExport limits the directories on the export, 0 for no limit
+	maxVolumesPerExport int
+	// resticRepo is the default of the resticRepository class parameter, empty for no backup
+	resticRepo string
+	// markerCheck is what deletions require of the marker file, strict, mismatch or off
+	markerCheck string
+	// rootsConfigMap, in rootsNamespace, maps namespaces to the directory their volumes are created in
+	rootsConfigMap string
+	// routesConfigMap, in rootsNamespace, routes the volumes of claims by their labels
+	routesConfigMap string
+	rootsNamespace  string
+	// sourceExports are the exports of other classes whose volumes can be copied
+	sourceExports []sourceExport
+	// streamPeers serve the volumes of exports which are not mounted, authenticated by streamToken
+	streamPeers []streamPeer
+	streamToken string
+	// tenants is the cache of StorageTenants, nil if the CRD is not installed
+	tenants cache.Store
+	// hooks are called after provisioning and before deleting volumes
+	hooks []volumeHook
+	// provisioningPaused is set while the export is below the critical free space threshold
+	provisioningPaused atomic.Bool
+	// provisioning counts the Provision calls in progress, background scans wait for bursts to end
+	provisioning atomic.Int32
+	// operations tracks the copies, syncs, deletes and archives in progress, nil to not track them
+	operations *operationTracker
+	// recent keeps the latest warnings for the dashboard, nil to not keep them
+	recent *recentWarnings
+	// mirrorExport is the standby export volumes with the mirror annotation are replicated to, if any
+	mirrorExport *sourceExport
+	// zoneExports serve the export to the nodes of their zone, volumes get the export of the zone of their consumer
+	zoneExports []zoneExport
+	// gracePeriod is how long the directories of deleted volumes are kept, unless their class sets deletionGracePeriod
+	gracePeriod time.Duration
+	// defaultMountOptions are merged into the mount options of every new volume
+	defaultMountOptions []string
 }
 
+// mountPath is where the export is mounted, a variable for the tests
+var mountPath = "/persistentvolumes"
+
 const (
-	mountPath = "/persistentvolumes"
+	// copyRetryDelay is the wait before the second attempt of a failed copy, doubled on every further attempt
+	copyRetryDelay = 10 * time.Second
+)
+
+const (
+	paramLinkMode     = "linkMode"
+	paramMaxCloneSize = "maxCloneSize"
+	// paramStrictCloneSource fails copy-data provisioning when the source cannot be found
+	paramStrictCloneSource = "strictCloneSource"
+
+	// linkModeRelative links to the source directory relative to the link itself,
+	// which resolves wherever the export is mounted
+	linkModeRelative = "relative"
+	// linkModeAbsolute links to the absolute path of the source directory on the NFS server
+	linkModeAbsolute = "absolute"
 )
 
 const (
@@ -57,137 +151,787 @@ const (
 	annLinkDate        = "nchc.ai/link-data"
 	annSrcPVCNamespace = "nchc.ai/src-pvc-namespace"
 	annSrcPVCName      = "nchc.ai/src-pvc-name"
+	annSrcArchived     = "nchc.ai/src-archived"
+	annSrcDirectory    = "nchc.ai/src-directory"
+	annSrcPVC          = "nchc.ai/src-pvc"
+	annCloneMode       = "nchc.ai/clone-mode"
+	// annAllowedNamespaces on a source PVC restricts which namespaces may clone it
+	annAllowedNamespaces = "nchc.ai/allowed-namespaces"
+)
+
+var (
+	errCloneNotAllowed     = errors.New("clone not allowed")
+	errUnsupportedCloneSrc = errors.New("unsupported clone source")
+)
+
+const (
+	cloneModeCopy = "copy"
+	cloneModeLink = "link"
 )
 
 var _ controller.Provisioner = &nfsProvisioner{}
 
 func (p *nfsProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	p.provisioning.Add(1)
+	defer p.provisioning.Add(-1)
+	attempt := &provisionAttempt{}
+	pv, state, err := p.provision(ctx, options, attempt)
+	if ctx.Err() != nil {
+		// the provision controller gave up on this call
+		glog.Warningf("provisioning %s timed out", options.PVName)
+		pv, state, err = nil, controller.ProvisioningFinished, transient("provisioning %s timed out: %v", options.PVName, ctx.Err())
+	}
+	if err != nil {
+		attempt.undo()
+	} else if attempt.restored != nil {
+		attempt.restored.done()
+	}
+	if err != nil && isCloneRequest(options.PVC) {
+		p.setCloneFailure(options.PVC, err)
+	}
+	if err != nil {
+		countFailure("provision", err, options.StorageClass.Name, options.PVC.Namespace)
+	}
+	return pv, state, withClass(err)
+}
+
+// cleanupTimeout limits undoing a failed attempt to provision a volume, which
+// also runs after the attempt timed out.
+const cleanupTimeout = 5 * time.Minute
+
+// provisionAttempt is what an attempt to provision a volume changed below
+// mountPath, so that it can be undone if the attempt fails.
+type provisionAttempt struct {
+	// created is the directory, or link, of the volume if the attempt created
+	// it, or an earlier attempt to provision the same volume left it behind
+	created string
+	// keep keeps created for the next attempt, e.g. a partial copy it resumes
+	keep bool
+	// restored is the data an undelete moved into created
+	restored *restoredData
+}
+
+// undo moves restored data back where it came from and removes the directory
+// the attempt created. Directories it reused, and restored data which cannot
+// be moved back, are kept.
+func (a *provisionAttempt) undo() {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	full := filepath.Join(mountPath, a.created)
+	if a.restored != nil {
+		if err := a.restored.undo(ctx); err != nil {
+			glog.Warningf("move restored data out of %s fail, keeping it: %s", full, err.Error())
+			return
+		}
+	}
+	if a.created == "" || a.keep {
+		return
+	}
+	glog.Infof("removing %s of the failed attempt", full)
+	if err := removeAllCtx(ctx, full); err != nil {
+		glog.Warningf("remove %s fail: %s", full, err.Error())
+	}
+}
+
+// volumeName returns the name of the directory of a new volume.
+func volumeName(options controller.ProvisionOptions) string {
+	return strings.Join([]string{options.PVC.Namespace, options.PVC.Name, options.PVName}, "-")
+}
+
+var _ controller.BlockProvisioner = &nfsProvisioner{}
+
+// SupportsBlock is false, volumes are directories on the export. The provision
+// controller rejects claims with volumeMode Block with a ProvisioningFailed event
+// before Provision is called.
+func (p *nfsProvisioner) SupportsBlock(ctx context.Context) bool {
+	return false
+}
+
+func (p *nfsProvisioner) provision(ctx context.Context, options controller.ProvisionOptions, attempt *provisionAttempt) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	if options.PVC.Spec.Selector != nil {
-		return nil, controller.ProvisioningFinished, fmt.Errorf("claim Selector is not supported")
+		return nil, controller.ProvisioningFinished, misconfigured("claim Selector is not supported")
+	}
+	if mode := options.PVC.Spec.VolumeMode; mode != nil && *mode == v1.PersistentVolumeBlock {
+		return nil, controller.ProvisioningFinished, misconfigured("volumeMode Block is not supported, NFS volumes are directories, use volumeMode Filesystem")
 	}
 	glog.V(4).Infof("nfs provisioner: VolumeOptions %v", options)
 
-	pvcNamespace := options.PVC.Namespace
-	pvcName := options.PVC.Name
+	// the v2 annotations of the claim are translated to the v1 ones used below
+	annotations, err := v1Annotations(options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	schemas := annotationSchemas(options.PVC.Annotations)
+	options.PVC = options.PVC.DeepCopy()
+	options.PVC.Annotations = annotations
 
-	pvName := strings.Join([]string{pvcNamespace, pvcName, options.PVName}, "-")
+	// the parameters of a tenant override those of the class for all its volumes
+	tenant, err := p.tenantFor(ctx, options.PVC.Namespace)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	options.StorageClass = withTenantParameters(options.StorageClass, tenant)
 
-	fullPath := filepath.Join(mountPath, pvName)
-	glog.V(4).Infof("creating path %s", fullPath)
+	modes, err := accessModes(options.StorageClass, options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	reclaim, err := reclaimPolicy(options.StorageClass, options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	inodes, err := inodeLimit(options.StorageClass, options.PVC.Spec.Resources.Requests[v1.ResourceStorage])
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	if err := p.checkVolumeCount(ctx, options.StorageClass, options.PVC); err != nil {
+		return nil, controller.ProvisioningFinished, inCategory(categoryQuota, err)
+	}
+	if p.provisioningPaused.Load() {
+		return nil, controller.ProvisioningFinished, transient("provisioning is paused, the export %s:%s is critically low on free space", p.server, p.path)
+	}
+
+	pvcNamespace := options.PVC.Namespace
+	pvcName := options.PVC.Name
 
 	isLinkData, isLinkDataFound := options.PVC.Annotations[annLinkDate]
 	isCopyData, isCopyDataFound := options.PVC.Annotations[annCopyDate]
 
 	islinkdata, _ := strconv.ParseBool(isLinkData)
 	iscopydata, _ := strconv.ParseBool(isCopyData)
+	issrcarchived, _ := strconv.ParseBool(options.PVC.Annotations[annSrcArchived])
 
-	// when we create symbolic link, no need to create folder
-	if !(isLinkDataFound == true && islinkdata == true) {
-		if err := os.MkdirAll(fullPath, 0777); err != nil {
-			return nil, controller.ProvisioningFinished, errors.New("unable to create directory to provision new pv: " + err.Error())
+	// archives may be pruned at any time, so they can only be copied
+	if islinkdata && issrcarchived {
+		return nil, controller.ProvisioningFinished, misconfigured("%s cannot be combined with %s", annLinkDate, annSrcArchived)
+	}
+	// sealing a link would seal its source
+	isseal, _ := strconv.ParseBool(options.PVC.Annotations[annSeal])
+	if islinkdata && isseal {
+		return nil, controller.ProvisioningFinished, misconfigured("%s cannot be combined with %s", annLinkDate, annSeal)
+	}
+
+	var root string
+	if tenant != nil {
+		root = tenant.Directory
+	} else if root, err = p.namespaceRoot(ctx, pvcNamespace); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	// the volumes of tenants stay on the export of their tenant
+	var zone *zoneExport
+	if tenant == nil {
+		if zone, err = p.selectZone(options.StorageClass, options.SelectedNode, options.PVName); errors.Is(err, errNoZoneExport) {
+			return nil, controller.ProvisioningReschedule, err
+		} else if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if zone != nil {
+			root = filepath.Join(zone.directory, root)
+		}
+	}
+	var route *exportRoute
+	if tenant == nil {
+		if route, err = p.selectRoute(ctx, options.PVC, options.StorageClass.Name); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if route != nil && zone != nil {
+			return nil, controller.ProvisioningFinished, misconfigured("pvc {%s/%s} takes export route %s, which cannot be combined with the export of zone %s", pvcNamespace, pvcName, route.Name, zone.zone)
+		}
+		if route != nil {
+			root = filepath.Join(route.Directory, root)
+		}
+	}
+	pvName := filepath.Join(root, volumeName(options))
+	subdir, isSubdirFound := options.PVC.Annotations[annSubdirName]
+	if isSubdirFound {
+		dir, release, err := reserveSubdir(ctx, options.StorageClass, root, subdir, options.PVName)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		defer release()
+		if err := p.claimDirectoryName(ctx, options, tenant, subdir, dir); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		pvName = dir
+	}
+	naming, err := directoryNaming(options.StorageClass)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	sticky := naming == directoryNamingSticky
+	// stickyReused is whether the sticky directory of a former claim of the same name is reused
+	var stickyReused bool
+	if sticky {
+		if isSubdirFound || islinkdata || isseal {
+			return nil, controller.ProvisioningFinished, misconfigured("%s, %s and %s cannot be used with %s %q", annSubdirName, annLinkDate, annSeal, paramDirectoryNaming, directoryNamingSticky)
+		}
+		pvName = filepath.Join(root, stickyName(pvcNamespace, pvcName))
+		if err := p.claimDirectoryName(ctx, options, tenant, pvcNamespace+"/"+pvcName, pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if stickyReused, err = p.checkStickyDirectory(ctx, options.PVC, options.PVName, pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if stickyReused {
+			glog.Infof("reusing sticky directory %s for pvc {%s/%s}", pvName, pvcNamespace, pvcName)
+		}
+	}
+	// reuse the directory a former claim of the same name left with onDelete: recycle
+	var recycled string
+	if rebind, _ := strconv.ParseBool(options.StorageClass.Parameters[paramRecycleRebind]); rebind && !islinkdata && !isSubdirFound && !sticky {
+		dir, err := findRecycled(root, pvcNamespace, pvcName)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if dir != "" {
+			glog.Infof("reusing recycled directory %s for pvc {%s/%s}", dir, pvcNamespace, pvcName)
+			pvName, recycled = dir, dir
 		}
-		os.Chmod(fullPath, 0777)
 	}
 
-	if (isCopyDataFound == true && iscopydata == true) || (isLinkDataFound == true && islinkdata == true) {
-		srcPvcNS, srcPvcNsFound := options.PVC.Annotations[annSrcPVCNamespace]
-		srcPvcName, srcPvcNameFound := options.PVC.Annotations[annSrcPVCName]
+	// reused directories add no entry to their parent
+	if pvName != recycled && !stickyReused {
+		if err := p.checkExportCapacity(filepath.Dir(pvName)); err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryQuota, err)
+		}
+	}
+
+	fullPath := filepath.Join(mountPath, pvName)
+	glog.V(4).Infof("creating path %s", fullPath)
+	// recycled and sticky directories are reused on purpose
+	if pvName != recycled && !sticky {
+		if err := p.checkExistingDirectory(ctx, options.StorageClass, options.PVC, options.PVName, pvName); err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryMkdir, err)
+		}
+	}
+
+	linkMode := linkModeRelative
+	if mode, ok := options.StorageClass.Parameters[paramLinkMode]; ok {
+		if mode != linkModeRelative && mode != linkModeAbsolute {
+			return nil, controller.ProvisioningFinished, misconfigured("invalid %s %q, must be %q or %q", paramLinkMode, mode, linkModeRelative, linkModeAbsolute)
+		}
+		linkMode = mode
+	}
+
+	strictCloneSource := p.strictCloneSource
+	if v, ok := options.StorageClass.Parameters[paramStrictCloneSource]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, misconfigured("invalid %s %q: %v", paramStrictCloneSource, v, err)
+		}
+		strictCloneSource = b
+	}
+
+	srcPvcNS, srcPvcNsFound := options.PVC.Annotations[annSrcPVCNamespace]
+	srcPvcName, srcPvcNameFound := options.PVC.Annotations[annSrcPVCName]
+
+	// populate fills the new directory from a data source other than a claim,
+	// which is recorded as dataSource
+	var populate func() error
+	var dataSource string
+	ref := dataSourceRef(options.PVC)
+	s3URL, isS3Found := options.PVC.Annotations[annPopulateS3]
+	tarURL, isURLFound := options.PVC.Annotations[annPopulateURL]
+	gitURL, isGitFound := options.PVC.Annotations[annPopulateGit]
+	image, isOCIFound := options.PVC.Annotations[annPopulateOCI]
+	undeleteFrom, isUndeleteFound := options.PVC.Annotations[annUndeleteFrom]
+	sources := 0
+	for _, found := range []bool{ref != nil, isS3Found, isURLFound, isGitFound, isOCIFound, isUndeleteFound, isCopyDataFound || isLinkDataFound} {
+		if found {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, controller.ProvisioningFinished, misconfigured("only one of dataSourceRef, %s, %s, %s, %s, %s, %s and %s can be set", annPopulateS3, annPopulateURL, annPopulateGit, annPopulateOCI, annUndeleteFrom, annCopyDate, annLinkDate)
+	}
+	if sources > 0 && stickyReused {
+		return nil, controller.ProvisioningFinished, misconfigured("the sticky directory %s of pvc {%s/%s} already holds data, data sources only populate new ones", pvName, pvcNamespace, pvcName)
+	}
+	if ref != nil {
+		if isClaimRef(ref) {
+			// a claim data source is cloned like copy-data, and must exist
+			isCopyDataFound, iscopydata, issrcarchived, strictCloneSource = true, true, false, true
+			srcPvcNS, srcPvcNsFound = refNamespace(ref, pvcNamespace), true
+			srcPvcName, srcPvcNameFound = ref.Name, true
+		} else if fn, ok := populators[refGroupKind(ref)]; ok {
+			populate = func() error { return fn(ctx, p, options.StorageClass, pvcNamespace, ref, pvName) }
+			dataSource = ref.Kind + "/" + refNamespace(ref, pvcNamespace) + "/" + ref.Name
+		} else {
+			return nil, controller.ProvisioningFinished, misconfigured("unsupported data source %s", refGroupKind(ref))
+		}
+	}
+	if isS3Found {
+		populate = func() error { return p.populateFromS3(ctx, options.StorageClass, options.PVC, s3URL, pvName) }
+		dataSource = s3URL
+	}
+	if isURLFound {
+		checksum := options.PVC.Annotations[annPopulateSHA256]
+		populate = func() error { return populateFromURL(ctx, tarURL, checksum, pvName) }
+		dataSource = tarURL
+	}
+	if isGitFound {
+		gitRef, commit := options.PVC.Annotations[annPopulateGitRef], options.PVC.Annotations[annPopulateGitCommit]
+		populate = func() error { return populateFromGit(ctx, gitURL, gitRef, commit, pvName) }
+		dataSource = gitURL
+		if gitRef != "" {
+			dataSource += "@" + gitRef
+		}
+	}
+	if isOCIFound {
+		populate = func() error { return p.populateFromOCI(ctx, options.StorageClass, options.PVC, image, pvName) }
+		dataSource = image
+	}
+	if isUndeleteFound {
+		populate = func() error {
+			source, restored, err := undelete(ctx, pvcNamespace, undeleteFrom, pvName)
+			dataSource, attempt.restored = source, restored
+			return err
+		}
+		dataSource = "PersistentVolumeClaim/" + pvcNamespace + "/" + undeleteFrom
+	}
 
+	// srcDirectory is the real directory the new volume is cloned from, if any,
+	// and srcPVC the "namespace/name" of the claim it belonged to
+	var srcDirectory, srcPVC string
+	// cloneReason is the reason of the Complete clone status, empty if the clone failed
+	var cloneReason string
+	if (isCopyDataFound == true && iscopydata == true) || (isLinkDataFound == true && islinkdata == true) {
+		p.setCloneStatus(options.PVC, cloneStatusPending, cloneReasonProvisioning, "cloning pvc {%s/%s}", srcPvcNS, srcPvcName)
 		if srcPvcNsFound == true && srcPvcNS != "" &&
 			srcPvcNameFound == true && srcPvcName != "" {
-			srcPVC, err := p.client.CoreV1().PersistentVolumeClaims(srcPvcNS).Get(ctx, srcPvcName, metav1.GetOptions{})
-			if err != nil {
-				glog.Warningf("Get pvc {%s/%s} fail: %s", srcPvcNS, srcPvcName, err.Error())
+			var srcPVName string
+			var err error
+			if issrcarchived {
+				// the claim of an archive is deleted together with its
+				// nchc.ai/allowed-namespaces, only its namespace may clone it
+				if srcPvcNS != pvcNamespace {
+					err = misconfigured("%w: archives of namespace %s can only be cloned in it, not in %s", errCloneNotAllowed, srcPvcNS, pvcNamespace)
+				} else {
+					srcPVName, err = findArchive(srcPvcNS, srcPvcName)
+				}
+				if err == nil {
+					// archives copied from are kept longer by archiveEviction: lru
+					if err := touchArchive(mountPath, srcPVName, time.Now()); err != nil {
+						glog.Warningf("record access of archive %s fail: %s", srcPVName, err.Error())
+					}
+				}
 			} else {
-				srcPVName := strings.Join([]string{srcPvcNS, srcPvcName, srcPVC.Spec.VolumeName}, "-")
-
-				if islinkdata {
-					glog.Infof("Create symbolic link from %s to %s", srcPVName, pvName)
-					err = p.linkDirectory(srcPVName, pvName)
-					if err != nil {
-						glog.Warningf("error Create symbolic link: %s", err.Error())
+				srcPVName, err = p.getSourceDirectory(ctx, srcPvcNS, srcPvcName, pvcNamespace)
+			}
+			// archives are never links, but may be nested below an archivePath
+			if err == nil && !issrcarchived {
+				// the source may itself be a linked volume, never create chains of links
+				srcPVName, err = p.resolveDirectory(srcPVName)
+			}
+			if err != nil {
+				// a linked volume without its source would be a dangling symbolic link,
+				// a copied one an unexpectedly empty volume
+				if islinkdata || strictCloneSource || errors.Is(err, errCloneNotAllowed) || errors.Is(err, errUnsupportedCloneSrc) || errors.Is(err, errOverQuota) {
+					err = fmt.Errorf("unable to clone pvc {%s/%s}: %w", srcPvcNS, srcPvcName, err)
+					if islinkdata {
+						return nil, controller.ProvisioningFinished, inCategory(categoryLink, err)
 					}
+					return nil, controller.ProvisioningFinished, inCategory(categoryCopy, err)
 				}
+				p.warn(options.PVC, reasonCloneSourceFailed, "Get source of pvc {%s/%s} fail: %s", srcPvcNS, srcPvcName, err.Error())
+				p.setCloneStatus(options.PVC, cloneStatusFailed, reasonCloneSourceFailed, "Get source of pvc {%s/%s} fail: %s, the volume is empty", srcPvcNS, srcPvcName, err.Error())
+			} else {
+				srcDirectory = srcPVName
+				srcPVC = srcPvcNS + "/" + srcPvcName
+			}
+		} else if islinkdata || strictCloneSource {
+			return nil, controller.ProvisioningFinished, misconfigured("cloning requires %s and %s", annSrcPVCNamespace, annSrcPVCName)
+		}
+	}
+
+	if srcDirectory != "" {
+		if islinkdata {
+			if filepath.IsAbs(srcDirectory) || isStreamSource(srcDirectory) {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, misconfigured("pvc {%s/%s} is located on the export of another storage class, symbolic links cannot cross exports, use %s instead", srcPvcNS, srcPvcName, annCopyDate))
+			}
+			if err := checkLinkSource(srcDirectory); err != nil {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, err)
+			}
+			// clients of a dedicated export cannot follow links out of it
+			if tenant != nil && tenant.Server != "" && !strings.HasPrefix(srcDirectory, tenant.Directory+string(filepath.Separator)) {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, misconfigured("volumes of StorageTenant %s have a dedicated export and cannot link to %s", tenant.Name, srcDirectory))
+			}
+			if zone != nil && zone.directory != "" && !strings.HasPrefix(srcDirectory, zone.directory+string(filepath.Separator)) {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, misconfigured("volumes of zone %s are on the export of %s and cannot link to %s", zone.zone, zone.directory, srcDirectory))
+			}
+			if route != nil && route.server != "" && !strings.HasPrefix(srcDirectory, route.Directory+string(filepath.Separator)) {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, misconfigured("volumes of export route %s are on the export of %s and cannot link to %s", route.Name, route.Directory, srcDirectory))
+			}
+		}
+		if iscopydata {
+			if err := p.checkCopySource(ctx, srcDirectory, options.StorageClass.Parameters); err != nil {
+				return nil, controller.ProvisioningFinished, inCategory(categoryCopy, err)
+			}
+		}
+	}
 
-				if iscopydata {
-					glog.Infof("Copy backing folder data from %s to %s", srcPVName, pvName)
-					err = p.copyDirectory(srcPVName, pvName)
-					if err != nil {
-						glog.Warningf("error copy dataset backing folder: %s", err.Error())
+	// when we create symbolic link, no need to create folder
+	if !(isLinkDataFound == true && islinkdata == true) {
+		own, err := ownDirectory(ctx, fullPath, options.PVName)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryMkdir, err)
+		}
+		if err := retryTransient(ctx, "mkdir "+fullPath, func() error { return mkdirAllCtx(ctx, fullPath, 0777) }); err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryMkdir, fmt.Errorf("unable to create directory to provision new pv: %w", err))
+		}
+		if own {
+			attempt.created = pvName
+		}
+		if err := retryTransient(ctx, "chmod "+fullPath, func() error { return chmodCtx(ctx, fullPath, 0777) }); err != nil {
+			p.warn(options.PVC, reasonChmodFailed, "unable to chmod %s: %s", fullPath, err.Error())
+		}
+	}
+
+	marker := &volumeMarker{
+		Provisioner:    p.name,
+		Volume:         options.PVName,
+		ClaimNamespace: pvcNamespace,
+		ClaimName:      pvcName,
+		ClaimUID:       string(options.PVC.UID),
+		StorageClass:   options.StorageClass.Name,
+		Created:        time.Now().UTC(),
+	}
+
+	if srcDirectory != "" {
+		if islinkdata {
+			glog.Infof("Create symbolic link from %s to %s", srcDirectory, pvName)
+			if err := runFS(ctx, func() error { return p.linkDirectory(srcDirectory, pvName, linkMode) }); err != nil {
+				return nil, controller.ProvisioningFinished, inCategory(categoryLink, fmt.Errorf("unable to create symbolic link to provision new pv: %w", err))
+			}
+			attempt.created = pvName
+			cloneReason = cloneReasonLinked
+		}
+
+		if iscopydata {
+			glog.Infof("Copy backing folder data from %s to %s", srcDirectory, pvName)
+			p.setCloneStatus(options.PVC, cloneStatusCopying, cloneReasonCopying, "copying pvc {%s} to %s", srcPVC, pvName)
+			if err := p.copyDirectory(ctx, srcDirectory, pvName); err != nil {
+				p.warn(options.PVC, reasonCopyFailed, "error copy dataset backing folder: %s", err.Error())
+				if classify(err) == classTransient {
+					// the retry of the provision controller resumes the copy,
+					// the marker keeps existingDirectory from applying to it
+					if err := runFS(ctx, func() error { return writeMarker(fullPath, marker) }); err == nil {
+						attempt.keep = true
 					}
 				}
+				return nil, controller.ProvisioningFinished, inCategory(categoryCopy, fmt.Errorf("unable to copy pvc {%s}: %w", srcPVC, err))
 			}
+			p.setCloneStatus(options.PVC, cloneStatusVerifying, cloneReasonVerifying, "comparing the copy with pvc {%s}", srcPVC)
+			if err := runFS(ctx, func() error { return verifyCopy(srcDirectory, pvName) }); err != nil {
+				p.warn(options.PVC, reasonCopyFailed, "copy of pvc {%s} differs from its source: %s", srcPVC, err.Error())
+				// the source may have changed during the copy, start over, the
+				// failed attempt removes the copy: files the source no longer has
+				// would survive a resumed copy
+				return nil, controller.ProvisioningFinished, inCategory(categoryCopy, transient("copy of pvc {%s} differs from its source: %v", srcPVC, err))
+			}
+			cloneReason = cloneReasonCopied
 		}
 	}
 
-	path := filepath.Join(p.path, pvName)
+	if populate != nil {
+		glog.Infof("Populate %s from %s", pvName, dataSource)
+		if err := populate(); err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryPopulate, fmt.Errorf("unable to populate from %s: %w", dataSource, err))
+		}
+	}
+
+	// a linked volume shares the directory, and the marker, of its source
+	if !islinkdata {
+		if err := runFS(ctx, func() error { return writeMarker(fullPath, marker) }); err != nil {
+			return nil, controller.ProvisioningFinished, inCategory(categoryMkdir, fmt.Errorf("unable to write marker of %s: %w", fullPath, err))
+		}
+	}
+
+	if isseal {
+		glog.Infof("Sealing %s", fullPath)
+		if err := runFS(ctx, func() error { return sealDirectory(fullPath) }); err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("unable to seal %s: %w", fullPath, err)
+		}
+	}
+
+	server, path := p.server, filepath.Join(p.path, pvName)
+	if tenant != nil && tenant.Server != "" {
+		if server, path, err = tenantSource(tenant, pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+	if zone != nil {
+		if server, path, err = zone.source(pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+	if route != nil && route.server != "" {
+		if server, path, err = route.source(pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
 
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
+			Name:        options.PVName,
+			Annotations: map[string]string{},
 		},
 		Spec: v1.PersistentVolumeSpec{
-			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
-			AccessModes:                   options.PVC.Spec.AccessModes,
-			MountOptions:                  options.StorageClass.MountOptions,
+			PersistentVolumeReclaimPolicy: reclaim,
+			AccessModes:                   modes,
+			MountOptions:                  p.mountOptions(options.StorageClass),
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
-					Server:   p.server,
+					Server:   server,
 					Path:     path,
-					ReadOnly: false,
+					ReadOnly: isseal,
 				},
 			},
 		},
 	}
+	if dataSource != "" {
+		pv.Annotations[annDataSource] = dataSource
+	}
+	if tenant != nil {
+		pv.Annotations[annTenant] = tenant.Name
+		if tenant.Server != "" {
+			pv.Annotations[annDirectory] = pvName
+		}
+	}
+	if zone != nil {
+		pv.Annotations[annZone] = zone.zone
+		pv.Annotations[annDirectory] = pvName
+		pv.Spec.NodeAffinity = zone.nodeAffinity()
+	}
+	if route != nil {
+		pv.Annotations[annRoute] = route.Name
+		if route.server != "" {
+			pv.Annotations[annDirectory] = pvName
+		}
+	}
+	if isSubdirFound {
+		pv.Annotations[annSubdirName] = subdir
+	}
+	if sticky {
+		pv.Annotations[annSticky] = "true"
+	}
+	if isseal {
+		pv.Annotations[annSealed] = "true"
+	}
+	if protected, _ := strconv.ParseBool(options.PVC.Annotations[annProtectData]); protected {
+		pv.Annotations[annProtectData] = "true"
+	}
+	if reclaim != *options.StorageClass.ReclaimPolicy {
+		pv.Annotations[annReclaimPolicy] = string(reclaim)
+	}
+	if inodes > 0 {
+		pv.Annotations[annInodeLimit] = strconv.FormatInt(inodes, 10)
+	}
+	if gc, _ := strconv.ParseBool(options.PVC.Annotations[annGCLinkTarget]); gc {
+		pv.Annotations[annGCLinkTarget] = "true"
+	}
+	if srcDirectory != "" {
+		pv.Annotations[annSrcDirectory] = srcDirectory
+		pv.Annotations[annSrcPVC] = srcPVC
+		if islinkdata {
+			pv.Annotations[annCloneMode] = cloneModeLink
+		} else {
+			pv.Annotations[annCloneMode] = cloneModeCopy
+			pv.Annotations[annLastSynced] = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+
+	if cloneReason != "" {
+		p.setCloneStatus(options.PVC, cloneStatusComplete, cloneReason, "cloned pvc {%s}", srcPVC)
+	}
+
+	p.warnDeprecated(options.PVC, options.StorageClass)
+	for _, schema := range schemas {
+		annotationSchemaUsage.WithLabelValues(schema).Inc()
+	}
+
+	e := p.newHookEvent(hookPostProvision, pv)
+	e.StorageClass, e.ClaimNamespace, e.ClaimName = options.StorageClass.Name, pvcNamespace, pvcName
+	if err := p.runHooks(ctx, e); err != nil {
+		p.warn(options.PVC, reasonHookFailed, "%s", err.Error())
+	}
 	return pv, controller.ProvisioningFinished, nil
 }
 
 func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
-	path := volume.Spec.PersistentVolumeSource.NFS.Path
-	oldPath := filepath.Base(path)
+	if err := p.deferDeletion(ctx, volume); err != nil {
+		if _, ignored := err.(*controller.IgnoredError); ignored {
+			return err
+		}
+		countVolumeFailure("delete", err, volume)
+		return withClass(err)
+	}
+	release, err := p.acquireDeleteSlot(ctx)
+	if err != nil {
+		return transient("waiting to delete %s: %v", volume.Name, err)
+	}
+	defer release()
 
-	err := os.Chdir(mountPath)
+	op := p.operations.start(operationDelete, volume.Name, p.volumeDirectory(volume))
+	err = p.delete(ctx, volume)
+	op.done(err)
+	if err == nil {
+		p.removeMirror(volume)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = transient("deleting %s timed out: %v", volume.Name, err)
+	}
 	if err != nil {
+		countVolumeFailure("delete", err, volume)
+	}
+	return withClass(err)
+}
+
+func (p *nfsProvisioner) delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	oldPath := p.volumeDirectory(volume)
+
+	if p.isProtected(ctx, volume) {
+		return fmt.Errorf("volume %s is protected by %s, remove the annotation to delete it", volume.Name, annProtectData)
+	}
+	if err := p.runHooks(ctx, p.newHookEvent(hookPreDelete, volume)); err != nil {
+		p.warn(volume, reasonHookFailed, "%s, volume kept", err.Error())
 		return err
 	}
 
-	var fileInfo os.FileInfo
+	if err := p.removeQuarantined(ctx, volume, oldPath); err != nil {
+		p.warn(volume, reasonDeleteFailed, "unable to remove quarantined link of pv %s: %s", volume.Name, err.Error())
+		return inCategory(categoryLink, err)
+	}
 
-	if fileInfo, err = os.Lstat(oldPath); os.IsNotExist(err) {
+	fileInfo, err := lstatCtx(ctx, filepath.Join(mountPath, oldPath))
+	if os.IsNotExist(err) {
 		glog.Warningf("path %s does not exist, deletion skipped", filepath.Join(mountPath, oldPath))
-		return nil
+		// the snapshots of a vanished volume have nothing left to restore
+		return inCategory(categoryRemove, p.removeVolume(ctx, volume, filepath.Join(snapshotDir, oldPath)))
+	} else if err != nil {
+		p.warn(volume, reasonDeleteFailed, "unable to stat %s: %s", filepath.Join(mountPath, oldPath), err.Error())
+		return err
 	}
 
 	if fileInfo.Mode()&os.ModeSymlink != 0 {
-		return os.RemoveAll(oldPath)
+		return inCategory(categoryLink, p.deleteLink(ctx, volume, oldPath))
+	}
+	if err := p.verifyMarker(ctx, volume, oldPath); err != nil {
+		p.warn(volume, reasonMarkerMismatch, "%s, volume kept", err.Error())
+		return err
+	}
+	if sticky, _ := strconv.ParseBool(volume.Annotations[annSticky]); sticky {
+		return p.releaseSticky(ctx, volume, oldPath)
+	}
+	if gc, _ := strconv.ParseBool(volume.Annotations[annGCLinkTarget]); gc {
+		if kept, err := p.deferLinkTarget(ctx, volume, oldPath); err != nil || kept {
+			return err
+		}
 	}
 
 	// Get the storage class for this volume.
 	storageClass, err := p.getClassForVolume(ctx, volume)
 	if err != nil {
+		p.warn(volume, reasonStorageClassFailed, "unable to get storage class of pv %s: %s", volume.Name, err.Error())
 		return err
 	}
-	// Determine if the "archiveOnDelete" parameter exists.
-	// If it exists and has a false value, delete the directory.
-	// Otherwise, archive it.
-	archiveOnDelete, exists := storageClass.Parameters["archiveOnDelete"]
-	if exists {
-		archiveBool, err := strconv.ParseBool(archiveOnDelete)
-		if err != nil {
-			return err
+	action, err := onDeleteAction(storageClass)
+	if err != nil {
+		p.warn(volume, reasonStorageClassFailed, "storage class %s: %s", storageClass.Name, err.Error())
+		return err
+	}
+	if action == onDeleteDelete || action == onDeleteRecycle {
+		if repo := p.resticRepository(storageClass); repo != "" {
+			if err := resticBackup(ctx, repo, volume, oldPath); err != nil {
+				p.warn(volume, reasonBackupFailed, "%s, volume kept", err.Error())
+				return inCategory(categoryBackup, err)
+			}
 		}
-		if !archiveBool {
-			return os.RemoveAll(oldPath)
+		if secure, _ := strconv.ParseBool(storageClass.Parameters[paramSecureDelete]); secure {
+			for _, dir := range []string{filepath.Join(snapshotDir, oldPath), oldPath} {
+				glog.V(4).Infof("overwriting the files of %s", filepath.Join(mountPath, dir))
+				if err := runCtx(ctx, func() error { return shredDirectory(filepath.Join(mountPath, dir)) }); err != nil {
+					p.warn(volume, reasonDeleteFailed, "unable to overwrite %s: %s, volume kept", filepath.Join(mountPath, dir), err.Error())
+					return inCategory(categoryRemove, err)
+				}
+			}
 		}
+		if err := p.removeVolume(ctx, volume, filepath.Join(snapshotDir, oldPath)); err != nil {
+			return inCategory(categoryRemove, err)
+		}
+		if action == onDeleteDelete {
+			return inCategory(categoryRemove, p.removeVolume(ctx, volume, oldPath))
+		}
+		glog.V(4).Infof("recycling path %s", filepath.Join(mountPath, oldPath))
+		if err := retryTransient(ctx, "recycle "+oldPath, func() error {
+			return runFS(ctx, func() error { return p.recycleDirectory(volume, oldPath) })
+		}); err != nil {
+			p.warn(volume, reasonDeleteFailed, "unable to recycle %s: %s", filepath.Join(mountPath, oldPath), err.Error())
+			return inCategory(categoryRemove, err)
+		}
+		return nil
+	}
+	if action == onDeleteTrash {
+		return inCategory(categoryArchive, p.trashDirectory(ctx, volume, volume, storageClass, oldPath))
 	}
 
-	archivePath := "archived-" + oldPath
-	glog.V(4).Infof("archiving path %s to %s", filepath.Join(mountPath, oldPath), filepath.Join(mountPath, archivePath))
-	return os.Rename(oldPath, archivePath)
+	return inCategory(categoryArchive, p.archiveDirectory(ctx, volume, volume, storageClass, oldPath))
+}
+
+// archiveDirectory archives the directory name below mountPath, named after
+// owner by the archivePath template of class, reporting failures on volume.
+func (p *nfsProvisioner) archiveDirectory(ctx context.Context, volume, owner *v1.PersistentVolume, class *storage.StorageClass, name string) error {
+	now := time.Now()
+	archivePath, err := archivePathFor(class, owner, name, now)
+	if err != nil {
+		p.warn(volume, reasonStorageClassFailed, "storage class %s: %s", class.Name, err.Error())
+		return err
+	}
+	if _, err := lstatCtx(ctx, filepath.Join(mountPath, archivePath)); err == nil {
+		err = fmt.Errorf("archive %s already exists", archivePath)
+		p.warn(volume, reasonArchiveFailed, "unable to archive %s: %s", filepath.Join(mountPath, name), err.Error())
+		return err
+	}
+	glog.V(4).Infof("archiving path %s to %s", filepath.Join(mountPath, name), filepath.Join(mountPath, archivePath))
+	op := p.operations.start(operationArchive, volume.Name, name)
+	op.setTarget(archivePath)
+	err = retryTransient(ctx, "archive "+name, func() error {
+		if err := mkdirAllCtx(ctx, filepath.Dir(filepath.Join(mountPath, archivePath)), 0777); err != nil {
+			return err
+		}
+		return renameCtx(ctx, filepath.Join(mountPath, name), filepath.Join(mountPath, archivePath))
+	})
+	op.done(err)
+	if err != nil {
+		p.warn(volume, reasonArchiveFailed, "unable to archive %s: %s", filepath.Join(mountPath, name), err.Error())
+		return err
+	}
+	if err := recordArchiveClass(mountPath, archivePath, class.Name); err != nil {
+		glog.Warningf("record storage class of archive %s fail: %s", archivePath, err.Error())
+	}
+	// the snapshots are kept, and removed, with the archive
+	snapshots := filepath.Join(mountPath, snapshotDir, name)
+	if err := runFS(ctx, func() error { return moveSnapshots(snapshots, filepath.Join(mountPath, snapshotDir, archivePath)) }); err != nil {
+		glog.Warningf("move snapshots of %s to archive %s fail: %s", name, archivePath, err.Error())
+	}
+	manifest := newArchiveManifest(p.name, volume, owner, name, now)
+	if err := runFS(ctx, func() error { return writeArchiveManifest(filepath.Join(mountPath, archivePath), manifest) }); err != nil {
+		glog.Warningf("write manifest of archive %s fail: %s", archivePath, err.Error())
+	}
+	return nil
+}
 
+// removeVolume removes name from mountPath, reporting failures on volume
+func (p *nfsProvisioner) removeVolume(ctx context.Context, volume *v1.PersistentVolume, name string) error {
+	full := filepath.Join(mountPath, name)
+	if err := retryTransient(ctx, "remove "+full, func() error { return removeAllCtx(ctx, full) }); err != nil {
+		p.warn(volume, reasonDeleteFailed, "unable to remove %s: %s", filepath.Join(mountPath, name), err.Error())
+		return err
+	}
+	return nil
 }
 
 // getClassForVolume returns StorageClass
@@ -199,42 +943,529 @@ func (p *nfsProvisioner) getClassForVolume(ctx context.Context, pv *v1.Persisten
 	if className == "" {
 		return nil, fmt.Errorf("Volume has no storage class")
 	}
+	if p.classLister != nil {
+		class, err := p.classLister.Get(className)
+		if err == nil {
+			return withTenantParameters(class, p.tenantOf(pv)), nil
+		}
+		// the cache may lag behind a newly created class
+		glog.V(4).Infof("storage class %s not cached, falling back to live lookup: %s", className, err.Error())
+	}
 	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
-	return class, nil
+	return withTenantParameters(class, p.tenantOf(pv)), nil
 }
 
-func (p *nfsProvisioner) copyDirectory(srcDir string, destDir string) error {
-	err := otiai10.Copy(path.Join(mountPath, srcDir), path.Join(mountPath, destDir))
-	return err
+// getSourceDirectory returns the directory name of the volume bound to pvc {namespace/name},
+// provided that pvcs in the requester namespace are allowed to clone it and that
+// the volume was provisioned by us on our export
+func (p *nfsProvisioner) getSourceDirectory(ctx context.Context, namespace, name, requester string) (string, error) {
+	srcPVC, err := p.getClaim(ctx, namespace, name)
+	if err != nil {
+		return "", err
+	}
+	if !cloneAllowed(srcPVC, requester) {
+		return "", misconfigured("%w: namespace %s is not listed in %s of pvc {%s/%s}", errCloneNotAllowed, requester, annAllowedNamespaces, namespace, name)
+	}
+	if srcPVC.Spec.VolumeName == "" {
+		return "", transient("pvc {%s/%s} is not bound", namespace, name)
+	}
+	srcPV, err := p.getVolume(ctx, srcPVC.Spec.VolumeName)
+	if err != nil {
+		return "", err
+	}
+	_, dedicated := srcPV.Annotations[annDirectory]
+	onExport := srcPV.Spec.NFS != nil && srcPV.Spec.NFS.Server == p.server && strings.HasPrefix(filepath.Clean(srcPV.Spec.NFS.Path), filepath.Clean(p.path)+"/")
+	if p.ownsVolume(srcPV) && (dedicated || onExport) {
+		if err := p.blockedByQuota(ctx, srcPV); err != nil {
+			return "", err
+		}
+		return p.volumeDirectory(srcPV), nil
+	}
+	// volumes of other storage classes can be copied if their export is mounted too
+	if dir, ok := p.sourceExportDirectory(srcPV); ok {
+		return dir, nil
+	}
+	// or streamed by the provisioner of their export
+	if src, ok := p.streamSourceURL(srcPV); ok {
+		return src, nil
+	}
+	if !p.ownsVolume(srcPV) {
+		return "", misconfigured("%w: pv %s of pvc {%s/%s} is not provisioned by %s, and not located in one of -source-exports or -stream-peers", errUnsupportedCloneSrc, srcPV.Name, namespace, name, p.name)
+	}
+	return "", misconfigured("%w: pv %s of pvc {%s/%s} is not located in %s:%s", errUnsupportedCloneSrc, srcPV.Name, namespace, name, p.server, p.path)
+}
+
+// cloneAllowed reports whether pvcs in namespace may clone srcPVC. Without the
+// allowed-namespaces annotation everybody may, otherwise only its own namespace
+// and the comma separated namespaces listed ("*" for all) may.
+func cloneAllowed(srcPVC *v1.PersistentVolumeClaim, namespace string) bool {
+	annotations, _ := v1Annotations(srcPVC)
+	allowed, ok := annotations[annAllowedNamespaces]
+	if !ok || namespace == srcPVC.Namespace {
+		return true
+	}
+	for _, ns := range strings.Split(allowed, ",") {
+		if ns = strings.TrimSpace(ns); ns == namespace || ns == "*" {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *nfsProvisioner) linkDirectory(srcDir string, destDir string) error {
-	err := os.Chdir(mountPath)
+// resolveDirectory follows the symbolic links of the volume directory name and
+// returns the name of the real directory, which must be located in mountPath.
+// The absolute directories of source exports must stay in their mount instead.
+func (p *nfsProvisioner) resolveDirectory(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return p.resolveSourceExportDirectory(name)
+	}
+	// the peer resolves the links of the volumes it streams
+	if isStreamSource(name) {
+		return name, nil
+	}
+	full := filepath.Join(mountPath, name)
+	// links created in absolute mode point to the path on the NFS server
+	if target, err := dataFS.Readlink(full); err == nil && filepath.IsAbs(target) {
+		rel, err := filepath.Rel(p.path, target)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("%s links to %s, which is outside of %s", name, target, p.path)
+		}
+		full = filepath.Join(mountPath, rel)
+	}
+
+	root, err := filepath.EvalSymlinks(mountPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = os.Symlink(srcDir, destDir)
+	target, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s resolves to %s, which is not a volume directory", name, target)
+	}
+	// volumes below a namespace root are nested, unlike the subdirectories of volumes they have a marker
+	if strings.Contains(rel, string(filepath.Separator)) {
+		if _, err := readMarker(target); err != nil {
+			return "", fmt.Errorf("%s resolves to %s, which is not a volume directory", name, target)
+		}
+	}
+	return rel, nil
+}
+
+// checkLinkSource verifies that the source directory of a link exists and is not empty
+func checkLinkSource(srcDir string) error {
+	f, err := dataFS.Open(filepath.Join(mountPath, srcDir))
+	if err != nil {
+		return fmt.Errorf("source directory %s of link is not accessible: %w", srcDir, err)
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return fmt.Errorf("source directory %s of link is empty", srcDir)
+	} else if err != nil {
+		return fmt.Errorf("source directory %s of link is not readable: %w", srcDir, err)
+	}
+	return nil
+}
+
+// checkCopySource verifies that srcDir is not larger than the maxCloneSize
+// parameter of the storage class, or the provisioner default, and that it
+// fits into the free space of the export
+func (p *nfsProvisioner) checkCopySource(ctx context.Context, srcDir string, parameters map[string]string) error {
+	limit := p.maxCloneSize
+	if v, ok := parameters[paramMaxCloneSize]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return misconfigured("invalid %s %q: %v", paramMaxCloneSize, v, err)
+		}
+		limit = q.Value()
+	}
+
+	var size int64
+	var err error
+	if isStreamSource(srcDir) {
+		size, err = p.streamSize(ctx, srcDir)
+	} else {
+		size, _, err = dirUsage(sourcePath(srcDir))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to measure clone source %s: %w", srcDir, err)
+	}
+	if limit > 0 && size > limit {
+		return misconfigured("clone source %s holds %s, more than the maximum of %s for %s, consider %s instead",
+			srcDir, formatBytes(size), formatBytes(limit), annCopyDate, annLinkDate)
+	}
+
+	free, err := freeSpace(mountPath)
+	if err != nil {
+		return fmt.Errorf("unable to measure free space of export: %w", err)
+	}
+	if size > free {
+		return fmt.Errorf("clone source %s holds %s, but only %s are free on the export", srcDir, formatBytes(size), formatBytes(free))
+	}
+	return nil
+}
+
+// listClasses returns all storage classes, from the cache if there is one
+func (p *nfsProvisioner) listClasses(ctx context.Context) ([]*storage.StorageClass, error) {
+	if p.classLister != nil {
+		return p.classLister.List(labels.Everything())
+	}
+	list, err := p.client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	classes := make([]*storage.StorageClass, 0, len(list.Items))
+	for i := range list.Items {
+		classes = append(classes, &list.Items[i])
+	}
+	return classes, nil
+}
+
+func (p *nfsProvisioner) copyDirectory(ctx context.Context, srcDir string, destDir string) error {
+	src, dest := sourcePath(srcDir), path.Join(mountPath, destDir)
+	op := p.operations.start(operationCopy, "", destDir)
+	if !isStreamSource(srcDir) {
+		// usually cached, checkCopySource measured it just before
+		size, _, _ := dirUsage(src)
+		op.setSource(srcDir, size)
+	} else {
+		op.setSource(srcDir, 0)
+	}
+	opts := otiai10.Options{
+		PreserveTimes: true,
+		// files completed by a previous attempt are not copied again
+		Skip: func(s string) (bool, error) {
+			// stop copying once the provision controller gave up
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			rel, err := filepath.Rel(src, s)
+			if err != nil {
+				return false, err
+			}
+			// the copy gets a marker of its own, and is no archive
+			if rel == markerFile || rel == archiveManifestFile {
+				return true, nil
+			}
+			srcInfo, err := dataFS.Lstat(s)
+			if err != nil || !srcInfo.Mode().IsRegular() {
+				return false, err
+			}
+			// files completed by a previous attempt count as copied too
+			op.progress(1, srcInfo.Size())
+			destInfo, err := dataFS.Lstat(filepath.Join(dest, rel))
+			return err == nil && unchanged(srcInfo, destInfo), nil
+		},
+	}
+
+	backoff := wait.Backoff{
+		Duration: copyRetryDelay,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    p.copyAttempts,
+	}
+	var copyErr error
+	attempt := 0
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		attempt++
+		release, err := p.acquireCopySlot(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer release()
+
+		op.restart()
+		run := func() error { return dataFS.Copy(src, dest, opts) }
+		if isStreamSource(srcDir) {
+			run = func() error { return p.streamDirectory(ctx, srcDir, dest, op) }
+		}
+		if copyErr = runCtx(ctx, run); copyErr != nil {
+			if classify(copyErr) != classTransient {
+				return false, copyErr
+			}
+			glog.Warningf("copy attempt %d/%d from %s to %s fail: %s", attempt, p.copyAttempts, srcDir, destDir, copyErr.Error())
+			return false, nil
+		}
+		return true, nil
+	})
+	if wait.Interrupted(err) && copyErr != nil {
+		err = copyErr
+	}
+	op.done(err)
 	return err
 }
 
+// acquireCopySlot waits until fewer than max-concurrent-copies copies are running
+func (p *nfsProvisioner) acquireCopySlot(ctx context.Context) (func(), error) {
+	if p.copySlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.copySlots <- struct{}{}:
+		return func() { <-p.copySlots }, nil
+	default:
+	}
+
+	glog.V(4).Infof("waiting for one of %d copy slots", cap(p.copySlots))
+	select {
+	case p.copySlots <- struct{}{}:
+		return func() { <-p.copySlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireDeleteSlot waits until fewer than max-concurrent-deletes deletions are running
+func (p *nfsProvisioner) acquireDeleteSlot(ctx context.Context) (func(), error) {
+	if p.deleteSlots != nil {
+		select {
+		case p.deleteSlots <- struct{}{}:
+		default:
+			glog.V(4).Infof("waiting for one of %d delete slots", cap(p.deleteSlots))
+			deletesQueued.Inc()
+			select {
+			case p.deleteSlots <- struct{}{}:
+				deletesQueued.Dec()
+			case <-ctx.Done():
+				deletesQueued.Dec()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	deletesInProgress.Inc()
+	return func() {
+		deletesInProgress.Dec()
+		if p.deleteSlots != nil {
+			<-p.deleteSlots
+		}
+	}, nil
+}
+
+func (p *nfsProvisioner) linkDirectory(srcDir string, destDir string, mode string) error {
+	dest := filepath.Join(mountPath, destDir)
+
+	var target string
+	switch mode {
+	case linkModeAbsolute:
+		target = filepath.Join(p.path, srcDir)
+	default:
+		rel, err := filepath.Rel(filepath.Dir(dest), filepath.Join(mountPath, srcDir))
+		if err != nil {
+			return err
+		}
+		target = rel
+	}
+	if err := dataFS.Symlink(target, dest); err != nil {
+		return err
+	}
+
+	// absolute links only resolve on the NFS server, check them against our own mount
+	resolved := dest
+	if mode == linkModeAbsolute {
+		resolved = filepath.Join(mountPath, srcDir)
+	}
+	if _, err := dataFS.Stat(resolved); err != nil {
+		dataFS.Remove(dest)
+		return fmt.Errorf("link %s -> %s does not resolve: %v", dest, target, err)
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if prefix := lookupSetting("archive-prefix"); prefix != "" {
+				archivePrefix = prefix
+			}
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flag.String(configFlag, "", "YAML file of flag names and values, for the flags not set on the command line or in the environment")
+	serverFlag := flag.String("nfs-server", "", "hostname or IP of the NFS server")
+	pathFlag := flag.String("nfs-path", "", "path of the export on the NFS server, mounted at "+mountPath)
+	provisionerNameFlag := flag.String("provisioner-name", "", "name of the provisioner StorageClasses refer to, e.g. fuseim.pri/ifs")
+	maxCloneSize := flag.String("max-clone-size", "", "default limit of the data copied by copy-data, e.g. 100Gi, overridden by the maxCloneSize parameter of the storage class")
+	maxConcurrentDeletes := flag.Int("max-concurrent-deletes", 0, "maximum number of volumes deleted at the same time, 0 for no limit")
+	maxConcurrentCopies := flag.Int("max-concurrent-copies", 0, "maximum number of clones copied at the same time, 0 for no limit")
+	strictCloneSource := flag.Bool("strict-clone-source", true, "fail copy-data provisioning when the source cannot be found, overridden by the strictCloneSource parameter of the storage class")
+	maxVolumesPerNamespace := flag.Int("max-volumes-per-namespace", 0, "maximum number of volumes of one storage class in a namespace, 0 for no limit, overridden by the maxVolumesPerNamespace parameter of the storage class")
+	maxVolumesPerExport := flag.Int("max-volumes-per-export", 0, "maximum number of directories in each directory of the export volumes are created in, including archived ones, 0 for no limit")
+	resticRepo := flag.String("restic-repository", "", "restic repository volumes are backed up to before they are removed or recycled, overridden by the resticRepository parameter of the storage class")
+	hookExec := flag.String("hook-exec", "", "command run after provisioning and before deleting a volume, with the event as argument and as JSON on stdin")
+	hookURL := flag.String("hook-url", "", "URL the event is POSTed to as JSON after provisioning and before deleting a volume")
+	hookTimeout := flag.Duration("hook-timeout", time.Minute, "timeout of -hook-exec and -hook-url")
+	provisionTimeout := flag.Duration("provision-timeout", 0, "maximum duration of provisioning a volume, including copies, after which it is cleaned up and retried, 0 for no limit")
+	deletionGracePeriod := flag.Duration("deletion-grace-period", 0, "how long the directories of deleted volumes are kept before they are removed or archived, so that deleted PVCs can be restored, 0 to delete them right away")
+	trashPurgeInterval := flag.Duration("trash-purge-interval", time.Hour, "interval of removing the volumes whose trashRetention expired from the trash, 0 to keep them")
+	deleteTimeout := flag.Duration("delete-timeout", 0, "maximum duration of deleting a volume, after which it is retried, 0 for no limit")
+	chaos := flag.String("chaos", "", "inject faults into the file system operations of provisioning and deletion, as latency=200ms,estale=0.01,enospc=0.001,seed=1, for staging clusters only")
+	faultInjection := flag.String("fault-injection", "", "YAML file with the probability, error and latency of the faults injected per file system operation, like -chaos, for staging clusters only")
+	flag.DurationVar(&fsTimeout, "fs-timeout", 0, "maximum duration of a single file system operation on the NFS mount, like mkdir or rename, 0 for no limit")
+	logMaxSize := flag.String("log-max-size", "100Mi", "size at which the log files written to -log_dir are rotated")
+	logMaxAge := flag.Duration("log-max-age", 7*24*time.Hour, "age at which rotated log files in -log_dir are removed, 0 to keep them")
+	eventWindow := flag.Duration("event-aggregation-window", 5*time.Minute, "window in which only the first event of each reason about an object is posted, the others are posted in aggregate when it ends, 0 to post all events")
+	eventBurst := flag.Int("event-burst", 10, "events of different reasons posted about an object in an -event-aggregation-window, 0 for no limit")
+	eventSampleEvery := flag.Int("event-sample-every", 1, "of repeated failures with the same reason on the same object, only log and post the first and every Nth, 1 to report all")
+	claimUsageInterval := flag.Duration("claim-usage-interval", 0, "how often bound PVCs are annotated with the usage of their volume, 0 to disable")
+	usageReportInterval := flag.Duration("usage-report-interval", time.Hour, "how often VolumeUsageReports are published, if the CRD is installed, 0 to disable")
+	idleAfter := flag.String("idle-after", "", "how long a volume was not used, according to -access-scan-interval, to be reported as idle, e.g. 180d, empty to disable")
+	idleReportInterval := flag.Duration("idle-report-interval", 24*time.Hour, "how often the idle volumes are published to -idle-report-configmap")
+	idleReportConfigMap := flag.String("idle-report-configmap", "", "name of the ConfigMap, in the namespace of the provisioner, the idle volumes are published to, <provisioner name>-idle-volumes if empty")
+	accessScanInterval := flag.Duration("access-scan-interval", 0, "how often the volumes are annotated with the latest modification and access times of their files, 0 to disable")
+	quotaCheckInterval := flag.Duration("quota-check-interval", 15*time.Minute, "how often the volumes of storage classes with a softQuota or hardQuota are measured, 0 to disable")
+	canaryEnabled := flag.Bool("canary", true, "provision, write, read back and delete a canary volume directory at startup")
+	canaryInterval := flag.Duration("canary-interval", 0, "how often the canary volume runs again after startup, 0 to only run it at startup")
+	probeInterval := flag.Duration("probe-interval", 0, "how often a PVC of -probe-class is created, bound, written and deleted as an end-to-end probe, 0 to disable")
+	probeClass := flag.String("probe-class", "", "storage class of the end-to-end probe PVCs, with Immediate volume binding")
+	probeNamespace := flag.String("probe-namespace", "", "namespace of the end-to-end probe PVCs, the namespace of the provisioner if empty")
+	probeTimeout := flag.Duration("probe-timeout", 2*time.Minute, "maximum duration of an end-to-end probe, after which it fails")
+	healthCheckInterval := flag.Duration("health-check-interval", 5*time.Minute, "how often the directories of all volumes are checked, 0 to disable")
+	metricsPort := flag.Int("metrics-port", 0, "port Prometheus metrics are served on at /metrics, 0 to disable")
+	freeSpaceWarning := flag.Float64("free-space-warning", 10, "percentage of free space on the export below which a warning event is posted, 0 to disable")
+	freeSpaceCritical := flag.Float64("free-space-critical", 5, "percentage of free space on the export below which a critical event is posted, 0 to disable")
+	pauseOnCritical := flag.Bool("pause-on-critical", false, "stop provisioning new volumes while the free space is below -free-space-critical")
+	archiveMetricsInterval := flag.Duration("archive-metrics-interval", 10*time.Minute, "how often the archives are scanned for their metrics, if -metrics-port is set, and checked against -archive-budget")
+	archiveBudget := flag.String("archive-budget", "", "total size of the archives, e.g. 2Ti, beyond which archives are removed in the order of the archiveEviction parameter of their storage class")
+	flag.StringVar(&archivePrefix, "archive-prefix", archivePrefix, "prefix of the directories volumes of storage classes without an archivePath template are archived to")
+	archiveMinFree := flag.Float64("archive-min-free", 0, "percentage of free space on the export below which archives are removed in the order of the archiveEviction parameter of their storage class, 0 to disable")
+	flag.IntVar(&usage.concurrency, "scan-concurrency", 1, "number of directories measured in parallel by disk usage scans")
+	flag.DurationVar(&usage.pace, "scan-pace", 0, "pause after reading each directory during disk usage scans, to limit the load on the NFS server")
+	flag.DurationVar(&usage.ttl, "scan-cache-ttl", time.Hour, "how long the size of a directory is reused while its modification time does not change, 0 to disable")
+	failOnInconsistency := flag.Bool("fail-on-inconsistency", false, "exit at startup if the export has orphan or missing directories, broken links or unreadable directories")
+	copyAttempts := flag.Int("copy-attempts", 5, "how often a failing clone copy is tried, with exponential backoff, before giving up")
+	linkCheckInterval := flag.Duration("link-check-interval", 10*time.Minute, "how often to look for linked volumes whose source no longer exists, 0 disables the check")
+	exportRoutesConfigMap := flag.String("export-routes", "", "name of the ConfigMap, in the namespace of the provisioner, routing the volumes of claims by their labels to directories of the export")
+	namespaceRootsConfigMap := flag.String("namespace-roots", "", "name of the ConfigMap, in the namespace of the provisioner, mapping namespaces to the directory below the export their volumes are created in")
+	markerCheck := flag.String("marker-check", markerCheckMismatch, "what deleting a directory requires of its marker file: mismatch (no marker or the marker of the deleted PV), strict (the marker of the deleted PV) or off")
+	var election leaderElection
+	flag.BoolVar(&election.enabled, "leader-elect", true, "run only one active replica, elected by a lease")
+	flag.StringVar(&election.lockType, "leader-elect-resource-lock", resourcelock.LeasesResourceLock, "type of the leader election lock object")
+	flag.StringVar(&election.namespace, "leader-elect-resource-namespace", "", "namespace of the leader election lock, the namespace of the provisioner if empty")
+	flag.StringVar(&election.name, "leader-elect-resource-name", "", "name of the leader election lock, the provisioner name with / replaced by - if empty")
+	flag.StringVar(&election.identity, "leader-elect-identity", "", "identity of this replica in the leader election, the hostname and a random suffix if empty")
+	flag.DurationVar(&election.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "how long other replicas wait before taking over the lease of a leader that stopped renewing it")
+	flag.DurationVar(&election.renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "how long the leader retries renewing its lease before giving up leadership, less than -leader-elect-lease-duration")
+	flag.DurationVar(&election.retryPeriod, "leader-elect-retry-period", 2*time.Second, "how often replicas try to acquire or renew the lease")
+	streamPort := flag.Int("stream-port", 0, "port the volumes of the export are served on to the provisioners of other exports, 0 to disable")
+	streamPeersFlag := flag.String("stream-peers", "", "comma separated exports of other storage classes which are not mounted, as server:/path=URL of their provisioner's -stream-port, whose volumes can be copied by copy-data")
+	streamTokenFile := flag.String("stream-token-file", "", "file with the token -stream-port and -stream-peers authenticate with")
+	dashboardPort := flag.Int("dashboard-port", 0, "port a read-only web dashboard is served on, 0 to disable")
+	dashboardTokenFile := flag.String("dashboard-token-file", "", "file with the token the dashboard accepts as password or bearer token")
+	dashboardScanInterval := flag.Duration("dashboard-scan-interval", 10*time.Minute, "interval the usage of the volumes shown on the dashboard is measured at")
+	rebalanceThreshold := flag.Float64("rebalance-threshold", 0, "percentage of the export in use above which volumes are planned to move to the -source-exports, 0 to disable")
+	rebalanceWindow := flag.String("rebalance-window", "", "daily maintenance window rebalancing runs in, in local time, e.g. 22:00-06:00, always if empty")
+	rebalanceInterval := flag.Duration("rebalance-interval", time.Hour, "how often the export is checked against -rebalance-threshold during -rebalance-window")
+	mirrorExportFlag := flag.String("mirror-export", "", "standby export mounted into the provisioner, as server:/path=/mount, which volumes with the mirror annotation are replicated to")
+	mirrorInterval := flag.Duration("mirror-interval", 15*time.Minute, "interval volumes are replicated to the -mirror-export at")
+	mountOptionsFlag := flag.String("mount-options", "", "comma separated mount options of every new volume, e.g. nconnect=8,noatime,vers=4.2, the mount options of its StorageClass override them")
+	zoneExportsFlag := flag.String("zone-exports", "", "comma separated exports of the export, or of a directory of it, to the nodes of a zone, as zone=server:/path or zone=server:/path=directory")
+	sourceExportsFlag := flag.String("source-exports", "", "comma separated exports of other storage classes mounted into the provisioner, as server:/path=/mount, whose volumes can be copied by copy-data")
+	brokenLinkAction := flag.String("broken-link-action", brokenLinkReport, "what to do with broken links: report, quarantine or repair")
 	flag.Parse()
-	flag.Set("logtostderr", "true")
+	sources, err := loadConfig(flag.CommandLine)
+	if err != nil {
+		glog.Fatalf("Invalid configuration: %v", err)
+	}
+
+	var logMaxBytes uint64
+	if *logMaxSize != "" {
+		q, err := resource.ParseQuantity(*logMaxSize)
+		if err != nil || q.Value() <= 0 {
+			glog.Fatalf("Invalid -log-max-size %q", *logMaxSize)
+		}
+		logMaxBytes = uint64(q.Value())
+	}
+	setupLogging(logMaxBytes, *logMaxAge)
+	logConfig(flag.CommandLine, sources)
+	handleVerbositySignals()
+
+	if *chaos != "" || *faultInjection != "" {
+		faulty, err := parseChaos(*chaos)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if *faultInjection != "" {
+			if err := faulty.loadFaultInjection(*faultInjection); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		glog.Warningf("chaos mode, injecting faults into the file system: %s", faulty)
+		dataFS = faulty
+	}
 
-	server := os.Getenv("NFS_SERVER")
+	server, path, provisionerName := *serverFlag, *pathFlag, *provisionerNameFlag
 	if server == "" {
-		glog.Fatal("NFS_SERVER not set")
+		glog.Fatal("-nfs-server or NFS_SERVER not set")
 	}
-	path := os.Getenv("NFS_PATH")
 	if path == "" {
-		glog.Fatal("NFS_PATH not set")
+		glog.Fatal("-nfs-path or NFS_PATH not set")
 	}
-	provisionerName := os.Getenv(provisionerNameKey)
 	if provisionerName == "" {
-		glog.Fatalf("environment variable %s is not set! Please set it.", provisionerNameKey)
+		glog.Fatalf("-provisioner-name or %s not set", provisionerNameKey)
+	}
+	if err := validateProvisionerName(provisionerName); err != nil {
+		glog.Fatal(err)
+	}
+	sourceExports, err := parseSourceExports(*sourceExportsFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if err := checkSourceExports(sourceExports); err != nil {
+		glog.Fatal(err)
+	}
+	zoneExports, err := parseZoneExports(*zoneExportsFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	mirrorExports, err := parseSourceExports(*mirrorExportFlag)
+	if err != nil || len(mirrorExports) > 1 {
+		glog.Fatalf("Invalid -mirror-export %q, must be one server:/path=/mount", *mirrorExportFlag)
+	}
+	if err := checkSourceExports(mirrorExports); err != nil {
+		glog.Fatal(err)
+	}
+	var idleAfterAge time.Duration
+	if *idleAfter != "" {
+		if idleAfterAge, err = parseAge(*idleAfter); err != nil || idleAfterAge <= 0 {
+			glog.Fatalf("Invalid -idle-after %q", *idleAfter)
+		}
+	}
+	window, err := parseMaintenanceWindow(*rebalanceWindow)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	streamPeers, err := parseStreamPeers(*streamPeersFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var streamToken string
+	if *streamPort > 0 || len(streamPeers) > 0 {
+		token, err := os.ReadFile(*streamTokenFile)
+		if err != nil || len(bytes.TrimSpace(token)) == 0 {
+			glog.Fatalf("-stream-port and -stream-peers require a token in -stream-token-file")
+		}
+		streamToken = string(bytes.TrimSpace(token))
+	}
+	var dashboardToken string
+	if *dashboardPort > 0 {
+		token, err := os.ReadFile(*dashboardTokenFile)
+		if err != nil || len(bytes.TrimSpace(token)) == 0 {
+			glog.Fatalf("-dashboard-port requires a token in -dashboard-token-file")
+		}
+		dashboardToken = string(bytes.TrimSpace(token))
 	}
 
 	// Create an InClusterConfig and use it to create a client for the controller
@@ -247,14 +1478,252 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Failed to create client: %v", err)
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		glog.Fatalf("Failed to create dynamic client: %v", err)
+	}
+
+	if *copyAttempts < 1 {
+		glog.Fatalf("Invalid -copy-attempts %d, must be at least 1", *copyAttempts)
+	}
+	switch *markerCheck {
+	case markerCheckStrict, markerCheckMismatch, markerCheckOff:
+	default:
+		glog.Fatalf("Invalid -marker-check %q, must be %s, %s or %s", *markerCheck, markerCheckStrict, markerCheckMismatch, markerCheckOff)
+	}
+	var maxCloneBytes int64
+	if *maxCloneSize != "" {
+		q, err := resource.ParseQuantity(*maxCloneSize)
+		if err != nil {
+			glog.Fatalf("Invalid -max-clone-size: %v", err)
+		}
+		maxCloneBytes = q.Value()
+	}
+	var archiveBudgetBytes int64 = -1
+	if *archiveBudget != "" {
+		q, err := resource.ParseQuantity(*archiveBudget)
+		if err != nil {
+			glog.Fatalf("Invalid -archive-budget: %v", err)
+		}
+		archiveBudgetBytes = q.Value()
+	}
+	if err := validArchivePrefix(archivePrefix); err != nil {
+		glog.Fatalf("Invalid -archive-prefix: %v", err)
+	}
+
+	broadcaster := events.NewEventBroadcasterAdapter(clientset)
+	broadcaster.StartRecordingToSink(wait.NeverStop)
 
 	clientNFSProvisioner := &nfsProvisioner{
-		client: clientset,
-		server: server,
-		path:   path,
+		client:   clientset,
+		recorder: broadcaster.NewRecorder(provisionerName),
+		name:     provisionerName,
+		server:   server,
+		path:     path,
+
+		dynamicClient: dynamicClient,
+		sampler:       newEventSampler(*eventSampleEvery),
+		operations:    newOperationTracker(),
+		recent:        &recentWarnings{},
+
+		maxCloneSize: maxCloneBytes,
+		copyAttempts: *copyAttempts,
+
+		strictCloneSource:      *strictCloneSource,
+		maxVolumesPerNamespace: *maxVolumesPerNamespace,
+		maxVolumesPerExport:    *maxVolumesPerExport,
+		resticRepo:             *resticRepo,
+		markerCheck:            *markerCheck,
+		rootsConfigMap:         *namespaceRootsConfigMap,
+		routesConfigMap:        *exportRoutesConfigMap,
+		rootsNamespace:         podNamespace(),
+		sourceExports:          sourceExports,
+		zoneExports:            zoneExports,
+		defaultMountOptions:    parseMountOptions(*mountOptionsFlag),
+		gracePeriod:            *deletionGracePeriod,
+		streamPeers:            streamPeers,
+		streamToken:            streamToken,
+	}
+	clientNFSProvisioner.limiter = newEventLimiter(*eventWindow, *eventBurst, clientNFSProvisioner.postEvent)
+	go clientNFSProvisioner.limiter.Run(context.Background())
+	if *hookExec != "" {
+		clientNFSProvisioner.hooks = append(clientNFSProvisioner.hooks, &execHook{command: *hookExec, timeout: *hookTimeout})
+	}
+	if *hookURL != "" {
+		clientNFSProvisioner.hooks = append(clientNFSProvisioner.hooks, &webhookHook{url: *hookURL, client: &http.Client{Timeout: *hookTimeout}})
+	}
+	if *maxConcurrentCopies > 0 {
+		clientNFSProvisioner.copySlots = make(chan struct{}, *maxConcurrentCopies)
+	}
+	if *maxConcurrentDeletes > 0 {
+		clientNFSProvisioner.deleteSlots = make(chan struct{}, *maxConcurrentDeletes)
+	}
+	// every replica serves streams, not only the leader
+	if *streamPort > 0 {
+		go clientNFSProvisioner.serveStreams(*streamPort, streamToken)
+	}
+	if hasResource(clientset, storageTenantResource) {
+		factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 10*time.Minute)
+		informer := factory.ForResource(storageTenantResource).Informer()
+		clientNFSProvisioner.tenants = informer.GetStore()
+		factory.Start(wait.NeverStop)
+		if !cache.WaitForCacheSync(wait.NeverStop, informer.HasSynced) {
+			glog.Fatalf("StorageTenant cache fail to sync")
+		}
+	} else {
+		glog.Infof("StorageTenant CRD is not installed, tenants disabled")
+	}
+	if *namespaceRootsConfigMap != "" {
+		if _, err := clientNFSProvisioner.namespaceRoots(context.Background()); err != nil {
+			glog.Warningf("%s, volumes of all namespaces fail to provision until it is fixed", err.Error())
+		}
+	}
+	if err := clientNFSProvisioner.checkProvisionerName(context.Background()); err != nil {
+		glog.Warningf("provisioner name check fail: %s", err.Error())
 	}
+	report, err := clientNFSProvisioner.checkConsistency(context.Background())
+	if err != nil {
+		glog.Warningf("export consistency check fail: %s", err.Error())
+	} else {
+		logConsistency(report)
+		if *failOnInconsistency && !report.consistent() {
+			glog.Fatalf("Export %s:%s is inconsistent with the persistent volumes", server, path)
+		}
+	}
+
 	// Start the provision controller which will dynamically provision efs NFS
 	// PVs
-	pc := controller.NewProvisionController(context.Background(), clientset, provisionerName, clientNFSProvisioner)
-	pc.Run(context.Background())
+	// share the informers with the provision controller, which does not start them itself
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	classInformer := informerFactory.Storage().V1().StorageClasses()
+	claimInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+	volumeInformer := informerFactory.Core().V1().PersistentVolumes()
+	clientNFSProvisioner.classLister = classInformer.Lister()
+	clientNFSProvisioner.claimLister = claimInformer.Lister()
+	clientNFSProvisioner.volumeLister = volumeInformer.Lister()
+	if err := clientNFSProvisioner.watchCloneSources(claimInformer.Informer()); err != nil {
+		glog.Fatalf("Failed to watch clone sources: %v", err)
+	}
+	if err := clientNFSProvisioner.watchClasses(classInformer.Informer()); err != nil {
+		glog.Fatalf("Failed to watch storage classes: %v", err)
+	}
+	if err := clientNFSProvisioner.watchResizes(claimInformer.Informer()); err != nil {
+		glog.Fatalf("Failed to watch claim resizes: %v", err)
+	}
+
+	pc := controller.NewProvisionController(context.Background(), clientset, provisionerName, clientNFSProvisioner,
+		controller.ClassesInformer(classInformer.Informer()),
+		controller.ClaimsInformer(claimInformer.Informer()),
+		controller.VolumesInformer(volumeInformer.Informer()),
+		controller.MetricsPort(int32(*metricsPort)),
+		controller.ProvisionTimeout(*provisionTimeout),
+		controller.DeletionTimeout(*deleteTimeout),
+		// elected in main, so the lease can be configured
+		controller.LeaderElection(false))
+	informerFactory.Start(context.Background().Done())
+	if len(mirrorExports) > 0 && *mirrorInterval > 0 {
+		clientNFSProvisioner.mirrorExport = &mirrorExports[0]
+	}
+	var checker *linkChecker
+	if *linkCheckInterval > 0 {
+		if checker, err = newLinkChecker(clientNFSProvisioner, *brokenLinkAction); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	probeNS := *probeNamespace
+	if probeNS == "" {
+		probeNS = podNamespace()
+	}
+	if *probeInterval > 0 && *probeClass == "" {
+		glog.Fatalf("-probe-interval needs -probe-class")
+	}
+	if *freeSpaceWarning > 0 || *freeSpaceCritical > 0 || *metricsPort > 0 {
+		go newCapacityMonitor(clientNFSProvisioner, *freeSpaceWarning, *freeSpaceCritical, *pauseOnCritical).Run(context.Background())
+	}
+	// every replica serves the dashboard, only the leader measures the volumes
+	var d *dashboard
+	if *dashboardPort > 0 {
+		d = newDashboard(clientNFSProvisioner, dashboardToken)
+		go clientNFSProvisioner.serveDashboard(*dashboardPort, d)
+	}
+
+	// the background work changes volumes and posts events, only the leader does it
+	lead := func(ctx context.Context) {
+		go newSnapshotter(clientNFSProvisioner).Run(ctx)
+		if _, err := clientset.Discovery().ServerResourcesForGroupVersion(volumeBackupResource.GroupVersion().String()); err == nil {
+			go newBackupController(clientNFSProvisioner, dynamicClient).Run(ctx)
+		} else {
+			glog.Infof("VolumeBackup CRD is not installed, backup controller disabled")
+		}
+		if *claimUsageInterval > 0 {
+			go newClaimUsageMonitor(clientNFSProvisioner).Run(ctx, *claimUsageInterval)
+		}
+		if *usageReportInterval > 0 {
+			if hasResource(clientset, volumeUsageReportResource) {
+				go newUsageReporter(clientNFSProvisioner, dynamicClient).Run(ctx, *usageReportInterval)
+			} else {
+				glog.Infof("VolumeUsageReport CRD is not installed, usage reports disabled")
+			}
+		}
+		go newSyncer(clientNFSProvisioner).Run(ctx)
+		if checker != nil {
+			go checker.Run(ctx, *linkCheckInterval)
+		}
+		if *trashPurgeInterval > 0 {
+			go wait.Until(func() { purgeTrash(mountPath, time.Now()) }, *trashPurgeInterval, ctx.Done())
+		}
+		if (*metricsPort > 0 || archiveBudgetBytes >= 0 || *archiveMinFree > 0 || clientNFSProvisioner.tenants != nil) && *archiveMetricsInterval > 0 {
+			go wait.Until(func() {
+				if n := clientNFSProvisioner.provisioning.Load(); n > 0 {
+					glog.V(4).Infof("skipping archive scan, %d volumes are being provisioned", n)
+					return
+				}
+				clientNFSProvisioner.enforceArchiveRetention(time.Now())
+				if archiveBudgetBytes >= 0 || *archiveMinFree > 0 {
+					clientNFSProvisioner.enforceArchiveBudget(mountPath, archiveBudgetBytes, *archiveMinFree)
+				}
+				if *metricsPort > 0 {
+					updateArchiveMetrics(mountPath)
+				}
+			}, *archiveMetricsInterval, ctx.Done())
+		}
+		if *quotaCheckInterval > 0 {
+			go newQuotaMonitor(clientNFSProvisioner).Run(ctx, *quotaCheckInterval)
+		}
+		if *accessScanInterval > 0 {
+			go newAccessMonitor(clientNFSProvisioner).Run(ctx, *accessScanInterval)
+		}
+		if idleAfterAge > 0 && *idleReportInterval > 0 {
+			if *accessScanInterval == 0 {
+				glog.Warningf("-idle-after reports no volumes without -access-scan-interval")
+			}
+			name := *idleReportConfigMap
+			if name == "" {
+				name = idleReportName(provisionerName)
+			}
+			go newIdleReporter(clientNFSProvisioner, idleAfterAge, podNamespace(), name).Run(ctx, *idleReportInterval)
+		}
+		if *rebalanceThreshold > 0 && *rebalanceInterval > 0 {
+			go newRebalancer(clientNFSProvisioner, *rebalanceThreshold, window).Run(ctx, *rebalanceInterval)
+		}
+		if *canaryEnabled {
+			go newCanary(clientNFSProvisioner).Run(ctx, *canaryInterval)
+		}
+		if *probeInterval > 0 {
+			go newEndToEndProbe(clientNFSProvisioner, *probeClass, probeNS, *probeTimeout).Run(ctx, *probeInterval)
+		}
+		if *healthCheckInterval > 0 {
+			go newHealthMonitor(clientNFSProvisioner).Run(ctx, *healthCheckInterval)
+		}
+		if d != nil {
+			go d.Run(ctx, *dashboardScanInterval)
+		}
+		if len(mirrorExports) > 0 && *mirrorInterval > 0 {
+			go newMirrorer(clientNFSProvisioner, mirrorExports[0], *mirrorInterval).Run(ctx)
+		}
+		pc.Run(ctx)
+	}
+	if err := election.run(context.Background(), clientset, broadcaster.DeprecatedNewLegacyRecorder(provisionerName), provisionerName, lead); err != nil {
+		glog.Fatalf("Leader election fail: %v", err)
+	}
 }
@@ -0,0 +1,279 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+const (
+	testProvisionerName = "nchc.ai/nfs"
+	testServer          = "nfs.example.com"
+	testExport          = "/exports"
+)
+
+// useTempMount points mountPath to an empty directory for the duration of the test.
+func useTempMount(t *testing.T) string {
+	t.Helper()
+	old := mountPath
+	mountPath = t.TempDir()
+	t.Cleanup(func() { mountPath = old })
+	return mountPath
+}
+
+// injectFaults makes every operation ops of dataFS fail with errno for the
+// duration of the test.
+func injectFaults(t *testing.T, errno syscall.Errno, ops ...string) {
+	t.Helper()
+	f := &faultyFS{fs: osFS{}, rules: map[string]*faultRule{}, rand: rand.New(rand.NewSource(1))}
+	for _, op := range ops {
+		f.rules[op] = &faultRule{Probability: 1, Error: faultErrorName(errno), errno: errno}
+	}
+	old := dataFS
+	dataFS = f
+	t.Cleanup(func() { dataFS = old })
+}
+
+// newTestProvisioner returns a provisioner of the export testServer:testExport,
+// mounted at a temporary mountPath, with a fake client holding objects.
+func newTestProvisioner(t *testing.T, markerCheck string, objects ...runtime.Object) *nfsProvisioner {
+	t.Helper()
+	useTempMount(t)
+	return &nfsProvisioner{
+		client:      fake.NewSimpleClientset(objects...),
+		name:        testProvisionerName,
+		server:      testServer,
+		path:        testExport,
+		markerCheck: markerCheck,
+	}
+}
+
+func testClass(name string, parameters map[string]string) *storage.StorageClass {
+	reclaim := v1.PersistentVolumeReclaimDelete
+	return &storage.StorageClass{
+		ObjectMeta:    metav1.ObjectMeta{Name: name},
+		Provisioner:   testProvisionerName,
+		Parameters:    parameters,
+		ReclaimPolicy: &reclaim,
+	}
+}
+
+func testClaim(namespace, name string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name), Annotations: annotations},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			Resources: v1.VolumeResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	}
+}
+
+// testVolume returns the PV name of the claim {namespace/claim} of class,
+// provisioned into the directory dir below mountPath.
+func testVolume(name, class, namespace, claim, dir string, annotations map[string]string) *v1.PersistentVolume {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annProvisionedBy] = testProvisionerName
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: class,
+			ClaimRef:         &v1.ObjectReference{Namespace: namespace, Name: claim, UID: types.UID("uid-" + claim)},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Server: testServer, Path: filepath.Join(testExport, dir)},
+			},
+		},
+	}
+}
+
+// makeVolumeDirectory creates the directory of volume below mountPath, with
+// its marker and a file data holding content.
+func makeVolumeDirectory(t *testing.T, volume *v1.PersistentVolume, dir, content string) {
+	t.Helper()
+	full := filepath.Join(mountPath, dir)
+	if err := os.MkdirAll(full, 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(full, "data"), content)
+	m := &volumeMarker{
+		Provisioner:    testProvisionerName,
+		Volume:         volume.Name,
+		ClaimNamespace: volume.Spec.ClaimRef.Namespace,
+		ClaimName:      volume.Spec.ClaimRef.Name,
+		ClaimUID:       string(volume.Spec.ClaimRef.UID),
+		StorageClass:   volume.Spec.StorageClassName,
+	}
+	if err := writeMarker(full, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the content of path, "" if it does not exist.
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestProvisionFailureCleanup(t *testing.T) {
+	const dir = "default-new-pv-new"
+	tests := []struct {
+		name string
+		// setup prepares the export before provisioning the claim new of class nfs
+		setup       func(t *testing.T, p *nfsProvisioner)
+		annotations map[string]string
+		// check verifies the export after provisioning failed
+		check func(t *testing.T)
+	}{
+		{
+			name: "new directory is removed",
+			check: func(t *testing.T) {
+				if pathExists(filepath.Join(mountPath, dir)) {
+					t.Errorf("%s of the failed attempt is kept", dir)
+				}
+			},
+		},
+		{
+			name: "directory of an earlier attempt is removed",
+			setup: func(t *testing.T, p *nfsProvisioner) {
+				makeVolumeDirectory(t, testVolume("pv-new", "nfs", "default", "new", dir, nil), dir, "partial")
+			},
+			check: func(t *testing.T) {
+				if pathExists(filepath.Join(mountPath, dir)) {
+					t.Errorf("%s of the earlier attempt is kept", dir)
+				}
+			},
+		},
+		{
+			name: "reused directory is kept",
+			setup: func(t *testing.T, p *nfsProvisioner) {
+				writeTestFile(t, filepath.Join(mountPath, dir, "data"), "by hand")
+			},
+			check: func(t *testing.T) {
+				if got := readTestFile(t, filepath.Join(mountPath, dir, "data")); got != "by hand" {
+					t.Errorf("data of the reused directory = %q, want %q", got, "by hand")
+				}
+			},
+		},
+		{
+			name:        "undeleted data is moved back to the trash",
+			setup:       deleteOldClaim(onDeleteTrash),
+			annotations: map[string]string{annUndeleteFrom: "old"},
+			check: func(t *testing.T) {
+				if got := readTestFile(t, filepath.Join(trashPath(mountPath, "pv-old"), trashData, "data")); got != "old" {
+					t.Errorf("data in the trash = %q, want %q", got, "old")
+				}
+				if _, err := readTrash(mountPath, "pv-old"); err != nil {
+					t.Errorf("trash entry of pv-old: %v", err)
+				}
+				if pathExists(filepath.Join(mountPath, dir)) {
+					t.Errorf("%s of the failed attempt is kept", dir)
+				}
+			},
+		},
+		{
+			name:        "undeleted data is moved back to the archive",
+			setup:       deleteOldClaim(onDeleteArchive),
+			annotations: map[string]string{annUndeleteFrom: "old"},
+			check: func(t *testing.T) {
+				if got := readTestFile(t, filepath.Join(mountPath, archivePrefix+"default-old-pv-old", "data")); got != "old" {
+					t.Errorf("data in the archive = %q, want %q", got, "old")
+				}
+				if _, err := findArchive("default", "old"); err != nil {
+					t.Errorf("archive of pvc {default/old}: %v", err)
+				}
+				if pathExists(filepath.Join(mountPath, dir)) {
+					t.Errorf("%s of the failed attempt is kept", dir)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("nfs", nil)
+			p := newTestProvisioner(t, markerCheckStrict, class)
+			if tt.setup != nil {
+				tt.setup(t, p)
+			}
+			// the marker of the new volume cannot be written
+			injectFaults(t, syscall.EROFS, "write")
+			options := controller.ProvisionOptions{
+				StorageClass: class,
+				PVName:       "pv-new",
+				PVC:          testClaim("default", "new", tt.annotations),
+			}
+			if _, _, err := p.Provision(context.Background(), options); err == nil {
+				t.Fatal("Provision() succeeded, want the marker write to fail")
+			}
+			tt.check(t)
+		})
+	}
+}
+
+// deleteOldClaim returns a setup which provisions the directory of the claim
+// old, holding "old", and deletes its volume pv-old with onDelete.
+func deleteOldClaim(onDelete string) func(t *testing.T, p *nfsProvisioner) {
+	return func(t *testing.T, p *nfsProvisioner) {
+		t.Helper()
+		class := testClass("old", map[string]string{paramOnDelete: onDelete})
+		if _, err := p.client.StorageV1().StorageClasses().Create(context.Background(), class, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		volume := testVolume("pv-old", "old", "default", "old", "default-old-pv-old", nil)
+		makeVolumeDirectory(t, volume, "default-old-pv-old", "old")
+		if err := p.Delete(context.Background(), volume); err != nil {
+			t.Fatalf("Delete() = %v", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// validateProvisionerName verifies that name can be used as the provisioner of
+// StorageClasses, e.g. fuseim.pri/ifs.
+func validateProvisionerName(name string) error {
+	if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+		return fmt.Errorf("invalid provisioner name %q: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// checkProvisionerName warns about the PVs on the export which were provisioned
+// under another name. The provisioner ignores them, so renaming it orphans
+// their directories: they are never deleted or archived.
+func (p *nfsProvisioner) checkProvisionerName(ctx context.Context) error {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	export := filepath.Clean(p.path) + "/"
+	others := map[string][]string{}
+	for _, pv := range pvs.Items {
+		name, ok := pv.Annotations[annProvisionedBy]
+		if !ok || name == p.name || pv.Spec.NFS == nil {
+			continue
+		}
+		if pv.Spec.NFS.Server != p.server || !strings.HasPrefix(filepath.Clean(pv.Spec.NFS.Path), export) {
+			continue
+		}
+		others[name] = append(others[name], pv.Name)
+	}
+
+	names := make([]string, 0, len(others))
+	for name := range others {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		volumes := others[name]
+		sort.Strings(volumes)
+		list := strings.Join(volumes, ", ")
+		if len(volumes) > 5 {
+			list = fmt.Sprintf("%s and %d more", strings.Join(volumes[:5], ", "), len(volumes)-5)
+		}
+		glog.Warningf("%d volumes on %s:%s were provisioned under another name, they are not deleted or archived by this provisioner:\n- %s: %s (%s)\n+ %s: %s",
+			len(volumes), p.server, p.path, annProvisionedBy, name, list, annProvisionedBy, p.name)
+	}
+	return nil
+}
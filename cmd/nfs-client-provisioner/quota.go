@@ -0,0 +1,269 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// paramSoftQuota is the usage, in percent of the requested capacity, above
+	// which a Warning event is posted on the claim, e.g. "90"
+	paramSoftQuota = "softQuota"
+	// paramHardQuota is the usage, in percent of the requested capacity, above
+	// which the volume is flagged with annQuotaExceeded, e.g. "110"
+	paramHardQuota = "hardQuota"
+
+	// annQuotaExceeded is set on a PV while it uses more than its hard quota.
+	// The provisioner stops writing into it, e.g. by re-syncs.
+	annQuotaExceeded = "nchc.ai/quota-exceeded"
+
+	// paramQuotaAction is what happens to the volumes of the class above their
+	// hard quota besides annQuotaExceeded
+	paramQuotaAction = "quotaAction"
+	// quotaActionWarn only posts the HardQuotaExceeded event
+	quotaActionWarn = "warn"
+	// quotaActionReadOnly adds the ro mount option to the PV, which applies
+	// when the volume is mounted next, the NFS source of a PV cannot change
+	quotaActionReadOnly = "readOnly"
+	// quotaActionBlock refuses to clone or snapshot the volume
+	quotaActionBlock = "block"
+	// annQuotaReadOnly is set on a PV made read-only by quotaActionReadOnly,
+	// "true" if the ro mount option was added and is removed with it
+	annQuotaReadOnly = "nchc.ai/quota-read-only"
+)
+
+// errOverQuota is returned for volumes quotaActionBlock does not clone.
+var errOverQuota = errors.New("volume over its hard quota")
+
+const (
+	quotaOK = iota
+	quotaSoft
+	quotaHard
+)
+
+// quotaMonitor periodically measures the volumes of classes with quotas. The
+// NFS client cannot limit what users write, quotas are reported instead.
+type quotaMonitor struct {
+	p *nfsProvisioner
+	// levels maps the volumes above a quota to the highest one, an event is
+	// only posted when a volume exceeds a quota
+	levels map[string]int
+}
+
+func newQuotaMonitor(p *nfsProvisioner) *quotaMonitor {
+	return &quotaMonitor{p: p, levels: map[string]int{}}
+}
+
+func (m *quotaMonitor) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, m.check, interval)
+}
+
+func (m *quotaMonitor) check(ctx context.Context) {
+	pvs, err := m.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for quota check fail: %s", err.Error())
+		return
+	}
+
+	volumeUsedBytes.Reset()
+	volumeUsedInodes.Reset()
+	levels := map[string]int{}
+	for _, pv := range pvs {
+		if !m.p.ownsVolume(pv) || pv.Spec.StorageClassName == "" {
+			continue
+		}
+		class, err := m.p.getClassForVolume(ctx, pv)
+		if err != nil {
+			continue
+		}
+		soft, hard, err := quotaLimits(class)
+		if err != nil {
+			glog.Warningf("storage class %s: %s", class.Name, err.Error())
+			continue
+		}
+		action, err := quotaAction(class)
+		if err != nil {
+			glog.Warningf("storage class %s: %s", class.Name, err.Error())
+			continue
+		}
+		request := pv.Spec.Capacity[v1.ResourceStorage]
+		inodes := volumeInodeLimit(pv)
+		if ((soft == 0 && hard == 0) || request.Value() == 0) && inodes == 0 {
+			continue
+		}
+		// linked volumes share the data, and the quota, of their source
+		dir := filepath.Join(mountPath, m.p.volumeDirectory(pv))
+		if info, err := dataFS.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		used, files, err := dirInodes(dir)
+		if err != nil {
+			glog.Warningf("usage of volume %s fail: %s", pv.Name, err.Error())
+			continue
+		}
+
+		var namespace, claim string
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			namespace, claim = ref.Namespace, ref.Name
+		}
+		volumeUsedBytes.WithLabelValues(pv.Name, namespace, claim, pv.Spec.StorageClassName).Set(float64(used))
+		volumeUsedInodes.WithLabelValues(pv.Name, namespace, claim, pv.Spec.StorageClassName).Set(float64(files))
+
+		level, limit := quotaOK, 0.0
+		switch {
+		case request.Value() == 0:
+		case hard > 0 && float64(used) > float64(request.Value())*hard/100:
+			level, limit = quotaHard, hard
+		case soft > 0 && float64(used) > float64(request.Value())*soft/100:
+			level, limit = quotaSoft, soft
+		}
+		// the inode limit is a hard quota of its own, the softQuota applies to it too
+		inodeLevel := quotaOK
+		switch {
+		case inodes == 0:
+		case files > inodes:
+			inodeLevel = quotaHard
+		case soft > 0 && float64(files) > float64(inodes)*soft/100:
+			inodeLevel = quotaSoft
+		}
+		if max(level, inodeLevel) != quotaOK {
+			levels[pv.Name] = max(level, inodeLevel)
+		}
+		if max(level, inodeLevel) > m.levels[pv.Name] {
+			reason := reasonSoftQuotaExceeded
+			if max(level, inodeLevel) == quotaHard {
+				reason = reasonHardQuotaExceeded
+			}
+			if inodeLevel > level && inodeLevel == quotaHard {
+				m.p.warnVolume(pv, reason, "volume %s holds %d files and directories, more than its inode limit of %d", pv.Name, files, inodes)
+			} else if inodeLevel > level {
+				m.p.warnVolume(pv, reason, "volume %s holds %d files and directories, more than %g%% of its inode limit of %d", pv.Name, files, soft, inodes)
+			} else {
+				m.p.warnVolume(pv, reason, "volume %s uses %s, more than %g%% of the requested %s", pv.Name, formatBytes(used), limit, request.String())
+			}
+		} else if max(level, inodeLevel) < m.levels[pv.Name] {
+			glog.Infof("volume %s uses %s, within its quota again", pv.Name, formatBytes(used))
+		}
+		if err := m.p.flagQuotaExceeded(ctx, pv, max(level, inodeLevel) == quotaHard, action); err != nil {
+			glog.Warningf("update %s of pv %s fail: %s", annQuotaExceeded, pv.Name, err.Error())
+		}
+	}
+	m.levels = levels
+}
+
+// quotaLimits returns the soft and hard quota of class in percent of the request, 0 if not set.
+func quotaLimits(class *storage.StorageClass) (soft, hard float64, err error) {
+	for param, limit := range map[string]*float64{paramSoftQuota: &soft, paramHardQuota: &hard} {
+		value, ok := class.Parameters[param]
+		if !ok {
+			continue
+		}
+		*limit, err = strconv.ParseFloat(value, 64)
+		if err != nil || *limit <= 0 {
+			return 0, 0, misconfigured("invalid %s %q, must be a percentage of the requested capacity", param, value)
+		}
+	}
+	if soft > 0 && hard > 0 && hard < soft {
+		return 0, 0, misconfigured("%s %g must not be below %s %g", paramHardQuota, hard, paramSoftQuota, soft)
+	}
+	return soft, hard, nil
+}
+
+// quotaAction returns what happens to the volumes of class above their hard quota.
+func quotaAction(class *storage.StorageClass) (string, error) {
+	action, ok := class.Parameters[paramQuotaAction]
+	if !ok {
+		return quotaActionWarn, nil
+	}
+	switch action {
+	case quotaActionWarn, quotaActionReadOnly, quotaActionBlock:
+		return action, nil
+	}
+	return "", misconfigured("invalid %s %q, must be %q, %q or %q", paramQuotaAction, action, quotaActionWarn, quotaActionReadOnly, quotaActionBlock)
+}
+
+// flagQuotaExceeded sets or removes annQuotaExceeded on pv, and the ro mount
+// option while it is exceeded with quotaActionReadOnly.
+func (p *nfsProvisioner) flagQuotaExceeded(ctx context.Context, pv *v1.PersistentVolume, exceeded bool, action string) error {
+	_, flagged := pv.Annotations[annQuotaExceeded]
+	_, readOnly := pv.Annotations[annQuotaReadOnly]
+	makeReadOnly := exceeded && action == quotaActionReadOnly
+	if flagged == exceeded && readOnly == makeReadOnly {
+		return nil
+	}
+	pv = pv.DeepCopy()
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	if exceeded {
+		pv.Annotations[annQuotaExceeded] = "true"
+	} else {
+		delete(pv.Annotations, annQuotaExceeded)
+	}
+	if makeReadOnly && !readOnly {
+		// "false" records that the volume was mounted read-only anyway
+		pv.Annotations[annQuotaReadOnly] = "false"
+		if !slices.Contains(pv.Spec.MountOptions, "ro") {
+			pv.Annotations[annQuotaReadOnly] = "true"
+			pv.Spec.MountOptions = append(pv.Spec.MountOptions, "ro")
+		}
+	} else if !makeReadOnly && readOnly {
+		added := pv.Annotations[annQuotaReadOnly] == "true"
+		delete(pv.Annotations, annQuotaReadOnly)
+		var options []string
+		for _, o := range pv.Spec.MountOptions {
+			if o != "ro" || !added {
+				options = append(options, o)
+			}
+		}
+		pv.Spec.MountOptions = options
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update pv %s: %w", pv.Name, err)
+	}
+	return nil
+}
+
+// blockedByQuota returns errOverQuota if pv is above its hard quota and its
+// class blocks clones and snapshots of such volumes.
+func (p *nfsProvisioner) blockedByQuota(ctx context.Context, pv *v1.PersistentVolume) error {
+	if pv.Annotations[annQuotaExceeded] != "true" {
+		return nil
+	}
+	class, err := p.getClassForVolume(ctx, pv)
+	if err != nil {
+		glog.Warningf("quota action of pv %s unknown: %s", pv.Name, err.Error())
+		return nil
+	}
+	if action, _ := quotaAction(class); action != quotaActionBlock {
+		return nil
+	}
+	return fmt.Errorf("%w: pv %s uses more than the %s of storage class %s, which blocks clones and snapshots", errOverQuota, pv.Name, paramHardQuota, class.Name)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// maintenanceWindow is a daily time range in the local time of the provisioner,
+// which may wrap around midnight, e.g. 22:00-06:00. The zero value is always open.
+type maintenanceWindow struct {
+	start, end time.Duration
+}
+
+func parseMaintenanceWindow(value string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	if value == "" {
+		return w, nil
+	}
+	from, to, ok := strings.Cut(value, "-")
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil {
+		return w, fmt.Errorf("invalid maintenance window %q, must be HH:MM-HH:MM", value)
+	}
+	w.start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	w.end = time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute
+	return w, nil
+}
+
+// contains reports whether t is in the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	if w.start == w.end {
+		return true
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start < w.end {
+		return now >= w.start && now < w.end
+	}
+	return now >= w.start || now < w.end
+}
+
+// rebalanceVolume is a volume of the export which could be moved.
+type rebalanceVolume struct {
+	pv       *v1.PersistentVolume
+	size     int64
+	lastUsed time.Time
+}
+
+// rebalancer looks for volumes to move off the export while it is fuller than
+// threshold percent. The source of a PV cannot be changed and its claim cannot
+// be bound to another PV, so a volume can only move by recreating its claim,
+// which the provisioner must not do to running workloads. The rebalancer plans
+// the moves instead, to the fullest exports the least recently used volumes
+// first, and reports them for the owners of the volumes to carry out.
+type rebalancer struct {
+	p         *nfsProvisioner
+	threshold float64
+	window    maintenanceWindow
+}
+
+func newRebalancer(p *nfsProvisioner, threshold float64, window maintenanceWindow) *rebalancer {
+	return &rebalancer{p: p, threshold: threshold, window: window}
+}
+
+func (r *rebalancer) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, r.check, interval)
+}
+
+func (r *rebalancer) check(ctx context.Context) {
+	if !r.window.contains(time.Now()) {
+		return
+	}
+	free, total, err := exportCapacity(mountPath)
+	if err != nil || total == 0 {
+		glog.Warningf("statfs %s for rebalancing fail: %v", mountPath, err)
+		return
+	}
+	used := total - free
+	excess := used - int64(r.threshold*float64(total)/100)
+	if excess <= 0 {
+		glog.V(4).Infof("export %s:%s is %.1f%% full, below the rebalance threshold", r.p.server, r.p.path, float64(used)*100/float64(total))
+		return
+	}
+
+	targets := r.targets()
+	if len(targets) == 0 {
+		glog.Warningf("export %s:%s is above the rebalance threshold of %.0f%%, but no source export has room", r.p.server, r.p.path, r.threshold)
+		return
+	}
+	candidates, err := r.candidates(ctx)
+	if err != nil {
+		glog.Warningf("list volumes for rebalancing fail: %s", err.Error())
+		return
+	}
+	for _, c := range candidates {
+		if excess <= 0 {
+			return
+		}
+		// the emptiest target which stays below the threshold with the volume
+		sort.Slice(targets, func(i, j int) bool { return targets[i].room > targets[j].room })
+		if targets[0].room < c.size {
+			continue
+		}
+		t := &targets[0]
+		t.room -= c.size
+		excess -= c.size
+		r.p.warnVolume(c.pv, reasonRebalanceCandidate, "volume %s (%s, last used %s) should move from %s:%s, which is above %.0f%% full, to %s:%s",
+			c.pv.Name, formatBytes(c.size), c.lastUsed.Format(time.RFC3339), r.p.server, r.p.path, r.threshold, t.export.server, t.export.path)
+	}
+	if excess > 0 {
+		glog.Warningf("export %s:%s stays %s above the rebalance threshold, the source exports have no more room", r.p.server, r.p.path, formatBytes(excess))
+	}
+}
+
+// rebalanceTarget is a source export with room below the threshold.
+type rebalanceTarget struct {
+	export sourceExport
+	room   int64
+}
+
+func (r *rebalancer) targets() []rebalanceTarget {
+	var targets []rebalanceTarget
+	for _, e := range r.p.sourceExports {
+		free, total, err := exportCapacity(e.mount)
+		if err != nil || total == 0 {
+			glog.Warningf("statfs %s for rebalancing fail: %v", e.mount, err)
+			continue
+		}
+		if room := int64(r.threshold*float64(total)/100) - (total - free); room > 0 {
+			targets = append(targets, rebalanceTarget{export: e, room: room})
+		}
+	}
+	return targets
+}
+
+// candidates returns the volumes of the export which hold data of their own,
+// the least recently used first.
+func (r *rebalancer) candidates(ctx context.Context) ([]rebalanceVolume, error) {
+	pvs, err := r.p.listVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []rebalanceVolume
+	for _, pv := range pvs {
+		// volumes on dedicated tenant exports and links stay where they are
+		if _, dedicated := pv.Annotations[annDirectory]; dedicated || !r.p.ownsVolume(pv) || pv.Annotations[annCloneMode] == cloneModeLink {
+			continue
+		}
+		dir := filepath.Join(mountPath, r.p.volumeDirectory(pv))
+		if info, err := dataFS.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		size, _, err := dirUsage(dir)
+		if err != nil {
+			glog.Warningf("measure %s for rebalancing fail: %s", dir, err.Error())
+			continue
+		}
+		_, lastUsed, err := volumeTimes(dir)
+		if err != nil {
+			glog.Warningf("scan %s for rebalancing fail: %s", dir, err.Error())
+			continue
+		}
+		candidates = append(candidates, rebalanceVolume{pv: pv, size: size, lastUsed: lastUsed})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed.Before(candidates[j].lastUsed) })
+	return candidates, nil
+}
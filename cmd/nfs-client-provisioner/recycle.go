@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// paramOnDelete is what happens to the directory of a deleted volume,
+	// it overrides archiveOnDelete
+	paramOnDelete = "onDelete"
+	// paramRecycleRebind makes a new PVC reuse the recycled directory of a former
+	// PVC with the same namespace and name
+	paramRecycleRebind = "recycleRebind"
+
+	onDeleteDelete  = "delete"
+	onDeleteArchive = "archive"
+	// onDeleteRecycle empties the directory but keeps it, so its path on the NFS server stays the same
+	onDeleteRecycle = "recycle"
+)
+
+// onDeleteAction returns what happens to the volumes of class when they are deleted.
+func onDeleteAction(class *storage.StorageClass) (string, error) {
+	if action, ok := class.Parameters[paramOnDelete]; ok {
+		switch action {
+		case onDeleteDelete, onDeleteArchive, onDeleteRecycle, onDeleteTrash:
+			return action, nil
+		}
+		return "", misconfigured("invalid %s %q, must be %q, %q, %q or %q", paramOnDelete, action, onDeleteDelete, onDeleteArchive, onDeleteRecycle, onDeleteTrash)
+	}
+	// Determine if the "archiveOnDelete" parameter exists.
+	// If it exists and has a false value, delete the directory.
+	// Otherwise, archive it.
+	if archiveOnDelete, ok := class.Parameters[paramArchiveOnDelete]; ok {
+		archiveBool, err := strconv.ParseBool(archiveOnDelete)
+		if err != nil {
+			return "", misconfigured("invalid %s %q: %v", paramArchiveOnDelete, archiveOnDelete, err)
+		}
+		if !archiveBool {
+			return onDeleteDelete, nil
+		}
+	}
+	return onDeleteArchive, nil
+}
+
+// recycleDirectory removes everything in the directory name below mountPath
+// but the directory itself, and marks it as recycled from volume.
+func (p *nfsProvisioner) recycleDirectory(volume *v1.PersistentVolume, name string) error {
+	dir := filepath.Join(mountPath, name)
+	now := time.Now().UTC()
+	created := now
+	if old, err := readMarker(dir); err == nil {
+		created = old.Created
+	}
+	if volume.Annotations[annSealed] == "true" {
+		if err := unsealDirectory(dir); err != nil {
+			return err
+		}
+	}
+	entries, err := dataFS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := removeAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	m := &volumeMarker{
+		Provisioner:  p.name,
+		Volume:       volume.Name,
+		StorageClass: volume.Spec.StorageClassName,
+		Created:      created,
+		Recycled:     &now,
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		m.ClaimNamespace, m.ClaimName, m.ClaimUID = ref.Namespace, ref.Name, string(ref.UID)
+	}
+	return writeMarker(dir, m)
+}
+
+// findRecycled returns the most recently recycled directory of a former claim
+// namespace/name below root, the root of its namespace, or "" if there is none.
+func findRecycled(root, namespace, name string) (string, error) {
+	entries, err := dataFS.ReadDir(filepath.Join(mountPath, root))
+	if err != nil {
+		return "", err
+	}
+	var found string
+	var latest time.Time
+	for _, e := range entries {
+		// the prefix is ambiguous for names with dashes, the marker is not
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), namespace+"-"+name+"-") {
+			continue
+		}
+		m, err := readMarker(filepath.Join(mountPath, root, e.Name()))
+		if err != nil || m.Recycled == nil || m.ClaimNamespace != namespace || m.ClaimName != name {
+			continue
+		}
+		if m.Recycled.After(latest) {
+			found, latest = filepath.Join(root, e.Name()), *m.Recycled
+		}
+	}
+	return found, nil
+}
+
+// isKept reports whether the directory name below mountPath is recycled, or a
+// released sticky directory, and waits to be reused.
+func isKept(name string) bool {
+	m, err := readMarker(filepath.Join(mountPath, name))
+	return err == nil && (m.Recycled != nil || m.Released != nil)
+}
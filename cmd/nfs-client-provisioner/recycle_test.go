@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+func TestRecycle(t *testing.T) {
+	const dir = "default-old-pv-old"
+	tests := []struct {
+		name   string
+		sealed bool
+		// fault is the operation failing while the volume is recycled, if any
+		fault   string
+		wantErr bool
+	}{
+		{name: "recycled"},
+		{name: "sealed", sealed: true},
+		{name: "removal fails", fault: "removeall", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("nfs", map[string]string{paramOnDelete: onDeleteRecycle, paramRecycleRebind: "true"})
+			p := newTestProvisioner(t, markerCheckStrict, class)
+			var annotations map[string]string
+			if tt.sealed {
+				annotations = map[string]string{annSealed: "true"}
+			}
+			volume := testVolume("pv-old", "nfs", "default", "old", dir, annotations)
+			makeVolumeDirectory(t, volume, dir, "old")
+			if tt.sealed {
+				if err := sealDirectory(filepath.Join(mountPath, dir)); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { unsealDirectory(filepath.Join(mountPath, dir)) })
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			err := p.Delete(context.Background(), volume)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Delete() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if got := readTestFile(t, filepath.Join(mountPath, dir, "data")); got != "old" {
+					t.Errorf("data of the kept volume = %q, want %q", got, "old")
+				}
+				return
+			}
+			entries, err := os.ReadDir(filepath.Join(mountPath, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != markerFile {
+				t.Errorf("recycled directory holds %v, want the marker only", entries)
+			}
+			m, err := readMarker(filepath.Join(mountPath, dir))
+			if err != nil || m.Recycled == nil || m.ClaimNamespace != "default" || m.ClaimName != "old" {
+				t.Fatalf("marker of the recycled directory = %+v, %v, want one recycled from pvc {default/old}", m, err)
+			}
+
+			// a new claim of the same name gets the recycled directory
+			options := controller.ProvisionOptions{
+				StorageClass: class,
+				PVName:       "pv-next",
+				PVC:          testClaim("default", "old", nil),
+			}
+			pv, _, err := p.Provision(context.Background(), options)
+			if err != nil {
+				t.Fatalf("Provision() = %v", err)
+			}
+			if want := filepath.Join(testExport, dir); pv.Spec.NFS.Path != want {
+				t.Errorf("path of the rebound volume = %s, want %s", pv.Spec.NFS.Path, want)
+			}
+		})
+	}
+}
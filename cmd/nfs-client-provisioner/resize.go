@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchResizes reports attempts to shrink bound claims. Kubernetes only allows
+// a request to be lowered while it is above the capacity of the volume, e.g. to
+// recover from a failed expansion, but not below it, and the capacity of the PV
+// stays authoritative for quotas. It must be called before the claim informer is
+// started.
+func (p *nfsProvisioner) watchResizes(informer cache.SharedIndexInformer) error {
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPVC, ok := oldObj.(*v1.PersistentVolumeClaim)
+			if !ok {
+				return
+			}
+			newPVC, ok := newObj.(*v1.PersistentVolumeClaim)
+			if !ok || newPVC.Spec.VolumeName == "" {
+				return
+			}
+			oldRequest := oldPVC.Spec.Resources.Requests[v1.ResourceStorage]
+			newRequest := newPVC.Spec.Resources.Requests[v1.ResourceStorage]
+			if newRequest.Cmp(oldRequest) >= 0 {
+				return
+			}
+			pv, err := p.getVolume(context.Background(), newPVC.Spec.VolumeName)
+			if err != nil || !p.ownsVolume(pv) {
+				return
+			}
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if newRequest.Cmp(capacity) < 0 {
+				p.warn(newPVC, reasonResizeRejected, "shrinking pvc {%s/%s} to %s is not supported, volume %s keeps its capacity of %s",
+					newPVC.Namespace, newPVC.Name, newRequest.String(), pv.Name, capacity.String())
+			}
+		},
+	})
+	return err
+}
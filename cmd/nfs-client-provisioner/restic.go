@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// paramResticRepository is the restic repository volumes are backed up to before
+	// they are removed by archiveOnDelete=false, or emptied by onDelete: recycle
+	paramResticRepository = "resticRepository"
+)
+
+// resticRepository returns the repository of class, or the provisioner default.
+func (p *nfsProvisioner) resticRepository(class *storage.StorageClass) string {
+	if repo, ok := class.Parameters[paramResticRepository]; ok {
+		return repo
+	}
+	return p.resticRepo
+}
+
+// resticBackup backs up the directory name below mountPath of volume to repo.
+// The password and the credentials of the repository backend are taken from the
+// environment of the provisioner, e.g. RESTIC_PASSWORD.
+func resticBackup(ctx context.Context, repo string, volume *v1.PersistentVolume, name string) error {
+	args := []string{"--repo", repo, "backup", "--host", "nfs-client-provisioner", "--tag", "pv=" + volume.Name}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		args = append(args, "--tag", "pvc="+ref.Namespace+"/"+ref.Name)
+	}
+	// back up relative to the export, so snapshots list the volume directory only
+	args = append(args, "--", name)
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	cmd.Dir = mountPath
+	glog.Infof("backing up %s to restic repository %s", filepath.Join(mountPath, name), repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("restic backup of %s fail: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Keys of the -namespace-roots ConfigMap.
+const (
+	// rootsKeyDefault is the root of namespaces without a mapping, the top level of the export if not set
+	rootsKeyDefault = "default"
+	// rootsKeyNamespaces maps namespace names to roots, e.g. "team-a: tenants/a"
+	rootsKeyNamespaces = "namespaces"
+	// rootsKeyLabels is a list of namespace label selectors and roots, the first match wins
+	rootsKeyLabels = "labels"
+)
+
+// namespaceRoots maps namespaces to the directory below the export their
+// volumes are created in.
+type namespaceRoots struct {
+	defaultRoot string
+	namespaces  map[string]string
+	labels      []labelRoot
+}
+
+type labelRoot struct {
+	Selector string `json:"selector"`
+	Root     string `json:"root"`
+
+	selector labels.Selector
+}
+
+// parseNamespaceRoots parses the data of the -namespace-roots ConfigMap.
+func parseNamespaceRoots(data map[string]string) (*namespaceRoots, error) {
+	r := &namespaceRoots{defaultRoot: data[rootsKeyDefault], namespaces: map[string]string{}}
+	if err := yaml.Unmarshal([]byte(data[rootsKeyNamespaces]), &r.namespaces); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", rootsKeyNamespaces, err)
+	}
+	if err := yaml.Unmarshal([]byte(data[rootsKeyLabels]), &r.labels); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", rootsKeyLabels, err)
+	}
+	for i := range r.labels {
+		selector, err := labels.Parse(r.labels[i].Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", r.labels[i].Selector, err)
+		}
+		r.labels[i].selector = selector
+	}
+	for _, root := range r.all() {
+		if err := checkRoot(root); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// all returns every root of r, including the default.
+func (r *namespaceRoots) all() []string {
+	roots := []string{r.defaultRoot}
+	for _, root := range r.namespaces {
+		roots = append(roots, root)
+	}
+	for _, l := range r.labels {
+		roots = append(roots, l.Root)
+	}
+	return roots
+}
+
+// checkRoot verifies that root is a directory below the export which cannot be
+// mistaken for a volume, archive or quarantined link.
+func checkRoot(root string) error {
+	if root == "" {
+		return nil
+	}
+	clean := filepath.Clean(root)
+	top := strings.SplitN(clean, string(filepath.Separator), 2)[0]
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") ||
+		strings.HasPrefix(top, ".") || strings.HasPrefix(top, archivePrefix) || strings.HasPrefix(top, quarantinePrefix) {
+		return fmt.Errorf("invalid root %q, must be a directory below the export not starting with '.', %s or %s", root, archivePrefix, quarantinePrefix)
+	}
+	return nil
+}
+
+// namespaceRoots reads the -namespace-roots ConfigMap, an empty mapping if it is not configured.
+func (p *nfsProvisioner) namespaceRoots(ctx context.Context) (*namespaceRoots, error) {
+	if p.rootsConfigMap == "" {
+		return &namespaceRoots{}, nil
+	}
+	cm, err := p.client.CoreV1().ConfigMaps(p.rootsNamespace).Get(ctx, p.rootsConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, misconfigured("namespace roots ConfigMap %s/%s not found", p.rootsNamespace, p.rootsConfigMap)
+	} else if err != nil {
+		return nil, err
+	}
+	roots, err := parseNamespaceRoots(cm.Data)
+	if err != nil {
+		return nil, misconfigured("namespace roots ConfigMap %s/%s: %v", p.rootsNamespace, p.rootsConfigMap, err)
+	}
+	return roots, nil
+}
+
+// namespaceRoot returns the directory below the export the volumes of namespace
+// are created in, "" for the top level.
+func (p *nfsProvisioner) namespaceRoot(ctx context.Context, namespace string) (string, error) {
+	roots, err := p.namespaceRoots(ctx)
+	if err != nil {
+		return "", err
+	}
+	if root, ok := roots.namespaces[namespace]; ok {
+		return filepath.Clean("/" + root)[1:], nil
+	}
+	if len(roots.labels) > 0 {
+		ns, err := p.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		for _, l := range roots.labels {
+			if l.selector.Matches(labels.Set(ns.Labels)) {
+				return filepath.Clean("/" + l.Root)[1:], nil
+			}
+		}
+	}
+	return filepath.Clean("/" + roots.defaultRoot)[1:], nil
+}
+
+// volumeDirectory returns the directory of pv below mountPath, which is nested
+// in the root of its namespace with -namespace-roots.
+func (p *nfsProvisioner) volumeDirectory(pv *v1.PersistentVolume) string {
+	return volumeDirectoryOn(p.path, pv)
+}
+
+// volumeDirectoryOn returns the directory of pv below the mount of export, the
+// path of the main export: annDirectory for volumes on other exports, like those
+// of zones, tenants and export routes, the path of the volume relative to export
+// otherwise.
+func volumeDirectoryOn(export string, pv *v1.PersistentVolume) string {
+	if dir, ok := pv.Annotations[annDirectory]; ok {
+		return dir
+	}
+	return exportDirectory(export, pv)
+}
+
+// exportDirectory returns the directory of pv relative to the path of the export.
+func exportDirectory(export string, pv *v1.PersistentVolume) string {
+	rel, err := filepath.Rel(filepath.Clean(export), filepath.Clean(pv.Spec.NFS.Path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return filepath.Base(pv.Spec.NFS.Path)
+	}
+	return rel
+}
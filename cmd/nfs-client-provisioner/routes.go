@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// routesKey of the -export-routes ConfigMap is the list of routes, the first match wins
+	routesKey = "routes"
+	// annRoute on a PV is the export route it was provisioned by
+	annRoute = "nchc.ai/route"
+)
+
+// exportRoute sends the volumes of the claims matching its selector to a
+// directory of the export, e.g. one on SSDs, which may be served by an export
+// of its own.
+type exportRoute struct {
+	Name string `json:"name"`
+	// Selector is a label selector of claims, e.g. "performance=high"
+	Selector string `json:"selector"`
+	// StorageClasses restricts the route to claims of these classes, all if empty
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// Directory is where the volumes of the route are created below the export of the provisioner
+	Directory string `json:"directory"`
+	// Export is the server:/path serving Directory, the export of the provisioner if empty
+	Export string `json:"export,omitempty"`
+
+	selector labels.Selector
+	server   string
+	path     string
+}
+
+// parseExportRoutes parses the data of the -export-routes ConfigMap.
+func parseExportRoutes(data map[string]string) ([]exportRoute, error) {
+	var routes []exportRoute
+	if err := yaml.UnmarshalStrict([]byte(data[routesKey]), &routes); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", routesKey, err)
+	}
+	seen := map[string]bool{}
+	for i := range routes {
+		r := &routes[i]
+		if r.Name == "" || seen[r.Name] {
+			return nil, fmt.Errorf("route %d must have a unique name", i)
+		}
+		seen[r.Name] = true
+		selector, err := labels.Parse(r.Selector)
+		if err != nil || selector.Empty() {
+			return nil, fmt.Errorf("invalid selector %q of route %s", r.Selector, r.Name)
+		}
+		r.selector = selector
+		if r.Directory == "" {
+			return nil, fmt.Errorf("route %s has no directory", r.Name)
+		}
+		if err := checkRoot(r.Directory); err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		r.Directory = filepath.Clean(r.Directory)
+		if r.Export != "" {
+			server, path, ok := strings.Cut(r.Export, ":")
+			if !ok || server == "" || !filepath.IsAbs(path) {
+				return nil, fmt.Errorf("invalid export %q of route %s, must be server:/path", r.Export, r.Name)
+			}
+			r.server, r.path = server, filepath.Clean(path)
+		}
+	}
+	return routes, nil
+}
+
+// matches reports whether the volume of pvc of class takes the route.
+func (r *exportRoute) matches(pvc *v1.PersistentVolumeClaim, class string) bool {
+	if len(r.StorageClasses) > 0 && !contains(r.StorageClasses, class) {
+		return false
+	}
+	return r.selector.Matches(labels.Set(pvc.Labels))
+}
+
+// source returns the NFS server and path of the directory name below the
+// export of the provisioner, which is below r.Directory, if the route has an
+// export of its own.
+func (r *exportRoute) source(name string) (string, string, error) {
+	rel, err := filepath.Rel(r.Directory, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", "", fmt.Errorf("%s is not below the directory %s of route %s", name, r.Directory, r.Name)
+	}
+	return r.server, filepath.Join(r.path, rel), nil
+}
+
+// exportRoutes reads the -export-routes ConfigMap, no routes if it is not configured.
+func (p *nfsProvisioner) exportRoutes(ctx context.Context) ([]exportRoute, error) {
+	if p.routesConfigMap == "" {
+		return nil, nil
+	}
+	cm, err := p.client.CoreV1().ConfigMaps(p.rootsNamespace).Get(ctx, p.routesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, misconfigured("export routes ConfigMap %s/%s not found", p.rootsNamespace, p.routesConfigMap)
+	} else if err != nil {
+		return nil, err
+	}
+	routes, err := parseExportRoutes(cm.Data)
+	if err != nil {
+		return nil, misconfigured("export routes ConfigMap %s/%s: %v", p.rootsNamespace, p.routesConfigMap, err)
+	}
+	return routes, nil
+}
+
+// selectRoute returns the first route the volume of pvc of class takes, nil
+// for none.
+func (p *nfsProvisioner) selectRoute(ctx context.Context, pvc *v1.PersistentVolumeClaim, class string) (*exportRoute, error) {
+	routes, err := p.exportRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		if routes[i].matches(pvc, class) {
+			return &routes[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// annPopulateS3 on a PVC downloads the objects below an s3://bucket/prefix URL into the new volume
+	annPopulateS3 = "nchc.ai/populate-s3"
+	// annPopulateS3Secret names the Secret, in the namespace of the PVC, with the S3 credentials
+	annPopulateS3Secret = "nchc.ai/populate-s3-secret"
+
+	defaultS3Endpoint = "s3.amazonaws.com"
+)
+
+// populateFromS3 downloads the objects below rawURL into dest, the name of a new
+// volume directory of class below mountPath. Object keys keep their path below
+// the prefix.
+func (p *nfsProvisioner) populateFromS3(ctx context.Context, class *storage.StorageClass, pvc *v1.PersistentVolumeClaim, rawURL, dest string) error {
+	bucket, prefix, err := parseS3URL(rawURL)
+	if err != nil {
+		return misconfigured("invalid %s %q, must be s3://bucket/prefix", annPopulateS3, rawURL)
+	}
+	client, err := p.newS3Client(ctx, class, pvc.Namespace, pvc.Annotations[annPopulateS3Secret])
+	if err != nil {
+		return err
+	}
+	return downloadFromS3(ctx, client, bucket, prefix, dest)
+}
+
+// parseS3URL returns the bucket and the key prefix of an s3://bucket/prefix URL.
+func parseS3URL(rawURL string) (bucket, prefix string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not an s3://bucket/prefix URL", rawURL)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// downloadFromS3 downloads the objects below prefix of bucket into dest, the
+// name of a volume directory below mountPath.
+func downloadFromS3(ctx context.Context, client *minio.Client, bucket, prefix, dest string) error {
+	root := filepath.Join(mountPath, dest)
+	for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		rel := filepath.Clean("/" + strings.TrimPrefix(object.Key, prefix))
+		target := filepath.Join(root, rel)
+		if err := dataFS.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		glog.V(4).Infof("downloading s3://%s/%s to %s", bucket, object.Key, target)
+		if err := client.FGetObject(ctx, bucket, object.Key, target, minio.GetObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadToS3 replaces the objects below prefix of bucket by the regular files
+// of the directory src and returns their size. S3 has no symbolic links, links
+// are skipped.
+func uploadToS3(ctx context.Context, client *minio.Client, src, bucket, prefix string) (int64, error) {
+	// start from scratch, like the backups on the export
+	stale := client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	for e := range client.RemoveObjects(ctx, bucket, stale, minio.RemoveObjectsOptions{}) {
+		if e.Err != nil {
+			return 0, e.Err
+		}
+	}
+
+	var bytes int64
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			if d.Type()&fs.ModeSymlink != 0 {
+				glog.Warningf("skipping symbolic link %s, S3 cannot store it", path)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		glog.V(4).Infof("uploading %s to s3://%s/%s", path, bucket, key)
+		info, err := client.FPutObject(ctx, bucket, key, path, minio.PutObjectOptions{})
+		if err != nil {
+			return err
+		}
+		bytes += info.Size
+		return nil
+	})
+	return bytes, err
+}
+
+// newS3Client returns a client using the credentials and endpoint of the Secret
+// secretName in namespace, or an anonymous client for AWS S3 if it is empty.
+// Only the Secrets listed in dataSourceSecrets of class are used.
+func (p *nfsProvisioner) newS3Client(ctx context.Context, class *storage.StorageClass, namespace, secretName string) (*minio.Client, error) {
+	opts := &minio.Options{Creds: credentials.NewStaticV4("", "", ""), Secure: true}
+	endpoint := defaultS3Endpoint
+
+	if secretName != "" {
+		if !secretAllowed(class, secretName) {
+			return nil, misconfigured("secret %s is not listed in %s of storage class %s", secretName, paramDataSourceSecrets, class.Name)
+		}
+		secret, err := p.client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		opts.Creds = credentials.NewStaticV4(string(secret.Data["accessKeyID"]), string(secret.Data["secretAccessKey"]), string(secret.Data["sessionToken"]))
+		opts.Region = string(secret.Data["region"])
+		if v, ok := secret.Data["endpoint"]; ok {
+			endpoint = string(v)
+		}
+		if v, ok := secret.Data["insecure"]; ok {
+			insecure, err := strconv.ParseBool(string(v))
+			if err != nil {
+				return nil, misconfigured("invalid insecure %q in secret %s/%s", v, namespace, secretName)
+			}
+			opts.Secure = !insecure
+		}
+	}
+	return minio.New(endpoint, opts)
+}
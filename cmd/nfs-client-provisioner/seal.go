@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// annSeal on a PVC makes the volume read-only once it is populated
+	annSeal = "nchc.ai/seal"
+	// annSealed is set on the PV of a sealed volume
+	annSealed = "nchc.ai/sealed"
+)
+
+// sealDirectory removes the write permission bits from dir and everything below it.
+// Symbolic links are not followed.
+func sealDirectory(dir string) error {
+	return chmodTree(dir, func(mode fs.FileMode) fs.FileMode { return mode &^ 0222 })
+}
+
+// unsealDirectory gives the owner write permission on dir and everything below
+// it again, so it can be removed.
+func unsealDirectory(dir string) error {
+	return chmodTree(dir, func(mode fs.FileMode) fs.FileMode { return mode | 0200 })
+}
+
+func chmodTree(dir string, change func(fs.FileMode) fs.FileMode) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return dataFS.Chmod(path, change(info.Mode())&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	})
+}
+
+// removeAll is os.RemoveAll, which also removes sealed directories.
+func removeAll(path string) error {
+	err := dataFS.RemoveAll(path)
+	if os.IsPermission(err) {
+		if err := unsealDirectory(path); err != nil {
+			return err
+		}
+		return dataFS.RemoveAll(path)
+	}
+	return err
+}
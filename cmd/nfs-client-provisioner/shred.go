@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// paramSecureDelete overwrites the files of a volume before it is removed or recycled
+	paramSecureDelete = "secureDelete"
+)
+
+// shredDirectory overwrites every regular file below dir with zeros and flushes
+// it to the NFS server, so that removing the files does not leave their data
+// behind in free blocks. Symbolic links are not followed. Copies kept by the
+// file system of the server, e.g. by snapshots or copy-on-write, are not
+// overwritten.
+func shredDirectory(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// sealed files are read-only
+		if info.Mode().Perm()&0200 == 0 {
+			if err := dataFS.Chmod(path, info.Mode().Perm()|0200); err != nil {
+				return err
+			}
+		}
+		return shredFile(path, info.Size())
+	})
+}
+
+func shredFile(path string, size int64) error {
+	f, err := dataFS.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, zeroReader{}, size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSecureDelete(t *testing.T) {
+	const dir = "default-old-pv-old"
+	tests := []struct {
+		name string
+		// fault is the operation failing while the files are overwritten, if any
+		fault   string
+		wantErr bool
+	}{
+		{name: "overwritten and removed"},
+		{name: "open fails", fault: "open", wantErr: true},
+		{name: "write fails", fault: "write", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("nfs", map[string]string{paramOnDelete: onDeleteDelete, paramSecureDelete: "true"})
+			p := newTestProvisioner(t, markerCheckStrict, class)
+			volume := testVolume("pv-old", "nfs", "default", "old", dir, nil)
+			makeVolumeDirectory(t, volume, dir, "secret")
+			full := filepath.Join(mountPath, dir)
+			writeTestFile(t, filepath.Join(full, "sealed"), "secret")
+			if err := os.Chmod(filepath.Join(full, "sealed"), 0444); err != nil {
+				t.Fatal(err)
+			}
+			// the links outside of the volume observe what happens to its files
+			outside := t.TempDir()
+			for _, name := range []string{"data", "sealed"} {
+				if err := os.Link(filepath.Join(full, name), filepath.Join(outside, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeTestFile(t, filepath.Join(outside, "target"), "keep")
+			if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(full, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			err := p.Delete(context.Background(), volume)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Delete() = %v, want error %v", err, tt.wantErr)
+			}
+			if got := pathExists(full); got != tt.wantErr {
+				t.Errorf("volume kept = %v, want %v", got, tt.wantErr)
+			}
+			if got := readTestFile(t, filepath.Join(outside, "target")); got != "keep" {
+				t.Errorf("target of the symbolic link = %q, want it untouched", got)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, name := range []string{"data", "sealed"} {
+				if got := readTestFile(t, filepath.Join(outside, name)); got != strings.Repeat("\x00", len("secret")) {
+					t.Errorf("%s = %q, want it overwritten with zeros", name, got)
+				}
+			}
+		})
+	}
+}
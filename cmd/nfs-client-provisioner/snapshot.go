@@ -0,0 +1,205 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	otiai10 "github.com/otiai10/copy"
+	"github.com/robfig/cron/v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	snapshotDir            = ".snapshots"
+	snapshotTimeFormat     = "20060102-150405"
+	snapshotCheckInterval  = time.Minute
+	defaultSnapshotRetain  = 7
+	annProvisionedBy       = "pv.kubernetes.io/provisioned-by"
+	paramSnapshotSchedule  = "snapshotSchedule"
+	paramSnapshotRetention = "snapshotRetention"
+)
+
+// snapshotter periodically copies the volumes of every StorageClass carrying a
+// "snapshotSchedule" cron expression to .snapshots/<volume>/<timestamp> on the
+// export, keeping the newest "snapshotRetention" copies.
+type snapshotter struct {
+	p *nfsProvisioner
+	// lastRun records when each StorageClass was last checked against its schedule.
+	lastRun map[string]time.Time
+}
+
+func newSnapshotter(p *nfsProvisioner) *snapshotter {
+	return &snapshotter{
+		p:       p,
+		lastRun: map[string]time.Time{},
+	}
+}
+
+func (s *snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDue(ctx, now)
+		}
+	}
+}
+
+// runDue snapshots the volumes of every class whose schedule fired since the last check.
+func (s *snapshotter) runDue(ctx context.Context, now time.Time) {
+	classes, err := s.p.listClasses(ctx)
+	if err != nil {
+		glog.Warningf("list storage classes for snapshots fail: %s", err.Error())
+		return
+	}
+
+	for _, class := range classes {
+		expr, ok := class.Parameters[paramSnapshotSchedule]
+		if !ok || class.Provisioner != s.p.name {
+			continue
+		}
+		schedule, err := cron.ParseStandard(expr)
+		if err != nil {
+			glog.Warningf("storage class %s has invalid %s %q: %s", class.Name, paramSnapshotSchedule, expr, err.Error())
+			continue
+		}
+		retain := defaultSnapshotRetain
+		if v, ok := class.Parameters[paramSnapshotRetention]; ok {
+			if retain, err = strconv.Atoi(v); err != nil || retain < 1 {
+				glog.Warningf("storage class %s has invalid %s %q", class.Name, paramSnapshotRetention, v)
+				continue
+			}
+		}
+
+		last, seen := s.lastRun[class.Name]
+		s.lastRun[class.Name] = now
+		if !seen || schedule.Next(last).After(now) {
+			continue
+		}
+		s.snapshotClass(ctx, class.Name, retain, now)
+	}
+}
+
+func (s *snapshotter) snapshotClass(ctx context.Context, className string, retain int, now time.Time) {
+	pvs, err := s.p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("list persistent volumes for snapshots fail: %s", err.Error())
+		return
+	}
+
+	for _, pv := range pvs.Items {
+		if pv.Spec.StorageClassName != className || !s.p.ownsVolume(&pv) {
+			continue
+		}
+		volume := s.p.volumeDirectory(&pv)
+		if err := s.p.blockedByQuota(ctx, &pv); err != nil {
+			s.p.warnVolume(&pv, reasonSnapshotFailed, "snapshot of %s skipped: %s", volume, err.Error())
+			continue
+		}
+		if err := takeSnapshot(volume, now.UTC().Format(snapshotTimeFormat)); err != nil {
+			s.p.warnVolume(&pv, reasonSnapshotFailed, "snapshot of %s fail: %s", volume, err.Error())
+			continue
+		}
+		if err := pruneSnapshots(volume, retain); err != nil {
+			s.p.warnVolume(&pv, reasonSnapshotFailed, "prune snapshots of %s fail: %s", volume, err.Error())
+		}
+	}
+}
+
+// ownsVolume reports whether pv is a NFS volume provisioned by this provisioner.
+func (p *nfsProvisioner) ownsVolume(pv *v1.PersistentVolume) bool {
+	return pv.Annotations[annProvisionedBy] == p.name && pv.Spec.NFS != nil
+}
+
+func takeSnapshot(volume string, name string) error {
+	src := filepath.Join(mountPath, volume)
+	info, err := dataFS.Lstat(src)
+	if err != nil {
+		return err
+	}
+	// linked volumes share their data with the source volume, which is snapshotted on its own
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	dest := filepath.Join(mountPath, snapshotDir, volume, name)
+	glog.V(4).Infof("snapshotting %s to %s", src, dest)
+	return dataFS.Copy(src, dest, otiai10.Options{})
+}
+
+// moveSnapshots moves the snapshots directory src of a volume to dest, so that
+// they follow the volume into an archive or the trash and back. Volumes without
+// snapshots have nothing to move.
+func moveSnapshots(src, dest string) error {
+	if _, err := dataFS.Lstat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := dataFS.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	return dataFS.Rename(src, dest)
+}
+
+// removeSnapshots removes the snapshots of the volume directory name below root,
+// and the parents left empty below snapshotDir by nested volumes.
+func removeSnapshots(root, name string) error {
+	if err := removeAll(filepath.Join(root, snapshotDir, name)); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		dataFS.Remove(filepath.Join(root, snapshotDir, dir))
+	}
+	return nil
+}
+
+// pruneSnapshots removes all but the newest retain snapshots of volume.
+func pruneSnapshots(volume string, retain int) error {
+	dir := filepath.Join(mountPath, snapshotDir, volume)
+	entries, err := dataFS.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// timestamps sort chronologically
+	sort.Strings(names)
+	for len(names) > retain {
+		glog.V(4).Infof("pruning snapshot %s", filepath.Join(dir, names[0]))
+		if err := removeAll(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// sourceExport is the export of another StorageClass, mounted into the
+// provisioner so that its volumes can be copied to the export of the provisioner.
+type sourceExport struct {
+	server string
+	path   string
+	// mount is where the export is mounted in the provisioner
+	mount string
+}
+
+// parseSourceExports parses the comma separated server:path=mount of -source-exports.
+func parseSourceExports(value string) ([]sourceExport, error) {
+	var exports []sourceExport
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		export, mount, ok := strings.Cut(entry, "=")
+		server, path, ok2 := strings.Cut(export, ":")
+		if !ok || !ok2 || server == "" || !filepath.IsAbs(path) || !filepath.IsAbs(mount) {
+			return nil, fmt.Errorf("invalid source export %q, must be server:/path=/mount", entry)
+		}
+		if filepath.Clean(mount) == mountPath || strings.HasPrefix(filepath.Clean(mount), mountPath+"/") {
+			return nil, fmt.Errorf("invalid source export %q, must not be mounted below %s", entry, mountPath)
+		}
+		exports = append(exports, sourceExport{server: server, path: filepath.Clean(path), mount: filepath.Clean(mount)})
+	}
+	return exports, nil
+}
+
+// sourceExportDirectory returns the directory of the NFS volume pv in the mount
+// of one of the source exports.
+func (p *nfsProvisioner) sourceExportDirectory(pv *v1.PersistentVolume) (string, bool) {
+	if pv.Spec.NFS == nil {
+		return "", false
+	}
+	for _, e := range p.sourceExports {
+		rel, err := filepath.Rel(e.path, filepath.Clean(pv.Spec.NFS.Path))
+		if pv.Spec.NFS.Server != e.server || err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return filepath.Join(e.mount, rel), true
+	}
+	return "", false
+}
+
+// resolveSourceExportDirectory follows the symbolic links of dir, a directory
+// in the mount of a source export, which must not lead out of the mount.
+func (p *nfsProvisioner) resolveSourceExportDirectory(dir string) (string, error) {
+	target, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range p.sourceExports {
+		mount, err := filepath.EvalSymlinks(e.mount)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(mount, target); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.Join(e.mount, rel), nil
+		}
+	}
+	return "", fmt.Errorf("%s resolves to %s, which is outside of the source exports", dir, target)
+}
+
+// sourcePath returns the path of the clone source dir in the provisioner: the
+// directories of volumes on source exports are absolute, the others below mountPath.
+func sourcePath(dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(mountPath, dir)
+}
+
+// checkSourceExports verifies that the source exports are mounted.
+func checkSourceExports(exports []sourceExport) error {
+	for _, e := range exports {
+		if info, err := dataFS.Stat(e.mount); err != nil {
+			return fmt.Errorf("source export %s:%s is not mounted at %s: %w", e.server, e.path, e.mount, err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("source export %s:%s is not mounted at %s, which is not a directory", e.server, e.path, e.mount)
+		}
+	}
+	return nil
+}
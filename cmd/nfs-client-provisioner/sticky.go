@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// paramDirectoryNaming is how the directories of new volumes of the class are named
+	paramDirectoryNaming = "directoryNaming"
+	// directoryNamingVolume names directories <namespace>-<pvc>-<pv>, a new one for every volume
+	directoryNamingVolume = "volume"
+	// directoryNamingSticky names directories <namespace>-<pvc>, which are kept
+	// when the volume is deleted and reused when the claim is created again
+	directoryNamingSticky = "sticky"
+
+	// annSticky on a PV keeps its directory when it is deleted
+	annSticky = "nchc.ai/sticky"
+)
+
+// directoryNaming returns how the directories of new volumes of class are named.
+func directoryNaming(class *storage.StorageClass) (string, error) {
+	switch naming := class.Parameters[paramDirectoryNaming]; naming {
+	case "":
+		return directoryNamingVolume, nil
+	case directoryNamingVolume, directoryNamingSticky:
+		return naming, nil
+	default:
+		return "", misconfigured("invalid %s %q, must be %q or %q", paramDirectoryNaming, naming, directoryNamingVolume, directoryNamingSticky)
+	}
+}
+
+// stickyName returns the directory name of the volumes of the claim namespace/name.
+func stickyName(namespace, name string) string {
+	return namespace + "-" + name
+}
+
+// checkStickyDirectory reports whether the sticky directory name below
+// mountPath of pvc exists and is reused for the new volume pvName. Only
+// directories whose marker names the same claim, and whose former volume is
+// gone, are reused, names of different claims may collide. Directories of an
+// earlier attempt to provision pvName are not reused but completed.
+func (p *nfsProvisioner) checkStickyDirectory(ctx context.Context, pvc *v1.PersistentVolumeClaim, pvName, name string) (bool, error) {
+	full := filepath.Join(mountPath, name)
+	info, err := lstatCtx(ctx, full)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, misconfigured("the sticky directory %s of pvc {%s/%s} is not a directory", full, pvc.Namespace, pvc.Name)
+	}
+	var m *volumeMarker
+	if err := runFS(ctx, func() (err error) {
+		m, err = readMarker(full)
+		return err
+	}); err != nil || m.ClaimNamespace != pvc.Namespace || m.ClaimName != pvc.Name {
+		return false, misconfigured("the sticky directory %s of pvc {%s/%s} exists but does not belong to it", full, pvc.Namespace, pvc.Name)
+	}
+	if m.Volume == pvName {
+		return false, nil
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Get(ctx, m.Volume, metav1.GetOptions{}); err == nil {
+		return false, misconfigured("the sticky directory %s of pvc {%s/%s} is still used by pv %s, delete it first", full, pvc.Namespace, pvc.Name, m.Volume)
+	} else if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseSticky keeps the directory name below mountPath of the deleted sticky
+// volume for the next claim of the same name, marking it as released.
+func (p *nfsProvisioner) releaseSticky(ctx context.Context, volume *v1.PersistentVolume, name string) error {
+	full := filepath.Join(mountPath, name)
+	err := runFS(ctx, func() error {
+		m, err := readMarker(full)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		m.Released = &now
+		return writeMarker(full, m)
+	})
+	if err != nil {
+		p.warn(volume, reasonDeleteFailed, "unable to release the sticky directory %s: %s, volume kept", full, err.Error())
+		return err
+	}
+	glog.Infof("keeping the sticky directory %s of volume %s", full, volume.Name)
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// streamVolumesPath is the path below which the stream server serves volumes by PV name
+	streamVolumesPath = "/volumes/"
+	// headerVolumeSize is the disk usage of a volume in bytes, answered to HEAD requests
+	headerVolumeSize = "X-Volume-Size"
+)
+
+// streamPeer is a provisioner of another export which is not mounted into this
+// one, serving the volumes of its export with -stream-port at url.
+type streamPeer struct {
+	server string
+	path   string
+	url    string
+}
+
+// parseStreamPeers parses the comma separated server:path=url of -stream-peers.
+func parseStreamPeers(value string) ([]streamPeer, error) {
+	var peers []streamPeer
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		export, rawURL, ok := strings.Cut(entry, "=")
+		server, path, ok2 := strings.Cut(export, ":")
+		u, err := url.Parse(rawURL)
+		if !ok || !ok2 || server == "" || !filepath.IsAbs(path) || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid stream peer %q, must be server:/path=http(s)://host:port", entry)
+		}
+		peers = append(peers, streamPeer{server: server, path: filepath.Clean(path), url: strings.TrimSuffix(rawURL, "/")})
+	}
+	return peers, nil
+}
+
+// isStreamSource reports whether the clone source dir is streamed from a peer.
+func isStreamSource(dir string) bool {
+	return strings.HasPrefix(dir, "http://") || strings.HasPrefix(dir, "https://")
+}
+
+// streamSourceURL returns the URL the NFS volume pv is streamed from, if its
+// export is served by one of the stream peers.
+func (p *nfsProvisioner) streamSourceURL(pv *v1.PersistentVolume) (string, bool) {
+	if pv.Spec.NFS == nil {
+		return "", false
+	}
+	for _, peer := range p.streamPeers {
+		rel, err := filepath.Rel(peer.path, filepath.Clean(pv.Spec.NFS.Path))
+		if pv.Spec.NFS.Server != peer.server || err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return peer.url + streamVolumesPath + url.PathEscape(pv.Name), true
+	}
+	return "", false
+}
+
+// streamRequest sends an authenticated request for the volume at src to its peer.
+func (p *nfsProvisioner) streamRequest(ctx context.Context, method, src string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.streamToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, transient("%s %s fail: %v", method, src, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, transient("%s %s fail: %s", method, src, resp.Status)
+		}
+		return nil, fmt.Errorf("%s %s fail: %s", method, src, resp.Status)
+	}
+	return resp, nil
+}
+
+// streamSize returns the disk usage of the volume at src, as measured by its peer.
+func (p *nfsProvisioner) streamSize(ctx context.Context, src string) (int64, error) {
+	resp, err := p.streamRequest(ctx, http.MethodHead, src)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get(headerVolumeSize), 10, 64)
+}
+
+// streamDirectory extracts the tarball of the volume at src into dest, the
+// path of a new volume directory.
+func (p *nfsProvisioner) streamDirectory(ctx context.Context, src, dest string, op *trackedOperation) error {
+	resp, err := p.streamRequest(ctx, http.MethodGet, src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	glog.V(4).Infof("streaming %s to %s", src, dest)
+	if err := extractTar(op.reader(resp.Body), dest); err != nil {
+		// most likely the connection broke, the next attempt overwrites what was extracted
+		return transient("stream %s fail: %v", src, err)
+	}
+	return nil
+}
+
+// streamServer serves the volumes of the export as gzip compressed tarballs
+// to the provisioners of other exports, which cannot mount it.
+type streamServer struct {
+	p     *nfsProvisioner
+	token string
+}
+
+func (s *streamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(s.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, streamVolumesPath)
+	pv, err := s.p.getVolume(r.Context(), name)
+	if apierrors.IsNotFound(err) || (err == nil && !s.p.ownsVolume(pv)) {
+		http.Error(w, fmt.Sprintf("volume %s not found", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// linked volumes are streamed with the data of their source
+	dir, err := s.p.resolveDirectory(s.p.volumeDirectory(pv))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	full := filepath.Join(mountPath, dir)
+
+	if r.Method == http.MethodHead {
+		size, _, err := dirUsage(full)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(headerVolumeSize, strconv.FormatInt(size, 10))
+		return
+	}
+	glog.Infof("streaming volume %s from %s to %s", pv.Name, full, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/gzip")
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err := writeTar(gz, full); err != nil {
+		// the status is sent already, the client sees a truncated tarball
+		glog.Warningf("stream volume %s fail: %s", pv.Name, err.Error())
+		return
+	}
+	if err := gz.Close(); err != nil {
+		glog.Warningf("stream volume %s fail: %s", pv.Name, err.Error())
+	}
+}
+
+// writeTar writes the files below root to w as a tarball, without the marker of root.
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == markerFile {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = dataFS.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := dataFS.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// serveStreams serves the volumes of the export to stream peers on port.
+func (p *nfsProvisioner) serveStreams(port int, token string) {
+	mux := http.NewServeMux()
+	mux.Handle(streamVolumesPath, &streamServer{p: p, token: token})
+	glog.Infof("serving volumes to stream peers on port %d", port)
+	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), mux))
+}
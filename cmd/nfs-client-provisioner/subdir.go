@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// annSubdirName on a PVC names the directory of its volume instead of
+	// <namespace>-<pvc>-<pv>, it is recorded on the PV
+	annSubdirName = "nchc.ai/subdir-name"
+	// paramAllowSubdirName lets PVCs of the class set annSubdirName
+	paramAllowSubdirName = "allowSubdirName"
+)
+
+// subdirNamePattern are the directory names users may choose: a single path
+// element of letters, digits, dots, dashes and underscores, not starting with
+// a dot or dash.
+var subdirNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// subdirReservations holds the directories named by annSubdirName which are
+// being provisioned, by their path below mountPath, with the name of their PV,
+// so that two claims asking for the same name at once do not share it.
+var subdirReservations sync.Map
+
+// reserveSubdir checks that the directory name requested by annSubdirName can
+// be created in root for the volume pvName of class, and reserves it until
+// release is called.
+func reserveSubdir(ctx context.Context, class *storage.StorageClass, root, name, pvName string) (string, func(), error) {
+	if allowed, _ := strconv.ParseBool(class.Parameters[paramAllowSubdirName]); !allowed {
+		return "", nil, misconfigured("%s is not allowed by storage class %s", annSubdirName, class.Name)
+	}
+	if !subdirNamePattern.MatchString(name) || strings.HasPrefix(name, archivePrefix) || strings.HasPrefix(name, quarantinePrefix) {
+		return "", nil, misconfigured("invalid %s %q, must be up to 128 letters, digits, '.', '-' or '_', not starting with '.', '-', %s or %s", annSubdirName, name, archivePrefix, quarantinePrefix)
+	}
+	dir := filepath.Join(root, name)
+	if other, loaded := subdirReservations.LoadOrStore(dir, pvName); loaded && other != pvName {
+		return "", nil, transient("directory %s is being provisioned for volume %s", dir, other)
+	}
+	release := func() { subdirReservations.Delete(dir) }
+
+	// a directory of an earlier attempt for the same volume is reused
+	if _, err := lstatCtx(ctx, filepath.Join(mountPath, dir)); err == nil {
+		var m *volumeMarker
+		err := runFS(ctx, func() (err error) {
+			m, err = readMarker(filepath.Join(mountPath, dir))
+			return err
+		})
+		if err != nil || m.Volume != pvName {
+			release()
+			return "", nil, misconfigured("%s %q is taken, %s already exists", annSubdirName, name, dir)
+		}
+	} else if !os.IsNotExist(err) {
+		release()
+		return "", nil, err
+	}
+	// the volume could not be archived under the default archive name
+	archived := filepath.Join(root, archivePrefix+name)
+	if _, err := lstatCtx(ctx, filepath.Join(mountPath, archived)); err == nil {
+		release()
+		return "", nil, misconfigured("%s %q is taken by the archive %s", annSubdirName, name, archived)
+	}
+	return dir, release, nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// annSyncInterval on a copied PVC re-syncs it from its source at that interval
+	annSyncInterval = "nchc.ai/sync-interval"
+	// annLastSynced on the PV records when the volume was last synced from its source
+	annLastSynced = "nchc.ai/last-synced"
+	// annResyncNow on a copied PVC triggers a one-shot sync whenever its value changes
+	annResyncNow = "nchc.ai/resync-now"
+	// annResyncHandled on the PV records the last resync-now value which was handled
+	annResyncHandled = "nchc.ai/resync-handled"
+
+	syncCheckInterval = time.Minute
+)
+
+// syncer copies new and updated files from the source of copied volumes whose
+// PVC carries the sync-interval annotation, or whose resync-now annotation changed.
+type syncer struct {
+	p *nfsProvisioner
+}
+
+func newSyncer(p *nfsProvisioner) *syncer {
+	return &syncer{p: p}
+}
+
+func (s *syncer) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, s.syncDue, syncCheckInterval)
+}
+
+func (s *syncer) syncDue(ctx context.Context) {
+	pvs, err := s.p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("list persistent volumes for sync fail: %s", err.Error())
+		return
+	}
+	pvcs, err := s.p.client.CoreV1().PersistentVolumeClaims(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("list persistent volume claims for sync fail: %s", err.Error())
+		return
+	}
+	claims := map[string]*v1.PersistentVolumeClaim{}
+	for i := range pvcs.Items {
+		claims[pvcs.Items[i].Spec.VolumeName] = &pvcs.Items[i]
+	}
+
+	now := time.Now()
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		pvc, ok := claims[pv.Name]
+		if !ok || !s.p.ownsVolume(pv) || pv.Annotations[annCloneMode] != cloneModeCopy || pv.Annotations[annSealed] == "true" || pv.Annotations[annQuotaExceeded] == "true" {
+			continue
+		}
+		annotations, _ := v1Annotations(pvc)
+		if request, ok := annotations[annResyncNow]; ok && request != pv.Annotations[annResyncHandled] {
+			s.syncVolume(ctx, pv, now, request)
+			continue
+		}
+		if s.syncIntervalDue(pvc, pv, now) {
+			s.syncVolume(ctx, pv, now, "")
+		}
+	}
+}
+
+func (s *syncer) syncIntervalDue(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, now time.Time) bool {
+	annotations, _ := v1Annotations(pvc)
+	value, ok := annotations[annSyncInterval]
+	if !ok {
+		return false
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		glog.Warningf("pvc {%s/%s} has invalid %s %q", pvc.Namespace, pvc.Name, annSyncInterval, value)
+		return false
+	}
+	last, err := time.Parse(time.RFC3339, pv.Annotations[annLastSynced])
+	return err != nil || !now.Before(last.Add(interval))
+}
+
+// syncVolume syncs pv from its source, request is the resync-now value which triggered it, if any.
+func (s *syncer) syncVolume(ctx context.Context, pv *v1.PersistentVolume, now time.Time, request string) {
+	src := pv.Annotations[annSrcDirectory]
+	dest := filepath.Join(mountPath, s.p.volumeDirectory(pv))
+	release, err := s.p.acquireCopySlot(ctx)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	glog.V(4).Infof("syncing %s from %s", dest, src)
+	op := s.p.operations.start(operationSync, pv.Name, s.p.volumeDirectory(pv))
+	op.setSource(src, 0)
+	if isStreamSource(src) {
+		// streams cannot be compared file by file, the whole source is extracted again
+		err = s.p.streamDirectory(ctx, src, dest, op)
+	} else {
+		err = syncDirectory(sourcePath(src), dest)
+	}
+	op.done(err)
+	if err != nil {
+		countVolumeFailure("sync", inCategory(categoryCopy, err), pv)
+		s.p.warnVolume(pv, reasonSyncFailed, "sync %s from %s fail: %s", dest, src, err.Error())
+		return
+	}
+
+	pv = pv.DeepCopy()
+	pv.Annotations[annLastSynced] = now.UTC().Format(time.RFC3339)
+	if request != "" {
+		pv.Annotations[annResyncHandled] = request
+	}
+	if _, err := s.p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		glog.Warningf("update %s of pv %s fail: %s", annLastSynced, pv.Name, err.Error())
+	}
+}
+
+// syncDirectory copies the files of src which are missing in dest or differ in
+// size or modification time. Files only present in dest are kept.
+func syncDirectory(src, dest string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == markerFile {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return dataFS.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			if _, err := dataFS.Lstat(target); err == nil {
+				return nil
+			}
+			link, err := dataFS.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return dataFS.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if existing, err := dataFS.Stat(target); err == nil && unchanged(info, existing) {
+				return nil
+			}
+			return copyFile(p, target, info)
+		}
+		return nil
+	})
+}
+
+// unchanged reports whether the copy dest of the regular file src is still up to date.
+// Copies preserve the modification time with a precision of one millisecond.
+func unchanged(src, dest fs.FileInfo) bool {
+	diff := src.ModTime().Sub(dest.ModTime())
+	return src.Size() == dest.Size() && diff < time.Millisecond && diff > -time.Millisecond
+}
+
+func copyFile(src, dest string, info fs.FileInfo) error {
+	in, err := dataFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dataFS.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return dataFS.Chtimes(dest, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// annTenant on a PV names the StorageTenant it was provisioned for
+	annTenant = "nchc.ai/tenant"
+	// annDirectory on a PV is its directory below the export of the provisioner,
+	// when its NFS source is the dedicated export of its tenant or the export of its zone
+	annDirectory = "nchc.ai/directory"
+)
+
+var storageTenantResource = schema.GroupVersionResource{Group: "nchc.ai", Version: "v1alpha1", Resource: "storagetenants"}
+
+// storageTenant binds namespaces to a directory of their own, optionally served
+// by a dedicated export, with parameters overriding those of the storage class.
+type storageTenant struct {
+	Name string `json:"-"`
+
+	Namespaces        []string              `json:"namespaces,omitempty"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Directory is where the volumes of the tenant are created, below the export of the provisioner
+	Directory string `json:"directory"`
+	// Server and Path are the dedicated export of Directory, if any, which PVs point to
+	Server string `json:"server,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Parameters override the storage class parameters, e.g. softQuota or onDelete
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// ArchiveRetention is how long archives below Directory are kept, e.g. 720h
+	ArchiveRetention string `json:"archiveRetention,omitempty"`
+
+	selector  labels.Selector
+	retention time.Duration
+}
+
+// parseTenant converts and validates a StorageTenant.
+func parseTenant(obj *unstructured.Unstructured) (*storageTenant, error) {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	t := &storageTenant{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, t); err != nil {
+		return nil, fmt.Errorf("StorageTenant %s: %v", obj.GetName(), err)
+	}
+	t.Name = obj.GetName()
+	if t.Directory == "" {
+		return nil, fmt.Errorf("StorageTenant %s has no directory", t.Name)
+	}
+	if err := checkRoot(t.Directory); err != nil {
+		return nil, fmt.Errorf("StorageTenant %s: %v", t.Name, err)
+	}
+	t.Directory = filepath.Clean(t.Directory)
+	if (t.Server == "") != (t.Path == "") {
+		return nil, fmt.Errorf("StorageTenant %s must set both server and path, or neither", t.Name)
+	}
+	if t.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(t.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("StorageTenant %s: invalid namespaceSelector: %v", t.Name, err)
+		}
+		t.selector = selector
+	}
+	if t.ArchiveRetention != "" {
+		retention, err := time.ParseDuration(t.ArchiveRetention)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("StorageTenant %s: invalid archiveRetention %q", t.Name, t.ArchiveRetention)
+		}
+		t.retention = retention
+	}
+	return t, nil
+}
+
+// listTenants returns the valid StorageTenants, sorted by name. Invalid ones are logged.
+func (p *nfsProvisioner) listTenants() []*storageTenant {
+	if p.tenants == nil {
+		return nil
+	}
+	var tenants []*storageTenant
+	for _, obj := range p.tenants.List() {
+		t, err := parseTenant(obj.(*unstructured.Unstructured))
+		if err != nil {
+			glog.Warningf("%s, ignored", err.Error())
+			continue
+		}
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
+
+// tenantByName returns the StorageTenant name, nil if it does not exist (anymore).
+func (p *nfsProvisioner) tenantByName(name string) *storageTenant {
+	for _, t := range p.listTenants() {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantFor returns the StorageTenant namespace belongs to, nil if none. A
+// namespace listed by name belongs to that tenant, otherwise namespaces must
+// not match the selectors of several tenants.
+func (p *nfsProvisioner) tenantFor(ctx context.Context, namespace string) (*storageTenant, error) {
+	tenants := p.listTenants()
+	var selected []*storageTenant
+	for _, t := range tenants {
+		for _, ns := range t.Namespaces {
+			if ns == namespace {
+				return t, nil
+			}
+		}
+		if t.selector != nil {
+			selected = append(selected, t)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, nil
+	}
+
+	ns, err := p.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	var tenant *storageTenant
+	for _, t := range selected {
+		if t.selector.Matches(labels.Set(ns.Labels)) {
+			matched = append(matched, t.Name)
+			tenant = t
+		}
+	}
+	if len(matched) > 1 {
+		return nil, misconfigured("namespace %s matches the StorageTenants %s", namespace, strings.Join(matched, ", "))
+	}
+	return tenant, nil
+}
+
+// volumeRoot returns the directory below the export the volumes of namespace are
+// created in, the directory of its tenant or its namespace root.
+func (p *nfsProvisioner) volumeRoot(ctx context.Context, namespace string) (string, error) {
+	tenant, err := p.tenantFor(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	if tenant != nil {
+		return tenant.Directory, nil
+	}
+	return p.namespaceRoot(ctx, namespace)
+}
+
+// withTenantParameters returns class with the parameters of tenant, if any, overriding its own.
+func withTenantParameters(class *storage.StorageClass, tenant *storageTenant) *storage.StorageClass {
+	if tenant == nil || len(tenant.Parameters) == 0 {
+		return class
+	}
+	class = class.DeepCopy()
+	if class.Parameters == nil {
+		class.Parameters = map[string]string{}
+	}
+	for k, v := range tenant.Parameters {
+		class.Parameters[k] = v
+	}
+	return class
+}
+
+// tenantSource returns the NFS server and path of the directory name below
+// tenant.Directory, on the dedicated export of tenant.
+func tenantSource(tenant *storageTenant, name string) (string, string, error) {
+	rel, err := filepath.Rel(tenant.Directory, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", "", fmt.Errorf("%s is not below the directory %s of StorageTenant %s", name, tenant.Directory, tenant.Name)
+	}
+	return tenant.Server, filepath.Join(tenant.Path, rel), nil
+}
+
+// enforceArchiveRetention removes the archives below the directories of
+// tenants which are older than their archiveRetention.
+func (p *nfsProvisioner) enforceArchiveRetention(now time.Time) {
+	var tenants []*storageTenant
+	for _, t := range p.listTenants() {
+		if t.retention > 0 {
+			tenants = append(tenants, t)
+		}
+	}
+	if len(tenants) == 0 {
+		return
+	}
+	archives, err := scanArchives(mountPath)
+	if err != nil {
+		glog.Warningf("scan archives of %s fail: %s", mountPath, err.Error())
+		return
+	}
+	for _, a := range archives {
+		for _, t := range tenants {
+			if strings.HasPrefix(a.Name, t.Directory+string(filepath.Separator)) && now.Sub(a.ModTime) > t.retention {
+				glog.Infof("removing archive %s, older than the archiveRetention %s of StorageTenant %s", a.Name, t.ArchiveRetention, t.Name)
+				if err := removeArchive(mountPath, a.Name); err != nil {
+					glog.Warningf("remove archive %s fail: %s", a.Name, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// tenantOf returns the StorageTenant pv was provisioned for, nil if none.
+func (p *nfsProvisioner) tenantOf(pv *v1.PersistentVolume) *storageTenant {
+	name, ok := pv.Annotations[annTenant]
+	if !ok {
+		return nil
+	}
+	return p.tenantByName(name)
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// onDeleteTrash moves the directory into trashDir, where it can be restored
+	// until the trashRetention of the class expires
+	onDeleteTrash = "trash"
+	// paramTrashRetention is how long the volumes of the class stay in the
+	// trash, e.g. 72h or 30d, 7d by default
+	paramTrashRetention = "trashRetention"
+	// trashDir holds a directory per trashed volume, named like the PV, with
+	// the data of the volume in trashData, its snapshots in trashSnapshots and
+	// its description in trashEntryFile
+	trashDir       = ".trash"
+	trashData      = "data"
+	trashSnapshots = "snapshots"
+	trashEntryFile = "trash.json"
+
+	defaultTrashRetention = 7 * 24 * time.Hour
+)
+
+// trashEntry describes a trashed volume: the PV it belonged to, so that it
+// can be recreated, and until when it is kept.
+type trashEntry struct {
+	// Volume is the deleted PV, its Directory the path of the volume below
+	// the export before it was trashed
+	Volume volumeMetadata `json:"volume"`
+	Server string         `json:"server"`
+	Path   string         `json:"path"`
+	// DeletedBy is the annDeletedBy annotation of the deleted PV, if any
+	DeletedBy string    `json:"deletedBy,omitempty"`
+	Deleted   time.Time `json:"deleted"`
+	Expires   time.Time `json:"expires"`
+}
+
+// trashRetention returns how long the volumes of class stay in the trash.
+func trashRetention(class *storage.StorageClass) (time.Duration, error) {
+	v, ok := class.Parameters[paramTrashRetention]
+	if !ok {
+		return defaultTrashRetention, nil
+	}
+	d, err := parseAge(v)
+	if err != nil || d <= 0 {
+		return 0, misconfigured("invalid %s %q, must be a positive duration like 72h or 30d", paramTrashRetention, v)
+	}
+	return d, nil
+}
+
+func trashPath(root, id string) string {
+	return filepath.Join(root, trashDir, id)
+}
+
+// trashDirectory moves the directory name below mountPath of volume into the
+// trash, as the volume owner it was provisioned for. They differ for the
+// target of a deleted link, whose failures are reported on the link.
+func (p *nfsProvisioner) trashDirectory(ctx context.Context, volume, owner *v1.PersistentVolume, class *storage.StorageClass, name string) error {
+	retention, err := trashRetention(class)
+	if err != nil {
+		p.warn(volume, reasonStorageClassFailed, "storage class %s: %s", class.Name, err.Error())
+		return err
+	}
+	now := time.Now().UTC()
+	meta := volumeToMetadata(owner, p.path)
+	meta.Directory = name
+	annotations, _ := v1Annotations(volume)
+	e := &trashEntry{
+		Volume:    meta,
+		Server:    owner.Spec.NFS.Server,
+		Path:      owner.Spec.NFS.Path,
+		DeletedBy: annotations[annDeletedBy],
+		Deleted:   now,
+		Expires:   now.Add(retention),
+	}
+	dir := trashPath(mountPath, owner.Name)
+	if _, err := lstatCtx(ctx, dir); err == nil {
+		err = fmt.Errorf("%s is already in the trash", owner.Name)
+		p.warn(volume, reasonDeleteFailed, "unable to trash %s: %s", filepath.Join(mountPath, name), err.Error())
+		return err
+	}
+
+	glog.V(4).Infof("moving path %s to the trash until %s", filepath.Join(mountPath, name), e.Expires.Format(time.RFC3339))
+	err = retryTransient(ctx, "trash "+name, func() error {
+		if err := mkdirAllCtx(ctx, dir, 0700); err != nil {
+			return err
+		}
+		// the entry first, a data directory without it is never purged
+		if err := runFS(ctx, func() error { return writeTrashEntry(dir, e) }); err != nil {
+			return err
+		}
+		return renameCtx(ctx, filepath.Join(mountPath, name), filepath.Join(dir, trashData))
+	})
+	if err != nil {
+		removeAll(dir)
+		p.warn(volume, reasonDeleteFailed, "unable to trash %s: %s", filepath.Join(mountPath, name), err.Error())
+		return err
+	}
+	// the snapshots are purged, and restored, with the data
+	snapshots := filepath.Join(mountPath, snapshotDir, name)
+	if err := runFS(ctx, func() error { return moveSnapshots(snapshots, filepath.Join(dir, trashSnapshots)) }); err != nil {
+		glog.Warningf("move snapshots of %s to the trash fail: %s", name, err.Error())
+	}
+	return nil
+}
+
+func writeTrashEntry(dir string, e *trashEntry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return dataFS.WriteFile(filepath.Join(dir, trashEntryFile), append(data, '\n'), 0644)
+}
+
+// readTrash returns the trashed volume id below root.
+func readTrash(root, id string) (*trashEntry, error) {
+	data, err := dataFS.ReadFile(filepath.Join(trashPath(root, id), trashEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	e := &trashEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("trash entry of %s: %w", id, err)
+	}
+	return e, nil
+}
+
+// listTrash returns the trashed volumes below root, most recently deleted
+// first. Entries which cannot be read are skipped.
+func listTrash(root string) ([]*trashEntry, error) {
+	entries, err := dataFS.ReadDir(filepath.Join(root, trashDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var trash []*trashEntry
+	for _, d := range entries {
+		if !d.IsDir() {
+			continue
+		}
+		e, err := readTrash(root, d.Name())
+		if err != nil {
+			glog.Warningf("skipping trashed volume %s: %s", d.Name(), err.Error())
+			continue
+		}
+		trash = append(trash, e)
+	}
+	sort.Slice(trash, func(i, j int) bool { return trash[i].Deleted.After(trash[j].Deleted) })
+	return trash, nil
+}
+
+// restoreFromTrash moves the data of the most recently trashed volume of the
+// deleted pvc {namespace/name} into dest, the name of a new empty volume
+// directory below mountPath. It returns nil if the trash holds none.
+func restoreFromTrash(ctx context.Context, namespace, name, dest string) (*restoredData, error) {
+	trash, err := listTrash(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range trash {
+		if e.Volume.ClaimNamespace != namespace || e.Volume.ClaimName != name {
+			continue
+		}
+		dir := trashPath(mountPath, e.Volume.Name)
+		data := filepath.Join(dir, trashData)
+		glog.Infof("restoring trashed volume %s of pvc {%s/%s} to %s", e.Volume.Name, namespace, name, dest)
+		if err := runFS(ctx, func() error { return moveIntoVolume(data, dest) }); err != nil {
+			return nil, err
+		}
+		// the entry stays in the trash until the new volume is provisioned
+		return &restoredData{
+			undo: func(ctx context.Context) error {
+				return renameCtx(ctx, filepath.Join(mountPath, dest), data)
+			},
+			done: func() {
+				if err := moveSnapshots(filepath.Join(dir, trashSnapshots), filepath.Join(mountPath, snapshotDir, dest)); err != nil {
+					glog.Warningf("restore snapshots of trashed volume %s fail: %s", e.Volume.Name, err.Error())
+				}
+				if err := removeAll(dir); err != nil {
+					glog.Warningf("remove trash entry %s fail: %s", dir, err.Error())
+				}
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+// purgeTrash removes the trashed volumes below root whose retention expired
+// before now.
+func purgeTrash(root string, now time.Time) {
+	trash, err := listTrash(root)
+	if err != nil {
+		glog.Warningf("list trash of %s fail: %s", root, err.Error())
+		return
+	}
+	for _, e := range trash {
+		if now.Before(e.Expires) {
+			continue
+		}
+		glog.Infof("removing trashed volume %s of pvc {%s/%s}, kept until %s", e.Volume.Name, e.Volume.ClaimNamespace, e.Volume.ClaimName, e.Expires.Format(time.RFC3339))
+		if err := removeAll(trashPath(root, e.Volume.Name)); err != nil {
+			glog.Warningf("remove trashed volume %s fail: %s", e.Volume.Name, err.Error())
+		}
+	}
+}
+
+// listTrashCommand prints the trashed volumes below root.
+func listTrashCommand(root string) error {
+	trash, err := listTrash(root)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PV\tPVC\tSTORAGECLASS\tDIRECTORY\tDELETED\tEXPIRES")
+	for _, e := range trash {
+		claim := "-"
+		if e.Volume.ClaimName != "" {
+			claim = e.Volume.ClaimNamespace + "/" + e.Volume.ClaimName
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Volume.Name, claim, e.Volume.StorageClass, e.Volume.Directory, e.Deleted.Format(time.RFC3339), e.Expires.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// restoreTrashCommand moves the trashed volume id below root back to its
+// directory and recreates its PV, pre-bound to its former claim.
+func restoreTrashCommand(root, id string) error {
+	if id != filepath.Base(id) || id == ".." || id == "." {
+		return fmt.Errorf("invalid -restore %q, must be a volume listed by -trash", id)
+	}
+	e, err := readTrash(root, id)
+	if err != nil {
+		return err
+	}
+	if e.Volume.ClaimName == "" {
+		return fmt.Errorf("trashed volume %s has no former claim", id)
+	}
+	pv, err := metadataToVolume(e.Volume, e.Server, "", lookupSetting("provisioner-name"))
+	if err != nil {
+		return err
+	}
+	pv.Spec.NFS.Path = e.Path
+	delete(pv.Annotations, annDeleteAfter)
+	delete(pv.Annotations, annDeletedBy)
+
+	dest := filepath.Join(root, e.Volume.Directory)
+	if exists(dest) {
+		return fmt.Errorf("directory %s of trashed volume %s exists, restore it with %s instead", e.Volume.Directory, id, annUndeleteFrom)
+	}
+	if err := dataFS.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	data := filepath.Join(trashPath(root, id), trashData)
+	if err := dataFS.Rename(data, dest); err != nil {
+		return err
+	}
+
+	client, err := newAdminClient()
+	if err != nil {
+		dataFS.Rename(dest, data)
+		return err
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+		dataFS.Rename(dest, data)
+		return err
+	}
+	if err := moveSnapshots(filepath.Join(trashPath(root, id), trashSnapshots), filepath.Join(root, snapshotDir, e.Volume.Directory)); err != nil {
+		fmt.Fprintf(os.Stderr, "restore snapshots of %s fail: %s\n", id, err.Error())
+	}
+	if err := removeAll(trashPath(root, id)); err != nil {
+		return err
+	}
+	fmt.Printf("volume %s is restored to %s, create the pvc %s/%s to bind it\n", id, e.Volume.Directory, e.Volume.ClaimNamespace, e.Volume.ClaimName)
+	return nil
+}
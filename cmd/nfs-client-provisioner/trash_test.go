@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+func TestTrashRoundTrip(t *testing.T) {
+	const dir = "default-old-pv-old"
+	tests := []struct {
+		name string
+		// setup prepares the export before the volume is deleted
+		setup func(t *testing.T)
+		// fault is the operation failing while the volume is deleted, if any
+		fault   string
+		wantErr bool
+	}{
+		{name: "trash and undelete"},
+		{
+			name:    "rename fails",
+			fault:   "rename",
+			wantErr: true,
+		},
+		{
+			name: "already in the trash",
+			setup: func(t *testing.T) {
+				writeTestFile(t, filepath.Join(trashPath(mountPath, "pv-old"), trashEntryFile), "{}")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("nfs", map[string]string{paramOnDelete: onDeleteTrash})
+			p := newTestProvisioner(t, markerCheckStrict, class)
+			volume := testVolume("pv-old", "nfs", "default", "old", dir, nil)
+			makeVolumeDirectory(t, volume, dir, "old")
+			writeTestFile(t, filepath.Join(mountPath, snapshotDir, dir, "snap", "data"), "snapshot")
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			err := p.Delete(context.Background(), volume)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Delete() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if got := readTestFile(t, filepath.Join(mountPath, dir, "data")); got != "old" {
+					t.Errorf("data of the kept volume = %q, want %q", got, "old")
+				}
+				return
+			}
+			if pathExists(filepath.Join(mountPath, dir)) {
+				t.Errorf("%s is kept after it was trashed", dir)
+			}
+			e, err := readTrash(mountPath, "pv-old")
+			if err != nil {
+				t.Fatalf("trash entry of pv-old: %v", err)
+			}
+			if e.Volume.Directory != dir || e.Volume.ClaimName != "old" || e.Path != filepath.Join(testExport, dir) {
+				t.Errorf("trash entry = %+v, want directory %s of pvc old at %s", e, dir, filepath.Join(testExport, dir))
+			}
+			if got := readTestFile(t, filepath.Join(trashPath(mountPath, "pv-old"), trashSnapshots, "snap", "data")); got != "snapshot" {
+				t.Errorf("snapshot in the trash = %q, want %q", got, "snapshot")
+			}
+
+			options := controller.ProvisionOptions{
+				StorageClass: class,
+				PVName:       "pv-new",
+				PVC:          testClaim("default", "new", map[string]string{annUndeleteFrom: "old"}),
+			}
+			if _, _, err := p.Provision(context.Background(), options); err != nil {
+				t.Fatalf("Provision() = %v", err)
+			}
+			if got := readTestFile(t, filepath.Join(mountPath, "default-new-pv-new", "data")); got != "old" {
+				t.Errorf("data of the undeleted volume = %q, want %q", got, "old")
+			}
+			if got := readTestFile(t, filepath.Join(mountPath, snapshotDir, "default-new-pv-new", "snap", "data")); got != "snapshot" {
+				t.Errorf("snapshot of the undeleted volume = %q, want %q", got, "snapshot")
+			}
+			if pathExists(trashPath(mountPath, "pv-old")) {
+				t.Error("the trash entry of pv-old is kept after it was undeleted")
+			}
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		expires time.Time
+		fault   string
+		want    bool
+	}{
+		{name: "expired", expires: now.Add(-time.Minute)},
+		{name: "retained", expires: now.Add(time.Hour), want: true},
+		{name: "removal fails", expires: now.Add(-time.Minute), fault: "removeall", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useTempMount(t)
+			dir := trashPath(root, "pv-old")
+			if err := os.MkdirAll(filepath.Join(dir, trashData), 0777); err != nil {
+				t.Fatal(err)
+			}
+			e := &trashEntry{Volume: volumeMetadata{Name: "pv-old"}, Deleted: now.Add(-time.Hour), Expires: tt.expires}
+			if err := writeTrashEntry(dir, e); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+			purgeTrash(root, now)
+			if got := pathExists(dir); got != tt.want {
+				t.Errorf("trashed volume kept = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// annUndeleteFrom on a PVC moves the data of the deleted PVC of that name in
+	// the same namespace into the new volume, from the trash or else its archive
+	annUndeleteFrom = "nchc.ai/undelete-from"
+)
+
+// restoredData is data moved into a new volume from where it was kept after
+// its former volume was deleted. It stays restorable there until the new volume
+// is provisioned: undo moves it back if provisioning fails, done drops what is
+// left of it once the volume is provisioned.
+type restoredData struct {
+	undo func(ctx context.Context) error
+	done func()
+}
+
+// undelete moves the data of the deleted pvc {namespace/name} into dest, the
+// name of a new empty volume directory below mountPath, and returns where it
+// came from: its most recently trashed volume, or else its most recent archive.
+func undelete(ctx context.Context, namespace, name, dest string) (string, *restoredData, error) {
+	if r, err := restoreFromTrash(ctx, namespace, name, dest); err != nil || r != nil {
+		return "Trash/" + namespace + "/" + name, r, err
+	}
+	// the archive is moved, not copied, only trust the owner its manifest records
+	archive, err := findArchiveOwnedBy(namespace, name, manifestOwner)
+	if err != nil {
+		return "", nil, misconfigured("pvc {%s/%s} is neither in the trash nor archived", namespace, name)
+	}
+	glog.Infof("restoring archive %s of pvc {%s/%s} to %s", archive, namespace, name, dest)
+	src := filepath.Join(mountPath, archive)
+	if err := runFS(ctx, func() error { return moveIntoVolume(src, dest) }); err != nil {
+		return "Archive/" + archive, nil, err
+	}
+	return "Archive/" + archive, &restoredData{
+		undo: func(ctx context.Context) error {
+			return renameCtx(ctx, filepath.Join(mountPath, dest), src)
+		},
+		done: func() {
+			// the data is a volume now, not an archive
+			if err := dataFS.Remove(filepath.Join(mountPath, dest, archiveManifestFile)); err != nil && !os.IsNotExist(err) {
+				glog.Warningf("remove manifest of archive %s fail: %s", archive, err.Error())
+			}
+			if err := moveSnapshots(filepath.Join(mountPath, snapshotDir, archive), filepath.Join(mountPath, snapshotDir, dest)); err != nil {
+				glog.Warningf("restore snapshots of archive %s fail: %s", archive, err.Error())
+			}
+			if err := removeArchive(mountPath, archive); err != nil {
+				glog.Warningf("remove index entry of archive %s fail: %s", archive, err.Error())
+			}
+		},
+	}, nil
+}
+
+// moveIntoVolume replaces dest, the name of a new empty volume directory below
+// mountPath, by the directory src. Sealed data is unsealed, since the marker of
+// the new volume is written into it.
+func moveIntoVolume(src, dest string) error {
+	if info, err := dataFS.Lstat(src); err != nil {
+		return err
+	} else if info.Mode()&0200 == 0 {
+		if err := unsealDirectory(src); err != nil {
+			return err
+		}
+	}
+	if err := dataFS.Remove(filepath.Join(mountPath, dest)); err != nil {
+		return err
+	}
+	if err := dataFS.Rename(src, filepath.Join(mountPath, dest)); err != nil {
+		// provisioning removes the directory it created on failure
+		dataFS.MkdirAll(filepath.Join(mountPath, dest), 0777)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v11/controller"
+)
+
+func TestUndeleteArchive(t *testing.T) {
+	const dir, archive = "default-new-pv-new", "archived-default-old-pv-old"
+	tests := []struct {
+		name string
+		// from is the claim the new volume is undeleted from
+		from string
+		// fault is the operation failing while the data is moved, if any
+		fault   string
+		wantErr bool
+	}{
+		{name: "archived claim", from: "old"},
+		{name: "unknown claim", from: "other", wantErr: true},
+		{name: "move fails", from: "old", fault: "rename", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("nfs", nil)
+			p := newTestProvisioner(t, markerCheckStrict, class)
+			deleteOldClaim(onDeleteArchive)(t, p)
+			if tt.fault != "" {
+				injectFaults(t, syscall.EROFS, tt.fault)
+			}
+
+			options := controller.ProvisionOptions{
+				StorageClass: class,
+				PVName:       "pv-new",
+				PVC:          testClaim("default", "new", map[string]string{annUndeleteFrom: tt.from}),
+			}
+			_, _, err := p.Provision(context.Background(), options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if got := readTestFile(t, filepath.Join(mountPath, archive, "data")); got != "old" {
+					t.Errorf("data of the archive = %q, want %q", got, "old")
+				}
+				if pathExists(filepath.Join(mountPath, dir)) {
+					t.Errorf("%s of the failed attempt is kept", dir)
+				}
+				return
+			}
+			if got := readTestFile(t, filepath.Join(mountPath, dir, "data")); got != "old" {
+				t.Errorf("data of the undeleted volume = %q, want %q", got, "old")
+			}
+			if m, err := readMarker(filepath.Join(mountPath, dir)); err != nil || m.Volume != "pv-new" {
+				t.Errorf("marker of the undeleted volume = %+v, %v, want one of pv-new", m, err)
+			}
+			if pathExists(filepath.Join(mountPath, dir, archiveManifestFile)) {
+				t.Error("the undeleted volume keeps the manifest of the archive")
+			}
+			if pathExists(filepath.Join(mountPath, archive)) || pathExists(filepath.Join(mountPath, archiveClassDir, archive)) {
+				t.Errorf("archive %s is kept after it was undeleted", archive)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// archiveClassDir holds a file per archive, named like it, with the storage class of the archived volume
+	archiveClassDir = ".archives"
+)
+
+// volumeUsage describes the disk usage of one top-level directory on the export.
+type volumeUsage struct {
+	Name     string    `json:"name"`
+	Bytes    int64     `json:"bytes"`
+	Files    int64     `json:"files"`
+	ModTime  time.Time `json:"modTime"`
+	Archived bool      `json:"archived"`
+	Link     string    `json:"link,omitempty"`
+}
+
+// usageScanner measures the disk usage of directories. On large exports, scans
+// can be spread over time with pace and sped up by reusing the size of directories
+// whose modification time did not change.
+type usageScanner struct {
+	// concurrency is the number of top-level directories scanVolumes measures in parallel
+	concurrency int
+	// pace is slept after reading each directory, to limit the load on the NFS server
+	pace time.Duration
+	// ttl bounds how long a cached directory is trusted, since files growing in place
+	// do not change the modification time of their directory; 0 disables the cache
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*dirCache
+}
+
+// dirCache is the usage of one directory, without its subdirectories.
+type dirCache struct {
+	modTime time.Time
+	scanned time.Time
+	bytes   int64
+	files   int64
+	subdirs []string
+}
+
+// usage is the scanner of dirUsage and scanVolumes, configured by flags in main.
+var usage = &usageScanner{concurrency: 1, cache: map[string]*dirCache{}}
+
+// dirUsage returns the apparent size and the number of files below dir.
+// Symbolic links are counted but never followed.
+func dirUsage(dir string) (int64, int64, error) {
+	return usage.dirUsage(dir)
+}
+
+// dirInodes returns the apparent size and the number of inodes below dir: its
+// files and directories, including dir itself.
+func dirInodes(dir string) (int64, int64, error) {
+	bytes, files, dirs, err := usage.walk(dir)
+	return bytes, files + dirs, err
+}
+
+func (s *usageScanner) dirUsage(dir string) (int64, int64, error) {
+	bytes, files, _, err := s.walk(dir)
+	return bytes, files, err
+}
+
+// walk returns the apparent size, the number of files and the number of
+// directories below dir, including dir itself.
+func (s *usageScanner) walk(dir string) (int64, int64, int64, error) {
+	info, err := dataFS.Lstat(dir)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), 1, 0, nil
+	}
+
+	c, err := s.readDir(dir, info)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bytes, files, dirs := c.bytes, c.files, int64(1)
+	for _, sub := range c.subdirs {
+		b, f, d, err := s.walk(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, 0, 0, err
+		}
+		bytes += b
+		files += f
+		dirs += d
+	}
+	return bytes, files, dirs, nil
+}
+
+// readDir returns the usage of dir itself, from the cache if dir did not change.
+func (s *usageScanner) readDir(dir string, info fs.FileInfo) (*dirCache, error) {
+	now := time.Now()
+	if s.ttl > 0 {
+		s.mu.Lock()
+		c, ok := s.cache[dir]
+		s.mu.Unlock()
+		if ok && c.modTime.Equal(info.ModTime()) && now.Sub(c.scanned) < s.ttl {
+			return c, nil
+		}
+	}
+
+	entries, err := dataFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &dirCache{modTime: info.ModTime(), scanned: now, bytes: info.Size()}
+	for _, e := range entries {
+		if e.IsDir() {
+			c.subdirs = append(c.subdirs, e.Name())
+			continue
+		}
+		fi, err := e.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		c.files++
+		c.bytes += fi.Size()
+	}
+	if s.ttl > 0 {
+		s.mu.Lock()
+		s.cache[dir] = c
+		s.mu.Unlock()
+	}
+	if s.pace > 0 {
+		time.Sleep(s.pace)
+	}
+	return c, nil
+}
+
+// expire drops the cached directories which are no longer trusted.
+func (s *usageScanner) expire() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir, c := range s.cache {
+		if now.Sub(c.scanned) >= s.ttl {
+			delete(s.cache, dir)
+		}
+	}
+}
+
+// scanVolumes returns the usage of every top-level entry below root, largest first.
+func scanVolumes(root string) ([]volumeUsage, error) {
+	return usage.scanVolumes(root)
+}
+
+func (s *usageScanner) scanVolumes(root string) ([]volumeUsage, error) {
+	s.expire()
+	entries, err := dataFS.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := listArchives(root)
+	if err != nil {
+		return nil, err
+	}
+	roots := archiveRoots(archives)
+
+	usages := make([]volumeUsage, 0, len(entries))
+	var dirs []int
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		u := volumeUsage{
+			Name:     e.Name(),
+			ModTime:  info.ModTime(),
+			Archived: roots[e.Name()] || strings.HasPrefix(e.Name(), archivePrefix),
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			u.Link, _ = dataFS.Readlink(filepath.Join(root, e.Name()))
+		} else if e.IsDir() {
+			dirs = append(dirs, len(usages))
+		} else {
+			continue
+		}
+		usages = append(usages, u)
+	}
+
+	// measure the directories with at most concurrency workers
+	work := make(chan int)
+	errs := make(chan error, len(dirs))
+	var wg sync.WaitGroup
+	for w := 0; w < s.concurrency || w == 0; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				u := &usages[i]
+				var err error
+				if u.Bytes, u.Files, err = s.dirUsage(filepath.Join(root, u.Name)); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, i := range dirs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].Bytes > usages[j].Bytes
+	})
+	return usages, nil
+}
+
+// scanArchives returns the usage of every archive below root, largest first.
+// Unlike scanVolumes, archives nested by archivePath templates are measured one by one.
+func scanArchives(root string) ([]volumeUsage, error) {
+	archives, err := listArchives(root)
+	if err != nil {
+		return nil, err
+	}
+	usages := make([]volumeUsage, 0, len(archives))
+	for _, name := range archives {
+		info, err := dataFS.Stat(filepath.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+		u := volumeUsage{Name: name, ModTime: info.ModTime(), Archived: true}
+		if u.Bytes, u.Files, err = dirUsage(filepath.Join(root, name)); err != nil {
+			return nil, err
+		}
+		usages = append(usages, u)
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].Bytes > usages[j].Bytes
+	})
+	return usages, nil
+}
+
+// archiveRecord is the entry of an archive in the archive index: the storage
+// class on the first line, followed by "key=value" lines. Entries written by
+// earlier versions hold the class only.
+type archiveRecord struct {
+	class string
+	// archived and accessed are zero if unknown
+	archived time.Time
+	accessed time.Time
+}
+
+// recordArchiveClass remembers the storage class of the volume archived as name below root, and when.
+func recordArchiveClass(root, name, class string) error {
+	return writeArchiveRecord(root, name, archiveRecord{class: class, archived: time.Now()})
+}
+
+func writeArchiveRecord(root, name string, r archiveRecord) error {
+	if err := dataFS.MkdirAll(filepath.Dir(filepath.Join(root, archiveClassDir, name)), 0755); err != nil {
+		return err
+	}
+	content := r.class + "\n"
+	if !r.archived.IsZero() {
+		content += "archived=" + r.archived.UTC().Format(time.RFC3339) + "\n"
+	}
+	if !r.accessed.IsZero() {
+		content += "accessed=" + r.accessed.UTC().Format(time.RFC3339) + "\n"
+	}
+	return dataFS.WriteFile(filepath.Join(root, archiveClassDir, name), []byte(content), 0644)
+}
+
+// readArchiveRecord returns the index entry of the archive name below root, if any.
+func readArchiveRecord(root, name string) (archiveRecord, bool) {
+	var r archiveRecord
+	content, err := dataFS.ReadFile(filepath.Join(root, archiveClassDir, name))
+	if err != nil {
+		return r, false
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	r.class = strings.TrimSpace(lines[0])
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "archived":
+			r.archived = t
+		case "accessed":
+			r.accessed = t
+		}
+	}
+	return r, true
+}
+
+// archiveClass returns the storage class recorded for the archive name below root, if any.
+func archiveClass(root, name string) string {
+	r, _ := readArchiveRecord(root, name)
+	return r.class
+}
+
+// touchArchive records that the archive name below root was accessed at now.
+// Archives without an index entry, archived-* directories of earlier versions,
+// get one without a storage class.
+func touchArchive(root, name string, now time.Time) error {
+	r, _ := readArchiveRecord(root, name)
+	r.accessed = now
+	return writeArchiveRecord(root, name, r)
+}
+
+// removeArchive removes the archive name below root together with its recorded
+// storage class and snapshots.
+func removeArchive(root, name string) error {
+	if err := removeAll(filepath.Join(root, name)); err != nil {
+		return err
+	}
+	if err := dataFS.Remove(filepath.Join(root, archiveClassDir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeSnapshots(root, name); err != nil {
+		return err
+	}
+	// remove the parents left empty by archives nested by an archivePath template
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		dataFS.Remove(filepath.Join(root, dir))
+		dataFS.Remove(filepath.Join(root, archiveClassDir, dir))
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the file system holding dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// exportCapacity returns the bytes available to unprivileged users and the total
+// size of the file system holding dir.
+func exportCapacity(dir string) (int64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// formatBytes renders n using binary units, e.g. 1.5Gi.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", float64(n)/float64(div), "KMGTPE"[exp])
+}
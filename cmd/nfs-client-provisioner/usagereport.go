@@ -0,0 +1,209 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var volumeUsageReportResource = schema.GroupVersionResource{Group: "nchc.ai", Version: "v1alpha1", Resource: "volumeusagereports"}
+
+// hasResource returns whether the API server serves gvr, e.g. because its CRD is installed.
+func hasResource(clientset kubernetes.Interface, gvr schema.GroupVersionResource) bool {
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// usageReporter periodically measures the volumes of the provisioner and
+// publishes one VolumeUsageReport per namespace and storage class, named after
+// the class, so usage can be consumed without access to the NFS export.
+type usageReporter struct {
+	p      *nfsProvisioner
+	client dynamic.Interface
+}
+
+func newUsageReporter(p *nfsProvisioner, client dynamic.Interface) *usageReporter {
+	return &usageReporter{p: p, client: client}
+}
+
+func (r *usageReporter) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, r.report, interval)
+}
+
+func (r *usageReporter) report(ctx context.Context) {
+	pvs, err := r.p.listVolumes(ctx)
+	if err != nil {
+		glog.Warningf("list persistent volumes for usage report fail: %s", err.Error())
+		return
+	}
+
+	// claims maps namespace/class to the usage of its claims
+	type reportKey struct{ namespace, class string }
+	claims := map[reportKey][]map[string]interface{}{}
+	for _, pv := range pvs {
+		ref := pv.Spec.ClaimRef
+		if !r.p.ownsVolume(pv) || pv.Spec.StorageClassName == "" || ref == nil {
+			continue
+		}
+		claim := map[string]interface{}{
+			"claimName":  ref.Name,
+			"volumeName": pv.Name,
+		}
+		dir := filepath.Join(mountPath, r.p.volumeDirectory(pv))
+		info, err := dataFS.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// linked volumes share the data of their source, which is reported
+			claim["link"] = true
+		} else {
+			bytes, files, err := dirUsage(dir)
+			if err != nil {
+				glog.Warningf("usage of volume %s fail: %s", pv.Name, err.Error())
+				continue
+			}
+			claim["usedBytes"], claim["files"] = bytes, files
+		}
+		key := reportKey{ref.Namespace, pv.Spec.StorageClassName}
+		claims[key] = append(claims[key], claim)
+	}
+
+	// reports of classes without volumes left are kept, with an empty list of claims
+	list, err := r.client.Resource(volumeUsageReportResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("list VolumeUsageReports fail: %s", err.Error())
+		return
+	}
+	existing := map[reportKey]*unstructured.Unstructured{}
+	for i := range list.Items {
+		report := &list.Items[i]
+		if report.GetAnnotations()[annProvisionedBy] != r.p.name {
+			continue
+		}
+		key := reportKey{report.GetNamespace(), report.GetName()}
+		existing[key] = report
+		if _, ok := claims[key]; !ok {
+			claims[key] = nil
+		}
+	}
+
+	now := time.Now()
+	for key, usage := range claims {
+		report := existing[key]
+		growth(usage, report, now)
+		sort.Slice(usage, func(i, j int) bool { return usage[i]["claimName"].(string) < usage[j]["claimName"].(string) })
+
+		var totalBytes, totalFiles int64
+		items := make([]interface{}, 0, len(usage))
+		for _, claim := range usage {
+			b, _ := claim["usedBytes"].(int64)
+			f, _ := claim["files"].(int64)
+			totalBytes, totalFiles = totalBytes+b, totalFiles+f
+			items = append(items, claim)
+		}
+		status := map[string]interface{}{
+			"storageClass": key.class,
+			"generated":    now.UTC().Format(time.RFC3339),
+			"totalBytes":   totalBytes,
+			"totalFiles":   totalFiles,
+			"claims":       items,
+		}
+		if err := r.publish(ctx, key.namespace, key.class, report, status); err != nil {
+			glog.Warningf("update VolumeUsageReport %s/%s fail: %s", key.namespace, key.class, err.Error())
+		}
+	}
+}
+
+// growth sets the growthBytesPerDay of usage, compared to the previous report.
+func growth(usage []map[string]interface{}, previous *unstructured.Unstructured, now time.Time) {
+	if previous == nil {
+		return
+	}
+	generated, _, _ := unstructured.NestedString(previous.Object, "status", "generated")
+	since, err := time.Parse(time.RFC3339, generated)
+	if err != nil || !now.After(since) {
+		return
+	}
+	items, _, _ := unstructured.NestedSlice(previous.Object, "status", "claims")
+	before := map[string]int64{}
+	for _, item := range items {
+		if claim, ok := item.(map[string]interface{}); ok {
+			name, _, _ := unstructured.NestedString(claim, "claimName")
+			bytes, found, _ := unstructured.NestedInt64(claim, "usedBytes")
+			if found {
+				before[name] = bytes
+			}
+		}
+	}
+	days := now.Sub(since).Hours() / 24
+	for _, claim := range usage {
+		bytes, ok := claim["usedBytes"].(int64)
+		prev, found := before[claim["claimName"].(string)]
+		if ok && found {
+			claim["growthBytesPerDay"] = int64(float64(bytes-prev) / days)
+		}
+	}
+}
+
+// publish creates the report name in namespace, or replaces the status of report.
+func (r *usageReporter) publish(ctx context.Context, namespace, name string, report *unstructured.Unstructured, status map[string]interface{}) error {
+	client := r.client.Resource(volumeUsageReportResource).Namespace(namespace)
+	if report == nil {
+		report = &unstructured.Unstructured{}
+		report.SetAPIVersion(volumeUsageReportResource.GroupVersion().String())
+		report.SetKind("VolumeUsageReport")
+		report.SetNamespace(namespace)
+		report.SetName(name)
+		report.SetAnnotations(map[string]string{annProvisionedBy: r.p.name})
+		if err := unstructured.SetNestedField(report.Object, status, "status"); err != nil {
+			return err
+		}
+		_, err := client.Create(ctx, report, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// created after the list, e.g. by another replica, updated by the next run
+			return nil
+		}
+		return err
+	}
+	if err := unstructured.SetNestedField(report.Object, status, "status"); err != nil {
+		return err
+	}
+	_, err := client.Update(ctx, report, metav1.UpdateOptions{})
+	return err
+}
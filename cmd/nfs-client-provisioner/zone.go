@@ -0,0 +1,200 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// annZone on a PV is the zone of the export it was provisioned on
+	annZone = "nchc.ai/zone"
+)
+
+// zoneLabel is the node label, and allowedTopologies key, of the zone of nodes.
+const zoneLabel = v1.LabelTopologyZone
+
+// errNoZoneExport is returned when the zone of the selected node has no export,
+// so that the scheduler picks another node.
+var errNoZoneExport = errors.New("no export in zone")
+
+// zoneExport serves the export of the provisioner, or a directory of it, to the
+// nodes of a zone, e.g. a mount target or filer interface in that zone.
+type zoneExport struct {
+	zone   string
+	server string
+	path   string
+	// directory is where the volumes of the zone are created below the export
+	// of the provisioner, empty if path serves the whole export
+	directory string
+}
+
+// parseZoneExports parses the comma separated zone=server:/path[=directory] of -zone-exports.
+func parseZoneExports(value string) ([]zoneExport, error) {
+	var exports []zoneExport
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		zone, rest, ok := strings.Cut(entry, "=")
+		export, directory, _ := strings.Cut(rest, "=")
+		server, path, ok2 := strings.Cut(export, ":")
+		if !ok || !ok2 || zone == "" || server == "" || !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("invalid zone export %q, must be zone=server:/path or zone=server:/path=directory", entry)
+		}
+		if err := checkRoot(directory); err != nil {
+			return nil, fmt.Errorf("invalid zone export %q: %v", entry, err)
+		}
+		if seen[zone] {
+			return nil, fmt.Errorf("zone %s has several exports", zone)
+		}
+		seen[zone] = true
+		if directory != "" {
+			directory = filepath.Clean(directory)
+		}
+		exports = append(exports, zoneExport{zone: zone, server: server, path: filepath.Clean(path), directory: directory})
+	}
+	return exports, nil
+}
+
+// source returns the NFS server and path of the directory name below the
+// export of the provisioner, which is below e.directory.
+func (e *zoneExport) source(name string) (string, string, error) {
+	if e.directory == "" {
+		return e.server, filepath.Join(e.path, name), nil
+	}
+	rel, err := filepath.Rel(e.directory, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", "", fmt.Errorf("%s is not below the directory %s of the export of zone %s", name, e.directory, e.zone)
+	}
+	return e.server, filepath.Join(e.path, rel), nil
+}
+
+// nodeAffinity restricts the volumes of the export to the nodes of its zone.
+func (e *zoneExport) nodeAffinity() *v1.VolumeNodeAffinity {
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      zoneLabel,
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{e.zone},
+				}},
+			}},
+		},
+	}
+}
+
+// allowedZones returns the zones the allowedTopologies of class allow, sorted,
+// nil if the class does not restrict the zone.
+func allowedZones(class *storage.StorageClass) []string {
+	seen := map[string]bool{}
+	for _, term := range class.AllowedTopologies {
+		restricted := false
+		for _, req := range term.MatchLabelExpressions {
+			if req.Key != zoneLabel {
+				continue
+			}
+			restricted = true
+			for _, zone := range req.Values {
+				seen[zone] = true
+			}
+		}
+		// terms are ORed, one without a zone allows every zone
+		if !restricted {
+			return nil
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	zones := make([]string, 0, len(seen))
+	for zone := range seen {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// zoneExport returns the export of zone, nil if it has none.
+func (p *nfsProvisioner) zoneExport(zone string) *zoneExport {
+	for i := range p.zoneExports {
+		if p.zoneExports[i].zone == zone {
+			return &p.zoneExports[i]
+		}
+	}
+	return nil
+}
+
+// selectZone returns the export the volume name of class is provisioned on: the
+// one in the zone of node, the node selected for the first consumer with
+// volumeBindingMode WaitForFirstConsumer, or else one of the zones allowed by
+// the allowedTopologies of class. It returns nil for the export of the
+// provisioner, without zone, when neither restricts the zone.
+func (p *nfsProvisioner) selectZone(class *storage.StorageClass, node *v1.Node, name string) (*zoneExport, error) {
+	if len(p.zoneExports) == 0 {
+		return nil, nil
+	}
+	allowed := allowedZones(class)
+	if node != nil && node.Labels[zoneLabel] != "" {
+		zone := node.Labels[zoneLabel]
+		if allowed != nil && !contains(allowed, zone) {
+			return nil, misconfigured("node %s is in zone %s, which the allowedTopologies of StorageClass %s do not allow", node.Name, zone, class.Name)
+		}
+		if e := p.zoneExport(zone); e != nil {
+			return e, nil
+		}
+		if allowed == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w %s of node %s", errNoZoneExport, zone, node.Name)
+	}
+	if allowed == nil {
+		return nil, nil
+	}
+	var candidates []*zoneExport
+	for _, zone := range allowed {
+		if e := p.zoneExport(zone); e != nil {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, misconfigured("none of the zones %s allowed by StorageClass %s has an export in -zone-exports", strings.Join(allowed, ", "), class.Name)
+	}
+	// spread the volumes over the allowed zones
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return candidates[h.Sum32()%uint32(len(candidates))], nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}